@@ -0,0 +1,60 @@
+package api
+
+import (
+	"context"
+	"crypto/x509"
+	"net/http"
+	"strings"
+	"tcptracker/internal/auth"
+)
+
+// authenticate requires Read role for safe methods and Admin role for the rest, public paths are skipped
+func (r *Router) authenticate(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if r.public[req.URL.Path] || isLocal(req.Context()) {
+			next.ServeHTTP(w, req)
+			return
+		}
+		var chains [][]*x509.Certificate
+		if req.TLS != nil {
+			chains = req.TLS.VerifiedChains
+		}
+		principal, err := r.auth.Authenticate(req.Header.Get("Authorization"), chains)
+		if err != nil {
+			auth.Audit(principal, req.RemoteAddr, req.Method, req.URL.Path, err)
+			w.Header().Set("WWW-Authenticate", `Bearer realm="tcptracker"`)
+			w.Header().Set(contentType, applicationJSON)
+			respond(w, err.Error(), http.StatusUnauthorized)
+			return
+		}
+		if err := auth.Authorize(principal, requiredRole(req.Method)); err != nil {
+			auth.Audit(principal, req.RemoteAddr, req.Method, req.URL.Path, err)
+			w.Header().Set(contentType, applicationJSON)
+			respond(w, err.Error(), http.StatusForbidden)
+			return
+		}
+		next.ServeHTTP(w, req)
+	})
+}
+
+type localKey struct{}
+
+// Local marks requests of the unix socket, they are trusted as admin, access is limited by the socket file mode
+func Local(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		h.ServeHTTP(w, req.WithContext(context.WithValue(req.Context(), localKey{}, true)))
+	})
+}
+
+func isLocal(ctx context.Context) bool {
+	local, _ := ctx.Value(localKey{}).(bool)
+	return local
+}
+
+func requiredRole(method string) auth.Role {
+	switch strings.ToUpper(method) {
+	case http.MethodGet, http.MethodHead, http.MethodOptions:
+		return auth.Read
+	}
+	return auth.Admin
+}
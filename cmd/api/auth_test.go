@@ -0,0 +1,96 @@
+package api
+
+import (
+	"github.com/go-chi/chi"
+	"github.com/golang/mock/gomock"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"tcptracker/internal/auth"
+	"tcptracker/internal/detection"
+	"tcptracker/mock"
+	"testing"
+)
+
+func TestAuthentication(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	mockFw := mock.NewMockFirewall(ctrl)
+	file := filepath.Join(t.TempDir(), "tokens")
+	require.NoError(t, os.WriteFile(file, []byte("admin ops admin-token\nread grafana read-token\n"), 0o600))
+	authenticator, err := auth.New(auth.Params{TokensFile: file})
+	require.NoError(t, err)
+	router := NewRouter(RouterParams{
+		Mux:         chi.NewRouter(),
+		Metrics:     prometheus.NewRegistry(),
+		Firewall:    mockFw,
+		Auth:        authenticator,
+		PublicPaths: []string{"/health", "/metrics"},
+	})
+	router.Routes()
+
+	mockFw.EXPECT().Blocks().Return([]detection.Block{}).Times(1)
+	mockFw.EXPECT().Block(detection.Detection{IP: "10.0.0.2", Type: detection.Manual}).Return(nil).Times(2)
+
+	tests := []struct {
+		name       string
+		method     string
+		path       string
+		body       string
+		token      string
+		statusCode int
+	}{
+		{name: "public health", method: http.MethodGet, path: "/health", statusCode: http.StatusOK},
+		{name: "public metrics", method: http.MethodGet, path: "/metrics", statusCode: http.StatusOK},
+		{name: "missing token", method: http.MethodGet, path: "/blocks", statusCode: http.StatusUnauthorized},
+		{name: "unknown token", method: http.MethodGet, path: "/blocks", token: "other", statusCode: http.StatusUnauthorized},
+		{name: "read lists", method: http.MethodGet, path: "/blocks", token: "read-token", statusCode: http.StatusOK},
+		{
+			name:       "read cannot block",
+			method:     http.MethodPost,
+			path:       "/blocks",
+			body:       `{"ip":"10.0.0.2"}`,
+			token:      "read-token",
+			statusCode: http.StatusForbidden,
+		},
+		{
+			name:       "read cannot disallow",
+			method:     http.MethodDelete,
+			path:       "/allowlist/10.0.0.2",
+			token:      "read-token",
+			statusCode: http.StatusForbidden,
+		},
+		{
+			name:       "admin blocks",
+			method:     http.MethodPost,
+			path:       "/blocks",
+			body:       `{"ip":"10.0.0.2"}`,
+			token:      "admin-token",
+			statusCode: http.StatusCreated,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(tt.method, tt.path, strings.NewReader(tt.body))
+			if tt.token != "" {
+				r.Header.Set("Authorization", "Bearer "+tt.token)
+			}
+			w := httptest.NewRecorder()
+			router.mux.ServeHTTP(w, r)
+			assert.Equal(t, tt.statusCode, w.Code)
+			if tt.statusCode == http.StatusUnauthorized {
+				assert.Equal(t, `Bearer realm="tcptracker"`, w.Header().Get("WWW-Authenticate"))
+			}
+		})
+	}
+
+	// unix socket requests are admin without credentials
+	w := httptest.NewRecorder()
+	Local(router.mux).ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/blocks", strings.NewReader(`{"ip":"10.0.0.2"}`)))
+	assert.Equal(t, http.StatusCreated, w.Code)
+}
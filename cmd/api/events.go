@@ -0,0 +1,69 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"tcptracker/internal/events"
+	"time"
+)
+
+// keepAliveInterval of SSE comments, proxies close idle connections
+const keepAliveInterval = 15 * time.Second
+
+// streamEvents is Server-Sent Events stream of connections, detections and blocks
+// Filters: `type=connection,detection,block,unblock,expiry`, `source=10.0.0.0/8` and `port=22`
+func (r *Router) streamEvents() http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		filter, err := events.ParseFilter(req.URL.Query())
+		if err != nil {
+			w.Header().Set(contentType, applicationJSON)
+			respond(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		flusher, ok := w.(http.Flusher)
+		if !ok || r.events == nil {
+			w.Header().Set(contentType, applicationJSON)
+			respond(w, "streaming is not supported", http.StatusNotImplemented)
+			return
+		}
+		stream, unsubscribe := r.events.Subscribe(filter)
+		defer unsubscribe()
+
+		w.Header().Set(contentType, "text/event-stream")
+		w.Header().Set("Cache-Control", "no-cache")
+		w.Header().Set("Connection", "keep-alive")
+		w.WriteHeader(http.StatusOK)
+		flusher.Flush()
+
+		keepAlive := time.NewTicker(keepAliveInterval)
+		defer keepAlive.Stop()
+		for {
+			select {
+			case <-req.Context().Done():
+				return
+			case <-keepAlive.C:
+				if _, err := fmt.Fprint(w, ": keep-alive\n\n"); err != nil {
+					return
+				}
+			case e := <-stream:
+				data, err := json.Marshal(e)
+				if err != nil {
+					continue
+				}
+				if _, err := fmt.Fprintf(w, "event: %s\ndata: %s\n\n", e.Type, data); err != nil {
+					return
+				}
+			}
+			flusher.Flush()
+		}
+	}
+}
+
+// eventSchema is JSON Schema of the events streamed on /events and sent by the sinks
+func (r *Router) eventSchema() http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set(contentType, "application/schema+json")
+		_, _ = w.Write(events.Schema)
+	}
+}
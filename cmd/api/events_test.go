@@ -0,0 +1,72 @@
+package api
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"github.com/go-chi/chi"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"tcptracker/internal/events"
+	"testing"
+	"time"
+)
+
+func TestStreamEvents(t *testing.T) {
+	broker := events.NewBroker("node-1", nil)
+	router := NewRouter(RouterParams{Mux: chi.NewRouter(), Metrics: prometheus.NewRegistry(), Events: broker})
+	router.Routes()
+	server := httptest.NewServer(router.mux)
+	defer server.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, server.URL+"/events?type=detection&source=10.0.0.0/8", nil)
+	require.NoError(t, err)
+	resp, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "text/event-stream", resp.Header.Get(contentType))
+
+	broker.Publish(events.Event{Type: events.Connection, SrcIP: "10.0.0.1", DstPort: 22})
+	broker.Publish(events.Event{Type: events.Detection, SrcIP: "192.168.0.1"})
+	broker.Publish(events.Event{Type: events.Detection, SrcIP: "10.0.0.1", Ports: []int{21, 22, 23, 25}, Score: 4})
+
+	reader := bufio.NewReader(resp.Body)
+	eventLine, err := reader.ReadString('\n')
+	require.NoError(t, err)
+	assert.Equal(t, "event: detection\n", eventLine)
+	dataLine, err := reader.ReadString('\n')
+	require.NoError(t, err)
+	var got events.Event
+	require.NoError(t, json.Unmarshal([]byte(strings.TrimPrefix(dataLine, "data: ")), &got))
+	assert.Equal(t, "10.0.0.1", got.SrcIP)
+	assert.Equal(t, 4, got.Score)
+	assert.Equal(t, events.SchemaVersion, got.Version)
+	assert.Equal(t, "node-1", got.Host)
+	assert.NotEmpty(t, got.ID)
+}
+
+func TestEventSchema(t *testing.T) {
+	router := NewRouter(RouterParams{Mux: chi.NewRouter(), Metrics: prometheus.NewRegistry()})
+	router.Routes()
+	w := httptest.NewRecorder()
+	router.mux.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/events/schema", nil))
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "application/schema+json", w.Header().Get(contentType))
+	assert.JSONEq(t, string(events.Schema), w.Body.String())
+}
+
+func TestStreamEventsInvalidFilter(t *testing.T) {
+	router := NewRouter(RouterParams{Mux: chi.NewRouter(), Metrics: prometheus.NewRegistry(), Events: events.NewBroker("node-1", nil)})
+	router.Routes()
+	w := httptest.NewRecorder()
+	router.mux.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/events?port=http", nil))
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	assert.Equal(t, applicationJSON, w.Header().Get(contentType))
+}
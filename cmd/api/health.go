@@ -0,0 +1,33 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"tcptracker/internal/health"
+)
+
+// probe writes the per-check report, failed report is returned with 503 so orchestrators act on it
+func probe(run func(*http.Request) health.Report) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		report := run(req)
+		if report.Status != health.OK {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+		if err := json.NewEncoder(w).Encode(report); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+}
+
+func (r *Router) livez() http.HandlerFunc {
+	return probe(func(req *http.Request) health.Report {
+		return r.checks.Liveness(req.Context())
+	})
+}
+
+func (r *Router) readyz() http.HandlerFunc {
+	return probe(func(req *http.Request) health.Report {
+		return r.checks.Readiness(req.Context())
+	})
+}
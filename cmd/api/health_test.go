@@ -0,0 +1,55 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"github.com/go-chi/chi"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"net/http"
+	"net/http/httptest"
+	"tcptracker/internal/health"
+	"testing"
+)
+
+func TestProbes(t *testing.T) {
+	checks := health.New(0)
+	checks.Live("capture", func(context.Context) error { return nil })
+	checks.Ready("firewall", func(context.Context) error { return errors.New("chain tcptracker is missing") })
+	router := NewRouter(RouterParams{Mux: chi.NewRouter(), Metrics: prometheus.NewRegistry(), Health: checks})
+	router.Routes()
+
+	tests := []struct {
+		path       string
+		statusCode int
+		status     health.Status
+		checks     []string
+	}{
+		{path: "/livez", statusCode: http.StatusOK, status: health.OK, checks: []string{"capture"}},
+		{path: "/readyz", statusCode: http.StatusServiceUnavailable, status: health.Fail, checks: []string{"capture", "firewall"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.path, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			router.mux.ServeHTTP(w, httptest.NewRequest(http.MethodGet, tt.path, nil))
+			assert.Equal(t, tt.statusCode, w.Code)
+			assert.Equal(t, applicationJSON, w.Header().Get(contentType))
+			var report health.Report
+			require.NoError(t, json.NewDecoder(w.Body).Decode(&report))
+			assert.Equal(t, tt.status, report.Status)
+			names := make([]string, 0, len(report.Checks))
+			for _, c := range report.Checks {
+				names = append(names, c.Name)
+			}
+			assert.Equal(t, tt.checks, names)
+		})
+	}
+
+	// /health follows liveness
+	checks.Live("detector", func(context.Context) error { return errors.New("detector goroutines are not running") })
+	w := httptest.NewRecorder()
+	router.mux.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/health", nil))
+	assert.Equal(t, http.StatusServiceUnavailable, w.Code)
+}
@@ -0,0 +1,37 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"tcptracker/internal/config"
+)
+
+// ConfigReloader reloads the config of the running tracker, implemented by config.Reloader
+type ConfigReloader interface {
+	Reload() config.ReloadStatus
+	Status() config.ReloadStatus
+}
+
+// reloadStatus gives the result of the last reload, SIGHUP or API triggered
+func (r *Router) reloadStatus() http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		writeReload(w, r.reloader.Status())
+	}
+}
+
+func (r *Router) reload() http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		writeReload(w, r.reloader.Reload())
+	}
+}
+
+// writeReload returns failed reload with 422, the running config is kept
+func writeReload(w http.ResponseWriter, status config.ReloadStatus) {
+	if !status.Success {
+		w.WriteHeader(http.StatusUnprocessableEntity)
+	}
+	if err := json.NewEncoder(w).Encode(status); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+}
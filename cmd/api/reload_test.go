@@ -0,0 +1,62 @@
+package api
+
+import (
+	"encoding/json"
+	"github.com/go-chi/chi"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"net/http"
+	"net/http/httptest"
+	"tcptracker/internal/config"
+	"testing"
+)
+
+type fakeReloader struct {
+	next    config.ReloadStatus
+	status  config.ReloadStatus
+	reloads int
+}
+
+func (f *fakeReloader) Reload() config.ReloadStatus {
+	f.reloads++
+	f.status = f.next
+	return f.status
+}
+
+func (f *fakeReloader) Status() config.ReloadStatus {
+	return f.status
+}
+
+func TestConfigReload(t *testing.T) {
+	reloader := &fakeReloader{
+		status: config.ReloadStatus{Success: true},
+		next:   config.ReloadStatus{Error: "invalid config:\n  detection.portScanThreshold: must be positive, got 0"},
+	}
+	router := NewRouter(RouterParams{Mux: chi.NewRouter(), Metrics: prometheus.NewRegistry(), Reloader: reloader})
+	router.Routes()
+
+	tests := []struct {
+		name       string
+		method     string
+		statusCode int
+		success    bool
+		reloads    int
+	}{
+		{name: "status", method: http.MethodGet, statusCode: http.StatusOK, success: true},
+		{name: "failed reload", method: http.MethodPost, statusCode: http.StatusUnprocessableEntity, reloads: 1},
+		{name: "status of the failed reload", method: http.MethodGet, statusCode: http.StatusUnprocessableEntity, reloads: 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			router.mux.ServeHTTP(w, httptest.NewRequest(tt.method, "/config/reload", nil))
+			assert.Equal(t, tt.statusCode, w.Code)
+			assert.Equal(t, applicationJSON, w.Header().Get(contentType))
+			var got config.ReloadStatus
+			require.NoError(t, json.NewDecoder(w.Body).Decode(&got))
+			assert.Equal(t, tt.success, got.Success)
+			assert.Equal(t, tt.reloads, reloader.reloads)
+		})
+	}
+}
@@ -1,17 +1,28 @@
 package api
 
 import (
+	"context"
 	"encoding/json"
+	"fmt"
 	"github.com/go-chi/chi"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/collectors"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"io"
 	"net/http"
+	"tcptracker/internal/auth"
+	"tcptracker/internal/connectiontracker"
+	"tcptracker/internal/detection"
+	"tcptracker/internal/events"
+	"tcptracker/internal/health"
+	"time"
 )
 
 const (
 	contentType     = "Content-Type"
 	applicationJSON = "application/json"
+	// maxReplaySize limits the uploaded pcap files
+	maxReplaySize = 64 << 20
 )
 
 //Response from the servid
@@ -28,21 +39,105 @@ func contentTypeJSON(h http.HandlerFunc) http.HandlerFunc {
 	}
 }
 
+// BlockRequest is a manual block of the IP, TTL is a duration e.g. `1h`, empty uses the Firewall default
+type BlockRequest struct {
+	IP  string `json:"ip"`
+	TTL string `json:"ttl,omitempty"`
+}
+
+// AllowRequest adds the IP to the allow list
+type AllowRequest struct {
+	IP string `json:"ip"`
+}
+
+// ConnectionLister gives recently captured connections, implemented by connectiontracker.Tracker
+type ConnectionLister interface {
+	Connections() []connectiontracker.Connection
+}
+
+// Replayer feeds pcap files through the running detection, implemented by connectiontracker.Tracker
+type Replayer interface {
+	Replay(ctx context.Context, r io.Reader) (int, error)
+}
+
+// RouterParams required params to create Router
+type RouterParams struct {
+	Mux         *chi.Mux
+	Metrics     *prometheus.Registry
+	Firewall    connectiontracker.Firewall
+	Events      *events.Broker
+	Connections ConnectionLister
+	// Auth is optional, when set every request except PublicPaths needs credentials
+	Auth        *auth.Authenticator
+	PublicPaths []string
+	// Health checks are optional, without them the probes are always OK
+	Health *health.Checks
+	// Reloader is optional, without it /config/reload is not served
+	Reloader ConfigReloader
+	// Replayer is optional, without it /replay is not served
+	Replayer Replayer
+}
+
 // Router structs represents Handlers
 type Router struct {
-	mux     *chi.Mux
-	metrics *prometheus.Registry
+	mux         *chi.Mux
+	metrics     *prometheus.Registry
+	firewall    connectiontracker.Firewall
+	events      *events.Broker
+	connections ConnectionLister
+	auth        *auth.Authenticator
+	public      map[string]bool
+	checks      *health.Checks
+	reloader    ConfigReloader
+	replayer    Replayer
 }
 
 // NewRouter is creating New Router with Handlers
-func NewRouter(mux *chi.Mux, req *prometheus.Registry) *Router {
-	return &Router{mux: mux, metrics: req}
+func NewRouter(p RouterParams) *Router {
+	router := &Router{
+		mux:         p.Mux,
+		metrics:     p.Metrics,
+		firewall:    p.Firewall,
+		events:      p.Events,
+		connections: p.Connections,
+		auth:        p.Auth,
+		public:      make(map[string]bool),
+		checks:      p.Health,
+		reloader:    p.Reloader,
+		replayer:    p.Replayer,
+	}
+	for _, path := range p.PublicPaths {
+		router.public[path] = true
+	}
+	return router
 }
 
 // Routes , all HTTP routes
 func (r *Router) Routes() {
+	if r.auth != nil {
+		r.mux.Use(r.authenticate)
+	}
 	r.mux.Get("/health", contentTypeJSON(r.health()))
+	r.mux.Get("/livez", contentTypeJSON(r.livez()))
+	r.mux.Get("/readyz", contentTypeJSON(r.readyz()))
 	r.mux.Handle("/metrics", r.prometheus())
+	r.mux.Get("/blocks", contentTypeJSON(r.blocks()))
+	r.mux.Post("/blocks", contentTypeJSON(r.block()))
+	r.mux.Delete("/blocks", contentTypeJSON(r.flush()))
+	r.mux.Delete("/blocks/{ip}", contentTypeJSON(r.unblock()))
+	r.mux.Get("/events", r.streamEvents())
+	r.mux.Get("/events/schema", r.eventSchema())
+	r.mux.Get("/connections", contentTypeJSON(r.listConnections()))
+	r.mux.Get("/allowlist", contentTypeJSON(r.allowList()))
+	r.mux.Post("/allowlist", contentTypeJSON(r.allow()))
+	r.mux.Delete("/allowlist/{ip}", contentTypeJSON(r.disallow()))
+	if r.reloader != nil {
+		r.mux.Get("/config/reload", contentTypeJSON(r.reloadStatus()))
+		r.mux.Post("/config/reload", contentTypeJSON(r.reload()))
+	}
+	if r.replayer != nil {
+		r.mux.Post("/replay", contentTypeJSON(r.replay()))
+	}
 }
 
 func (r *Router) prometheus() http.Handler {
@@ -61,17 +156,184 @@ func (r *Router) prometheus() http.Handler {
 	)
 }
 
+// health is kept for the existing monitors, it follows the liveness checks, /livez and /readyz give the details
 func (r *Router) health() http.HandlerFunc {
-	return func(w http.ResponseWriter, r *http.Request) {
-		response := Response{
-			Message:    "healthy",
-			StatusText: http.StatusText(http.StatusOK),
-			StatusCode: http.StatusOK,
+	return func(w http.ResponseWriter, req *http.Request) {
+		if r.checks.Liveness(req.Context()).Status != health.OK {
+			respond(w, "unhealthy", http.StatusServiceUnavailable)
+			return
 		}
-		if err := json.NewEncoder(w).Encode(response); err != nil {
+		respond(w, "healthy", http.StatusOK)
+	}
+}
+
+func (r *Router) blocks() http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		if err := json.NewEncoder(w).Encode(r.firewall.Blocks()); err != nil {
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
 		}
 	}
+}
+
+func (r *Router) block() http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		var body BlockRequest
+		if err := json.NewDecoder(req.Body).Decode(&body); err != nil {
+			respond(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if !detection.ValidIPv4(body.IP) {
+			respond(w, "invalid IPv4 address", http.StatusBadRequest)
+			return
+		}
+		var ttl time.Duration
+		if body.TTL != "" {
+			parsed, err := time.ParseDuration(body.TTL)
+			if err != nil || parsed < 0 {
+				respond(w, "invalid TTL", http.StatusBadRequest)
+				return
+			}
+			ttl = parsed
+		}
+		err := r.firewall.Block(detection.Detection{IP: body.IP, Type: detection.Manual, TTL: ttl})
+		if err != nil {
+			respond(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		// the queued block can still fail, the result is in the logs and the metrics
+		if b, ok := r.firewall.(batching); ok && b.Batching() {
+			respond(w, "queued", http.StatusAccepted)
+			return
+		}
+		respond(w, "blocked", http.StatusCreated)
+	}
+}
+
+// batching Firewall applies the blocks later, e.g. *connectiontracker.IPTables with a batch window
+type batching interface {
+	Batching() bool
+}
+
+func (r *Router) unblock() http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		ip := chi.URLParam(req, "ip")
+		if !detection.ValidIPv4(ip) {
+			respond(w, "invalid IPv4 address", http.StatusBadRequest)
+			return
+		}
+		if err := r.firewall.Unblock(ip); err != nil {
+			respond(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		respond(w, "unblocked", http.StatusOK)
+	}
+}
 
+// flush removes all the blocks, the allow list is kept
+func (r *Router) flush() http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		blocks := r.firewall.Blocks()
+		for _, b := range blocks {
+			if err := r.firewall.Unblock(b.IP); err != nil {
+				respond(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+		}
+		respond(w, fmt.Sprintf("unblocked %d", len(blocks)), http.StatusOK)
+	}
+}
+
+// replay reads pcap file from the body, e.g. `curl --data-binary @scan.pcap localhost:8081/replay`
+func (r *Router) replay() http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		replayed, err := r.replayer.Replay(req.Context(), http.MaxBytesReader(w, req.Body, maxReplaySize))
+		if err != nil {
+			respond(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		respond(w, fmt.Sprintf("replayed %d connections", replayed), http.StatusOK)
+	}
+}
+
+// listConnections supports the same `source` and `port` filters as /events
+func (r *Router) listConnections() http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		filter, err := events.ParseFilter(req.URL.Query())
+		if err != nil {
+			respond(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err := json.NewEncoder(w).Encode(FilterConnections(r.connections.Connections(), filter)); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+}
+
+// FilterConnections returns the connections matching the events filter
+func FilterConnections(connections []connectiontracker.Connection, filter events.Filter) []connectiontracker.Connection {
+	result := make([]connectiontracker.Connection, 0, len(connections))
+	for _, c := range connections {
+		if filter.Match(events.Event{Type: events.Connection, SrcIP: c.SrcIP, DstIP: c.DstIP, DstPort: c.DstPort}) {
+			result = append(result, c)
+		}
+	}
+	return result
+}
+
+func (r *Router) allowList() http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		if err := json.NewEncoder(w).Encode(r.firewall.AllowList()); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+}
+
+func (r *Router) allow() http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		var body AllowRequest
+		if err := json.NewDecoder(req.Body).Decode(&body); err != nil {
+			respond(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if !detection.ValidIPv4(body.IP) {
+			respond(w, "invalid IPv4 address", http.StatusBadRequest)
+			return
+		}
+		if err := r.firewall.Allow(body.IP); err != nil {
+			respond(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		respond(w, "allowed", http.StatusCreated)
+	}
+}
+
+func (r *Router) disallow() http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		ip := chi.URLParam(req, "ip")
+		if !detection.ValidIPv4(ip) {
+			respond(w, "invalid IPv4 address", http.StatusBadRequest)
+			return
+		}
+		if err := r.firewall.Disallow(ip); err != nil {
+			respond(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		respond(w, "removed from the allow list", http.StatusOK)
+	}
+}
+
+func respond(w http.ResponseWriter, message string, statusCode int) {
+	w.WriteHeader(statusCode)
+	response := Response{
+		Message:    message,
+		StatusText: http.StatusText(statusCode),
+		StatusCode: statusCode,
+	}
+	if err := json.NewEncoder(w).Encode(response); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
 }
@@ -1,17 +1,27 @@
 package api
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"github.com/go-chi/chi"
+	"github.com/golang/mock/gomock"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"io"
 	"net/http"
 	"net/http/httptest"
+	"strings"
+	"tcptracker/internal/connectiontracker"
+	"tcptracker/internal/detection"
+	"tcptracker/mock"
 	"testing"
+	"time"
 )
 
 func TestEndpoints(t *testing.T) {
-	router := NewRouter(chi.NewRouter(), prometheus.NewRegistry())
+	router := NewRouter(RouterParams{Mux: chi.NewRouter(), Metrics: prometheus.NewRegistry()})
 	router.Routes()
 	w := httptest.NewRecorder()
 
@@ -54,3 +64,149 @@ func TestEndpoints(t *testing.T) {
 		})
 	}
 }
+
+func TestBlockEndpoints(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	mockFw := mock.NewMockFirewall(ctrl)
+	router := NewRouter(RouterParams{Mux: chi.NewRouter(), Metrics: prometheus.NewRegistry(), Firewall: mockFw})
+	router.Routes()
+
+	blocks := []detection.Block{{IP: "10.0.0.1", Type: detection.PortScan, Score: 4, Action: "DROP"}}
+	mockFw.EXPECT().Blocks().Return(blocks).Times(2)
+	mockFw.EXPECT().Block(detection.Detection{IP: "10.0.0.2", Type: detection.Manual, TTL: time.Hour}).Return(nil).Times(1)
+	mockFw.EXPECT().Unblock("10.0.0.1").Return(nil).Times(2)
+
+	tests := []struct {
+		name       string
+		method     string
+		path       string
+		body       string
+		statusCode int
+	}{
+		{name: "list", method: http.MethodGet, path: "/blocks", statusCode: http.StatusOK},
+		{name: "block", method: http.MethodPost, path: "/blocks", body: `{"ip":"10.0.0.2","ttl":"1h"}`, statusCode: http.StatusCreated},
+		{name: "block invalid IP", method: http.MethodPost, path: "/blocks", body: `{"ip":"10.0.0"}`, statusCode: http.StatusBadRequest},
+		{name: "block invalid TTL", method: http.MethodPost, path: "/blocks", body: `{"ip":"10.0.0.2","ttl":"1y"}`, statusCode: http.StatusBadRequest},
+		{name: "unblock", method: http.MethodDelete, path: "/blocks/10.0.0.1", statusCode: http.StatusOK},
+		{name: "unblock invalid IP", method: http.MethodDelete, path: "/blocks/nope", statusCode: http.StatusBadRequest},
+		{name: "block IPv6", method: http.MethodPost, path: "/blocks", body: `{"ip":"2001:db8::1"}`, statusCode: http.StatusBadRequest},
+		{name: "unblock IPv6", method: http.MethodDelete, path: "/blocks/2001:db8::1", statusCode: http.StatusBadRequest},
+		{name: "flush", method: http.MethodDelete, path: "/blocks", statusCode: http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			r := httptest.NewRequest(tt.method, tt.path, strings.NewReader(tt.body))
+			router.mux.ServeHTTP(w, r)
+			assert.Equal(t, tt.statusCode, w.Code)
+			assert.Equal(t, applicationJSON, w.Header().Get(contentType))
+		})
+	}
+}
+
+// batchingFirewall queues the blocks like connectiontracker.IPTables with a batch window
+type batchingFirewall struct {
+	*mock.MockFirewall
+}
+
+func (batchingFirewall) Batching() bool { return true }
+
+func TestBlockQueuedInBatch(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	mockFw := mock.NewMockFirewall(ctrl)
+	router := NewRouter(RouterParams{Mux: chi.NewRouter(), Metrics: prometheus.NewRegistry(), Firewall: batchingFirewall{mockFw}})
+	router.Routes()
+	mockFw.EXPECT().Block(detection.Detection{IP: "10.0.0.2", Type: detection.Manual}).Return(nil).Times(1)
+
+	w := httptest.NewRecorder()
+	router.mux.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/blocks", strings.NewReader(`{"ip":"10.0.0.2"}`)))
+	assert.Equal(t, http.StatusAccepted, w.Code)
+	assert.Contains(t, w.Body.String(), "queued")
+}
+
+type fakeReplayer struct {
+	body string
+}
+
+func (f *fakeReplayer) Replay(_ context.Context, r io.Reader) (int, error) {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return 0, err
+	}
+	f.body = string(data)
+	if f.body == "" {
+		return 0, errors.New("reading pcap: EOF")
+	}
+	return 3, nil
+}
+
+func TestReplayEndpoint(t *testing.T) {
+	replayer := &fakeReplayer{}
+	router := NewRouter(RouterParams{Mux: chi.NewRouter(), Metrics: prometheus.NewRegistry(), Replayer: replayer})
+	router.Routes()
+
+	w := httptest.NewRecorder()
+	router.mux.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/replay", strings.NewReader("pcap")))
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "pcap", replayer.body)
+	var got Response
+	require.NoError(t, json.NewDecoder(w.Body).Decode(&got))
+	assert.Equal(t, "replayed 3 connections", got.Message)
+
+	w = httptest.NewRecorder()
+	router.mux.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/replay", nil))
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+}
+
+type fakeConnections []connectiontracker.Connection
+
+func (f fakeConnections) Connections() []connectiontracker.Connection { return f }
+
+func TestAllowListAndConnectionsEndpoints(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	mockFw := mock.NewMockFirewall(ctrl)
+	connections := fakeConnections{
+		{SrcIP: "10.0.0.1", DstIP: "192.168.0.1", DstPort: 22},
+		{SrcIP: "10.0.0.2", DstIP: "192.168.0.1", DstPort: 80},
+	}
+	router := NewRouter(RouterParams{Mux: chi.NewRouter(), Metrics: prometheus.NewRegistry(), Firewall: mockFw, Connections: connections})
+	router.Routes()
+
+	mockFw.EXPECT().AllowList().Return([]string{"10.0.0.3"}).Times(1)
+	mockFw.EXPECT().Allow("10.0.0.3").Return(nil).Times(1)
+	mockFw.EXPECT().Disallow("10.0.0.3").Return(nil).Times(1)
+
+	tests := []struct {
+		name       string
+		method     string
+		path       string
+		body       string
+		statusCode int
+		want       string
+	}{
+		{name: "connections", method: http.MethodGet, path: "/connections?port=22", statusCode: http.StatusOK,
+			want: `[{"srcIp":"10.0.0.1","dstIp":"192.168.0.1","dstPort":22,"seen":"0001-01-01T00:00:00Z"}]`},
+		{name: "connections invalid filter", method: http.MethodGet, path: "/connections?source=nope", statusCode: http.StatusBadRequest},
+		{name: "allow list", method: http.MethodGet, path: "/allowlist", statusCode: http.StatusOK, want: `["10.0.0.3"]`},
+		{name: "allow", method: http.MethodPost, path: "/allowlist", body: `{"ip":"10.0.0.3"}`, statusCode: http.StatusCreated},
+		{name: "allow invalid IP", method: http.MethodPost, path: "/allowlist", body: `{"ip":"nope"}`, statusCode: http.StatusBadRequest},
+		{name: "allow IPv4-mapped IPv6", method: http.MethodPost, path: "/allowlist", body: `{"ip":"::ffff:10.0.0.3"}`,
+			statusCode: http.StatusBadRequest},
+		{name: "disallow IPv6", method: http.MethodDelete, path: "/allowlist/::1", statusCode: http.StatusBadRequest},
+		{name: "disallow", method: http.MethodDelete, path: "/allowlist/10.0.0.3", statusCode: http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			r := httptest.NewRequest(tt.method, tt.path, strings.NewReader(tt.body))
+			router.mux.ServeHTTP(w, r)
+			assert.Equal(t, tt.statusCode, w.Code)
+			if tt.want != "" {
+				assert.JSONEq(t, tt.want, w.Body.String())
+			}
+		})
+	}
+}
@@ -0,0 +1,301 @@
+// Package cli implements `tcptracker <command>` operating the running tracker through its HTTP API
+package cli
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"tcptracker/cmd/api"
+	"tcptracker/internal/detection"
+	"tcptracker/internal/health"
+	"text/tabwriter"
+	"time"
+)
+
+const defaultAddr = "http://127.0.0.1:8081"
+
+var errNotReady = errors.New("tracker is not ready")
+
+// usageError is reported with the usage of the command and exit code 2
+type usageError string
+
+func (e usageError) Error() string { return string(e) }
+
+// options are the flags of the commands, the connection flags are shared by all of them
+type options struct {
+	addr      string
+	socket    string
+	token     string
+	tokenFile string
+	json      bool
+	ttl       time.Duration
+	top       int
+	window    time.Duration
+	out       io.Writer
+}
+
+type command struct {
+	usage string
+	flags func(fs *flag.FlagSet, o *options)
+	run   func(ctx context.Context, c *client, o *options, args []string) error
+}
+
+var commands = map[string]command{
+	"status": {usage: "status", run: status},
+	"blocks": {usage: "blocks list [-json]", flags: jsonFlag, run: blocks},
+	"block": {
+		usage: "block <ip> [-ttl 1h]",
+		flags: func(fs *flag.FlagSet, o *options) {
+			fs.DurationVar(&o.ttl, "ttl", 0, "How long the IP stays blocked, 0 uses the tracker default.")
+		},
+		run: block,
+	},
+	"unblock": {usage: "unblock <ip>", run: unblock},
+	"allow":   {usage: "allow add|remove <ip>, allow list [-json]", flags: jsonFlag, run: allow},
+	"top": {
+		usage: "top [-n 10] [-window 10s]",
+		flags: func(fs *flag.FlagSet, o *options) {
+			fs.IntVar(&o.top, "n", 10, "Number of sources to show.")
+			fs.DurationVar(&o.window, "window", 10*time.Second, "Window of counting the connections.")
+		},
+		run: top,
+	},
+	"replay": {usage: "replay <file.pcap>", run: replay},
+	"flush":  {usage: "flush", run: flush},
+}
+
+// IsCommand tells if the arg is a CLI command, the daemon is started without one
+func IsCommand(arg string) bool {
+	_, ok := commands[arg]
+	return ok
+}
+
+// Run executes the command of args[0] and returns the exit code
+func Run(ctx context.Context, args []string, stdout, stderr io.Writer) int {
+	cmd, ok := commands[args[0]]
+	if !ok {
+		fmt.Fprintf(stderr, "unknown command %q\n", args[0])
+		return 2
+	}
+	o := &options{out: stdout}
+	fs := flag.NewFlagSet("tcptracker "+args[0], flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	fs.Usage = func() {
+		fmt.Fprintf(stderr, "Usage: tcptracker %s\n", cmd.usage)
+		fs.PrintDefaults()
+	}
+	fs.StringVar(&o.addr, "addr", defaultAddr, "HTTP API address of the tracker.")
+	fs.StringVar(&o.socket, "socket", "", "Unix socket of the tracker (-apiSocket), used instead of -addr.")
+	fs.StringVar(&o.token, "token", "", "Bearer token of the API.")
+	fs.StringVar(&o.tokenFile, "tokenFile", "", "File with the bearer token of the API.")
+	if cmd.flags != nil {
+		cmd.flags(fs, o)
+	}
+	positional, err := parseArgs(fs, args[1:])
+	if errors.Is(err, flag.ErrHelp) {
+		return 0
+	}
+	if err != nil {
+		return 2
+	}
+	c, err := newClient(o)
+	if err != nil {
+		fmt.Fprintln(stderr, err)
+		return 1
+	}
+	err = cmd.run(ctx, c, o, positional)
+	var usage usageError
+	switch {
+	case errors.As(err, &usage):
+		fmt.Fprintln(stderr, err)
+		fs.Usage()
+		return 2
+	case err != nil:
+		fmt.Fprintln(stderr, err)
+		return 1
+	}
+	return 0
+}
+
+// parseArgs allows the flags after the positional args, e.g. `block 10.0.0.1 --ttl 1h`
+func parseArgs(fs *flag.FlagSet, args []string) ([]string, error) {
+	var positional []string
+	for {
+		if err := fs.Parse(args); err != nil {
+			return nil, err
+		}
+		if fs.NArg() == 0 {
+			return positional, nil
+		}
+		positional = append(positional, fs.Arg(0))
+		args = fs.Args()[1:]
+	}
+}
+
+func jsonFlag(fs *flag.FlagSet, o *options) {
+	fs.BoolVar(&o.json, "json", false, "Print JSON instead of the table.")
+}
+
+func wantArgs(args []string, n int) error {
+	if len(args) != n {
+		return usageError(fmt.Sprintf("expected %d arguments, got %d", n, len(args)))
+	}
+	return nil
+}
+
+// status prints the readiness checks and the counts, it fails when the tracker is not ready
+func status(ctx context.Context, c *client, o *options, args []string) error {
+	if err := wantArgs(args, 0); err != nil {
+		return err
+	}
+	// 503 still carries the report
+	resp, err := c.request(ctx, http.MethodGet, "/readyz", nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusServiceUnavailable {
+		return responseError(resp)
+	}
+	var report health.Report
+	if err := json.NewDecoder(resp.Body).Decode(&report); err != nil {
+		return err
+	}
+	var blockList []detection.Block
+	if err := c.do(ctx, http.MethodGet, "/blocks", nil, &blockList); err != nil {
+		return err
+	}
+	var allowList []string
+	if err := c.do(ctx, http.MethodGet, "/allowlist", nil, &allowList); err != nil {
+		return err
+	}
+	w := tabwriter.NewWriter(o.out, 0, 0, 2, ' ', 0)
+	fmt.Fprintf(w, "status\t%s\n", report.Status)
+	for _, check := range report.Checks {
+		fmt.Fprintf(w, "  %s\t%s\t%s\n", check.Name, check.Status, check.Error)
+	}
+	fmt.Fprintf(w, "blocks\t%d\n", len(blockList))
+	fmt.Fprintf(w, "allowed\t%d\n", len(allowList))
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	if report.Status != health.OK {
+		return errNotReady
+	}
+	return nil
+}
+
+func blocks(ctx context.Context, c *client, o *options, args []string) error {
+	if len(args) != 1 || args[0] != "list" {
+		return usageError("expected `blocks list`")
+	}
+	var list []detection.Block
+	if err := c.do(ctx, http.MethodGet, "/blocks", nil, &list); err != nil {
+		return err
+	}
+	if o.json {
+		return json.NewEncoder(o.out).Encode(list)
+	}
+	w := tabwriter.NewWriter(o.out, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "IP\tTYPE\tSCORE\tACTION\tCREATED\tEXPIRES")
+	for _, b := range list {
+		expires := "never"
+		if !b.ExpiresAt.IsZero() {
+			expires = b.ExpiresAt.Local().Format(time.RFC3339)
+		}
+		fmt.Fprintf(w, "%s\t%s\t%d\t%s\t%s\t%s\n",
+			b.IP, b.Type, b.Score, b.Action, b.CreatedAt.Local().Format(time.RFC3339), expires)
+	}
+	return w.Flush()
+}
+
+func block(ctx context.Context, c *client, o *options, args []string) error {
+	if err := wantArgs(args, 1); err != nil {
+		return err
+	}
+	req := api.BlockRequest{IP: args[0]}
+	if o.ttl > 0 {
+		req.TTL = o.ttl.String()
+	}
+	return printResponse(o, c.doJSON(ctx, http.MethodPost, "/blocks", req, nil), "blocked "+args[0])
+}
+
+func unblock(ctx context.Context, c *client, o *options, args []string) error {
+	if err := wantArgs(args, 1); err != nil {
+		return err
+	}
+	err := c.do(ctx, http.MethodDelete, "/blocks/"+url.PathEscape(args[0]), nil, nil)
+	return printResponse(o, err, "unblocked "+args[0])
+}
+
+func allow(ctx context.Context, c *client, o *options, args []string) error {
+	if len(args) == 1 && args[0] == "list" {
+		var list []string
+		if err := c.do(ctx, http.MethodGet, "/allowlist", nil, &list); err != nil {
+			return err
+		}
+		if o.json {
+			return json.NewEncoder(o.out).Encode(list)
+		}
+		_, err := fmt.Fprintln(o.out, strings.Join(list, "\n"))
+		return err
+	}
+	if len(args) != 2 {
+		return usageError("expected `allow add <ip>`, `allow remove <ip>` or `allow list`")
+	}
+	switch ip := args[1]; args[0] {
+	case "add":
+		err := c.doJSON(ctx, http.MethodPost, "/allowlist", api.AllowRequest{IP: ip}, nil)
+		return printResponse(o, err, "allowed "+ip)
+	case "remove":
+		err := c.do(ctx, http.MethodDelete, "/allowlist/"+url.PathEscape(ip), nil, nil)
+		return printResponse(o, err, "removed "+ip+" from the allow list")
+	}
+	return usageError(fmt.Sprintf("unknown allow command %q", args[0]))
+}
+
+// replay uploads the pcap file, its connections go through the detection of the running tracker
+func replay(ctx context.Context, c *client, o *options, args []string) error {
+	if err := wantArgs(args, 1); err != nil {
+		return err
+	}
+	f, err := os.Open(args[0])
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	var resp api.Response
+	if err := c.do(ctx, http.MethodPost, "/replay", f, &resp); err != nil {
+		return err
+	}
+	_, err = fmt.Fprintln(o.out, resp.Message)
+	return err
+}
+
+// flush removes all the blocks, the allow list is kept
+func flush(ctx context.Context, c *client, o *options, args []string) error {
+	if err := wantArgs(args, 0); err != nil {
+		return err
+	}
+	var resp api.Response
+	if err := c.do(ctx, http.MethodDelete, "/blocks", nil, &resp); err != nil {
+		return err
+	}
+	_, err := fmt.Fprintln(o.out, resp.Message)
+	return err
+}
+
+func printResponse(o *options, err error, message string) error {
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintln(o.out, message)
+	return err
+}
@@ -0,0 +1,175 @@
+package cli
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"flag"
+	"github.com/go-chi/chi"
+	"github.com/golang/mock/gomock"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"io"
+	"net"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"tcptracker/cmd/api"
+	"tcptracker/internal/auth"
+	"tcptracker/internal/detection"
+	"tcptracker/internal/events"
+	"tcptracker/internal/health"
+	"tcptracker/mock"
+	"testing"
+	"time"
+)
+
+type fakeReplayer struct{}
+
+func (fakeReplayer) Replay(_ context.Context, r io.Reader) (int, error) {
+	data, err := io.ReadAll(r)
+	if err != nil || len(data) == 0 {
+		return 0, errors.New("reading pcap: EOF")
+	}
+	return 2, nil
+}
+
+func TestCommands(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	mockFw := mock.NewMockFirewall(ctrl)
+	tokens := filepath.Join(t.TempDir(), "tokens")
+	require.NoError(t, os.WriteFile(tokens, []byte("admin ops admin-token\n"), 0o600))
+	authenticator, err := auth.New(auth.Params{TokensFile: tokens})
+	require.NoError(t, err)
+	checks := health.New(0)
+	checks.Ready("firewall", func(context.Context) error { return nil })
+	mux := chi.NewRouter()
+	api.NewRouter(api.RouterParams{
+		Mux:      mux,
+		Metrics:  prometheus.NewRegistry(),
+		Firewall: mockFw,
+		Auth:     authenticator,
+		Health:   checks,
+		Replayer: fakeReplayer{},
+	}).Routes()
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	// the socket is trusted without token
+	socket := filepath.Join(t.TempDir(), "tcptracker.sock")
+	listener, err := net.Listen("unix", socket)
+	require.NoError(t, err)
+	local := httptest.NewUnstartedServer(api.Local(mux))
+	local.Listener = listener
+	local.Start()
+	defer local.Close()
+
+	blocks := []detection.Block{{IP: "10.0.0.1", Type: detection.PortScan, Score: 4, Action: "DROP"}}
+	mockFw.EXPECT().Blocks().Return(blocks).AnyTimes()
+	mockFw.EXPECT().AllowList().Return([]string{"10.0.0.3"}).AnyTimes()
+	mockFw.EXPECT().Block(detection.Detection{IP: "10.0.0.2", Type: detection.Manual, TTL: time.Hour}).Return(nil).Times(1)
+	mockFw.EXPECT().Unblock("10.0.0.1").Return(nil).Times(2)
+	mockFw.EXPECT().Allow("10.0.0.3").Return(nil).Times(1)
+	mockFw.EXPECT().Disallow("10.0.0.3").Return(nil).Times(1)
+
+	pcapFile := filepath.Join(t.TempDir(), "scan.pcap")
+	require.NoError(t, os.WriteFile(pcapFile, []byte("pcap"), 0o600))
+	tokenFile := filepath.Join(t.TempDir(), "token")
+	require.NoError(t, os.WriteFile(tokenFile, []byte("admin-token\n"), 0o600))
+	withToken := []string{"-addr", server.URL, "-tokenFile", tokenFile}
+
+	tests := []struct {
+		name string
+		args []string
+		code int
+		out  string
+	}{
+		{name: "status", args: []string{"status"}, code: 0, out: "blocks      1"},
+		{name: "blocks list", args: []string{"blocks", "list"}, code: 0, out: "10.0.0.1  portscan  4      DROP"},
+		{name: "blocks list json", args: []string{"blocks", "list", "-json"}, code: 0, out: `"ip":"10.0.0.1"`},
+		{name: "block with ttl after ip", args: []string{"block", "10.0.0.2", "--ttl", "1h"}, code: 0, out: "blocked 10.0.0.2"},
+		{name: "block without ip", args: []string{"block"}, code: 2},
+		{name: "unblock", args: []string{"unblock", "10.0.0.1"}, code: 0, out: "unblocked 10.0.0.1"},
+		{name: "allow add", args: []string{"allow", "add", "10.0.0.3"}, code: 0, out: "allowed 10.0.0.3"},
+		{name: "allow remove", args: []string{"allow", "remove", "10.0.0.3"}, code: 0},
+		{name: "allow list", args: []string{"allow", "list"}, code: 0, out: "10.0.0.3"},
+		{name: "allow unknown", args: []string{"allow", "drop", "10.0.0.3"}, code: 2},
+		{name: "replay", args: []string{"replay", pcapFile}, code: 0, out: "replayed 2 connections"},
+		{name: "replay missing file", args: []string{"replay", "missing.pcap"}, code: 1},
+		{name: "flush", args: []string{"flush"}, code: 0, out: "unblocked 1"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var stdout, stderr bytes.Buffer
+			args := append(append([]string{}, tt.args...), "-socket", socket)
+			code := Run(context.Background(), args, &stdout, &stderr)
+			assert.Equal(t, tt.code, code, stderr.String())
+			assert.Contains(t, stdout.String(), tt.out)
+		})
+	}
+
+	t.Run("token over TCP", func(t *testing.T) {
+		var stdout, stderr bytes.Buffer
+		assert.Equal(t, 0, Run(context.Background(), append([]string{"allow", "list"}, withToken...), &stdout, &stderr))
+		assert.Equal(t, 1, Run(context.Background(), []string{"allow", "list", "-addr", server.URL}, &stdout, &stderr))
+		assert.Contains(t, stderr.String(), "401 Unauthorized: unauthenticated")
+	})
+}
+
+func TestStatusNotReady(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	mockFw := mock.NewMockFirewall(ctrl)
+	mockFw.EXPECT().Blocks().Return(nil)
+	mockFw.EXPECT().AllowList().Return(nil)
+	checks := health.New(0)
+	checks.Ready("firewall", func(context.Context) error { return errors.New("chain tcptracker is missing") })
+	mux := chi.NewRouter()
+	api.NewRouter(api.RouterParams{Mux: mux, Metrics: prometheus.NewRegistry(), Firewall: mockFw, Health: checks}).Routes()
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	var stdout, stderr bytes.Buffer
+	assert.Equal(t, 1, Run(context.Background(), []string{"status", "-addr", server.URL}, &stdout, &stderr))
+	assert.Contains(t, stdout.String(), "chain tcptracker is missing")
+	assert.Contains(t, stderr.String(), errNotReady.Error())
+}
+
+func Test_parseArgs(t *testing.T) {
+	fs := flag.NewFlagSet("block", flag.ContinueOnError)
+	ttl := fs.Duration("ttl", 0, "")
+	args, err := parseArgs(fs, []string{"10.0.0.1", "--ttl", "1h", "extra"})
+	require.NoError(t, err)
+	assert.Equal(t, []string{"10.0.0.1", "extra"}, args)
+	assert.Equal(t, time.Hour, *ttl)
+}
+
+func TestTop(t *testing.T) {
+	stream := strings.Join([]string{
+		": keep-alive",
+		"",
+		`event: connection`,
+		`data: {"type":"connection","srcIp":"10.0.0.1","dstPort":22}`,
+		"",
+		`data: {"type":"connection","srcIp":"10.0.0.2","dstPort":22}`,
+		`data: {"type":"connection","srcIp":"10.0.0.1","dstPort":80}`,
+		"",
+	}, "\n")
+	counts := newTalkers(10 * time.Second)
+	now := time.Now()
+	var received []events.Event
+	err := readEvents(strings.NewReader(stream), func(e events.Event) {
+		received = append(received, e)
+		counts.add(e.SrcIP, now)
+	})
+	assert.ErrorIs(t, err, errStreamClosed)
+	require.Len(t, received, 3)
+	assert.Equal(t, 80, received[2].DstPort)
+
+	counts.add("10.0.0.3", now.Add(5*time.Second))
+	assert.Equal(t, []talker{{source: "10.0.0.1", connections: 2}, {source: "10.0.0.2", connections: 1}}, counts.top(2, now))
+	assert.Equal(t, []talker{{source: "10.0.0.3", connections: 1}}, counts.top(2, now.Add(12*time.Second)), "older hits are dropped")
+}
@@ -0,0 +1,88 @@
+package cli
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"tcptracker/cmd/api"
+)
+
+// client of the HTTP API, over TCP or the unix socket of the running tracker
+type client struct {
+	base  string
+	token string
+	http  *http.Client
+}
+
+func newClient(o *options) (*client, error) {
+	c := &client{base: strings.TrimSuffix(o.addr, "/"), token: o.token, http: &http.Client{}}
+	if o.tokenFile != "" {
+		data, err := os.ReadFile(o.tokenFile)
+		if err != nil {
+			return nil, err
+		}
+		c.token = strings.TrimSpace(string(data))
+	}
+	if o.socket != "" {
+		// the host is ignored by the dialer, socket requests do not need a token
+		c.base = "http://tcptracker"
+		c.http.Transport = &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				var d net.Dialer
+				return d.DialContext(ctx, "unix", o.socket)
+			},
+		}
+	}
+	return c, nil
+}
+
+func (c *client) request(ctx context.Context, method, path string, body io.Reader) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, method, c.base+path, body)
+	if err != nil {
+		return nil, err
+	}
+	if c.token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.token)
+	}
+	return c.http.Do(req)
+}
+
+// do decodes the JSON response into out, error responses of the API are returned with their message
+func (c *client) do(ctx context.Context, method, path string, body io.Reader, out interface{}) error {
+	resp, err := c.request(ctx, method, path, body)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= http.StatusBadRequest {
+		return responseError(resp)
+	}
+	if out == nil {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+// doJSON sends the value as JSON body
+func (c *client) doJSON(ctx context.Context, method, path string, in, out interface{}) error {
+	data, err := json.Marshal(in)
+	if err != nil {
+		return err
+	}
+	return c.do(ctx, method, path, bytes.NewReader(data), out)
+}
+
+func responseError(resp *http.Response) error {
+	var r api.Response
+	if err := json.NewDecoder(resp.Body).Decode(&r); err != nil || r.Message == "" {
+		return errors.New(resp.Status)
+	}
+	return fmt.Errorf("%s: %s", resp.Status, r.Message)
+}
@@ -0,0 +1,151 @@
+package cli
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"tcptracker/internal/events"
+	"text/tabwriter"
+	"time"
+)
+
+const (
+	refreshInterval = time.Second
+	clearScreen     = "\033[H\033[2J"
+)
+
+var errStreamClosed = errors.New("event stream closed by the tracker")
+
+// top shows the sources with the most new connections in the window, counted from the /events stream
+func top(ctx context.Context, c *client, o *options, args []string) error {
+	if err := wantArgs(args, 0); err != nil {
+		return err
+	}
+	if o.top <= 0 || o.window <= 0 {
+		return usageError("-n and -window must be positive")
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	resp, err := c.request(ctx, http.MethodGet, "/events?type=connection", nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return responseError(resp)
+	}
+	counts := newTalkers(o.window)
+	streamErr := make(chan error, 1)
+	go func() {
+		streamErr <- readEvents(resp.Body, func(e events.Event) {
+			counts.add(e.SrcIP, time.Now())
+		})
+	}()
+	ticker := time.NewTicker(refreshInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case err := <-streamErr:
+			return err
+		case now := <-ticker.C:
+			if err := renderTop(o, counts.top(o.top, now)); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+func renderTop(o *options, sources []talker) error {
+	w := tabwriter.NewWriter(o.out, 0, 0, 2, ' ', 0)
+	fmt.Fprint(w, clearScreen)
+	fmt.Fprintf(w, "Top sources of new connections in the last %s\n\n", o.window)
+	fmt.Fprintln(w, "SOURCE\tCONNECTIONS")
+	for _, s := range sources {
+		fmt.Fprintf(w, "%s\t%d\n", s.source, s.connections)
+	}
+	return w.Flush()
+}
+
+// readEvents calls fn with every event of the Server-Sent Events stream until it is closed
+func readEvents(r io.Reader, fn func(events.Event)) error {
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if !strings.HasPrefix(line, "data: ") {
+			continue
+		}
+		var e events.Event
+		if err := json.Unmarshal([]byte(strings.TrimPrefix(line, "data: ")), &e); err != nil {
+			return fmt.Errorf("decoding event: %w", err)
+		}
+		fn(e)
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+	return errStreamClosed
+}
+
+type talker struct {
+	source      string
+	connections int
+}
+
+type hit struct {
+	source string
+	at     time.Time
+}
+
+// talkers counts connections per source in the sliding window
+type talkers struct {
+	window time.Duration
+	hits   []hit
+	m      sync.Mutex
+}
+
+func newTalkers(window time.Duration) *talkers {
+	return &talkers{window: window}
+}
+
+func (t *talkers) add(source string, now time.Time) {
+	t.m.Lock()
+	defer t.m.Unlock()
+	t.hits = append(t.hits, hit{source: source, at: now})
+}
+
+// top returns at most n sources ordered by connections, older hits are dropped
+func (t *talkers) top(n int, now time.Time) []talker {
+	t.m.Lock()
+	defer t.m.Unlock()
+	start := sort.Search(len(t.hits), func(i int) bool {
+		return now.Sub(t.hits[i].at) < t.window
+	})
+	t.hits = append(t.hits[:0], t.hits[start:]...)
+	counts := make(map[string]int)
+	for _, h := range t.hits {
+		counts[h.source]++
+	}
+	sources := make([]talker, 0, len(counts))
+	for source, connections := range counts {
+		sources = append(sources, talker{source: source, connections: connections})
+	}
+	sort.Slice(sources, func(i, j int) bool {
+		if sources[i].connections == sources[j].connections {
+			return sources[i].source < sources[j].source
+		}
+		return sources[i].connections > sources[j].connections
+	})
+	if len(sources) > n {
+		sources = sources[:n]
+	}
+	return sources
+}
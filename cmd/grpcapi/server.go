@@ -0,0 +1,232 @@
+package grpcapi
+
+import (
+	"context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/timestamppb"
+	"net/url"
+	"strconv"
+	"tcptracker/cmd/api"
+	"tcptracker/internal/connectiontracker"
+	"tcptracker/internal/detection"
+	"tcptracker/internal/events"
+	trackerv1 "tcptracker/proto/tcptracker/v1"
+)
+
+// Params required params to create Server, the same state is used by the REST API
+type Params struct {
+	Firewall    connectiontracker.Firewall
+	Events      *events.Broker
+	Connections api.ConnectionLister
+	// Config returns the running config, it follows the reloads
+	Config func() *trackerv1.Config
+}
+
+// Server implements trackerv1.TrackerServiceServer
+type Server struct {
+	trackerv1.UnimplementedTrackerServiceServer
+	firewall    connectiontracker.Firewall
+	events      *events.Broker
+	connections api.ConnectionLister
+	config      func() *trackerv1.Config
+}
+
+// NewServer creates Server, register it with Register
+func NewServer(p Params) *Server {
+	return &Server{
+		firewall:    p.Firewall,
+		events:      p.Events,
+		connections: p.Connections,
+		config:      p.Config,
+	}
+}
+
+// Register adds the service to gRPC server
+func (s *Server) Register(g *grpc.Server) {
+	trackerv1.RegisterTrackerServiceServer(g, s)
+}
+
+// readOnlyMethods need only auth.Read role, the others change the firewall
+var readOnlyMethods = map[string]bool{
+	trackerv1.TrackerService_ListConnections_FullMethodName:  true,
+	trackerv1.TrackerService_WatchConnections_FullMethodName: true,
+	trackerv1.TrackerService_ListBlocks_FullMethodName:       true,
+	trackerv1.TrackerService_ListAllowlist_FullMethodName:    true,
+	trackerv1.TrackerService_GetConfig_FullMethodName:        true,
+}
+
+// ReadOnly tells if the full gRPC method name doesn't change the firewall, used by the auth interceptors
+func ReadOnly(fullMethod string) bool {
+	return readOnlyMethods[fullMethod]
+}
+
+func (s *Server) ListConnections(_ context.Context, req *trackerv1.ListConnectionsRequest) (*trackerv1.ListConnectionsResponse, error) {
+	filter, err := parseFilter(nil, req.GetSource(), req.GetPort())
+	if err != nil {
+		return nil, err
+	}
+	connections := api.FilterConnections(s.connections.Connections(), filter)
+	resp := &trackerv1.ListConnectionsResponse{Connections: make([]*trackerv1.Connection, 0, len(connections))}
+	for _, c := range connections {
+		resp.Connections = append(resp.Connections, &trackerv1.Connection{
+			SrcIp:   c.SrcIP,
+			DstIp:   c.DstIP,
+			DstPort: uint32(c.DstPort),
+			Seen:    timestamppb.New(c.Seen),
+		})
+	}
+	return resp, nil
+}
+
+func (s *Server) WatchConnections(req *trackerv1.WatchConnectionsRequest, stream trackerv1.TrackerService_WatchConnectionsServer) error {
+	types := req.GetTypes()
+	if len(types) == 0 {
+		types = []string{string(events.Connection)}
+	}
+	filter, err := parseFilter(types, req.GetSource(), req.GetPort())
+	if err != nil {
+		return err
+	}
+	if s.events == nil {
+		return status.Error(codes.Unavailable, "events are not enabled")
+	}
+	published, unsubscribe := s.events.Subscribe(filter)
+	defer unsubscribe()
+	for {
+		select {
+		case <-stream.Context().Done():
+			return nil
+		case e := <-published:
+			if err := stream.Send(toEvent(e)); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+func (s *Server) ListBlocks(context.Context, *trackerv1.ListBlocksRequest) (*trackerv1.ListBlocksResponse, error) {
+	blocks := s.firewall.Blocks()
+	resp := &trackerv1.ListBlocksResponse{Blocks: make([]*trackerv1.Block, 0, len(blocks))}
+	for _, b := range blocks {
+		block := &trackerv1.Block{
+			Ip:          b.IP,
+			DetectionId: b.DetectionID,
+			Type:        string(b.Type),
+			Score:       int32(b.Score),
+			Action:      b.Action,
+			CreatedAt:   timestamppb.New(b.CreatedAt),
+		}
+		if !b.ExpiresAt.IsZero() {
+			block.ExpiresAt = timestamppb.New(b.ExpiresAt)
+		}
+		resp.Blocks = append(resp.Blocks, block)
+	}
+	return resp, nil
+}
+
+func (s *Server) AddBlock(_ context.Context, req *trackerv1.AddBlockRequest) (*trackerv1.AddBlockResponse, error) {
+	if err := validIP(req.GetIp()); err != nil {
+		return nil, err
+	}
+	ttl := req.GetTtl().AsDuration()
+	if ttl < 0 {
+		return nil, status.Error(codes.InvalidArgument, "invalid TTL")
+	}
+	if err := s.firewall.Block(detection.Detection{IP: req.GetIp(), Type: detection.Manual, TTL: ttl}); err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	return &trackerv1.AddBlockResponse{}, nil
+}
+
+func (s *Server) RemoveBlock(_ context.Context, req *trackerv1.RemoveBlockRequest) (*trackerv1.RemoveBlockResponse, error) {
+	if err := validIP(req.GetIp()); err != nil {
+		return nil, err
+	}
+	if err := s.firewall.Unblock(req.GetIp()); err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	return &trackerv1.RemoveBlockResponse{}, nil
+}
+
+func (s *Server) ListAllowlist(context.Context, *trackerv1.ListAllowlistRequest) (*trackerv1.ListAllowlistResponse, error) {
+	return &trackerv1.ListAllowlistResponse{Ips: s.firewall.AllowList()}, nil
+}
+
+func (s *Server) AddAllowlist(_ context.Context, req *trackerv1.AddAllowlistRequest) (*trackerv1.AddAllowlistResponse, error) {
+	if err := validIP(req.GetIp()); err != nil {
+		return nil, err
+	}
+	if err := s.firewall.Allow(req.GetIp()); err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	return &trackerv1.AddAllowlistResponse{}, nil
+}
+
+func (s *Server) RemoveAllowlist(_ context.Context, req *trackerv1.RemoveAllowlistRequest) (*trackerv1.RemoveAllowlistResponse, error) {
+	if err := validIP(req.GetIp()); err != nil {
+		return nil, err
+	}
+	if err := s.firewall.Disallow(req.GetIp()); err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	return &trackerv1.RemoveAllowlistResponse{}, nil
+}
+
+func (s *Server) GetConfig(context.Context, *trackerv1.GetConfigRequest) (*trackerv1.Config, error) {
+	if s.config == nil {
+		return &trackerv1.Config{}, nil
+	}
+	return s.config(), nil
+}
+
+// parseFilter reuses the validation of /events query params
+func parseFilter(types []string, source string, port uint32) (events.Filter, error) {
+	query := url.Values{"type": types}
+	if source != "" {
+		query.Set("source", source)
+	}
+	if port != 0 {
+		query.Set("port", strconv.Itoa(int(port)))
+	}
+	filter, err := events.ParseFilter(query)
+	if err != nil {
+		return events.Filter{}, status.Error(codes.InvalidArgument, err.Error())
+	}
+	return filter, nil
+}
+
+func validIP(ip string) error {
+	if !detection.ValidIPv4(ip) {
+		return status.Error(codes.InvalidArgument, "invalid IPv4 address")
+	}
+	return nil
+}
+
+func toEvent(e events.Event) *trackerv1.Event {
+	ports := make([]uint32, 0, len(e.Ports))
+	for _, p := range e.Ports {
+		ports = append(ports, uint32(p))
+	}
+	event := &trackerv1.Event{
+		Type:          string(e.Type),
+		Time:          timestamppb.New(e.Time),
+		SrcIp:         e.SrcIP,
+		DstIp:         e.DstIP,
+		DstPort:       uint32(e.DstPort),
+		Ports:         ports,
+		DetectionId:   e.DetectionID,
+		DetectionType: string(e.DetectionType),
+		Score:         int32(e.Score),
+		Action:        e.Action,
+		Id:            e.ID,
+		Host:          e.Host,
+		SrcPort:       uint32(e.SrcPort),
+		DstOwner:      e.DstOwner,
+	}
+	if e.ExpiresAt != nil {
+		event.ExpiresAt = timestamppb.New(*e.ExpiresAt)
+	}
+	return event
+}
@@ -0,0 +1,157 @@
+package grpcapi
+
+import (
+	"context"
+	"github.com/golang/mock/gomock"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+	"google.golang.org/protobuf/types/known/durationpb"
+	"net"
+	"tcptracker/internal/connectiontracker"
+	"tcptracker/internal/detection"
+	"tcptracker/internal/events"
+	"tcptracker/mock"
+	trackerv1 "tcptracker/proto/tcptracker/v1"
+	"testing"
+	"time"
+)
+
+type fakeConnections []connectiontracker.Connection
+
+func (f fakeConnections) Connections() []connectiontracker.Connection { return f }
+
+func newTestClient(t *testing.T, p Params) trackerv1.TrackerServiceClient {
+	listener := bufconn.Listen(1 << 20)
+	g := grpc.NewServer()
+	NewServer(p).Register(g)
+	go func() {
+		_ = g.Serve(listener)
+	}()
+	t.Cleanup(g.Stop)
+	conn, err := grpc.Dial("bufnet",
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) {
+			return listener.DialContext(ctx)
+		}),
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+	)
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = conn.Close() })
+	return trackerv1.NewTrackerServiceClient(conn)
+}
+
+func TestBlocksAndAllowlist(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	mockFw := mock.NewMockFirewall(ctrl)
+	client := newTestClient(t, Params{Firewall: mockFw})
+	ctx := context.Background()
+
+	expires := time.Now().Add(time.Hour)
+	mockFw.EXPECT().Block(detection.Detection{IP: "10.0.0.1", Type: detection.Manual, TTL: time.Hour}).Return(nil)
+	mockFw.EXPECT().Blocks().Return([]detection.Block{{IP: "10.0.0.1", Type: detection.Manual, Action: "DROP", ExpiresAt: expires}})
+	mockFw.EXPECT().Unblock("10.0.0.1").Return(nil)
+	mockFw.EXPECT().Allow("10.0.0.2").Return(nil)
+	mockFw.EXPECT().AllowList().Return([]string{"10.0.0.2"})
+	mockFw.EXPECT().Disallow("10.0.0.2").Return(nil)
+
+	_, err := client.AddBlock(ctx, &trackerv1.AddBlockRequest{Ip: "10.0.0.1", Ttl: durationpb.New(time.Hour)})
+	require.NoError(t, err)
+	blocks, err := client.ListBlocks(ctx, &trackerv1.ListBlocksRequest{})
+	require.NoError(t, err)
+	require.Len(t, blocks.GetBlocks(), 1)
+	assert.Equal(t, "manual", blocks.GetBlocks()[0].GetType())
+	assert.Equal(t, expires.Unix(), blocks.GetBlocks()[0].GetExpiresAt().AsTime().Unix())
+	_, err = client.RemoveBlock(ctx, &trackerv1.RemoveBlockRequest{Ip: "10.0.0.1"})
+	require.NoError(t, err)
+
+	_, err = client.AddAllowlist(ctx, &trackerv1.AddAllowlistRequest{Ip: "10.0.0.2"})
+	require.NoError(t, err)
+	allowed, err := client.ListAllowlist(ctx, &trackerv1.ListAllowlistRequest{})
+	require.NoError(t, err)
+	assert.Equal(t, []string{"10.0.0.2"}, allowed.GetIps())
+	_, err = client.RemoveAllowlist(ctx, &trackerv1.RemoveAllowlistRequest{Ip: "10.0.0.2"})
+	require.NoError(t, err)
+
+	_, err = client.AddBlock(ctx, &trackerv1.AddBlockRequest{Ip: "10.0.0"})
+	assert.Equal(t, codes.InvalidArgument, status.Code(err))
+	_, err = client.AddBlock(ctx, &trackerv1.AddBlockRequest{Ip: "2001:db8::1"})
+	assert.Equal(t, codes.InvalidArgument, status.Code(err), "IPv6 is not blocked")
+	_, err = client.AddAllowlist(ctx, &trackerv1.AddAllowlistRequest{Ip: "::ffff:10.0.0.2"})
+	assert.Equal(t, codes.InvalidArgument, status.Code(err))
+}
+
+func TestConnections(t *testing.T) {
+	broker := events.NewBroker("node-1", nil)
+	connections := fakeConnections{
+		{SrcIP: "10.0.0.1", DstIP: "192.168.0.1", DstPort: 22},
+		{SrcIP: "172.16.0.1", DstIP: "192.168.0.1", DstPort: 22},
+		{SrcIP: "10.0.0.1", DstIP: "192.168.0.1", DstPort: 80},
+	}
+	config := &trackerv1.Config{DeviceName: "eth0"}
+	client := newTestClient(t, Params{Events: broker, Connections: connections, Config: func() *trackerv1.Config { return config }})
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	listed, err := client.ListConnections(ctx, &trackerv1.ListConnectionsRequest{Source: "10.0.0.0/8", Port: 22})
+	require.NoError(t, err)
+	require.Len(t, listed.GetConnections(), 1)
+	assert.Equal(t, "10.0.0.1", listed.GetConnections()[0].GetSrcIp())
+
+	_, err = client.ListConnections(ctx, &trackerv1.ListConnectionsRequest{Source: "10.0.0"})
+	assert.Equal(t, codes.InvalidArgument, status.Code(err))
+
+	stream, err := client.WatchConnections(ctx, &trackerv1.WatchConnectionsRequest{Port: 22})
+	require.NoError(t, err)
+	// the subscription is created when the stream reaches the server, publishing until the first event is received
+	received := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(10 * time.Millisecond)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-received:
+				return
+			case <-ticker.C:
+				broker.Publish(events.Event{Type: events.Detection, SrcIP: "10.0.0.1", Ports: []int{22}})
+				broker.Publish(events.Event{Type: events.Connection, SrcIP: "10.0.0.1", DstPort: 80})
+				broker.Publish(events.Event{Type: events.Connection, SrcIP: "10.0.0.1", SrcPort: 40000, DstPort: 22})
+			}
+		}
+	}()
+	event, err := stream.Recv()
+	close(received)
+	require.NoError(t, err)
+	assert.Equal(t, "connection", event.GetType())
+	assert.Equal(t, uint32(22), event.GetDstPort())
+	assert.Equal(t, uint32(40000), event.GetSrcPort())
+	assert.NotEmpty(t, event.GetId())
+	assert.Equal(t, "node-1", event.GetHost())
+
+	got, err := client.GetConfig(ctx, &trackerv1.GetConfigRequest{})
+	require.NoError(t, err)
+	assert.Equal(t, "eth0", got.GetDeviceName())
+}
+
+func TestToEvent(t *testing.T) {
+	expiresAt := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	event := toEvent(events.Event{
+		ID:        "9f1c2a7b3e4d5f60",
+		Type:      events.Block,
+		Host:      "node-1",
+		SrcIP:     "10.0.0.1",
+		DstOwner:  "docker:web",
+		Action:    "DROP",
+		ExpiresAt: &expiresAt,
+	})
+	assert.Equal(t, "9f1c2a7b3e4d5f60", event.GetId())
+	assert.Equal(t, "node-1", event.GetHost())
+	assert.Equal(t, "docker:web", event.GetDstOwner())
+	assert.Equal(t, expiresAt, event.GetExpiresAt().AsTime())
+
+	assert.Nil(t, toEvent(events.Event{Type: events.Block, SrcIP: "10.0.0.1"}).GetExpiresAt(), "never expires")
+}
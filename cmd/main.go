@@ -2,12 +2,81 @@ package main
 
 import (
 	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+	"tcptracker/cmd/cli"
 	"tcptracker/cmd/servid"
+	"tcptracker/internal/config"
 )
 
 func main() {
-	ctx := context.Background()
-	app := servid.NewApp()
+	args := os.Args[1:]
+	if len(args) > 0 && args[0] == servid.FirewallHelperCommand {
+		os.Exit(servid.RunFirewallHelper(args[1:]))
+	}
+	if len(args) > 0 && cli.IsCommand(args[0]) {
+		ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+		code := cli.Run(ctx, args, os.Stdout, os.Stderr)
+		stop()
+		os.Exit(code)
+	}
+	// registered before the slow start, so SIGHUP doesn't kill the tracker while it is starting,
+	// it is waiting in the channel until the reloads are served
+	hangup := make(chan os.Signal, 1)
+	signal.Notify(hangup, syscall.SIGHUP)
+	// `config dump [flags]` prints the effective config without starting the tracker
+	dump := len(args) >= 2 && args[0] == "config" && args[1] == "dump"
+	if dump {
+		args = args[2:]
+	}
+	cfg, err := loadConfig(args)
+	if errors.Is(err, flag.ErrHelp) {
+		return
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+	if dump {
+		if err := cfg.Dump(os.Stdout); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		return
+	}
+	// started by root with -user, the firewall helper keeps CAP_NET_ADMIN and the tracker drops everything
+	privileges, err := servid.SeparatePrivileges(cfg)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	// the first signal starts the graceful shutdown, the second one stops the process
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM, syscall.SIGQUIT)
+	go func() {
+		<-ctx.Done()
+		stop()
+	}()
+	app := servid.NewApp(cfg, privileges, func() (*config.Config, error) {
+		return loadConfig(args)
+	}, hangup)
 	app.TrackHostConnections(ctx)
-	app.ServerStart()
+	if err := app.ServerStart(ctx); err != nil {
+		os.Exit(1)
+	}
+}
+
+// loadConfig reads the config and validates the fields parsed by the firewall and the sinks
+func loadConfig(args []string) (*config.Config, error) {
+	cfg, err := config.Load(args, os.Environ())
+	if err != nil {
+		return nil, err
+	}
+	if err := servid.ValidateConfig(cfg); err != nil {
+		return nil, err
+	}
+	return cfg, nil
 }
@@ -0,0 +1,219 @@
+package servid
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"github.com/rs/zerolog/log"
+	"golang.org/x/sys/unix"
+	"net"
+	"os"
+	"os/exec"
+	"os/signal"
+	"os/user"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"tcptracker/internal/config"
+	"tcptracker/internal/connectiontracker"
+)
+
+// FirewallHelperCommand is the hidden first argument of the firewall helper re-executed by the tracker
+const FirewallHelperCommand = "__firewall-helper"
+
+// helperCapabilities of the firewall helper, the ambient set passes CAP_NET_ADMIN to iptables and iptables-restore
+var helperCapabilities = []uintptr{unix.CAP_NET_ADMIN}
+
+var errNotRoot = errors.New("dropping privileges requires the tracker to be started as root")
+
+// Privileges of the tracker started by root with -user. The firewall helper is re-executed as the user keeping
+// only CAP_NET_ADMIN, the tracker opens the capture handle as root and drops every capability before the APIs
+// start, so a bug in the HTTP or gRPC layer can neither reach the host with root nor change the firewall
+// beyond the tracker chain.
+type Privileges struct {
+	cred   *syscall.Credential
+	user   string
+	helper net.Conn
+}
+
+// SeparatePrivileges starts the firewall helper when the tracker was started by root with -user. It returns nil
+// when -user is not set or the tracker is already running as the user, the capabilities are kept then.
+func SeparatePrivileges(cfg *config.Config) (*Privileges, error) {
+	if cfg.Privileges.User == "" {
+		return nil, nil
+	}
+	configureLogger(cfg.Log)
+	cred, err := lookupCredential(cfg.Privileges.User)
+	if err != nil {
+		return nil, fmt.Errorf("cannot drop privileges: %w", err)
+	}
+	switch uid := os.Geteuid(); {
+	case uid == int(cred.Uid):
+		log.Warn().Msgf("Privileges: already running as %s, the capabilities are kept, start as root to drop them",
+			cfg.Privileges.User)
+		return nil, nil
+	case uid != 0:
+		return nil, fmt.Errorf("running as uid %d, -user %s: %w", uid, cfg.Privileges.User, errNotRoot)
+	}
+	exe, err := os.Executable()
+	if err != nil {
+		return nil, fmt.Errorf("cannot find the executable: %w", err)
+	}
+	fds, err := syscall.Socketpair(syscall.AF_UNIX, syscall.SOCK_STREAM|syscall.SOCK_CLOEXEC, 0)
+	if err != nil {
+		return nil, err
+	}
+	local, remote := os.NewFile(uintptr(fds[0]), "firewall-helper"), os.NewFile(uintptr(fds[1]), "firewall-helper")
+	defer local.Close()
+	defer remote.Close()
+	helper, err := net.FileConn(local)
+	if err != nil {
+		return nil, err
+	}
+	cmd := helperCommand(exe, cfg.Firewall.Chain, cred)
+	cmd.Stdout, cmd.Stderr = os.Stdout, os.Stderr
+	cmd.ExtraFiles = []*os.File{remote}
+	if err := cmd.Start(); err != nil {
+		helper.Close()
+		return nil, fmt.Errorf("starting the firewall helper as %s failed: %w", cfg.Privileges.User, err)
+	}
+	// the helper exits once the tracker closed its end of the connection
+	go func() { _ = cmd.Wait() }()
+	log.Info().Msgf("Privileges: firewall helper is running as %s (uid %d, pid %d)", cfg.Privileges.User, cred.Uid,
+		cmd.Process.Pid)
+	return &Privileges{cred: cred, user: cfg.Privileges.User, helper: helper}, nil
+}
+
+// helperCommand runs the firewall helper as the user with CAP_NET_ADMIN in the ambient set,
+// it reads EOF and exits when the tracker dies
+func helperCommand(exe, chain string, cred *syscall.Credential) *exec.Cmd {
+	cmd := exec.Command(exe, FirewallHelperCommand, chain)
+	cmd.SysProcAttr = &syscall.SysProcAttr{
+		Credential:  cred,
+		AmbientCaps: helperCapabilities,
+		Setpgid:     true,
+	}
+	return cmd
+}
+
+// RunFirewallHelper serves the tracker connected to fd 3 until it disconnects, args are the tracker chain.
+// The signals stopping the service are ignored, the chain is removed by the tracker through the helper.
+func RunFirewallHelper(args []string) int {
+	signal.Ignore(syscall.SIGINT, syscall.SIGTERM, syscall.SIGQUIT, syscall.SIGHUP)
+	chain := ""
+	if len(args) > 0 {
+		chain = args[0]
+	}
+	conn, err := net.FileConn(os.NewFile(3, "firewall-helper"))
+	if err != nil {
+		log.Err(err).Msg("Firewall helper: no connection to the tracker")
+		return 1
+	}
+	if err := connectiontracker.ServeFirewallHelper(conn, chain); err != nil {
+		log.Err(err).Msg("Firewall helper: cannot run iptables")
+		return 1
+	}
+	return 0
+}
+
+// firewallHelper is the connection to the helper, nil when the privileges are not separated
+func (p *Privileges) firewallHelper() net.Conn {
+	if p == nil {
+		return nil
+	}
+	return p.helper
+}
+
+// drop switches every thread to the user, leaving root clears the permitted, effective and ambient capabilities
+func (p *Privileges) drop() error {
+	groups := make([]int, 0, len(p.cred.Groups))
+	for _, g := range p.cred.Groups {
+		groups = append(groups, int(g))
+	}
+	// the Go runtime applies the credentials to all the threads
+	if err := syscall.Setgroups(groups); err != nil {
+		return fmt.Errorf("setgroups: %w", err)
+	}
+	if err := syscall.Setresgid(int(p.cred.Gid), int(p.cred.Gid), int(p.cred.Gid)); err != nil {
+		return fmt.Errorf("setresgid: %w", err)
+	}
+	if err := syscall.Setresuid(int(p.cred.Uid), int(p.cred.Uid), int(p.cred.Uid)); err != nil {
+		return fmt.Errorf("setresuid: %w", err)
+	}
+	if err := checkNoCapabilities(); err != nil {
+		return err
+	}
+	log.Info().Msgf("Privileges: tracker is running as %s (uid %d) without capabilities", p.user, p.cred.Uid)
+	return nil
+}
+
+// checkNoCapabilities fails when any thread of the process has a permitted, effective or ambient capability
+func checkNoCapabilities() error {
+	tasks, err := filepath.Glob("/proc/self/task/*/status")
+	if err != nil {
+		return err
+	}
+	for _, task := range tasks {
+		caps, err := capabilities(task)
+		if err != nil {
+			return err
+		}
+		for _, set := range []string{"CapPrm", "CapEff", "CapAmb"} {
+			if value, err := strconv.ParseUint(caps[set], 16, 64); err != nil || value != 0 {
+				return fmt.Errorf("%s of %s is %q after dropping privileges", set, task, caps[set])
+			}
+		}
+	}
+	return nil
+}
+
+// capabilities reads the Cap* sets of the status file
+func capabilities(status string) (map[string]string, error) {
+	f, err := os.Open(status)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	caps := make(map[string]string)
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		if name, value, ok := strings.Cut(scanner.Text(), ":"); ok && strings.HasPrefix(name, "Cap") {
+			caps[name] = strings.TrimSpace(value)
+		}
+	}
+	return caps, scanner.Err()
+}
+
+// lookupCredential resolves the user name or uid with its primary and supplementary groups
+func lookupCredential(name string) (*syscall.Credential, error) {
+	u, err := user.Lookup(name)
+	var unknown user.UnknownUserError
+	if _, errUID := strconv.Atoi(name); errors.As(err, &unknown) && errUID == nil {
+		u, err = user.LookupId(name)
+	}
+	if err != nil {
+		return nil, err
+	}
+	uid, err := strconv.ParseUint(u.Uid, 10, 32)
+	if err != nil {
+		return nil, fmt.Errorf("user %s: uid %q: %w", name, u.Uid, err)
+	}
+	gid, err := strconv.ParseUint(u.Gid, 10, 32)
+	if err != nil {
+		return nil, fmt.Errorf("user %s: gid %q: %w", name, u.Gid, err)
+	}
+	cred := &syscall.Credential{Uid: uint32(uid), Gid: uint32(gid)}
+	groups, err := u.GroupIds()
+	if err != nil {
+		return nil, fmt.Errorf("user %s: groups: %w", name, err)
+	}
+	for _, g := range groups {
+		id, err := strconv.ParseUint(g, 10, 32)
+		if err != nil {
+			return nil, fmt.Errorf("user %s: group %q: %w", name, g, err)
+		}
+		cred.Groups = append(cred.Groups, uint32(id))
+	}
+	return cred, nil
+}
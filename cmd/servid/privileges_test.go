@@ -0,0 +1,102 @@
+package servid
+
+import (
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"strconv"
+	"syscall"
+	"tcptracker/internal/config"
+	"testing"
+)
+
+func Test_lookupCredential(t *testing.T) {
+	uid := strconv.Itoa(os.Getuid())
+	byUID, err := lookupCredential(uid)
+	require.NoError(t, err)
+	assert.Equal(t, uint32(os.Getuid()), byUID.Uid)
+	assert.Contains(t, byUID.Groups, byUID.Gid)
+
+	byName, err := lookupCredential("root")
+	require.NoError(t, err)
+	assert.Equal(t, uint32(0), byName.Uid)
+
+	_, err = lookupCredential("no-such-tracker-user")
+	assert.Error(t, err)
+}
+
+func Test_helperCommand(t *testing.T) {
+	cred := &syscall.Credential{Uid: 65534, Gid: 65534}
+	cmd := helperCommand("/usr/bin/tcptracker", "tcptracker", cred)
+	assert.Equal(t, []string{"/usr/bin/tcptracker", FirewallHelperCommand, "tcptracker"}, cmd.Args)
+	assert.Equal(t, cred, cmd.SysProcAttr.Credential)
+	assert.Equal(t, []uintptr{12}, cmd.SysProcAttr.AmbientCaps, "only CAP_NET_ADMIN")
+	assert.True(t, cmd.SysProcAttr.Setpgid)
+}
+
+func TestSeparatePrivileges(t *testing.T) {
+	cfg := config.Default()
+	privileges, err := SeparatePrivileges(cfg)
+	require.NoError(t, err)
+	assert.Nil(t, privileges, "privileges are kept without -user")
+
+	// already running as the user
+	cfg.Privileges.User = strconv.Itoa(os.Geteuid())
+	privileges, err = SeparatePrivileges(cfg)
+	require.NoError(t, err)
+	assert.Nil(t, privileges)
+}
+
+// TestDropPrivilegesClearsCapabilities re-executes the test as root, the process serving the APIs
+// must have no capability left in any of its threads
+func TestDropPrivilegesClearsCapabilities(t *testing.T) {
+	if os.Getenv("TCPTRACKER_TEST_DROP") == "1" {
+		dropAndPrintCapabilities()
+		return
+	}
+	if os.Geteuid() != 0 {
+		t.Skip("dropping privileges requires root")
+	}
+	cmd := exec.Command(os.Args[0], "-test.run=^TestDropPrivilegesClearsCapabilities$")
+	cmd.Env = append(os.Environ(), "TCPTRACKER_TEST_DROP=1")
+	out, err := cmd.CombinedOutput()
+	require.NoError(t, err, string(out))
+	lines := regexp.MustCompile(`(?m)^task \d+ CapEff:\s*([0-9a-f]+)$`).FindAllStringSubmatch(string(out), -1)
+	require.Greater(t, len(lines), 1, "every thread is checked: %s", out)
+	for _, line := range lines {
+		assert.Equal(t, "0000000000000000", line[1], line[0])
+	}
+}
+
+func dropAndPrintCapabilities() {
+	// threads started before the drop lose the capabilities too
+	ready := make(chan struct{})
+	for i := 0; i < 4; i++ {
+		go func() {
+			runtime.LockOSThread()
+			ready <- struct{}{}
+			select {}
+		}()
+		<-ready
+	}
+	p := &Privileges{cred: &syscall.Credential{Uid: 65534, Gid: 65534}, user: "nobody"}
+	if err := p.drop(); err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	tasks, _ := filepath.Glob("/proc/self/task/*/status")
+	for _, task := range tasks {
+		caps, err := capabilities(task)
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		fmt.Printf("task %s CapEff: %s\n", filepath.Base(filepath.Dir(task)), caps["CapEff"])
+	}
+	os.Exit(0)
+}
@@ -0,0 +1,45 @@
+package servid
+
+import (
+	"github.com/rs/zerolog"
+	"golang.org/x/exp/slices"
+	"tcptracker/internal/config"
+	"tcptracker/internal/connectiontracker"
+	"time"
+)
+
+// configApplier applies the reloadable fields to the running tracker, capture handle and blocks are kept
+type configApplier struct {
+	tracker  *connectiontracker.Tracker
+	firewall *connectiontracker.IPTables
+}
+
+func (a *configApplier) apply(old, new *config.Config) error {
+	// validated by ValidateConfig
+	policy, err := connectiontracker.ParseActionPolicy(new.Firewall.Action, new.Firewall.ActionByType, new.Firewall.ActionTiers)
+	if err != nil {
+		return err
+	}
+	a.firewall.Reconfigure(policy, time.Duration(new.Firewall.BlockTTL))
+	a.tracker.SetMinimumPortScans(new.Detection.PortScanThreshold)
+	zerolog.SetGlobalLevel(zerolog.Level(new.Log.Level))
+	// IPs allowed through the API are kept unless they were in the previous config
+	for _, ip := range old.Firewall.Allowlist {
+		if !slices.Contains(new.Firewall.Allowlist, ip) {
+			if err := a.firewall.Disallow(ip); err != nil {
+				return err
+			}
+		}
+	}
+	return allow(a.firewall, new.Firewall.Allowlist)
+}
+
+// allow unblocks the IPs when they are already blocked
+func allow(firewall connectiontracker.Firewall, ips []string) error {
+	for _, ip := range ips {
+		if err := firewall.Allow(ip); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,59 @@
+package servid
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"github.com/prometheus/client_golang/prometheus"
+	"os"
+	"strings"
+	"tcptracker/internal/auth"
+	"tcptracker/internal/config"
+)
+
+// newTLSConfig returns nil when TLS is not configured, the pairs of files are checked by config validation
+func newTLSConfig(cfg config.API) (*tls.Config, error) {
+	if cfg.TLSCert == "" {
+		return nil, nil
+	}
+	cert, err := tls.LoadX509KeyPair(cfg.TLSCert, cfg.TLSKey)
+	if err != nil {
+		return nil, err
+	}
+	tlsConfig := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+	}
+	if cfg.TLSClientCA != "" {
+		pem, err := os.ReadFile(cfg.TLSClientCA)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("%s: no certificates found", cfg.TLSClientCA)
+		}
+		tlsConfig.ClientCAs = pool
+		// clients without certificate can still use bearer tokens
+		tlsConfig.ClientAuth = tls.VerifyClientCertIfGiven
+	}
+	return tlsConfig, nil
+}
+
+func newAuthenticator(cfg config.API, metrics *prometheus.Registry) (*auth.Authenticator, error) {
+	return auth.New(auth.Params{
+		TokensFile: cfg.AuthTokens,
+		MTLS:       cfg.TLSClientCA != "",
+		MTLSAdmins: strings.Split(cfg.MTLSAdmins, ","),
+		Metrics:    metrics,
+	})
+}
+
+// publicPaths are served without credentials, cluster messages are authenticated with HMAC
+func publicPaths(cfg config.API, clusterPath string) []string {
+	paths := []string{clusterPath}
+	if cfg.AuthPublicMetrics {
+		paths = append(paths, "/metrics", "/health", "/livez", "/readyz")
+	}
+	return paths
+}
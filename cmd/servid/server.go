@@ -2,22 +2,42 @@ package servid
 
 import (
 	"context"
-	"flag"
+	"crypto/tls"
 	"github.com/go-chi/chi"
+	"github.com/go-redis/redis/v8"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/rs/zerolog"
 	"github.com/rs/zerolog/pkgerrors"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/protobuf/types/known/durationpb"
+	"io"
+	"net"
 	"net/http"
 	"os"
-	"os/signal"
-	"syscall"
 	"tcptracker/cmd/api"
+	"tcptracker/cmd/grpcapi"
+	"tcptracker/internal/cluster"
+	"tcptracker/internal/config"
 	"tcptracker/internal/connectiontracker"
+	"tcptracker/internal/events"
+	"tcptracker/internal/health"
+	"tcptracker/internal/systemd"
+	trackerv1 "tcptracker/proto/tcptracker/v1"
 	"time"
 
 	"github.com/rs/zerolog/log"
 )
 
+const (
+	// socketMode of the API socket, its requests are trusted as admin
+	socketMode = 0o660
+	// shutdownTimeout is the grace period of draining the tracker and the API requests
+	shutdownTimeout = 20 * time.Second
+	// grpcStopTimeout ends the open streams, GracefulStop would wait for them
+	grpcStopTimeout = 5 * time.Second
+)
+
 // App Instance which contains HTTP router
 type App struct {
 	*http.Server
@@ -25,35 +45,118 @@ type App struct {
 	handler    *api.Router
 	metrics    *prometheus.Registry
 	tcpTracker *connectiontracker.Tracker
+	cluster    *cluster.Node
+	grpcServer *grpc.Server
+	httpAddr   string
+	grpcAddr   string
+	tlsConfig  *tls.Config
+	reloader   *config.Reloader
+	// hangup receives SIGHUP, it is registered by main before the slow start
+	hangup     <-chan os.Signal
+	broker     *events.Broker
+	health     *health.Checks
+	deviceName string
+	socket     string
+	// stopTracking cancels the tracker, tracking is closed when its pipeline is drained
+	stopTracking context.CancelFunc
+	tracking     chan struct{}
+	// stopSinks cancels the sinks, they are done once they sent the buffered events
+	stopSinks context.CancelFunc
+	sinks     []<-chan struct{}
 }
 
-// NewApp creates new App that wraps the dependencies
-func NewApp() *App {
+// NewApp creates new App that wraps the dependencies, load re-reads the config on the signals of hangup.
+// With the separated privileges the capture handle is opened and the capabilities are dropped before the APIs are set up.
+func NewApp(cfg *config.Config, privileges *Privileges, load func() (*config.Config, error), hangup <-chan os.Signal) *App {
+	configureLogger(cfg.Log)
 	mux := chi.NewRouter()
 	metrics := prometheus.NewRegistry()
-	params := trackerParams(metrics)
+	broker := events.NewBroker(cfg.Cluster.NodeName, metrics)
+	params, firewall, node := trackerParams(cfg, metrics, broker, privileges.firewallHelper())
 	tracker := connectiontracker.NewTracker(params)
+	if err := allow(firewall, cfg.Firewall.Allowlist); err != nil {
+		log.Fatal().Err(err).Send()
+	}
+	if privileges != nil {
+		if err := tracker.Open(); err != nil {
+			log.Fatal().Err(err).Msgf("Capture of %s cannot be opened before dropping privileges", cfg.Capture.Device)
+		}
+		if err := privileges.drop(); err != nil {
+			log.Fatal().Err(err).Msg("Privileges: cannot drop privileges")
+		}
+	}
+	applier := &configApplier{tracker: tracker, firewall: firewall}
+	reloader := config.NewReloader(cfg, load, applier.apply, metrics)
+	tlsConfig, err := newTLSConfig(cfg.API)
+	if err != nil {
+		log.Fatal().Err(err).Send()
+	}
+	authenticator, err := newAuthenticator(cfg.API, metrics)
+	if err != nil {
+		log.Fatal().Err(err).Send()
+	}
+	if authenticator == nil {
+		log.Warn().Msg("API authentication is disabled, set -authTokens or -tlsClientCA")
+	}
+	checks := healthChecks(tracker, params.Firewall)
 	server := &App{
-		mux:        mux,
-		handler:    api.NewRouter(mux, metrics),
+		mux: mux,
+		handler: api.NewRouter(api.RouterParams{
+			Mux:         mux,
+			Metrics:     metrics,
+			Firewall:    params.Firewall,
+			Events:      broker,
+			Connections: tracker,
+			Auth:        authenticator,
+			PublicPaths: publicPaths(cfg.API, cluster.Path),
+			Health:      checks,
+			Reloader:    reloader,
+			Replayer:    tracker,
+		}),
 		metrics:    metrics,
 		tcpTracker: tracker,
+		cluster:    node,
+		httpAddr:   cfg.API.HTTPAddr,
+		grpcAddr:   cfg.API.GRPCAddr,
+		tlsConfig:  tlsConfig,
+		reloader:   reloader,
+		hangup:     hangup,
+		broker:     broker,
+		health:     checks,
+		deviceName: cfg.Capture.Device,
+		socket:     cfg.API.Socket,
+	}
+	if cfg.API.GRPCAddr != "" {
+		var options []grpc.ServerOption
+		if tlsConfig != nil {
+			options = append(options, grpc.Creds(credentials.NewTLS(tlsConfig)))
+		}
+		if authenticator != nil {
+			options = append(options,
+				grpc.UnaryInterceptor(authenticator.UnaryInterceptor(grpcapi.ReadOnly)),
+				grpc.StreamInterceptor(authenticator.StreamInterceptor(grpcapi.ReadOnly)),
+			)
+		}
+		server.grpcServer = grpc.NewServer(options...)
+		grpcapi.NewServer(grpcapi.Params{
+			Firewall:    params.Firewall,
+			Events:      broker,
+			Connections: tracker,
+			Config:      func() *trackerv1.Config { return protoConfig(reloader.Current()) },
+		}).Register(server.grpcServer)
 	}
-	server.configureLogger()
 	server.routes()
+	// sinks subscribe before the tracking starts, so no detection is missed
+	server.startSinks(cfg)
 	return server
 }
 
-func (app *App) configureLogger() {
-	var logJSON bool
-	var logLevel int
-	flag.BoolVar(&logJSON, "logJSON", false, "configure log format to be PLAIN or JSON")
-	flag.IntVar(&logLevel, "logLevel", 0, "configure log level")
+func configureLogger(cfg config.Log) {
 	timeFormat := "2006-01-02 15:04:05"
 	zerolog.TimeFieldFormat = timeFormat
 	zerolog.ErrorStackMarshaler = pkgerrors.MarshalStack
-	zerolog.SetGlobalLevel(zerolog.Level(logLevel))
-	if !logJSON {
+	zerolog.SetGlobalLevel(zerolog.Level(cfg.Level))
+	if !cfg.JSON {
 		log.Logger = log.Output(zerolog.ConsoleWriter{
 			Out:        os.Stdout,
 			TimeFormat: timeFormat,
@@ -63,72 +166,261 @@ func (app *App) configureLogger() {
 
 func (app *App) routes() {
 	app.handler.Routes()
+	if app.cluster != nil {
+		app.mux.Post(cluster.Path, app.cluster.Handler())
+	}
 }
 
-// ServerStart launching the HTTP Server
-func (app *App) ServerStart() {
-	srv := http.Server{Addr: ":8081", Handler: app.mux}
-	// Server run context
-	serverCtx, serverStopCtx := context.WithCancel(context.Background())
-	// Listen for syscall signals for process to interrupt/quit
-	sig := make(chan os.Signal, 1)
-	signal.Notify(sig, syscall.SIGHUP, syscall.SIGINT, syscall.SIGTERM, syscall.SIGQUIT)
+// ServerStart launching the HTTP Server and gRPC Server when enabled, it returns when ctx is cancelled
+// or the HTTP server fails, after the tracker, the servers and the firewall are stopped in order
+func (app *App) ServerStart(ctx context.Context) error {
+	// request contexts are cancelled with ctx, so the event streams end on shutdown
+	baseContext := func(net.Listener) context.Context { return ctx }
+	srv := &http.Server{Addr: app.httpAddr, Handler: app.mux, TLSConfig: app.tlsConfig, BaseContext: baseContext}
+	listener, err := activatedListener()
+	if err != nil {
+		log.Err(err).Msg("Socket activation failed")
+		app.shutdown(srv, nil)
+		return err
+	}
+	go app.reloadOnHangup(ctx)
+	go app.notifyReady(ctx)
+	go app.pingWatchdog(ctx)
+	var local *http.Server
+	if app.socket != "" {
+		local = &http.Server{Handler: api.Local(app.mux), BaseContext: baseContext}
+		go app.serveSocket(local)
+	}
+	if app.grpcServer != nil {
+		go app.serveGRPC()
+	}
+	log.Info().Msg("HTTP server is starting...")
+	serveErr := make(chan error, 1)
 	go func() {
-		recSig := <-sig
+		serveErr <- app.listenAndServe(srv, listener)
+	}()
+
+	select {
+	case <-ctx.Done():
 		log.Info().Msg("Shutting down in progress...")
-		// Shutdown signal with grace period of 20 seconds
-		shutdownCtx, cancel := context.WithTimeout(serverCtx, 20*time.Second)
-		defer cancel()
-
-		go func() {
-			<-shutdownCtx.Done()
-			if shutdownCtx.Err() == context.DeadlineExceeded {
-				log.Fatal().Msg("Graceful shutdown timed out.. forcing exit.")
-			}
-		}()
-		log.Info().Msgf("Graceful shutdown received: %s", recSig.String())
-		errClose := app.tcpTracker.Close()
-		if errClose != nil {
-			log.Err(errClose).Msgf("Closing TCP Tracker with error %s", errClose)
-		} else {
-			log.Info().Msg("TCP Tracker closed successfully...")
+	case err = <-serveErr:
+		log.Err(err).Msg("HTTP server stopped, shutting down...")
+	}
+	app.shutdown(srv, local)
+	return err
+}
+
+// shutdown drains the tracker first, so the detected port scans are still blocked, then the APIs stop
+// and the firewall chain is removed last
+func (app *App) shutdown(srv, local *http.Server) {
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	if _, err := systemd.Notify(systemd.Stopping); err != nil {
+		log.Err(err).Msg("systemd: STOPPING notification failed")
+	}
+	go func() {
+		<-shutdownCtx.Done()
+		if shutdownCtx.Err() == context.DeadlineExceeded {
+			log.Fatal().Msg("Graceful shutdown timed out.. forcing exit.")
 		}
-		// Trigger graceful shutdown
-		err := srv.Shutdown(shutdownCtx)
-		if err != nil {
-			log.Fatal().Err(err).Send()
+	}()
+	if app.stopTracking != nil {
+		app.stopTracking()
+		<-app.tracking
+	}
+	// the events of the drained tracker are sent
+	app.stopSinks()
+	for _, done := range app.sinks {
+		<-done
+	}
+	if app.grpcServer != nil {
+		app.stopGRPC()
+	}
+	if local != nil {
+		if err := local.Shutdown(shutdownCtx); err != nil {
+			log.Err(err).Msg("API socket shutdown failed")
 		}
-		serverStopCtx()
+	}
+	if err := srv.Shutdown(shutdownCtx); err != nil {
+		log.Err(err).Msg("HTTP server shutdown failed")
+	}
+	if err := app.tcpTracker.Close(); err != nil {
+		log.Err(err).Msgf("Closing TCP Tracker with error %s", err)
+	} else {
+		log.Info().Msg("TCP Tracker closed successfully...")
+	}
+}
+
+// stopGRPC waits for the running calls, the open streams are ended after grpcStopTimeout
+func (app *App) stopGRPC() {
+	stopped := make(chan struct{})
+	go func() {
+		app.grpcServer.GracefulStop()
+		close(stopped)
 	}()
+	select {
+	case <-stopped:
+	case <-time.After(grpcStopTimeout):
+		app.grpcServer.Stop()
+	}
+}
 
-	// Run the servid
-	log.Info().Msg("HTTP server is starting...")
-	if err := srv.ListenAndServe(); err != http.ErrServerClosed {
-		log.Info().Msgf("HTTP server ListenAndServe: %v", err)
+// reloadOnHangup re-reads the config on SIGHUP until ctx is cancelled, the result is logged and served on /config/reload.
+// SIGHUP received while the app was starting is waiting in the channel.
+func (app *App) reloadOnHangup(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-app.hangup:
+			log.Info().Msg("SIGHUP received, reloading config...")
+			app.reloader.Reload()
+		}
 	}
+}
 
-	// Wait for servid context to be stopped
-	<-serverCtx.Done()
+// listenAndServe serves the socket activated listener when systemd passed one, otherwise it listens on httpAddr
+func (app *App) listenAndServe(srv *http.Server, listener net.Listener) error {
+	if listener == nil {
+		var err error
+		if listener, err = net.Listen("tcp", app.httpAddr); err != nil {
+			return err
+		}
+	} else {
+		log.Info().Msgf("HTTP server is using the socket activated listener %s", listener.Addr())
+	}
+	if app.tlsConfig != nil {
+		// certificates are already loaded into TLSConfig
+		return srv.ServeTLS(listener, "", "")
+	}
+	return srv.Serve(listener)
 }
 
-// TrackHostConnections runs the process of TCP Tracking
-func (app *App) TrackHostConnections(ctx context.Context) {
-	go app.tcpTracker.Execute(ctx)
+// serveSocket serves the HTTP API on the unix socket for the CLI, only the owner and the group can connect
+func (app *App) serveSocket(srv *http.Server) {
+	// socket file left by the previous run
+	if err := os.Remove(app.socket); err != nil && !os.IsNotExist(err) {
+		log.Fatal().Err(err).Msg("API socket cannot be removed")
+	}
+	listener, err := net.Listen("unix", app.socket)
+	if err != nil {
+		log.Fatal().Err(err).Msg("API socket cannot listen")
+	}
+	if err := os.Chmod(app.socket, socketMode); err != nil {
+		log.Fatal().Err(err).Msg("API socket mode cannot be set")
+	}
+	log.Info().Msgf("API socket is listening on %s...", app.socket)
+	if err := srv.Serve(listener); err != http.ErrServerClosed {
+		log.Err(err).Msg("API socket stopped")
+	}
+}
+
+func (app *App) serveGRPC() {
+	listener, err := net.Listen("tcp", app.grpcAddr)
+	if err != nil {
+		log.Fatal().Err(err).Msg("gRPC server cannot listen")
+	}
+	log.Info().Msgf("gRPC server is starting on %s...", app.grpcAddr)
+	if err := app.grpcServer.Serve(listener); err != nil {
+		log.Err(err).Msg("gRPC server stopped")
+	}
 }
 
-func trackerParams(metrics *prometheus.Registry) connectiontracker.TrackerParams {
-	var deviceName string
-	flag.StringVar(&deviceName, "deviceName", "eth0", "Network Interface Device Name to track new connections.")
-	flag.Parse()
+// TrackHostConnections runs the process of TCP Tracking until ctx is cancelled or the shutdown starts
+func (app *App) TrackHostConnections(ctx context.Context) {
+	ctx, app.stopTracking = context.WithCancel(ctx)
+	app.tracking = make(chan struct{})
+	go func() {
+		defer close(app.tracking)
+		app.tcpTracker.Execute(ctx)
+	}()
+}
 
-	firewall, err := connectiontracker.NewFirewall(deviceName)
+func trackerParams(
+	cfg *config.Config, metrics *prometheus.Registry, broker *events.Broker, helper io.ReadWriteCloser,
+) (connectiontracker.TrackerParams, *connectiontracker.IPTables, *cluster.Node) {
+	// validated by ValidateConfig
+	policy, errPolicy := connectiontracker.ParseActionPolicy(cfg.Firewall.Action, cfg.Firewall.ActionByType, cfg.Firewall.ActionTiers)
+	if errPolicy != nil {
+		log.Fatal().Err(errPolicy).Send()
+	}
+	local, err := connectiontracker.NewFirewall(connectiontracker.FirewallParams{
+		DeviceName:        cfg.Capture.Device,
+		Policy:            policy,
+		Forward:           cfg.Firewall.Forward,
+		Metrics:           metrics,
+		ReconcileInterval: time.Duration(cfg.Firewall.ReconcileInterval),
+		BatchWindow:       time.Duration(cfg.Firewall.BatchWindow),
+		BlockTTL:          time.Duration(cfg.Firewall.BlockTTL),
+		Events:            broker,
+		Chain:             cfg.Firewall.Chain,
+		Helper:            helper,
+	})
 	if err != nil {
 		log.Fatal().Err(err).Send()
 	}
+	var firewall connectiontracker.Firewall = local
+	var node *cluster.Node
+	if len(cfg.Cluster.Peers) > 0 {
+		node, err = cluster.NewNode(cluster.Params{
+			Name:     cfg.Cluster.NodeName,
+			Peers:    cfg.Cluster.Peers,
+			Secret:   cfg.Cluster.Secret,
+			Firewall: local,
+		})
+		if err != nil {
+			log.Fatal().Err(err).Send()
+		}
+		firewall = node
+	}
 	params := connectiontracker.TrackerParams{
-		DeviceName: deviceName,
-		Firewall:   firewall,
-		Metrics:    metrics,
+		DeviceName:       cfg.Capture.Device,
+		Firewall:         firewall,
+		Metrics:          metrics,
+		Events:           broker,
+		SnapLen:          cfg.Capture.SnapLen,
+		BPFFilter:        cfg.Capture.BPFFilter,
+		CacheTTL:         time.Duration(cfg.Detection.Window),
+		MinimumPortScans: cfg.Detection.PortScanThreshold,
+	}
+	if cfg.Firewall.Forward {
+		params.Attributor = connectiontracker.NewAttributor()
 	}
-	return params
+	if cfg.Redis.Addr != "" {
+		params.Redis = redis.NewClient(&redis.Options{
+			Addr:     cfg.Redis.Addr,
+			Password: cfg.Redis.Password,
+		})
+	}
+	return params, local, node
+}
+
+// protoConfig is returned by GetConfig of the gRPC API, secrets are not included
+func protoConfig(cfg *config.Config) *trackerv1.Config {
+	return &trackerv1.Config{
+		DeviceName:           cfg.Capture.Device,
+		FirewallAction:       cfg.Firewall.Action,
+		FirewallActionByType: cfg.Firewall.ActionByType,
+		FirewallActionTiers:  cfg.Firewall.ActionTiers,
+		Forward:              cfg.Firewall.Forward,
+		ReconcileInterval:    durationpb.New(time.Duration(cfg.Firewall.ReconcileInterval)),
+		BatchWindow:          durationpb.New(time.Duration(cfg.Firewall.BatchWindow)),
+		BlockTtl:             durationpb.New(time.Duration(cfg.Firewall.BlockTTL)),
+		RedisAddr:            cfg.Redis.Addr,
+		ClusterPeers:         cfg.Cluster.Peers,
+		NodeName:             cfg.Cluster.NodeName,
+		HttpAddr:             cfg.API.HTTPAddr,
+		GrpcAddr:             cfg.API.GRPCAddr,
+	}
+}
+
+// healthChecks of the Tracker goroutines are liveness, firewall and cache can recover on their own
+func healthChecks(tracker *connectiontracker.Tracker, firewall connectiontracker.Firewall) *health.Checks {
+	checks := health.New(0)
+	checks.Live("capture", tracker.CheckCapture)
+	checks.Live("detector", tracker.CheckDetector)
+	checks.Ready("device", tracker.CheckDevice)
+	checks.Ready("firewall", firewall.Check)
+	checks.Ready("cache", tracker.CheckCache)
+	return checks
 }
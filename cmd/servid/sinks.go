@@ -0,0 +1,116 @@
+package servid
+
+import (
+	"context"
+	"github.com/rs/zerolog/log"
+	"strings"
+	"tcptracker/internal/config"
+	"tcptracker/internal/events"
+	"tcptracker/internal/sinks"
+	"time"
+)
+
+var detections = events.Filter{Types: map[events.Type]bool{events.Detection: true}}
+
+// blocks fire and resolve the alerts
+var blocks = events.Filter{Types: map[events.Type]bool{events.Block: true, events.Unblock: true, events.Expiry: true}}
+
+// siemEvents are sent to SIEM, connections are too many for it
+var siemEvents = events.Filter{Types: map[events.Type]bool{
+	events.Detection: true, events.Block: true, events.Unblock: true, events.Expiry: true,
+}}
+
+// startSinks attaches the event sinks until stopSinks, the log sink writes the detections
+func (app *App) startSinks(cfg *config.Config) {
+	ctx, cancel := context.WithCancel(context.Background())
+	app.stopSinks = cancel
+	app.attach(ctx, events.LogSink{}, detections, 0)
+
+	if cfg := cfg.Syslog; cfg.Addr != "" {
+		syslog, err := sinks.NewSyslog(sinks.SyslogParams{Addr: cfg.Addr, Format: cfg.Format, Facility: cfg.Facility, TLSCA: cfg.TLSCA})
+		if err != nil {
+			log.Fatal().Err(err).Msg("Syslog: invalid sink")
+		}
+		app.attach(ctx, syslog, siemEvents, cfg.Buffer)
+		log.Info().Msgf("Syslog: sending %s events to %s", cfg.Format, cfg.Addr)
+	}
+	if cfg := cfg.Webhook; len(cfg.URLs) > 0 {
+		webhook, err := sinks.NewWebhook(sinks.WebhookParams{
+			URLs:          cfg.URLs,
+			Template:      cfg.Template,
+			ContentType:   cfg.ContentType,
+			Secret:        cfg.Secret,
+			Attempts:      cfg.Attempts,
+			Timeout:       time.Duration(cfg.Timeout),
+			RatePerMinute: cfg.RateLimit,
+			Burst:         cfg.Burst,
+			DedupWindow:   time.Duration(cfg.DedupWindow),
+			Metrics:       app.metrics,
+		})
+		if err != nil {
+			log.Fatal().Err(err).Msg("Webhook: invalid sink")
+		}
+		app.attach(ctx, webhook, detections, cfg.Buffer)
+		log.Info().Msgf("Webhook: notifying %d URLs with %s template", len(cfg.URLs), cfg.Template)
+	}
+	if cfg := cfg.Alertmanager; len(cfg.URLs) > 0 {
+		alertmanager, err := sinks.NewAlertmanager(sinks.AlertmanagerParams{
+			URLs:           cfg.URLs,
+			ResendInterval: time.Duration(cfg.ResendInterval),
+			Timeout:        time.Duration(cfg.Timeout),
+		})
+		if err != nil {
+			log.Fatal().Err(err).Msg("Alertmanager: invalid sink")
+		}
+		app.attach(ctx, alertmanager, blocks, cfg.Buffer)
+		log.Info().Msgf("Alertmanager: pushing alerts to %s", strings.Join(cfg.URLs, ", "))
+	}
+	// every event of the pipeline is streamed, a slow bus drops them instead of blocking the capture
+	if cfg := cfg.Kafka; len(cfg.Brokers) > 0 {
+		kafka, err := sinks.NewKafka(sinks.KafkaParams{
+			StreamParams:  app.streamParams(cfg.Topic, cfg.BatchSize, cfg.Linger, cfg.Compression),
+			Brokers:       cfg.Brokers,
+			Username:      cfg.Username,
+			Password:      cfg.Password,
+			SASLMechanism: cfg.SASLMechanism,
+			TLS:           cfg.TLS,
+			TLSCA:         cfg.TLSCA,
+			Timeout:       time.Duration(cfg.Timeout),
+		})
+		if err != nil {
+			log.Fatal().Err(err).Msg("Kafka: invalid sink")
+		}
+		app.attach(ctx, kafka, events.Filter{}, cfg.Buffer)
+		log.Info().Msgf("Kafka: producing events to %s on %s", cfg.Topic, strings.Join(cfg.Brokers, ", "))
+	}
+	if cfg := cfg.NATS; cfg.URL != "" {
+		nats, err := sinks.NewNATS(sinks.NATSParams{
+			StreamParams: app.streamParams(cfg.Subject, cfg.BatchSize, cfg.Linger, cfg.Compression),
+			URL:          cfg.URL,
+			User:         cfg.User,
+			Password:     cfg.Password,
+			Token:        cfg.Token,
+			TLSCA:        cfg.TLSCA,
+			Timeout:      time.Duration(cfg.Timeout),
+		})
+		if err != nil {
+			log.Fatal().Err(err).Msg("NATS: invalid sink")
+		}
+		app.attach(ctx, nats, events.Filter{}, cfg.Buffer)
+		log.Info().Msgf("NATS: publishing events to %s on %s", cfg.Subject, cfg.URL)
+	}
+}
+
+func (app *App) streamParams(topic string, batchSize int, linger config.Duration, compression string) sinks.StreamParams {
+	return sinks.StreamParams{
+		Topic:       topic,
+		BatchSize:   batchSize,
+		Linger:      time.Duration(linger),
+		Compression: compression,
+		Metrics:     app.metrics,
+	}
+}
+
+func (app *App) attach(ctx context.Context, sink events.Sink, filter events.Filter, buffer int) {
+	app.sinks = append(app.sinks, app.broker.Attach(ctx, sink, filter, buffer))
+}
@@ -0,0 +1,93 @@
+package servid
+
+import (
+	"context"
+	"fmt"
+	"github.com/rs/zerolog/log"
+	"net"
+	"tcptracker/internal/health"
+	"tcptracker/internal/systemd"
+	"time"
+)
+
+// httpSocketName is FileDescriptorName= of the HTTP API socket, a single socket may be left unnamed
+const httpSocketName = "http"
+
+// activatedListener returns the HTTP API socket passed by systemd, nil when the tracker listens on its own
+func activatedListener() (net.Listener, error) {
+	activated, err := systemd.Listeners()
+	if err != nil || len(activated) == 0 {
+		return nil, err
+	}
+	listener, ok := activated[httpSocketName]
+	if !ok && len(activated) == 1 {
+		listener, ok = activated["unknown"]
+	}
+	for name, l := range activated {
+		if l != listener {
+			log.Warn().Msgf("Socket activation: closing unused socket %s (%s)", name, l.Addr())
+			l.Close()
+		}
+	}
+	if !ok {
+		return nil, fmt.Errorf("socket activation: no socket named %q", httpSocketName)
+	}
+	return listener, nil
+}
+
+// notifyReady tells systemd the tracker is started, the firewall chain is set up by NewApp
+// and the capture handle is opened by the tracker
+func (app *App) notifyReady(ctx context.Context) {
+	select {
+	case <-ctx.Done():
+		return
+	case <-app.tcpTracker.Started():
+	}
+	sent, err := systemd.Notify(systemd.Ready + "\n" + systemd.Status("capturing on "+app.deviceName))
+	if err != nil {
+		log.Err(err).Msg("systemd: READY notification failed")
+		return
+	}
+	if sent {
+		log.Info().Msg("systemd: READY notification sent")
+	}
+}
+
+// pingWatchdog pings the systemd watchdog twice per WatchdogSec= when the capture loop has beaten since the last
+// ping and the liveness checks pass, the loop beats after every read of the handle, so a stuck capture loop
+// gets the service restarted
+func (app *App) pingWatchdog(ctx context.Context) {
+	interval, err := systemd.WatchdogInterval()
+	if err != nil {
+		log.Err(err).Msg("systemd: watchdog is disabled")
+		return
+	}
+	if interval == 0 {
+		return
+	}
+	log.Info().Msgf("systemd: watchdog is pinged every %s", interval/2)
+	ticker := time.NewTicker(interval / 2)
+	defer ticker.Stop()
+	var lastBeat time.Time
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			beat := app.tcpTracker.Heartbeat()
+			if !beat.After(lastBeat) {
+				log.Warn().Msgf("systemd: skipping watchdog ping, capture loop has not beaten since %s", beat.Format(time.RFC3339))
+				continue
+			}
+			if report := app.health.Liveness(ctx); report.Status != health.OK {
+				log.Warn().Msgf("systemd: skipping watchdog ping, liveness failed: %+v", report.Checks)
+				continue
+			}
+			if _, err := systemd.Notify(systemd.Watchdog); err != nil {
+				log.Err(err).Msg("systemd: watchdog ping failed")
+				continue
+			}
+			lastBeat = beat
+		}
+	}
+}
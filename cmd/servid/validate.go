@@ -0,0 +1,50 @@
+package servid
+
+import (
+	"tcptracker/internal/config"
+	"tcptracker/internal/connectiontracker"
+	"tcptracker/internal/sinks"
+)
+
+// ValidateConfig checks the fields parsed by the firewall and the sinks, config.Load checks the rest of them
+// without importing these packages. It returns *config.ValidationError.
+func ValidateConfig(cfg *config.Config) error {
+	var problems []string
+	check := func(key string, err error) {
+		if err != nil {
+			problems = append(problems, key+": "+err.Error())
+		}
+	}
+	_, err := connectiontracker.ParseActionPolicy(cfg.Firewall.Action, cfg.Firewall.ActionByType, cfg.Firewall.ActionTiers)
+	check("firewall.action", err)
+
+	if cfg.Syslog.Addr != "" {
+		network, _, err := sinks.ParseSyslogAddr(cfg.Syslog.Addr)
+		check("syslog.addr", err)
+		if err == nil && cfg.Syslog.TLSCA != "" && network != "tls" {
+			problems = append(problems, "syslog.tlsCA: requires tls:// addr")
+		}
+		_, err = sinks.ParseFormat(cfg.Syslog.Format)
+		check("syslog.format", err)
+		_, err = sinks.ParseFacility(cfg.Syslog.Facility)
+		check("syslog.facility", err)
+	}
+	if len(cfg.Webhook.URLs) > 0 {
+		_, err := sinks.ParseTemplate(cfg.Webhook.Template)
+		check("webhook.template", err)
+	}
+	if len(cfg.Kafka.Brokers) > 0 {
+		check("kafka.compression", sinks.ParseCompression(cfg.Kafka.Compression))
+		if cfg.Kafka.Username != "" {
+			check("kafka.saslMechanism", sinks.ParseSASLMechanism(cfg.Kafka.SASLMechanism))
+		}
+	}
+	if cfg.NATS.URL != "" {
+		check("nats.compression", sinks.ParseCompression(cfg.NATS.Compression))
+	}
+
+	if len(problems) > 0 {
+		return &config.ValidationError{Problems: problems}
+	}
+	return nil
+}
@@ -0,0 +1,50 @@
+package servid
+
+import (
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"strings"
+	"tcptracker/internal/config"
+	"testing"
+)
+
+func TestValidateConfig(t *testing.T) {
+	cfg := config.Default()
+	require.NoError(t, ValidateConfig(cfg))
+
+	cfg.Firewall.ActionTiers = "10=explode"
+	cfg.Syslog.Addr = "syslog.example.com:514"
+	cfg.Syslog.Facility = "local9"
+	cfg.Webhook.URLs = []string{"https://hooks.slack.com/services/T0"}
+	cfg.Webhook.Template = "discord"
+	cfg.Kafka.Brokers = []string{"kafka:9092"}
+	cfg.Kafka.Username = "producer"
+	cfg.Kafka.SASLMechanism = "gssapi"
+	cfg.NATS.URL = "nats://nats:4222"
+	cfg.NATS.Compression = "zstd"
+	err := ValidateConfig(cfg)
+	var validation *config.ValidationError
+	require.ErrorAs(t, err, &validation)
+	keys := make([]string, 0, len(validation.Problems))
+	for _, p := range validation.Problems {
+		key, _, _ := strings.Cut(p, ":")
+		keys = append(keys, key)
+	}
+	assert.Equal(t, []string{
+		"firewall.action",
+		"syslog.addr",
+		"syslog.facility",
+		"webhook.template",
+		"kafka.saslMechanism",
+		"nats.compression",
+	}, keys)
+}
+
+func TestValidateConfigSyslogTLSCA(t *testing.T) {
+	cfg := config.Default()
+	cfg.Syslog.Addr = "tcp://syslog.example.com:601"
+	cfg.Syslog.TLSCA = "ca.pem"
+	assert.ErrorContains(t, ValidateConfig(cfg), "syslog.tlsCA")
+	cfg.Syslog.Addr = "tls://syslog.example.com:6514"
+	assert.NoError(t, ValidateConfig(cfg))
+}
@@ -0,0 +1,260 @@
+package auth
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/rs/zerolog/log"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+	"io"
+	"os"
+	"strings"
+)
+
+// Role of the authenticated client, Admin can do everything Read can
+type Role int
+
+const (
+	None Role = iota
+	// Read can list and watch
+	Read
+	// Admin can also change blocks and the allow list
+	Admin
+)
+
+func (r Role) String() string {
+	switch r {
+	case Read:
+		return "read"
+	case Admin:
+		return "admin"
+	}
+	return "none"
+}
+
+// ParseRole accepts `read` and `admin`
+func ParseRole(s string) (Role, error) {
+	switch s {
+	case "read":
+		return Read, nil
+	case "admin":
+		return Admin, nil
+	}
+	return None, fmt.Errorf("unknown role: %q", s)
+}
+
+const (
+	methodToken = "token"
+	methodMTLS  = "mtls"
+	bearer      = "Bearer "
+)
+
+var (
+	// ErrUnauthenticated is returned when no valid credentials were given
+	ErrUnauthenticated = errors.New("unauthenticated")
+	// ErrForbidden is returned when the role of the client is not enough
+	ErrForbidden = errors.New("forbidden")
+)
+
+var denied = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Name: "tcptracker_api_denied_total",
+	Help: "API requests denied by authentication or authorization, by reason",
+}, []string{"reason"})
+
+// Principal is the authenticated client
+type Principal struct {
+	Name   string
+	Role   Role
+	Method string
+}
+
+// Params required params to create Authenticator
+type Params struct {
+	// Tokens are read from the file, see LoadTokens
+	TokensFile string
+	// MTLS enables client certificates verified by the server TLS config
+	MTLS bool
+	// MTLSAdmins are Common Names of client certificates with Admin role, other verified certificates are Read only
+	MTLSAdmins []string
+	Metrics    *prometheus.Registry
+}
+
+// Authenticator checks bearer tokens and client certificates
+type Authenticator struct {
+	tokens     map[[sha256.Size]byte]Principal
+	mtls       bool
+	mtlsAdmins map[string]bool
+}
+
+// New creates Authenticator, it returns nil when no authentication is configured
+func New(p Params) (*Authenticator, error) {
+	if p.TokensFile == "" && !p.MTLS {
+		return nil, nil
+	}
+	a := &Authenticator{
+		tokens:     make(map[[sha256.Size]byte]Principal),
+		mtls:       p.MTLS,
+		mtlsAdmins: make(map[string]bool),
+	}
+	if p.TokensFile != "" {
+		f, err := os.Open(p.TokensFile)
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+		if a.tokens, err = LoadTokens(f); err != nil {
+			return nil, fmt.Errorf("%s: %w", p.TokensFile, err)
+		}
+	}
+	for _, cn := range p.MTLSAdmins {
+		if cn = strings.TrimSpace(cn); cn != "" {
+			a.mtlsAdmins[cn] = true
+		}
+	}
+	if p.Metrics != nil {
+		p.Metrics.MustRegister(denied)
+	}
+	return a, nil
+}
+
+// LoadTokens reads `<role> <name> <token>` lines, empty lines and lines starting with # are skipped
+// Only SHA-256 of the tokens is kept in memory
+func LoadTokens(r io.Reader) (map[[sha256.Size]byte]Principal, error) {
+	tokens := make(map[[sha256.Size]byte]Principal)
+	scanner := bufio.NewScanner(r)
+	line := 0
+	for scanner.Scan() {
+		line++
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		fields := strings.Fields(text)
+		if len(fields) != 3 {
+			return nil, fmt.Errorf("line %d: expected `<role> <name> <token>`", line)
+		}
+		role, err := ParseRole(fields[0])
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", line, err)
+		}
+		tokens[sha256.Sum256([]byte(fields[2]))] = Principal{Name: fields[1], Role: role, Method: methodToken}
+	}
+	return tokens, scanner.Err()
+}
+
+// Authenticate takes the Authorization header value and verified client certificates
+// Bearer token has precedence over the client certificate
+func (a *Authenticator) Authenticate(authorization string, verifiedChains [][]*x509.Certificate) (Principal, error) {
+	if authorization != "" {
+		if !strings.HasPrefix(authorization, bearer) {
+			return Principal{}, ErrUnauthenticated
+		}
+		sum := sha256.Sum256([]byte(strings.TrimPrefix(authorization, bearer)))
+		// every token is compared to keep the time constant
+		var found Principal
+		for hash, principal := range a.tokens {
+			if subtle.ConstantTimeCompare(hash[:], sum[:]) == 1 {
+				found = principal
+			}
+		}
+		if found.Role == None {
+			return Principal{}, ErrUnauthenticated
+		}
+		return found, nil
+	}
+	if a.mtls && len(verifiedChains) > 0 && len(verifiedChains[0]) > 0 {
+		cn := verifiedChains[0][0].Subject.CommonName
+		role := Read
+		if a.mtlsAdmins[cn] {
+			role = Admin
+		}
+		return Principal{Name: cn, Role: role, Method: methodMTLS}, nil
+	}
+	return Principal{}, ErrUnauthenticated
+}
+
+// Authorize checks the role of the Principal
+func Authorize(p Principal, required Role) error {
+	if p.Role < required {
+		return ErrForbidden
+	}
+	return nil
+}
+
+// Audit logs the denied request and counts it in metrics
+func Audit(p Principal, remote, action, resource string, err error) {
+	reason := "unauthenticated"
+	if errors.Is(err, ErrForbidden) {
+		reason = "forbidden"
+	}
+	denied.WithLabelValues(reason).Inc()
+	log.Warn().
+		Str("audit", "denied").
+		Str("reason", reason).
+		Str("principal", p.Name).
+		Str("role", p.Role.String()).
+		Str("remote", remote).
+		Str("action", action).
+		Str("resource", resource).
+		Msg("API request denied")
+}
+
+// UnaryInterceptor authenticates gRPC calls, readOnly tells if the full method name needs Read role only
+func (a *Authenticator) UnaryInterceptor(readOnly func(method string) bool) grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		if err := a.authorizeRPC(ctx, info.FullMethod, readOnly); err != nil {
+			return nil, err
+		}
+		return handler(ctx, req)
+	}
+}
+
+// StreamInterceptor authenticates gRPC streams, readOnly tells if the full method name needs Read role only
+func (a *Authenticator) StreamInterceptor(readOnly func(method string) bool) grpc.StreamServerInterceptor {
+	return func(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		if err := a.authorizeRPC(ss.Context(), info.FullMethod, readOnly); err != nil {
+			return err
+		}
+		return handler(srv, ss)
+	}
+}
+
+func (a *Authenticator) authorizeRPC(ctx context.Context, method string, readOnly func(method string) bool) error {
+	var authorization, remote string
+	if md, ok := metadata.FromIncomingContext(ctx); ok {
+		if values := md.Get("authorization"); len(values) > 0 {
+			authorization = values[0]
+		}
+	}
+	var chains [][]*x509.Certificate
+	if p, ok := peer.FromContext(ctx); ok {
+		remote = p.Addr.String()
+		if info, ok := p.AuthInfo.(credentials.TLSInfo); ok {
+			chains = info.State.VerifiedChains
+		}
+	}
+	principal, err := a.Authenticate(authorization, chains)
+	if err != nil {
+		Audit(principal, remote, "rpc", method, err)
+		return status.Error(codes.Unauthenticated, err.Error())
+	}
+	required := Admin
+	if readOnly(method) {
+		required = Read
+	}
+	if err := Authorize(principal, required); err != nil {
+		Audit(principal, remote, "rpc", method, err)
+		return status.Error(codes.PermissionDenied, err.Error())
+	}
+	return nil
+}
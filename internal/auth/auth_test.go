@@ -0,0 +1,156 @@
+package auth
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+const tokens = `
+# role name token
+admin ops s3cr3t-admin
+read grafana s3cr3t-read
+`
+
+func newTestAuthenticator(t *testing.T) *Authenticator {
+	file := filepath.Join(t.TempDir(), "tokens")
+	require.NoError(t, os.WriteFile(file, []byte(tokens), 0o600))
+	a, err := New(Params{TokensFile: file, MTLS: true, MTLSAdmins: []string{"ops.example.com", ""}})
+	require.NoError(t, err)
+	return a
+}
+
+func chain(cn string) [][]*x509.Certificate {
+	return [][]*x509.Certificate{{{Subject: pkix.Name{CommonName: cn}}}}
+}
+
+func TestLoadTokens(t *testing.T) {
+	tests := []struct {
+		name    string
+		file    string
+		want    int
+		wantErr bool
+	}{
+		{name: "valid", file: tokens, want: 2},
+		{name: "empty", file: "", want: 0},
+		{name: "unknown role", file: "root ops token", wantErr: true},
+		{name: "missing token", file: "admin ops", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := LoadTokens(strings.NewReader(tt.file))
+			if tt.wantErr {
+				require.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Len(t, got, tt.want)
+		})
+	}
+}
+
+func TestNewDisabled(t *testing.T) {
+	a, err := New(Params{})
+	require.NoError(t, err)
+	assert.Nil(t, a)
+	_, err = New(Params{TokensFile: filepath.Join(t.TempDir(), "missing")})
+	require.Error(t, err)
+}
+
+func TestAuthenticate(t *testing.T) {
+	a := newTestAuthenticator(t)
+	tests := []struct {
+		name          string
+		authorization string
+		chains        [][]*x509.Certificate
+		want          Principal
+		wantErr       bool
+	}{
+		{name: "admin token", authorization: "Bearer s3cr3t-admin", want: Principal{Name: "ops", Role: Admin, Method: methodToken}},
+		{name: "read token", authorization: "Bearer s3cr3t-read", want: Principal{Name: "grafana", Role: Read, Method: methodToken}},
+		{name: "unknown token", authorization: "Bearer other", wantErr: true},
+		{name: "basic auth", authorization: "Basic b3BzOnMzY3IzdA==", wantErr: true},
+		{
+			name:          "invalid token wins over certificate",
+			authorization: "Bearer other",
+			chains:        chain("ops.example.com"),
+			wantErr:       true,
+		},
+		{name: "admin certificate", chains: chain("ops.example.com"), want: Principal{Name: "ops.example.com", Role: Admin, Method: methodMTLS}},
+		{name: "read certificate", chains: chain("grafana.example.com"), want: Principal{Name: "grafana.example.com", Role: Read, Method: methodMTLS}},
+		{name: "no credentials", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := a.Authenticate(tt.authorization, tt.chains)
+			if tt.wantErr {
+				require.ErrorIs(t, err, ErrUnauthenticated)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
+
+func TestAuthorize(t *testing.T) {
+	assert.NoError(t, Authorize(Principal{Role: Admin}, Read))
+	assert.NoError(t, Authorize(Principal{Role: Read}, Read))
+	assert.ErrorIs(t, Authorize(Principal{Role: Read}, Admin), ErrForbidden)
+}
+
+func TestUnaryInterceptor(t *testing.T) {
+	a := newTestAuthenticator(t)
+	interceptor := a.UnaryInterceptor(func(method string) bool { return method == "/list" })
+	handler := func(context.Context, interface{}) (interface{}, error) { return "ok", nil }
+	addr := &net.TCPAddr{IP: net.ParseIP("10.0.0.1"), Port: 40000}
+	tests := []struct {
+		name   string
+		method string
+		token  string
+		peer   *peer.Peer
+		want   codes.Code
+	}{
+		{name: "read token lists", method: "/list", token: "Bearer s3cr3t-read", want: codes.OK},
+		{name: "read token cannot block", method: "/block", token: "Bearer s3cr3t-read", want: codes.PermissionDenied},
+		{name: "admin token blocks", method: "/block", token: "Bearer s3cr3t-admin", want: codes.OK},
+		{name: "no credentials", method: "/list", want: codes.Unauthenticated},
+		{
+			name:   "admin certificate",
+			method: "/block",
+			peer: &peer.Peer{Addr: addr, AuthInfo: credentials.TLSInfo{
+				State: tls.ConnectionState{VerifiedChains: chain("ops.example.com")},
+			}},
+			want: codes.OK,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.Background()
+			if tt.token != "" {
+				ctx = metadata.NewIncomingContext(ctx, metadata.Pairs("authorization", tt.token))
+			}
+			p := tt.peer
+			if p == nil {
+				p = &peer.Peer{Addr: addr}
+			}
+			ctx = peer.NewContext(ctx, p)
+			_, err := interceptor(ctx, nil, &grpc.UnaryServerInfo{FullMethod: tt.method}, handler)
+			assert.Equal(t, tt.want, status.Code(err))
+		})
+	}
+}
@@ -0,0 +1,375 @@
+package cluster
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/rs/zerolog/log"
+	"io"
+	"math"
+	"net/http"
+	"strings"
+	"sync"
+	"tcptracker/internal/connectiontracker"
+	"tcptracker/internal/detection"
+	"time"
+)
+
+const (
+	// Path of the endpoint receiving messages from the peers
+	Path = "/cluster/v1/blocks"
+	// SignatureHeader carries hex encoded HMAC-SHA256 of the body
+	SignatureHeader = "X-Tcptracker-Signature"
+
+	opBlock   = "block"
+	opUnblock = "unblock"
+
+	maxMessageSize = 64 << 10
+	// messages older than that are rejected, protects from replaying captured messages
+	maxClockSkew = 5 * time.Minute
+	// same IP is announced again only after the interval, detections repeat while the scan is going on
+	announceInterval = time.Minute
+	pushAttempts     = 3
+	pushBackoff      = 200 * time.Millisecond
+	pushTimeout      = 5 * time.Second
+)
+
+// Message is a block decision pushed between tracker nodes
+// TTLSeconds is relative to Timestamp, 0 means the default TTL of the receiving node
+type Message struct {
+	ID         string         `json:"id"`
+	Origin     string         `json:"origin"`
+	Op         string         `json:"op"`
+	IP         string         `json:"ip"`
+	Type       detection.Type `json:"type,omitempty"`
+	Score      int            `json:"score,omitempty"`
+	TTLSeconds int64          `json:"ttlSeconds,omitempty"`
+	Timestamp  time.Time      `json:"timestamp"`
+}
+
+// Params required params to create Node
+type Params struct {
+	// Name of this node, messages are ignored when they come back to the origin
+	Name string
+	// Peers are base URLs of the other nodes, e.g. http://10.0.0.2:8081
+	Peers []string
+	// Secret shared by all the nodes to sign the messages
+	Secret   string
+	Firewall connectiontracker.Firewall
+}
+
+// Node is a Firewall sharing block decisions with peer tracker nodes, every peer applies them with its own Firewall
+type Node struct {
+	local     connectiontracker.Firewall
+	name      string
+	peers     []string
+	secret    []byte
+	client    *http.Client
+	seen      map[string]time.Time // message ID -> received, de-duplicates retried pushes
+	announced map[string]time.Time // IP -> last push
+	wg        sync.WaitGroup
+	m         sync.Mutex
+}
+
+// NewNode wraps the local Firewall
+func NewNode(p Params) (*Node, error) {
+	if p.Secret == "" {
+		return nil, errors.New("cluster secret is required")
+	}
+	if p.Firewall == nil {
+		return nil, errors.New("firewall is required")
+	}
+	peers := make([]string, 0, len(p.Peers))
+	for _, peer := range p.Peers {
+		if peer = strings.TrimRight(strings.TrimSpace(peer), "/"); peer != "" {
+			peers = append(peers, peer)
+		}
+	}
+	return &Node{
+		local:     p.Firewall,
+		name:      p.Name,
+		peers:     peers,
+		secret:    []byte(p.Secret),
+		client:    &http.Client{Timeout: pushTimeout},
+		seen:      make(map[string]time.Time),
+		announced: make(map[string]time.Time),
+	}, nil
+}
+
+// Block applies the block locally and pushes it to the peers
+func (n *Node) Block(d detection.Detection) error {
+	if err := n.local.Block(d); err != nil {
+		return err
+	}
+	n.m.Lock()
+	last, ok := n.announced[d.IP]
+	if ok && time.Since(last) < announceInterval {
+		n.m.Unlock()
+		return nil
+	}
+	n.announced[d.IP] = time.Now()
+	n.m.Unlock()
+	now := time.Now().UTC()
+	msg := Message{
+		Op:        opBlock,
+		IP:        d.IP,
+		Type:      d.Type,
+		Score:     d.Score,
+		Timestamp: now,
+	}
+	// the peers block until the same time as this node, never expiring blocks use their default TTL
+	if expiresAt := n.expiresAt(d, now); !expiresAt.IsZero() {
+		msg.TTLSeconds = int64(math.Ceil(expiresAt.Sub(now).Seconds()))
+	}
+	n.broadcast(msg)
+	return nil
+}
+
+// expirer resolves the expiry of the detection with the default TTL, e.g. *connectiontracker.IPTables
+type expirer interface {
+	ExpiresAt(d detection.Detection, now time.Time) time.Time
+}
+
+// expiresAt of the local block, the detection is still queued in a batch when the block is not applied yet
+func (n *Node) expiresAt(d detection.Detection, now time.Time) time.Time {
+	for _, b := range n.local.Blocks() {
+		if b.IP == d.IP {
+			return b.ExpiresAt
+		}
+	}
+	if e, ok := n.local.(expirer); ok {
+		return e.ExpiresAt(d, now)
+	}
+	if d.TTL > 0 {
+		return now.Add(d.TTL)
+	}
+	return time.Time{}
+}
+
+// Changes of the local Firewall, see connectiontracker.IPTables
+func (n *Node) Changes(d detection.Detection) bool {
+	c, ok := n.local.(interface {
+		Changes(d detection.Detection) bool
+	})
+	return ok && c.Changes(d)
+}
+
+// Batching of the local Firewall, see connectiontracker.IPTables
+func (n *Node) Batching() bool {
+	b, ok := n.local.(interface{ Batching() bool })
+	return ok && b.Batching()
+}
+
+// Unblock lifts the block locally and on the peers
+func (n *Node) Unblock(ip string) error {
+	if err := n.local.Unblock(ip); err != nil {
+		return err
+	}
+	n.m.Lock()
+	delete(n.announced, ip)
+	n.m.Unlock()
+	n.broadcast(Message{Op: opUnblock, IP: ip})
+	return nil
+}
+
+// Blocks returns the local blocks
+func (n *Node) Blocks() []detection.Block {
+	return n.local.Blocks()
+}
+
+// Allow adds the IP to the local allow list only, every node keeps its own allow list
+func (n *Node) Allow(ip string) error {
+	return n.local.Allow(ip)
+}
+
+// Disallow removes the IP from the local allow list
+func (n *Node) Disallow(ip string) error {
+	return n.local.Disallow(ip)
+}
+
+// AllowList returns the local allow list
+func (n *Node) AllowList() []string {
+	return n.local.AllowList()
+}
+
+// Check of the local firewall, peers have their own probes
+func (n *Node) Check(ctx context.Context) error {
+	return n.local.Check(ctx)
+}
+
+// Close waits for the pushes in flight and closes the local Firewall
+func (n *Node) Close() error {
+	n.wg.Wait()
+	return n.local.Close()
+}
+
+func (n *Node) broadcast(msg Message) {
+	msg.ID = newID()
+	msg.Origin = n.name
+	if msg.Timestamp.IsZero() {
+		msg.Timestamp = time.Now().UTC()
+	}
+	body, err := json.Marshal(msg)
+	if err != nil {
+		log.Err(err).Send()
+		return
+	}
+	signature := sign(n.secret, body)
+	for _, peer := range n.peers {
+		n.wg.Add(1)
+		go func(peer string) {
+			defer n.wg.Done()
+			if err := n.push(peer, body, signature); err != nil {
+				log.Err(err).Msgf("Cluster: pushing %s of %s to %s failed", msg.Op, msg.IP, peer)
+			}
+		}(peer)
+	}
+}
+
+// push retries with backoff, the receiver de-duplicates by message ID
+func (n *Node) push(peer string, body []byte, signature string) error {
+	var err error
+	for attempt := 0; attempt < pushAttempts; attempt++ {
+		if attempt > 0 {
+			time.Sleep(pushBackoff << (attempt - 1))
+		}
+		if err = n.send(peer, body, signature); err == nil {
+			return nil
+		}
+	}
+	return err
+}
+
+func (n *Node) send(peer string, body []byte, signature string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), pushTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, peer+Path, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(SignatureHeader, signature)
+	resp, err := n.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= http.StatusMultipleChoices {
+		return fmt.Errorf("peer responded with %s", resp.Status)
+	}
+	return nil
+}
+
+// Handler receives the messages from the peers
+func (n *Node) Handler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		body, err := io.ReadAll(io.LimitReader(r.Body, maxMessageSize))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if !verify(n.secret, body, r.Header.Get(SignatureHeader)) {
+			log.Warn().Msgf("Cluster: message with invalid signature from %s", r.RemoteAddr)
+			http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+			return
+		}
+		var msg Message
+		if err := json.Unmarshal(body, &msg); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if skew := time.Since(msg.Timestamp); skew > maxClockSkew || skew < -maxClockSkew {
+			http.Error(w, "message timestamp out of range", http.StatusUnauthorized)
+			return
+		}
+		// the IP ends up in the firewall rules, the signature only tells a peer sent it
+		if !detection.ValidIPv4(msg.IP) {
+			log.Warn().Msgf("Cluster: message with invalid IPv4 address %q from %s", msg.IP, msg.Origin)
+			http.Error(w, "invalid IPv4 address", http.StatusBadRequest)
+			return
+		}
+		if msg.Origin == n.name || n.duplicate(msg.ID) {
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		if err := n.apply(msg); err != nil {
+			log.Err(err).Msgf("Cluster: applying %s of %s from %s failed", msg.Op, msg.IP, msg.Origin)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		// a failed message is applied again when the origin retries it
+		n.remember(msg.ID)
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// apply uses the local Firewall, received messages are not pushed further
+func (n *Node) apply(msg Message) error {
+	switch msg.Op {
+	case opBlock:
+		d := detection.Detection{IP: msg.IP, Type: msg.Type, Score: msg.Score}
+		if msg.TTLSeconds > 0 {
+			d.TTL = time.Until(msg.Timestamp.Add(time.Duration(msg.TTLSeconds) * time.Second))
+			if d.TTL <= 0 {
+				return nil
+			}
+		}
+		log.Info().Msgf("Cluster: %s blocked %s, detection %s", msg.Origin, msg.IP, msg.Type)
+		return n.local.Block(d)
+	case opUnblock:
+		log.Info().Msgf("Cluster: %s unblocked %s", msg.Origin, msg.IP)
+		return n.local.Unblock(msg.IP)
+	}
+	return fmt.Errorf("unknown cluster operation: %q", msg.Op)
+}
+
+// duplicate tells the message was already applied
+func (n *Node) duplicate(id string) bool {
+	n.m.Lock()
+	defer n.m.Unlock()
+	_, ok := n.seen[id]
+	return ok
+}
+
+// remember the applied message ID, old IDs are forgotten after they can't pass maxClockSkew check anyway
+func (n *Node) remember(id string) {
+	n.m.Lock()
+	defer n.m.Unlock()
+	now := time.Now()
+	for seenID, at := range n.seen {
+		if now.Sub(at) > 2*maxClockSkew {
+			delete(n.seen, seenID)
+		}
+	}
+	n.seen[id] = now
+}
+
+func sign(secret, body []byte) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func verify(secret, body []byte, signature string) bool {
+	expected, err := hex.DecodeString(signature)
+	if err != nil {
+		return false
+	}
+	mac := hmac.New(sha256.New, secret)
+	mac.Write(body)
+	return hmac.Equal(mac.Sum(nil), expected)
+}
+
+func newID() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return fmt.Sprint(time.Now().UnixNano())
+	}
+	return hex.EncodeToString(b)
+}
@@ -0,0 +1,225 @@
+package cluster
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"tcptracker/internal/detection"
+	"testing"
+	"time"
+)
+
+// fakeFirewall records the calls, pushes are asynchronous so gomock expectations are not a good fit
+type fakeFirewall struct {
+	blocked   []detection.Detection
+	unblocked []string
+	// blocks are the applied blocks, failures fail the next Block calls
+	blocks   []detection.Block
+	failures int
+	m        sync.Mutex
+}
+
+func (f *fakeFirewall) Block(d detection.Detection) error {
+	f.m.Lock()
+	defer f.m.Unlock()
+	if f.failures > 0 {
+		f.failures--
+		return errors.New("iptables: resource temporarily unavailable")
+	}
+	f.blocked = append(f.blocked, d)
+	return nil
+}
+
+func (f *fakeFirewall) Unblock(ip string) error {
+	f.m.Lock()
+	defer f.m.Unlock()
+	f.unblocked = append(f.unblocked, ip)
+	return nil
+}
+
+func (f *fakeFirewall) Blocks() []detection.Block {
+	f.m.Lock()
+	defer f.m.Unlock()
+	return f.blocks
+}
+
+func (f *fakeFirewall) Allow(string) error { return nil }
+
+func (f *fakeFirewall) Disallow(string) error { return nil }
+
+func (f *fakeFirewall) AllowList() []string { return nil }
+
+func (f *fakeFirewall) Check(context.Context) error { return nil }
+
+func (f *fakeFirewall) Close() error { return nil }
+
+func (f *fakeFirewall) calls() ([]detection.Detection, []string) {
+	f.m.Lock()
+	defer f.m.Unlock()
+	return append([]detection.Detection(nil), f.blocked...), append([]string(nil), f.unblocked...)
+}
+
+func newTestNode(t *testing.T, name, secret string, peers ...string) (*Node, *fakeFirewall) {
+	fw := &fakeFirewall{}
+	node, err := NewNode(Params{Name: name, Peers: peers, Secret: secret, Firewall: fw})
+	require.NoError(t, err)
+	return node, fw
+}
+
+func TestNodePropagatesBlockAndUnblock(t *testing.T) {
+	peer, peerFw := newTestNode(t, "node2", "secret")
+	server := httptest.NewServer(peer.Handler())
+	defer server.Close()
+	node, localFw := newTestNode(t, "node1", "secret", server.URL+"/")
+
+	d := detection.Detection{IP: "10.0.0.1", Type: detection.PortScan, Score: 4, TTL: time.Hour}
+	require.NoError(t, node.Block(d))
+	// announced once, the scan keeps being detected
+	require.NoError(t, node.Block(d))
+	node.wg.Wait()
+	require.NoError(t, node.Unblock("10.0.0.1"))
+	require.NoError(t, node.Close())
+
+	localBlocked, _ := localFw.calls()
+	assert.Len(t, localBlocked, 2)
+	blocked, unblocked := peerFw.calls()
+	require.Len(t, blocked, 1)
+	assert.Equal(t, "10.0.0.1", blocked[0].IP)
+	assert.Equal(t, detection.PortScan, blocked[0].Type)
+	assert.InDelta(t, time.Hour.Seconds(), blocked[0].TTL.Seconds(), 5)
+	assert.Equal(t, []string{"10.0.0.1"}, unblocked)
+}
+
+func TestHandlerRejectsInvalidMessages(t *testing.T) {
+	node, fw := newTestNode(t, "node1", "secret")
+	valid := func(msg Message) []byte {
+		body, err := json.Marshal(msg)
+		require.NoError(t, err)
+		return body
+	}
+	fresh := Message{ID: "1", Origin: "node2", Op: opBlock, IP: "10.0.0.1", Timestamp: time.Now()}
+	tests := []struct {
+		name       string
+		body       []byte
+		signature  string
+		statusCode int
+	}{
+		{
+			name:       "wrong secret",
+			body:       valid(fresh),
+			signature:  sign([]byte("other"), valid(fresh)),
+			statusCode: http.StatusUnauthorized,
+		},
+		{
+			name:       "missing signature",
+			body:       valid(fresh),
+			statusCode: http.StatusUnauthorized,
+		},
+		{
+			name:       "replayed old message",
+			body:       valid(Message{ID: "2", Origin: "node2", Op: opBlock, IP: "10.0.0.1", Timestamp: time.Now().Add(-time.Hour)}),
+			statusCode: http.StatusUnauthorized,
+		},
+		{
+			name:       "unknown operation",
+			body:       valid(Message{ID: "3", Origin: "node2", Op: "flush", IP: "10.0.0.1", Timestamp: time.Now()}),
+			statusCode: http.StatusInternalServerError,
+		},
+		{
+			name: "rule injection",
+			body: valid(Message{ID: "6", Origin: "node2", Op: opBlock, IP: "10.0.0.1 -j ACCEPT\n-A INPUT",
+				Timestamp: time.Now()}),
+			statusCode: http.StatusBadRequest,
+		},
+		{
+			name:       "IPv6 unblock",
+			body:       valid(Message{ID: "7", Origin: "node2", Op: opUnblock, IP: "2001:db8::1", Timestamp: time.Now()}),
+			statusCode: http.StatusBadRequest,
+		},
+		{
+			name:       "valid",
+			body:       valid(fresh),
+			statusCode: http.StatusNoContent,
+		},
+		{
+			name:       "duplicate",
+			body:       valid(fresh),
+			statusCode: http.StatusNoContent,
+		},
+		{
+			name:       "own message",
+			body:       valid(Message{ID: "4", Origin: "node1", Op: opBlock, IP: "10.0.0.2", Timestamp: time.Now()}),
+			statusCode: http.StatusNoContent,
+		},
+		{
+			name: "expired block",
+			body: valid(Message{ID: "5", Origin: "node2", Op: opBlock, IP: "10.0.0.3", TTLSeconds: 60,
+				Timestamp: time.Now().Add(-2 * time.Minute)}),
+			statusCode: http.StatusNoContent,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			signature := tt.signature
+			if signature == "" && tt.name != "missing signature" {
+				signature = sign([]byte("secret"), tt.body)
+			}
+			r := httptest.NewRequest(http.MethodPost, Path, bytes.NewReader(tt.body))
+			r.Header.Set(SignatureHeader, signature)
+			w := httptest.NewRecorder()
+			node.Handler().ServeHTTP(w, r)
+			assert.Equal(t, tt.statusCode, w.Code)
+		})
+	}
+	blocked, unblocked := fw.calls()
+	require.Len(t, blocked, 1)
+	assert.Equal(t, "10.0.0.1", blocked[0].IP)
+	assert.Empty(t, unblocked)
+}
+
+func TestNodeAnnouncesEffectiveExpiry(t *testing.T) {
+	peer, peerFw := newTestNode(t, "node2", "secret")
+	server := httptest.NewServer(peer.Handler())
+	defer server.Close()
+	node, localFw := newTestNode(t, "node1", "secret", server.URL)
+	// the detection has no TTL, the local block expires with the default TTL of this node
+	localFw.blocks = []detection.Block{{IP: "10.0.0.1", Type: detection.PortScan, ExpiresAt: time.Now().Add(30 * time.Minute)}}
+
+	require.NoError(t, node.Block(detection.Detection{IP: "10.0.0.1", Type: detection.PortScan}))
+	require.NoError(t, node.Close())
+
+	blocked, _ := peerFw.calls()
+	require.Len(t, blocked, 1)
+	assert.InDelta(t, (30 * time.Minute).Seconds(), blocked[0].TTL.Seconds(), 5)
+}
+
+func TestHandlerAppliesRetriedMessageAfterFailure(t *testing.T) {
+	node, fw := newTestNode(t, "node1", "secret")
+	fw.failures = 1
+	body, err := json.Marshal(Message{ID: "1", Origin: "node2", Op: opBlock, IP: "10.0.0.1", Timestamp: time.Now()})
+	require.NoError(t, err)
+	push := func() int {
+		r := httptest.NewRequest(http.MethodPost, Path, bytes.NewReader(body))
+		r.Header.Set(SignatureHeader, sign([]byte("secret"), body))
+		w := httptest.NewRecorder()
+		node.Handler().ServeHTTP(w, r)
+		return w.Code
+	}
+	assert.Equal(t, http.StatusInternalServerError, push())
+	// the retry of the origin is not a duplicate, the first attempt was not applied
+	assert.Equal(t, http.StatusNoContent, push())
+	assert.Equal(t, http.StatusNoContent, push())
+	blocked, _ := fw.calls()
+	assert.Len(t, blocked, 1)
+}
+
+func TestNewNodeRequiresSecret(t *testing.T) {
+	_, err := NewNode(Params{Name: "node1", Firewall: &fakeFirewall{}})
+	require.Error(t, err)
+}
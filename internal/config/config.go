@@ -0,0 +1,605 @@
+package config
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"github.com/pelletier/go-toml/v2"
+	"gopkg.in/yaml.v3"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// EnvPrefix of the environment variables overriding the config file, e.g. TCPTRACKER_FIREWALL_ACTION
+const EnvPrefix = "TCPTRACKER_"
+
+// envConfigFile points to the config file when -config flag is not set
+const envConfigFile = EnvPrefix + "CONFIG"
+
+// Config is loaded from defaults, YAML or TOML file, TCPTRACKER_* env vars and flags, later ones take precedence
+type Config struct {
+	Capture      Capture      `yaml:"capture" toml:"capture"`
+	Detection    Detection    `yaml:"detection" toml:"detection"`
+	Firewall     Firewall     `yaml:"firewall" toml:"firewall"`
+	API          API          `yaml:"api" toml:"api"`
+	Redis        Redis        `yaml:"redis" toml:"redis"`
+	Cluster      Cluster      `yaml:"cluster" toml:"cluster"`
+	Syslog       Syslog       `yaml:"syslog" toml:"syslog"`
+	Webhook      Webhook      `yaml:"webhook" toml:"webhook"`
+	Alertmanager Alertmanager `yaml:"alertmanager" toml:"alertmanager"`
+	Kafka        Kafka        `yaml:"kafka" toml:"kafka"`
+	NATS         NATS         `yaml:"nats" toml:"nats"`
+	Privileges   Privileges   `yaml:"privileges" toml:"privileges"`
+	Log          Log          `yaml:"log" toml:"log"`
+}
+
+// Capture of new connections on the device
+type Capture struct {
+	Device    string `yaml:"device" toml:"device"`
+	SnapLen   int    `yaml:"snapLen" toml:"snapLen"`
+	BPFFilter string `yaml:"bpfFilter" toml:"bpfFilter"`
+}
+
+// Detection of port scans
+type Detection struct {
+	// Window of remembering the ports per source
+	Window Duration `yaml:"window" toml:"window"`
+	// PortScanThreshold is the number of ports in the window above which the source is blocked
+	PortScanThreshold int `yaml:"portScanThreshold" toml:"portScanThreshold" reload:"true"`
+}
+
+// Firewall blocking the detected sources, action and TTL changes apply to the next blocks
+type Firewall struct {
+	Chain             string   `yaml:"chain" toml:"chain"`
+	Action            string   `yaml:"action" toml:"action" reload:"true"`
+	ActionByType      string   `yaml:"actionByType" toml:"actionByType" reload:"true"`
+	ActionTiers       string   `yaml:"actionTiers" toml:"actionTiers" reload:"true"`
+	Forward           bool     `yaml:"forward" toml:"forward"`
+	ReconcileInterval Duration `yaml:"reconcileInterval" toml:"reconcileInterval"`
+	BatchWindow       Duration `yaml:"batchWindow" toml:"batchWindow"`
+	BlockTTL          Duration `yaml:"blockTTL" toml:"blockTTL" reload:"true"`
+	// Allowlist IPs are never blocked, they are added to the allow list managed by the API
+	Allowlist []string `yaml:"allowlist" toml:"allowlist" reload:"true"`
+}
+
+// API servers and their authentication
+type API struct {
+	HTTPAddr          string `yaml:"httpAddr" toml:"httpAddr"`
+	GRPCAddr          string `yaml:"grpcAddr" toml:"grpcAddr"`
+	TLSCert           string `yaml:"tlsCert" toml:"tlsCert"`
+	TLSKey            string `yaml:"tlsKey" toml:"tlsKey"`
+	TLSClientCA       string `yaml:"tlsClientCA" toml:"tlsClientCA"`
+	AuthTokens        string `yaml:"authTokens" toml:"authTokens"`
+	MTLSAdmins        string `yaml:"mtlsAdmins" toml:"mtlsAdmins"`
+	AuthPublicMetrics bool   `yaml:"authPublicMetrics" toml:"authPublicMetrics"`
+	// Socket is unix socket of the CLI, its requests are trusted as admin
+	Socket string `yaml:"socket" toml:"socket"`
+}
+
+// Redis sharing the detection state, Password is secret
+type Redis struct {
+	Addr     string `yaml:"addr" toml:"addr"`
+	Password string `yaml:"password" toml:"password" secret:"true"`
+}
+
+// Cluster of trackers sharing the blocks, Secret is secret
+type Cluster struct {
+	Peers    []string `yaml:"peers" toml:"peers"`
+	NodeName string   `yaml:"nodeName" toml:"nodeName"`
+	Secret   string   `yaml:"secret" toml:"secret" secret:"true"`
+}
+
+// Syslog sink sending detections and blocks to SIEM, disabled without Addr
+type Syslog struct {
+	// Addr is udp://host:514, tcp://host:601, tls://host:6514 or unix:///dev/log
+	Addr     string `yaml:"addr" toml:"addr"`
+	Format   string `yaml:"format" toml:"format"`
+	Facility string `yaml:"facility" toml:"facility"`
+	TLSCA    string `yaml:"tlsCA" toml:"tlsCA"`
+	// Buffer of the events waiting while the collector is unavailable, the newest are dropped when it is full
+	Buffer int `yaml:"buffer" toml:"buffer"`
+}
+
+// Webhook sink notifying about the detections, disabled without URLs, URLs (they often hold tokens) and Secret are secret
+type Webhook struct {
+	URLs []string `yaml:"urls" toml:"urls" secret:"true"`
+	// Template is built-in json, slack, mattermost, teams or pagerduty, or a Go template file
+	Template    string   `yaml:"template" toml:"template"`
+	ContentType string   `yaml:"contentType" toml:"contentType"`
+	Secret      string   `yaml:"secret" toml:"secret" secret:"true"`
+	Attempts    int      `yaml:"attempts" toml:"attempts"`
+	Timeout     Duration `yaml:"timeout" toml:"timeout"`
+	// RateLimit is the number of notifications per minute, Burst of them can be sent at once
+	RateLimit int `yaml:"rateLimit" toml:"rateLimit"`
+	Burst     int `yaml:"burst" toml:"burst"`
+	// DedupWindow of notifying a source about the same detection type once, 0 notifies every detection
+	DedupWindow Duration `yaml:"dedupWindow" toml:"dedupWindow"`
+	Buffer      int      `yaml:"buffer" toml:"buffer"`
+}
+
+// Alertmanager receiving an alert per blocked source, disabled without URLs
+type Alertmanager struct {
+	// URLs of all the Alertmanager instances, e.g. http://alertmanager:9093
+	URLs           []string `yaml:"urls" toml:"urls"`
+	ResendInterval Duration `yaml:"resendInterval" toml:"resendInterval"`
+	Timeout        Duration `yaml:"timeout" toml:"timeout"`
+	Buffer         int      `yaml:"buffer" toml:"buffer"`
+}
+
+// Kafka sink streaming all the events, disabled without Brokers, Password is secret
+type Kafka struct {
+	// Brokers are the seed brokers host:port
+	Brokers []string `yaml:"brokers" toml:"brokers"`
+	// Username enables SASL authentication with SASLMechanism: plain, scram-sha-256 or scram-sha-512
+	Username      string `yaml:"username" toml:"username"`
+	Password      string `yaml:"password" toml:"password" secret:"true"`
+	SASLMechanism string `yaml:"saslMechanism" toml:"saslMechanism"`
+	TLS           bool   `yaml:"tls" toml:"tls"`
+	TLSCA         string `yaml:"tlsCA" toml:"tlsCA"`
+	// Topic of the events, {type} is replaced by the event type
+	Topic       string   `yaml:"topic" toml:"topic"`
+	BatchSize   int      `yaml:"batchSize" toml:"batchSize"`
+	Linger      Duration `yaml:"linger" toml:"linger"`
+	Compression string   `yaml:"compression" toml:"compression"`
+	Timeout     Duration `yaml:"timeout" toml:"timeout"`
+	// Buffer of the events waiting for the batch to be published, the newest are dropped when it is full
+	Buffer int `yaml:"buffer" toml:"buffer"`
+}
+
+// NATS sink streaming all the events, disabled without URL, Password and Token are secret
+type NATS struct {
+	URL      string `yaml:"url" toml:"url"`
+	User     string `yaml:"user" toml:"user"`
+	Password string `yaml:"password" toml:"password" secret:"true"`
+	Token    string `yaml:"token" toml:"token" secret:"true"`
+	TLSCA    string `yaml:"tlsCA" toml:"tlsCA"`
+	// Subject of the events, {type} is replaced by the event type
+	Subject     string   `yaml:"subject" toml:"subject"`
+	BatchSize   int      `yaml:"batchSize" toml:"batchSize"`
+	Linger      Duration `yaml:"linger" toml:"linger"`
+	Compression string   `yaml:"compression" toml:"compression"`
+	Timeout     Duration `yaml:"timeout" toml:"timeout"`
+	Buffer      int      `yaml:"buffer" toml:"buffer"`
+}
+
+// Privileges of the running tracker
+type Privileges struct {
+	// User the tracker started by root runs as without capabilities once the capture is open,
+	// the firewall helper runs as the user keeping only CAP_NET_ADMIN
+	User string `yaml:"user" toml:"user"`
+}
+
+// Log format and level
+type Log struct {
+	JSON  bool `yaml:"json" toml:"json"`
+	Level int  `yaml:"level" toml:"level" reload:"true"`
+}
+
+// Duration is written as `30s` or `1m` in the config file and env vars
+type Duration time.Duration
+
+func (d Duration) String() string {
+	return time.Duration(d).String()
+}
+
+func (d Duration) MarshalText() ([]byte, error) {
+	return []byte(d.String()), nil
+}
+
+func (d *Duration) UnmarshalText(text []byte) error {
+	v, err := time.ParseDuration(string(text))
+	if err != nil {
+		return err
+	}
+	*d = Duration(v)
+	return nil
+}
+
+// Default config, the values were the hard-coded constants before
+func Default() *Config {
+	return &Config{
+		Capture: Capture{
+			Device:    "eth0",
+			SnapLen:   80,
+			BPFFilter: `tcp[tcpflags] &(tcp-syn) != 0 and tcp[tcpflags] &(tcp-ack) = 0`,
+		},
+		Detection: Detection{
+			Window:            Duration(time.Minute),
+			PortScanThreshold: 3,
+		},
+		Firewall: Firewall{
+			Chain:             "tcptracker",
+			Action:            "drop",
+			ReconcileInterval: Duration(30 * time.Second),
+			BatchWindow:       Duration(100 * time.Millisecond),
+			Allowlist:         []string{},
+		},
+		API: API{
+			HTTPAddr:          "127.0.0.1:8081",
+			GRPCAddr:          "127.0.0.1:8082",
+			AuthPublicMetrics: true,
+		},
+		Cluster: Cluster{NodeName: hostname()},
+		Syslog: Syslog{
+			Format:   "cef",
+			Facility: "authpriv",
+			Buffer:   1000,
+		},
+		Webhook: Webhook{
+			URLs:        []string{},
+			Template:    "json",
+			ContentType: "application/json",
+			Attempts:    5,
+			Timeout:     Duration(10 * time.Second),
+			RateLimit:   30,
+			Burst:       10,
+			DedupWindow: Duration(10 * time.Minute),
+			Buffer:      1000,
+		},
+		Alertmanager: Alertmanager{
+			URLs:           []string{},
+			ResendInterval: Duration(time.Minute),
+			Timeout:        Duration(10 * time.Second),
+			Buffer:         1000,
+		},
+		Kafka: Kafka{
+			Brokers:       []string{},
+			SASLMechanism: "plain",
+			Topic:         "tcptracker.events",
+			BatchSize:     500,
+			Linger:        Duration(time.Second),
+			Compression:   "gzip",
+			Timeout:       Duration(10 * time.Second),
+			Buffer:        10000,
+		},
+		NATS: NATS{
+			Subject:     "tcptracker.events.{type}",
+			BatchSize:   500,
+			Linger:      Duration(time.Second),
+			Compression: "none",
+			Timeout:     Duration(10 * time.Second),
+			Buffer:      10000,
+		},
+	}
+}
+
+// Load builds the effective config from args (without the program name) and environ (os.Environ),
+// flag.ErrHelp is returned when -h was requested
+func Load(args []string, environ []string) (*Config, error) {
+	// flags are parsed first to find the config file, then applied again on top of the file and env
+	var path string
+	parsed := flag.NewFlagSet("tcptracker", flag.ContinueOnError)
+	bindFlags(parsed, Default(), &path)
+	if err := parsed.Parse(args); err != nil {
+		return nil, err
+	}
+	if parsed.NArg() > 0 {
+		return nil, fmt.Errorf("unexpected arguments: %v", parsed.Args())
+	}
+	env, err := parseEnv(environ)
+	if err != nil {
+		return nil, err
+	}
+	if path == "" {
+		path = env[envConfigFile]
+	}
+
+	c := Default()
+	if path != "" {
+		if err := c.loadFile(path); err != nil {
+			return nil, err
+		}
+	}
+	if err := c.applyEnv(env); err != nil {
+		return nil, err
+	}
+	effective := flag.NewFlagSet("tcptracker", flag.ContinueOnError)
+	bindFlags(effective, c, &path)
+	var errSet error
+	parsed.Visit(func(f *flag.Flag) {
+		if err := effective.Set(f.Name, f.Value.String()); err != nil && errSet == nil {
+			errSet = fmt.Errorf("-%s: %w", f.Name, err)
+		}
+	})
+	if errSet != nil {
+		return nil, errSet
+	}
+	if err := c.Validate(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// bindFlags keeps the flag names used before the config file was introduced, secrets are not flags
+// to keep them out of the process list
+func bindFlags(fs *flag.FlagSet, c *Config, path *string) {
+	fs.StringVar(path, "config", "", "YAML (.yaml, .yml) or TOML (.toml) config file, env "+envConfigFile)
+	fs.StringVar(&c.Capture.Device, "deviceName", c.Capture.Device, "Network Interface Device Name to track new connections.")
+	fs.IntVar(&c.Capture.SnapLen, "snapLen", c.Capture.SnapLen, "Bytes captured per packet, enough for Ethernet, IPv4 and TCP headers.")
+	fs.StringVar(&c.Capture.BPFFilter, "bpfFilter", c.Capture.BPFFilter, "BPF filter selecting new TCP connections.")
+	fs.DurationVar((*time.Duration)(&c.Detection.Window), "detectionWindow", time.Duration(c.Detection.Window),
+		"Window of remembering the ports connected by a source.")
+	fs.IntVar(&c.Detection.PortScanThreshold, "portScanThreshold", c.Detection.PortScanThreshold,
+		"Source connecting to more ports than this in the window is a port scan.")
+	fs.StringVar(&c.Firewall.Chain, "firewallChain", c.Firewall.Chain, "iptables chain holding the blocks.")
+	fs.StringVar(&c.Firewall.Action, "firewallAction", c.Firewall.Action, "Default firewall action: drop, reject, tarpit, ratelimit[:rate].")
+	fs.StringVar(&c.Firewall.ActionByType, "firewallActionByType", c.Firewall.ActionByType,
+		"Firewall action per detection type, e.g. portscan=reject")
+	fs.StringVar(&c.Firewall.ActionTiers, "firewallActionTiers", c.Firewall.ActionTiers,
+		"Firewall action per minimum score, e.g. 10=ratelimit,50=tarpit")
+	fs.Var((*listValue)(&c.Firewall.Allowlist), "allowlist", "IPs never blocked, e.g. 10.0.0.1,10.0.0.2")
+	fs.BoolVar(&c.Firewall.Forward, "forward", c.Firewall.Forward,
+		"Protect routed containers and VMs, hooks into FORWARD and DOCKER-USER chains.")
+	fs.DurationVar((*time.Duration)(&c.Firewall.ReconcileInterval), "reconcileInterval", time.Duration(c.Firewall.ReconcileInterval),
+		"Firewall reconciliation interval, 0 disables it.")
+	fs.DurationVar((*time.Duration)(&c.Firewall.BatchWindow), "batchWindow", time.Duration(c.Firewall.BatchWindow),
+		"Window of batching blocks into one iptables-restore, 0 disables it.")
+	fs.DurationVar((*time.Duration)(&c.Firewall.BlockTTL), "blockTTL", time.Duration(c.Firewall.BlockTTL),
+		"How long detected IPs stay blocked, 0 blocks until shutdown.")
+	fs.StringVar(&c.API.HTTPAddr, "httpAddr", c.API.HTTPAddr,
+		"HTTP API listen address. Non-loopback addresses require -authTokens or -tlsClientCA.")
+	fs.StringVar(&c.API.GRPCAddr, "grpcAddr", c.API.GRPCAddr,
+		"gRPC API listen address, empty disables it. Non-loopback addresses require -authTokens or -tlsClientCA.")
+	fs.StringVar(&c.API.TLSCert, "tlsCert", c.API.TLSCert, "TLS certificate of the HTTP and gRPC APIs, empty serves plain text.")
+	fs.StringVar(&c.API.TLSKey, "tlsKey", c.API.TLSKey, "TLS private key of the HTTP and gRPC APIs.")
+	fs.StringVar(&c.API.TLSClientCA, "tlsClientCA", c.API.TLSClientCA, "CA verifying client certificates, enables mTLS authentication.")
+	fs.StringVar(&c.API.AuthTokens, "authTokens", c.API.AuthTokens, "File with one 'role name token' per line, roles are read and admin.")
+	fs.StringVar(&c.API.MTLSAdmins, "mtlsAdmins", c.API.MTLSAdmins,
+		"Client certificate Common Names with admin role, other clients are read only.")
+	fs.BoolVar(&c.API.AuthPublicMetrics, "authPublicMetrics", c.API.AuthPublicMetrics, "Keep /metrics and the health probes unauthenticated.")
+	fs.StringVar(&c.API.Socket, "apiSocket", c.API.Socket,
+		"Unix socket of the HTTP API for the CLI, requests are trusted as admin, empty disables it.")
+	fs.StringVar(&c.Redis.Addr, "redisAddr", c.Redis.Addr, "Redis address to share detection state across tracker nodes, e.g. redis:6379")
+	fs.Var((*listValue)(&c.Cluster.Peers), "clusterPeers",
+		"Peer tracker URLs sharing block decisions, e.g. http://10.0.0.2:8081,http://10.0.0.3:8081")
+	fs.StringVar(&c.Cluster.NodeName, "nodeName", c.Cluster.NodeName, "Name of this tracker node in the cluster.")
+	fs.StringVar(&c.Syslog.Addr, "syslogAddr", c.Syslog.Addr,
+		"Syslog collector of the SIEM, e.g. udp://10.0.0.5:514, tls://siem:6514 or unix:///dev/log, empty disables it.")
+	fs.StringVar(&c.Syslog.Format, "syslogFormat", c.Syslog.Format, "Syslog message format: cef (ArcSight) or leef (QRadar).")
+	fs.StringVar(&c.Syslog.Facility, "syslogFacility", c.Syslog.Facility, "Syslog facility, e.g. authpriv or local0.")
+	fs.StringVar(&c.Syslog.TLSCA, "syslogTLSCA", c.Syslog.TLSCA, "CA verifying the tls:// collector, empty uses the system roots.")
+	fs.IntVar(&c.Syslog.Buffer, "syslogBuffer", c.Syslog.Buffer, "Events buffered while the syslog collector is unavailable.")
+	fs.StringVar(&c.Webhook.Template, "webhookTemplate", c.Webhook.Template,
+		"Webhook body: json, slack, mattermost, teams, pagerduty or a Go template file.")
+	fs.StringVar(&c.Webhook.ContentType, "webhookContentType", c.Webhook.ContentType, "Content-Type of the webhook body.")
+	fs.IntVar(&c.Webhook.Attempts, "webhookAttempts", c.Webhook.Attempts, "Webhook delivery attempts, retried with exponential backoff.")
+	fs.DurationVar((*time.Duration)(&c.Webhook.Timeout), "webhookTimeout", time.Duration(c.Webhook.Timeout), "Timeout of a webhook request.")
+	fs.IntVar(&c.Webhook.RateLimit, "webhookRateLimit", c.Webhook.RateLimit, "Webhook notifications per minute, 0 disables the limit.")
+	fs.IntVar(&c.Webhook.Burst, "webhookBurst", c.Webhook.Burst, "Webhook notifications sent at once above the rate limit.")
+	fs.DurationVar((*time.Duration)(&c.Webhook.DedupWindow), "webhookDedupWindow", time.Duration(c.Webhook.DedupWindow),
+		"Window of notifying a source about the same detection type once, 0 notifies every detection.")
+	fs.IntVar(&c.Webhook.Buffer, "webhookBuffer", c.Webhook.Buffer, "Detections buffered while the webhooks are being delivered.")
+	fs.Var((*listValue)(&c.Alertmanager.URLs), "alertmanagerURLs",
+		"Alertmanager instances receiving an alert per blocked source, e.g. http://alertmanager:9093")
+	fs.DurationVar((*time.Duration)(&c.Alertmanager.ResendInterval), "alertmanagerResendInterval",
+		time.Duration(c.Alertmanager.ResendInterval), "Interval of resending the active alerts to Alertmanager.")
+	fs.DurationVar((*time.Duration)(&c.Alertmanager.Timeout), "alertmanagerTimeout", time.Duration(c.Alertmanager.Timeout),
+		"Timeout of an Alertmanager request.")
+	fs.IntVar(&c.Alertmanager.Buffer, "alertmanagerBuffer", c.Alertmanager.Buffer, "Blocks buffered while the alerts are being pushed.")
+	fs.Var((*listValue)(&c.Kafka.Brokers), "kafkaBrokers",
+		"Kafka brokers streaming all the events, e.g. kafka-1:9092,kafka-2:9092, empty disables it.")
+	fs.StringVar(&c.Kafka.Topic, "kafkaTopic", c.Kafka.Topic, "Kafka topic of the events, {type} is replaced by the event type.")
+	fs.IntVar(&c.Kafka.BatchSize, "kafkaBatchSize", c.Kafka.BatchSize, "Events produced to Kafka at once.")
+	fs.DurationVar((*time.Duration)(&c.Kafka.Linger), "kafkaLinger", time.Duration(c.Kafka.Linger),
+		"Interval of producing the batches not full yet to Kafka.")
+	fs.StringVar(&c.Kafka.Compression, "kafkaCompression", c.Kafka.Compression, "Compression of the Kafka records: none or gzip.")
+	fs.IntVar(&c.Kafka.Buffer, "kafkaBuffer", c.Kafka.Buffer, "Events buffered for Kafka, newer ones are dropped when it is full.")
+	fs.StringVar(&c.NATS.URL, "natsURL", c.NATS.URL, "NATS server streaming all the events, e.g. nats://nats:4222, empty disables it.")
+	fs.StringVar(&c.NATS.Subject, "natsSubject", c.NATS.Subject, "NATS subject of the events, {type} is replaced by the event type.")
+	fs.IntVar(&c.NATS.BatchSize, "natsBatchSize", c.NATS.BatchSize, "Events published to NATS in one message.")
+	fs.DurationVar((*time.Duration)(&c.NATS.Linger), "natsLinger", time.Duration(c.NATS.Linger),
+		"Interval of publishing the batches not full yet to NATS.")
+	fs.StringVar(&c.NATS.Compression, "natsCompression", c.NATS.Compression, "Compression of the NATS messages: none or gzip.")
+	fs.IntVar(&c.NATS.Buffer, "natsBuffer", c.NATS.Buffer, "Events buffered for NATS, newer ones are dropped when it is full.")
+	fs.StringVar(&c.Privileges.User, "user", c.Privileges.User,
+		"Unprivileged user (name or uid) running the tracker started as root, empty keeps the privileges.")
+	fs.BoolVar(&c.Log.JSON, "logJSON", c.Log.JSON, "configure log format to be PLAIN or JSON")
+	fs.IntVar(&c.Log.Level, "logLevel", c.Log.Level, "configure log level")
+}
+
+// listValue is a comma separated flag
+type listValue []string
+
+func (l *listValue) String() string {
+	if l == nil {
+		return ""
+	}
+	return strings.Join(*l, ",")
+}
+
+func (l *listValue) Set(s string) error {
+	*l = splitList(s)
+	return nil
+}
+
+func splitList(s string) []string {
+	var list []string
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			list = append(list, item)
+		}
+	}
+	return list
+}
+
+func (c *Config) loadFile(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	switch ext := strings.ToLower(filepath.Ext(path)); ext {
+	case ".yaml", ".yml":
+		dec := yaml.NewDecoder(f)
+		dec.KnownFields(true)
+		if err := dec.Decode(c); err != nil && !errors.Is(err, io.EOF) {
+			return fmt.Errorf("%s: %w", path, err)
+		}
+	case ".toml":
+		dec := toml.NewDecoder(f)
+		dec.DisallowUnknownFields()
+		if err := dec.Decode(c); err != nil {
+			var strict *toml.StrictMissingError
+			if errors.As(err, &strict) {
+				return fmt.Errorf("%s: unknown fields:\n%s", path, strict.String())
+			}
+			var decode *toml.DecodeError
+			if errors.As(err, &decode) {
+				return fmt.Errorf("%s: %s", path, decode.String())
+			}
+			return fmt.Errorf("%s: %w", path, err)
+		}
+	default:
+		return fmt.Errorf("%s: unsupported config format %q, use .yaml, .yml or .toml", path, ext)
+	}
+	return nil
+}
+
+// field of a config section, it is addressed as section.name in the files and SECTION_NAME in env vars
+type field struct {
+	key    string
+	env    string
+	secret bool
+	// reload tells the field can be applied to the running tracker
+	reload bool
+	value  reflect.Value
+}
+
+func (c *Config) fields() []field {
+	var fields []field
+	sections := reflect.ValueOf(c).Elem()
+	for i := 0; i < sections.NumField(); i++ {
+		sectionName := sections.Type().Field(i).Tag.Get("yaml")
+		section := sections.Field(i)
+		for j := 0; j < section.NumField(); j++ {
+			f := section.Type().Field(j)
+			name := f.Tag.Get("yaml")
+			fields = append(fields, field{
+				key:    sectionName + "." + name,
+				env:    EnvPrefix + envName(sectionName) + "_" + envName(name),
+				secret: f.Tag.Get("secret") == "true",
+				reload: f.Tag.Get("reload") == "true",
+				value:  section.Field(j),
+			})
+		}
+	}
+	return fields
+}
+
+// envName converts camelCase to SNAKE_CASE, e.g. reconcileInterval to RECONCILE_INTERVAL, tlsClientCA to TLS_CLIENT_CA
+func envName(name string) string {
+	var b strings.Builder
+	runes := []rune(name)
+	for i, r := range runes {
+		if i > 0 && unicode.IsUpper(r) && !unicode.IsUpper(runes[i-1]) {
+			b.WriteByte('_')
+		}
+		b.WriteRune(unicode.ToUpper(r))
+	}
+	return b.String()
+}
+
+// parseEnv returns TCPTRACKER_* variables, unknown ones are rejected to catch typos
+func parseEnv(environ []string) (map[string]string, error) {
+	known := map[string]bool{envConfigFile: true}
+	for _, f := range Default().fields() {
+		known[f.env] = true
+	}
+	env := make(map[string]string)
+	var unknown []string
+	for _, kv := range environ {
+		parts := strings.SplitN(kv, "=", 2)
+		if !strings.HasPrefix(parts[0], EnvPrefix) || len(parts) != 2 {
+			continue
+		}
+		if !known[parts[0]] {
+			unknown = append(unknown, parts[0])
+			continue
+		}
+		env[parts[0]] = parts[1]
+	}
+	if len(unknown) > 0 {
+		sort.Strings(unknown)
+		return nil, fmt.Errorf("unknown environment variables: %s", strings.Join(unknown, ", "))
+	}
+	return env, nil
+}
+
+// applyEnv sets the fields from TCPTRACKER_* env vars
+func (c *Config) applyEnv(env map[string]string) error {
+	for _, f := range c.fields() {
+		value, ok := env[f.env]
+		if !ok {
+			continue
+		}
+		if err := setValue(f.value, value); err != nil {
+			return fmt.Errorf("%s: %w", f.env, err)
+		}
+	}
+	return nil
+}
+
+func setValue(v reflect.Value, s string) error {
+	switch v.Interface().(type) {
+	case Duration:
+		var d Duration
+		if err := d.UnmarshalText([]byte(s)); err != nil {
+			return err
+		}
+		v.Set(reflect.ValueOf(d))
+	case []string:
+		v.Set(reflect.ValueOf(splitList(s)))
+	case string:
+		v.SetString(s)
+	case bool:
+		b, err := strconv.ParseBool(s)
+		if err != nil {
+			return err
+		}
+		v.SetBool(b)
+	case int:
+		i, err := strconv.Atoi(s)
+		if err != nil {
+			return err
+		}
+		v.SetInt(int64(i))
+	default:
+		return fmt.Errorf("unsupported type %s", v.Type())
+	}
+	return nil
+}
+
+// Dump writes the effective config as YAML, secrets are redacted
+func (c *Config) Dump(w io.Writer) error {
+	redacted := *c
+	for _, f := range redacted.fields() {
+		switch {
+		case !f.secret:
+		case f.value.Kind() == reflect.Slice && f.value.Len() > 0:
+			f.value.Set(reflect.ValueOf([]string{"REDACTED"}))
+		case f.value.Kind() == reflect.String && f.value.String() != "":
+			f.value.SetString("REDACTED")
+		}
+	}
+	enc := yaml.NewEncoder(w)
+	enc.SetIndent(2)
+	if err := enc.Encode(&redacted); err != nil {
+		return err
+	}
+	return enc.Close()
+}
+
+func hostname() string {
+	name, err := os.Hostname()
+	if err != nil {
+		return "tcptracker"
+	}
+	return name
+}
@@ -0,0 +1,267 @@
+package config
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func writeFile(t *testing.T, name, content string) string {
+	path := filepath.Join(t.TempDir(), name)
+	require.NoError(t, os.WriteFile(path, []byte(content), 0o600))
+	return path
+}
+
+const yamlConfig = `
+capture:
+  device: ens3
+detection:
+  portScanThreshold: 5
+firewall:
+  action: reject
+  blockTTL: 1h
+cluster:
+  peers: [http://10.0.0.2:8081, http://10.0.0.3:8081]
+  secret: from-file
+`
+
+const tomlConfig = `
+[capture]
+device = "ens3"
+
+[detection]
+portScanThreshold = 5
+
+[firewall]
+action = "reject"
+blockTTL = "1h"
+
+[cluster]
+peers = ["http://10.0.0.2:8081", "http://10.0.0.3:8081"]
+secret = "from-file"
+`
+
+func TestLoadPrecedence(t *testing.T) {
+	for name, path := range map[string]string{
+		"yaml": writeFile(t, "tcptracker.yaml", yamlConfig),
+		"toml": writeFile(t, "tcptracker.toml", tomlConfig),
+	} {
+		t.Run(name, func(t *testing.T) {
+			cfg, err := Load(
+				[]string{"-config", path, "-blockTTL", "2h", "-clusterPeers", "http://10.0.0.4:8081"},
+				[]string{"TCPTRACKER_FIREWALL_ACTION=tarpit", "TCPTRACKER_FIREWALL_BLOCK_TTL=3h", "PATH=/usr/bin"},
+			)
+			require.NoError(t, err)
+			// file
+			assert.Equal(t, "ens3", cfg.Capture.Device)
+			assert.Equal(t, 5, cfg.Detection.PortScanThreshold)
+			assert.Equal(t, "from-file", cfg.Cluster.Secret)
+			// env over file
+			assert.Equal(t, "tarpit", cfg.Firewall.Action)
+			// flags over env and file
+			assert.Equal(t, Duration(2*time.Hour), cfg.Firewall.BlockTTL)
+			assert.Equal(t, []string{"http://10.0.0.4:8081"}, cfg.Cluster.Peers)
+			// defaults
+			assert.Equal(t, "127.0.0.1:8081", cfg.API.HTTPAddr)
+			assert.Equal(t, Duration(time.Minute), cfg.Detection.Window)
+		})
+	}
+}
+
+func TestLoadConfigFromEnv(t *testing.T) {
+	path := writeFile(t, "tcptracker.yml", "firewall:\n  chain: tt\n")
+	cfg, err := Load(nil, []string{"TCPTRACKER_CONFIG=" + path, "TCPTRACKER_API_TLS_CLIENT_CA=", "TCPTRACKER_LOG_JSON=true"})
+	require.NoError(t, err)
+	assert.Equal(t, "tt", cfg.Firewall.Chain)
+	assert.True(t, cfg.Log.JSON)
+}
+
+func TestLoadErrors(t *testing.T) {
+	tests := []struct {
+		name    string
+		args    []string
+		env     []string
+		file    string
+		content string
+		wantErr string
+	}{
+		{name: "unknown yaml field", file: "c.yaml", content: "capture:\n  snaplen: 80\n", wantErr: "field snaplen not found"},
+		{name: "unknown toml field", file: "c.toml", content: "[firewall]\nactoin = \"drop\"\n", wantErr: "unknown fields"},
+		{name: "invalid duration", file: "c.yaml", content: "firewall:\n  blockTTL: 1x\n", wantErr: "unknown unit"},
+		{name: "unsupported format", file: "c.json", content: "{}", wantErr: "unsupported config format"},
+		{name: "unknown env", env: []string{"TCPTRACKER_FIREWAL_ACTION=drop"}, wantErr: "TCPTRACKER_FIREWAL_ACTION"},
+		{name: "invalid env", env: []string{"TCPTRACKER_CAPTURE_SNAP_LEN=many"}, wantErr: "TCPTRACKER_CAPTURE_SNAP_LEN"},
+		{name: "unknown flag", args: []string{"-deviceNmae", "eth1"}, wantErr: "flag provided but not defined"},
+		{name: "positional argument", args: []string{"eth1"}, wantErr: "unexpected arguments"},
+		{name: "invalid value", args: []string{"-snapLen", "10"}, wantErr: "capture.snapLen"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			args := tt.args
+			if tt.file != "" {
+				args = append([]string{"-config", writeFile(t, tt.file, tt.content)}, args...)
+			}
+			_, err := Load(args, tt.env)
+			require.Error(t, err)
+			assert.Contains(t, err.Error(), tt.wantErr)
+		})
+	}
+}
+
+func TestLoadHelp(t *testing.T) {
+	_, err := Load([]string{"-h"}, nil)
+	assert.True(t, errors.Is(err, flag.ErrHelp))
+}
+
+func TestValidate(t *testing.T) {
+	cfg := Default()
+	require.NoError(t, cfg.Validate())
+
+	cfg.Capture.Device = ""
+	cfg.Detection.PortScanThreshold = 0
+	cfg.Firewall.Chain = "a chain with spaces"
+	cfg.Firewall.BatchWindow = Duration(-time.Second)
+	cfg.Firewall.Allowlist = []string{"10.0.0.1", "2001:db8::1"}
+	cfg.API.GRPCAddr = "localhost"
+	cfg.API.TLSKey = "key.pem"
+	cfg.Cluster.Peers = []string{"10.0.0.2:8081"}
+	cfg.Syslog.Addr = "udp://syslog.example.com:514"
+	cfg.Syslog.Buffer = 0
+	cfg.Webhook.URLs = []string{"hooks.slack.com/services/T0"}
+	cfg.Alertmanager.URLs = []string{"http://alertmanager:9093"}
+	cfg.Alertmanager.ResendInterval = 0
+	cfg.Kafka.Brokers = []string{"kafka"}
+	cfg.NATS.URL = "nats://nats:4222"
+	cfg.NATS.Linger = 0
+	cfg.Privileges.User = "root"
+	cfg.Log.Level = 9
+	err := cfg.Validate()
+	var validation *ValidationError
+	require.ErrorAs(t, err, &validation)
+	keys := make([]string, 0, len(validation.Problems))
+	for _, p := range validation.Problems {
+		keys = append(keys, p[:bytes.IndexByte([]byte(p), ':')])
+	}
+	assert.Equal(t, []string{
+		"capture.device",
+		"detection.portScanThreshold",
+		"firewall.chain",
+		"firewall.batchWindow",
+		"firewall.allowlist",
+		"api.grpcAddr",
+		"api.tlsCert",
+		"cluster.peers",
+		"cluster.secret",
+		"syslog.buffer",
+		"webhook.urls",
+		"alertmanager.resendInterval",
+		"kafka.brokers",
+		"nats.linger",
+		"privileges.user",
+		"log.level",
+	}, keys)
+}
+
+func TestValidateHTTPAuth(t *testing.T) {
+	tests := []struct {
+		addr, tokens, clientCA string
+		wantErr                bool
+	}{
+		{addr: "127.0.0.1:8081"},
+		{addr: "[::1]:8081"},
+		{addr: "localhost:8081"},
+		{addr: ":8081", wantErr: true},
+		{addr: "0.0.0.0:8081", wantErr: true},
+		{addr: "10.0.0.1:8081", wantErr: true},
+		{addr: ":8081", tokens: "tokens.txt"},
+		{addr: "10.0.0.1:8081", clientCA: "ca.pem"},
+	}
+	for _, tt := range tests {
+		cfg := Default()
+		cfg.API.HTTPAddr, cfg.API.AuthTokens, cfg.API.TLSClientCA = tt.addr, tt.tokens, tt.clientCA
+		if tt.clientCA != "" {
+			cfg.API.TLSCert, cfg.API.TLSKey = "cert.pem", "key.pem"
+		}
+		err := cfg.Validate()
+		if tt.wantErr {
+			assert.ErrorContains(t, err, "api.httpAddr: non-loopback", tt.addr)
+		} else {
+			assert.NoError(t, err, tt.addr)
+		}
+	}
+}
+
+func TestValidateGRPCAuth(t *testing.T) {
+	tests := []struct {
+		addr, tokens, clientCA string
+		wantErr                bool
+	}{
+		{addr: "127.0.0.1:8082"},
+		{addr: "[::1]:8082"},
+		{addr: "localhost:8082"},
+		{addr: ""},
+		{addr: ":8082", wantErr: true},
+		{addr: "0.0.0.0:8082", wantErr: true},
+		{addr: "10.0.0.1:8082", wantErr: true},
+		{addr: ":8082", tokens: "tokens.txt"},
+		{addr: "10.0.0.1:8082", clientCA: "ca.pem"},
+	}
+	for _, tt := range tests {
+		cfg := Default()
+		cfg.API.GRPCAddr, cfg.API.AuthTokens, cfg.API.TLSClientCA = tt.addr, tt.tokens, tt.clientCA
+		if tt.clientCA != "" {
+			cfg.API.TLSCert, cfg.API.TLSKey = "cert.pem", "key.pem"
+		}
+		err := cfg.Validate()
+		if tt.wantErr {
+			assert.ErrorContains(t, err, "api.grpcAddr: non-loopback", tt.addr)
+		} else {
+			assert.NoError(t, err, tt.addr)
+		}
+	}
+}
+
+func TestDumpRedactsSecrets(t *testing.T) {
+	cfg := Default()
+	cfg.Redis.Password = "redis-password"
+	cfg.Cluster.Secret = "cluster-secret"
+	var b bytes.Buffer
+	require.NoError(t, cfg.Dump(&b))
+	assert.NotContains(t, b.String(), "redis-password")
+	assert.NotContains(t, b.String(), "cluster-secret")
+	assert.Contains(t, b.String(), "secret: REDACTED")
+	assert.Equal(t, "cluster-secret", cfg.Cluster.Secret)
+
+	// dump can be loaded back
+	path := writeFile(t, "dump.yaml", b.String())
+	loaded, err := Load([]string{"-config", path}, nil)
+	require.NoError(t, err)
+	assert.Equal(t, cfg.Firewall, loaded.Firewall)
+
+	cfg.Webhook.URLs = []string{"https://hooks.slack.com/services/T0/B0/webhook-token"}
+	cfg.Webhook.Secret = "webhook-secret"
+	b.Reset()
+	require.NoError(t, cfg.Dump(&b))
+	assert.NotContains(t, b.String(), "webhook-token")
+	assert.NotContains(t, b.String(), "webhook-secret")
+	assert.Equal(t, "https://hooks.slack.com/services/T0/B0/webhook-token", cfg.Webhook.URLs[0])
+}
+
+func Test_envName(t *testing.T) {
+	tests := map[string]string{
+		"device":            "DEVICE",
+		"reconcileInterval": "RECONCILE_INTERVAL",
+		"tlsClientCA":       "TLS_CLIENT_CA",
+		"blockTTL":          "BLOCK_TTL",
+		"bpfFilter":         "BPF_FILTER",
+	}
+	for name, want := range tests {
+		assert.Equal(t, want, envName(name))
+	}
+}
@@ -0,0 +1,133 @@
+package config
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/rs/zerolog/log"
+	"reflect"
+	"sync"
+	"time"
+)
+
+const (
+	reloadSuccess = "success"
+	reloadFailure = "failure"
+)
+
+var (
+	reloads = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "tcptracker_config_reloads_total",
+		Help: "Config reloads by result",
+	}, []string{"result"})
+	lastReloadSuccessful = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "tcptracker_config_last_reload_successful",
+		Help: "Whether the last config reload succeeded",
+	})
+	lastReloadSuccess = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "tcptracker_config_last_reload_success_timestamp_seconds",
+		Help: "Timestamp of the last successful config reload",
+	})
+)
+
+// ReloadStatus is the result of the last reload, exposed by the API
+type ReloadStatus struct {
+	Time    time.Time `json:"time"`
+	Success bool      `json:"success"`
+	Error   string    `json:"error,omitempty"`
+	// Changed fields applied to the running tracker
+	Changed []string `json:"changed"`
+	// RestartRequired fields changed in the config but kept until the next start
+	RestartRequired []string `json:"restartRequired"`
+}
+
+// Reloader re-reads the config and applies the fields tagged with `reload:"true"` to the running tracker,
+// capture, API servers, the firewall chain and the applied blocks are not touched
+type Reloader struct {
+	current *Config
+	load    func() (*Config, error)
+	apply   func(old, new *Config) error
+	status  ReloadStatus
+	m       sync.Mutex
+}
+
+// NewReloader creates Reloader, load usually calls Load with the process arguments,
+// apply gets the running and the new config, metrics are optional
+func NewReloader(current *Config, load func() (*Config, error), apply func(old, new *Config) error,
+	metrics *prometheus.Registry) *Reloader {
+	if metrics != nil {
+		metrics.MustRegister(reloads, lastReloadSuccessful, lastReloadSuccess)
+	}
+	lastReloadSuccessful.Set(1)
+	lastReloadSuccess.SetToCurrentTime()
+	return &Reloader{
+		current: current,
+		load:    load,
+		apply:   apply,
+		status:  ReloadStatus{Time: time.Now(), Success: true, Changed: []string{}, RestartRequired: []string{}},
+	}
+}
+
+// Reload keeps the running config when the new one is invalid or cannot be applied
+func (r *Reloader) Reload() ReloadStatus {
+	r.m.Lock()
+	defer r.m.Unlock()
+	status := ReloadStatus{Time: time.Now(), Changed: []string{}, RestartRequired: []string{}}
+	next, err := r.load()
+	if err != nil {
+		return r.finish(status, err)
+	}
+	// only reloadable fields are taken, so the running config keeps describing the running tracker
+	applied := *r.current
+	current, loaded, target := r.current.fields(), next.fields(), applied.fields()
+	for i, f := range current {
+		if reflect.DeepEqual(f.value.Interface(), loaded[i].value.Interface()) {
+			continue
+		}
+		if !f.reload {
+			status.RestartRequired = append(status.RestartRequired, f.key)
+			continue
+		}
+		target[i].value.Set(loaded[i].value)
+		status.Changed = append(status.Changed, f.key)
+	}
+	if len(status.Changed) > 0 {
+		if err := r.apply(r.current, &applied); err != nil {
+			return r.finish(status, err)
+		}
+		r.current = &applied
+	}
+	return r.finish(status, nil)
+}
+
+func (r *Reloader) finish(status ReloadStatus, err error) ReloadStatus {
+	if err != nil {
+		status.Error = err.Error()
+		reloads.WithLabelValues(reloadFailure).Inc()
+		lastReloadSuccessful.Set(0)
+		log.Err(err).Msg("Config reload failed, keeping the running config")
+	} else {
+		status.Success = true
+		reloads.WithLabelValues(reloadSuccess).Inc()
+		lastReloadSuccessful.Set(1)
+		lastReloadSuccess.SetToCurrentTime()
+		log.Info().Strs("changed", status.Changed).Msg("Config reloaded")
+		if len(status.RestartRequired) > 0 {
+			log.Warn().Strs("fields", status.RestartRequired).Msg("Config changes require a restart")
+		}
+	}
+	r.status = status
+	return status
+}
+
+// Status of the last reload, the start counts as a successful one
+func (r *Reloader) Status() ReloadStatus {
+	r.m.Lock()
+	defer r.m.Unlock()
+	return r.status
+}
+
+// Current is the running config
+func (r *Reloader) Current() *Config {
+	r.m.Lock()
+	defer r.m.Unlock()
+	return r.current
+}
@@ -0,0 +1,92 @@
+package config
+
+import (
+	"errors"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"testing"
+)
+
+func TestReloader(t *testing.T) {
+	running := Default()
+	running.Capture.Device = "eth0"
+	path := writeFile(t, "config.yaml", `
+capture:
+  device: ens3
+detection:
+  portScanThreshold: 5
+firewall:
+  allowlist: [10.0.0.1]
+`)
+	var applied []*Config
+	var applyErr error
+	reloader := NewReloader(running, func() (*Config, error) {
+		return Load([]string{"-config", path, "-deviceName", "eth0"}, nil)
+	}, func(old, new *Config) error {
+		applied = append(applied, new)
+		return applyErr
+	}, prometheus.NewRegistry())
+	assert.True(t, reloader.Status().Success)
+
+	status := reloader.Reload()
+	require.True(t, status.Success, status.Error)
+	assert.Equal(t, []string{"detection.portScanThreshold", "firewall.allowlist"}, status.Changed)
+	assert.Empty(t, status.RestartRequired)
+	require.Len(t, applied, 1)
+	assert.Equal(t, 5, reloader.Current().Detection.PortScanThreshold)
+	assert.Equal(t, []string{"10.0.0.1"}, reloader.Current().Firewall.Allowlist)
+	assert.Equal(t, 3, running.Detection.PortScanThreshold, "the previous config is not modified")
+
+	// capture device is kept until restart
+	path = writeFile(t, "config.yaml", "capture:\n  device: ens3\ndetection:\n  portScanThreshold: 7\n")
+	reloader.load = func() (*Config, error) { return Load([]string{"-config", path}, nil) }
+	status = reloader.Reload()
+	require.True(t, status.Success, status.Error)
+	assert.Equal(t, []string{"detection.portScanThreshold", "firewall.allowlist"}, status.Changed)
+	assert.Equal(t, []string{"capture.device"}, status.RestartRequired)
+	assert.Equal(t, "eth0", reloader.Current().Capture.Device)
+	assert.Equal(t, 7, reloader.Current().Detection.PortScanThreshold)
+
+	// nothing to apply
+	status = reloader.Reload()
+	require.True(t, status.Success, status.Error)
+	assert.Empty(t, status.Changed)
+	assert.Len(t, applied, 2)
+	assert.Equal(t, 3.0, testutil.ToFloat64(reloads.WithLabelValues(reloadSuccess)))
+}
+
+func TestReloaderKeepsRunningConfig(t *testing.T) {
+	running := Default()
+	tests := []struct {
+		name    string
+		load    func() (*Config, error)
+		applyEr error
+	}{
+		{
+			name: "invalid config",
+			load: func() (*Config, error) { return Load([]string{"-portScanThreshold", "0"}, nil) },
+		},
+		{
+			name: "apply failed",
+			load: func() (*Config, error) {
+				c := Default()
+				c.Detection.PortScanThreshold = 10
+				return c, nil
+			},
+			applyEr: errors.New("iptables is locked"),
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			reloader := NewReloader(running, tt.load, func(old, new *Config) error { return tt.applyEr }, nil)
+			status := reloader.Reload()
+			assert.False(t, status.Success)
+			assert.NotEmpty(t, status.Error)
+			assert.Equal(t, status, reloader.Status())
+			assert.Same(t, running, reloader.Current())
+			assert.Equal(t, 0.0, testutil.ToFloat64(lastReloadSuccessful))
+		})
+	}
+}
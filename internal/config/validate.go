@@ -0,0 +1,172 @@
+package config
+
+import (
+	"fmt"
+	"net"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"tcptracker/internal/detection"
+)
+
+const (
+	// Ethernet, IPv4 and TCP headers without options
+	minSnapLen = 14 + 20 + 20
+	maxSnapLen = 65535
+	// iptables limits chain names to 28 characters
+	maxChainLen = 28
+)
+
+// builtinChains cannot hold the blocks, the tracker chain is hooked into them and removed on shutdown
+var builtinChains = map[string]bool{
+	"INPUT": true, "OUTPUT": true, "FORWARD": true, "PREROUTING": true, "POSTROUTING": true, "DOCKER-USER": true,
+}
+
+// ValidationError lists every invalid field, so all of them can be fixed at once
+type ValidationError struct {
+	Problems []string
+}
+
+func (e *ValidationError) Error() string {
+	return "invalid config:\n  " + strings.Join(e.Problems, "\n  ")
+}
+
+type validator struct {
+	problems []string
+}
+
+func (v *validator) check(ok bool, key, format string, args ...interface{}) {
+	if !ok {
+		v.problems = append(v.problems, key+": "+fmt.Sprintf(format, args...))
+	}
+}
+
+// Validate checks every field but the firewall actions and the sink options parsed by their packages,
+// see servid.ValidateConfig. It returns *ValidationError.
+func (c *Config) Validate() error {
+	v := &validator{}
+	v.check(c.Capture.Device != "", "capture.device", "is required")
+	v.check(c.Capture.SnapLen >= minSnapLen && c.Capture.SnapLen <= maxSnapLen,
+		"capture.snapLen", "must be between %d and %d, got %d", minSnapLen, maxSnapLen, c.Capture.SnapLen)
+	v.check(strings.TrimSpace(c.Capture.BPFFilter) != "", "capture.bpfFilter", "is required")
+
+	v.check(c.Detection.Window > 0, "detection.window", "must be positive, got %s", c.Detection.Window)
+	v.check(c.Detection.PortScanThreshold > 0, "detection.portScanThreshold", "must be positive, got %d", c.Detection.PortScanThreshold)
+
+	chain := c.Firewall.Chain
+	v.check(chain != "" && len(chain) <= maxChainLen && !strings.ContainsAny(chain, " \t!"),
+		"firewall.chain", "must be 1-%d characters without spaces, got %q", maxChainLen, chain)
+	v.check(!builtinChains[strings.ToUpper(chain)], "firewall.chain", "cannot be the built-in chain %s", chain)
+	v.check(c.Firewall.ReconcileInterval >= 0, "firewall.reconcileInterval", "cannot be negative")
+	v.check(c.Firewall.BatchWindow >= 0, "firewall.batchWindow", "cannot be negative")
+	v.check(c.Firewall.BlockTTL >= 0, "firewall.blockTTL", "cannot be negative")
+	for _, ip := range c.Firewall.Allowlist {
+		v.check(detection.ValidIPv4(ip), "firewall.allowlist", "must be IPv4 addresses, got %q", ip)
+	}
+
+	v.check(validAddr(c.API.HTTPAddr), "api.httpAddr", "must be host:port, got %q", c.API.HTTPAddr)
+	// anyone reaching the REST API could unblock sources, only /metrics and the health probes are public
+	v.check(!validAddr(c.API.HTTPAddr) || loopbackAddr(c.API.HTTPAddr) || c.API.AuthTokens != "" || c.API.TLSClientCA != "",
+		"api.httpAddr", "non-loopback %q requires authTokens or tlsClientCA", c.API.HTTPAddr)
+	v.check(c.API.GRPCAddr == "" || validAddr(c.API.GRPCAddr), "api.grpcAddr", "must be host:port or empty, got %q", c.API.GRPCAddr)
+	// the gRPC API has no public paths, anyone reaching it could unblock sources
+	v.check(!validAddr(c.API.GRPCAddr) || loopbackAddr(c.API.GRPCAddr) || c.API.AuthTokens != "" || c.API.TLSClientCA != "",
+		"api.grpcAddr", "non-loopback %q requires authTokens or tlsClientCA", c.API.GRPCAddr)
+	v.check((c.API.TLSCert == "") == (c.API.TLSKey == ""), "api.tlsCert", "tlsCert and tlsKey must be set together")
+	v.check(c.API.TLSClientCA == "" || c.API.TLSCert != "", "api.tlsClientCA", "requires tlsCert and tlsKey")
+	v.check(c.API.MTLSAdmins == "" || c.API.TLSClientCA != "", "api.mtlsAdmins", "requires tlsClientCA")
+	v.check(c.API.Socket == "" || filepath.IsAbs(c.API.Socket), "api.socket", "must be absolute path, got %q", c.API.Socket)
+
+	v.check(c.Redis.Addr == "" || validAddr(c.Redis.Addr), "redis.addr", "must be host:port, got %q", c.Redis.Addr)
+
+	for _, peer := range c.Cluster.Peers {
+		u, err := url.Parse(peer)
+		v.check(err == nil && (u.Scheme == "http" || u.Scheme == "https") && u.Host != "",
+			"cluster.peers", "must be http(s) URLs, got %q", peer)
+	}
+	v.check(len(c.Cluster.Peers) == 0 || c.Cluster.Secret != "", "cluster.secret", "is required with cluster.peers")
+	v.check(len(c.Cluster.Peers) == 0 || c.Cluster.NodeName != "", "cluster.nodeName", "is required with cluster.peers")
+
+	if c.Syslog.Addr != "" {
+		v.check(c.Syslog.Buffer > 0, "syslog.buffer", "must be positive, got %d", c.Syslog.Buffer)
+	}
+
+	if len(c.Webhook.URLs) > 0 {
+		for _, raw := range c.Webhook.URLs {
+			u, err := url.Parse(raw)
+			// the URL is not printed, it can hold a token
+			v.check(err == nil && (u.Scheme == "http" || u.Scheme == "https") && u.Host != "",
+				"webhook.urls", "must be http(s) URLs")
+		}
+		v.check(c.Webhook.Attempts > 0, "webhook.attempts", "must be positive, got %d", c.Webhook.Attempts)
+		v.check(c.Webhook.Timeout > 0, "webhook.timeout", "must be positive, got %s", c.Webhook.Timeout)
+		v.check(c.Webhook.RateLimit >= 0, "webhook.rateLimit", "cannot be negative")
+		v.check(c.Webhook.RateLimit == 0 || c.Webhook.Burst > 0, "webhook.burst", "must be positive with rateLimit, got %d", c.Webhook.Burst)
+		v.check(c.Webhook.DedupWindow >= 0, "webhook.dedupWindow", "cannot be negative")
+		v.check(c.Webhook.Buffer > 0, "webhook.buffer", "must be positive, got %d", c.Webhook.Buffer)
+	}
+
+	for _, raw := range c.Alertmanager.URLs {
+		u, err := url.Parse(raw)
+		v.check(err == nil && (u.Scheme == "http" || u.Scheme == "https") && u.Host != "",
+			"alertmanager.urls", "must be http(s) URLs, got %q", raw)
+	}
+	if len(c.Alertmanager.URLs) > 0 {
+		v.check(c.Alertmanager.ResendInterval > 0, "alertmanager.resendInterval", "must be positive, got %s", c.Alertmanager.ResendInterval)
+		v.check(c.Alertmanager.Timeout > 0, "alertmanager.timeout", "must be positive, got %s", c.Alertmanager.Timeout)
+		v.check(c.Alertmanager.Buffer > 0, "alertmanager.buffer", "must be positive, got %d", c.Alertmanager.Buffer)
+	}
+
+	if len(c.Kafka.Brokers) > 0 {
+		for _, broker := range c.Kafka.Brokers {
+			v.check(validAddr(broker), "kafka.brokers", "must be host:port, got %q", broker)
+		}
+		v.check(c.Kafka.TLSCA == "" || c.Kafka.TLS, "kafka.tlsCA", "requires tls")
+		v.check(strings.TrimSpace(c.Kafka.Topic) != "", "kafka.topic", "is required")
+		v.checkStream("kafka", c.Kafka.BatchSize, c.Kafka.Linger, c.Kafka.Timeout, c.Kafka.Buffer)
+	}
+	if c.NATS.URL != "" {
+		u, err := url.Parse(c.NATS.URL)
+		v.check(err == nil && (u.Scheme == "nats" || u.Scheme == "tls") && u.Port() != "",
+			"nats.url", "must be nats://host:port or tls://host:port, got %q", c.NATS.URL)
+		v.check(strings.TrimSpace(c.NATS.Subject) != "", "nats.subject", "is required")
+		v.checkStream("nats", c.NATS.BatchSize, c.NATS.Linger, c.NATS.Timeout, c.NATS.Buffer)
+	}
+
+	user := c.Privileges.User
+	v.check(user != "root" && user != "0", "privileges.user", "must be unprivileged user, got %q", user)
+
+	// zerolog levels from trace to panic
+	v.check(c.Log.Level >= -1 && c.Log.Level <= 5, "log.level", "must be between -1 (trace) and 5 (panic), got %d", c.Log.Level)
+
+	if len(v.problems) > 0 {
+		return &ValidationError{Problems: v.problems}
+	}
+	return nil
+}
+
+// checkStream checks the fields shared by the Kafka and NATS sections
+func (v *validator) checkStream(section string, batchSize int, linger Duration, timeout Duration, buffer int) {
+	v.check(batchSize > 0, section+".batchSize", "must be positive, got %d", batchSize)
+	v.check(linger > 0, section+".linger", "must be positive, got %s", linger)
+	v.check(timeout > 0, section+".timeout", "must be positive, got %s", timeout)
+	v.check(buffer > 0, section+".buffer", "must be positive, got %d", buffer)
+}
+
+// loopbackAddr tells the host of the address is localhost or a loopback IP, empty host listens on all the interfaces
+func loopbackAddr(addr string) bool {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return false
+	}
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+func validAddr(addr string) bool {
+	_, port, err := net.SplitHostPort(addr)
+	return err == nil && port != ""
+}
@@ -0,0 +1,197 @@
+package connectiontracker
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"tcptracker/internal/detection"
+)
+
+const (
+	drop      = "DROP"
+	reject    = "REJECT"
+	tarpit    = "TARPIT"
+	rateLimit = "RATELIMIT"
+
+	// defaultRateLimit is used by ratelimit Action when no rate is given, e.g. `ratelimit` instead of `ratelimit:5/minute`
+	defaultRateLimit = "10/minute"
+	// hashlimit names are limited in length by the kernel, shared table is fine because buckets are per source IP
+	hashLimitName = "tcptracker"
+)
+
+// rateUnits of hashlimit, the rate is <number>/<unit>
+var rateUnits = map[string]bool{"second": true, "minute": true, "hour": true, "day": true}
+
+// Action describes how the firewall answers a blocked source IP
+type Action interface {
+	// Name of the action in upper case, e.g. DROP, used in logs and the block events, the configuration ignores the case
+	Name() string
+	// RuleSpec returns iptables rule spec for the given source IP
+	RuleSpec(ip string) []string
+}
+
+type dropAction struct{}
+
+func (dropAction) Name() string { return drop }
+
+func (dropAction) RuleSpec(ip string) []string {
+	return []string{"-s", ip, "-j", drop}
+}
+
+// rejectAction answers with TCP RST, so the scanner sees closed ports instead of filtered ones
+type rejectAction struct{}
+
+func (rejectAction) Name() string { return reject }
+
+func (rejectAction) RuleSpec(ip string) []string {
+	return []string{"-s", ip, "-p", "tcp", "-j", reject, "--reject-with", "tcp-reset"}
+}
+
+// rateLimitAction drops only the new connections above the rate using `hashlimit` module
+type rateLimitAction struct {
+	rate string
+}
+
+func (rateLimitAction) Name() string { return rateLimit }
+
+func (a rateLimitAction) RuleSpec(ip string) []string {
+	return []string{
+		"-s", ip,
+		"-m", "hashlimit",
+		"--hashlimit-above", a.rate,
+		"--hashlimit-mode", "srcip",
+		"--hashlimit-name", hashLimitName,
+		"-j", drop,
+	}
+}
+
+// tarpitAction holds the connection open with zero window to slow the scanner down, requires xtables-addons
+type tarpitAction struct{}
+
+func (tarpitAction) Name() string { return tarpit }
+
+func (tarpitAction) RuleSpec(ip string) []string {
+	return []string{"-s", ip, "-p", "tcp", "-j", tarpit}
+}
+
+// ParseAction returns Action by its name: drop, reject, tarpit, ratelimit or ratelimit:<rate> e.g. ratelimit:5/minute
+func ParseAction(name string) (Action, error) {
+	name, arg, _ := strings.Cut(strings.TrimSpace(name), ":")
+	switch strings.ToUpper(name) {
+	case drop:
+		return dropAction{}, nil
+	case reject:
+		return rejectAction{}, nil
+	case tarpit:
+		return tarpitAction{}, nil
+	case rateLimit:
+		if arg == "" {
+			arg = defaultRateLimit
+		}
+		if err := validRate(arg); err != nil {
+			return nil, err
+		}
+		return rateLimitAction{rate: arg}, nil
+	}
+	return nil, fmt.Errorf("unknown firewall action: %q", name)
+}
+
+// validRate checks the rate of ratelimit, iptables would reject it only when the block is applied
+func validRate(rate string) error {
+	amount, unit, _ := strings.Cut(rate, "/")
+	if n, err := strconv.Atoi(amount); err != nil || n < 1 || !rateUnits[unit] {
+		return fmt.Errorf("invalid ratelimit rate %q, expected <number>/<second|minute|hour|day> e.g. 5/minute", rate)
+	}
+	return nil
+}
+
+// ScoreTier applies Action for detections with score equal or higher than MinScore
+type ScoreTier struct {
+	MinScore int
+	Action   Action
+}
+
+// ActionPolicy decides which Action is used for a Detection
+// detection.Type has precedence over score tiers, Default is used when nothing else matches
+type ActionPolicy struct {
+	Default Action
+	ByType  map[detection.Type]Action
+	Tiers   []ScoreTier
+}
+
+// DefaultActionPolicy drops all the detected IPs
+func DefaultActionPolicy() ActionPolicy {
+	return ActionPolicy{Default: dropAction{}}
+}
+
+// Resolve returns the Action for the Detection
+func (p ActionPolicy) Resolve(d detection.Detection) Action {
+	if a, ok := p.ByType[d.Type]; ok {
+		return a
+	}
+	tiers := make([]ScoreTier, len(p.Tiers))
+	copy(tiers, p.Tiers)
+	sort.Slice(tiers, func(i, j int) bool {
+		return tiers[i].MinScore > tiers[j].MinScore
+	})
+	for _, tier := range tiers {
+		if d.Score >= tier.MinScore {
+			return tier.Action
+		}
+	}
+	if p.Default == nil {
+		return dropAction{}
+	}
+	return p.Default
+}
+
+// ParseActionPolicy builds ActionPolicy from the flag values
+// byType is a list of `type=action` e.g. `portscan=reject`, tiers is a list of `minScore=action` e.g. `10=ratelimit,50=tarpit`
+func ParseActionPolicy(defaultAction, byType, tiers string) (ActionPolicy, error) {
+	policy := ActionPolicy{ByType: make(map[detection.Type]Action)}
+	a, err := ParseAction(defaultAction)
+	if err != nil {
+		return policy, err
+	}
+	policy.Default = a
+	errType := parsePairs(byType, func(key string, a Action) error {
+		policy.ByType[detection.Type(key)] = a
+		return nil
+	})
+	if errType != nil {
+		return policy, errType
+	}
+	errTiers := parsePairs(tiers, func(key string, a Action) error {
+		minScore, err := strconv.Atoi(key)
+		if err != nil {
+			return fmt.Errorf("invalid score tier %q: %w", key, err)
+		}
+		policy.Tiers = append(policy.Tiers, ScoreTier{MinScore: minScore, Action: a})
+		return nil
+	})
+	if errTiers != nil {
+		return policy, errTiers
+	}
+	return policy, nil
+}
+
+func parsePairs(list string, add func(key string, a Action) error) error {
+	for _, pair := range strings.Split(list, ",") {
+		if strings.TrimSpace(pair) == "" {
+			continue
+		}
+		key, name, ok := strings.Cut(pair, "=")
+		if !ok {
+			return fmt.Errorf("invalid action mapping %q, expected key=action", pair)
+		}
+		a, err := ParseAction(name)
+		if err != nil {
+			return err
+		}
+		if err := add(strings.TrimSpace(key), a); err != nil {
+			return err
+		}
+	}
+	return nil
+}
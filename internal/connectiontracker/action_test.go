@@ -0,0 +1,115 @@
+package connectiontracker
+
+import (
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"strings"
+	"tcptracker/internal/detection"
+	"testing"
+)
+
+func TestParseAction(t *testing.T) {
+	tests := []struct {
+		name     string
+		want     Action
+		wantRule []string
+		wantErr  bool
+	}{
+		{
+			name:     "drop",
+			want:     dropAction{},
+			wantRule: []string{"-s", "10.0.0.1", "-j", "DROP"},
+		},
+		{
+			name:     "REJECT",
+			want:     rejectAction{},
+			wantRule: []string{"-s", "10.0.0.1", "-p", "tcp", "-j", "REJECT", "--reject-with", "tcp-reset"},
+		},
+		{
+			name:     "tarpit",
+			want:     tarpitAction{},
+			wantRule: []string{"-s", "10.0.0.1", "-p", "tcp", "-j", "TARPIT"},
+		},
+		{
+			name: "ratelimit",
+			want: rateLimitAction{rate: defaultRateLimit},
+			wantRule: []string{"-s", "10.0.0.1", "-m", "hashlimit", "--hashlimit-above", "10/minute",
+				"--hashlimit-mode", "srcip", "--hashlimit-name", "tcptracker", "-j", "DROP"},
+		},
+		{
+			name: "ratelimit:5/second",
+			want: rateLimitAction{rate: "5/second"},
+		},
+		{
+			name:    "accept",
+			wantErr: true,
+		},
+		{name: "ratelimit:5", wantErr: true},
+		{name: "ratelimit:five/second", wantErr: true},
+		{name: "ratelimit:0/minute", wantErr: true},
+		{name: "ratelimit:5/week", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ParseAction(tt.name)
+			if tt.wantErr {
+				require.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.want, got)
+			name, _, _ := strings.Cut(tt.name, ":")
+			assert.Equal(t, strings.ToUpper(name), got.Name(), "names are reported in upper case")
+			if tt.wantRule != nil {
+				assert.Equal(t, tt.wantRule, got.RuleSpec("10.0.0.1"))
+			}
+		})
+	}
+}
+
+func TestActionPolicy_Resolve(t *testing.T) {
+	policy := ActionPolicy{
+		Default: dropAction{},
+		ByType: map[detection.Type]Action{
+			"honeyport": tarpitAction{},
+		},
+		Tiers: []ScoreTier{
+			{MinScore: 10, Action: rateLimitAction{rate: defaultRateLimit}},
+			{MinScore: 50, Action: rejectAction{}},
+		},
+	}
+	tests := []struct {
+		name string
+		d    detection.Detection
+		want Action
+	}{
+		{name: "default", d: detection.Detection{Type: detection.PortScan, Score: 4}, want: dropAction{}},
+		{name: "lower tier", d: detection.Detection{Type: detection.PortScan, Score: 10}, want: rateLimitAction{rate: defaultRateLimit}},
+		{name: "higher tier", d: detection.Detection{Type: detection.PortScan, Score: 70}, want: rejectAction{}},
+		{name: "by type wins", d: detection.Detection{Type: "honeyport", Score: 70}, want: tarpitAction{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.want, policy.Resolve(tt.d))
+		})
+	}
+	assert.Equal(t, dropAction{}, ActionPolicy{}.Resolve(detection.Detection{}))
+}
+
+func TestParseActionPolicy(t *testing.T) {
+	policy, err := ParseActionPolicy("reject", "portscan=tarpit", "10=ratelimit:1/second, 50=drop")
+	require.NoError(t, err)
+	assert.Equal(t, rejectAction{}, policy.Default)
+	assert.Equal(t, tarpitAction{}, policy.ByType[detection.PortScan])
+	assert.Equal(t, []ScoreTier{
+		{MinScore: 10, Action: rateLimitAction{rate: "1/second"}},
+		{MinScore: 50, Action: dropAction{}},
+	}, policy.Tiers)
+
+	_, err = ParseActionPolicy("drop", "portscan", "")
+	require.Error(t, err)
+	_, err = ParseActionPolicy("drop", "", "ten=reject")
+	require.Error(t, err)
+	_, err = ParseActionPolicy("nope", "", "")
+	require.Error(t, err)
+}
@@ -0,0 +1,252 @@
+package connectiontracker
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/rs/zerolog/log"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+const (
+	dockerSocket   = "/var/run/docker.sock"
+	procPath       = "/proc"
+	netnsPath      = "/var/run/netns"
+	ownersRefresh  = 30 * time.Second
+	dockerTimeout  = 2 * time.Second
+	dockerOwnerFmt = "container:%s"
+	netnsOwnerFmt  = "netns:%s"
+)
+
+// Attributor tells who owns the destination IP, e.g. a container or a network namespace
+type Attributor interface {
+	// Owner returns empty string when the IP is not owned by any known workload
+	Owner(ip string) string
+}
+
+// ownerSource returns mapping of IP -> owner
+type ownerSource func(ctx context.Context) (map[string]string, error)
+
+// ownerResolver refreshes the owners from the sources in the background, so Owner never waits for them,
+// first source wins when the IP is found in many. A failed source keeps its last owners, e.g. the Docker socket
+// and /proc of other processes cannot be read after the privileges are dropped.
+type ownerResolver struct {
+	sources []ownerSource
+	refresh time.Duration
+	// found are the last owners of every source, unavailable sources are logged once until they recover
+	found       []map[string]string
+	unavailable []bool
+	owners      map[string]string
+	updated     time.Time
+	refreshing  bool
+	m           sync.Mutex
+}
+
+// NewAttributor returns Attributor for containers from Docker API and for network namespaces,
+// the owners are loaded right away, before the privileges are dropped
+func NewAttributor() Attributor {
+	r := &ownerResolver{
+		sources: []ownerSource{
+			dockerOwners(dockerSocket),
+			netnsOwners(procPath, netnsPath),
+		},
+		refresh: ownersRefresh,
+	}
+	r.load()
+	return r
+}
+
+func (r *ownerResolver) Owner(ip string) string {
+	r.m.Lock()
+	defer r.m.Unlock()
+	if !r.refreshing && time.Since(r.updated) > r.refresh {
+		r.refreshing = true
+		go r.load()
+	}
+	return r.owners[ip]
+}
+
+func (r *ownerResolver) load() {
+	ctx, cancel := context.WithTimeout(context.Background(), dockerTimeout)
+	defer cancel()
+	found := make([]map[string]string, len(r.sources))
+	errs := make([]error, len(r.sources))
+	for i, source := range r.sources {
+		found[i], errs[i] = source(ctx)
+	}
+
+	r.m.Lock()
+	defer r.m.Unlock()
+	if r.found == nil {
+		r.found = make([]map[string]string, len(r.sources))
+		r.unavailable = make([]bool, len(r.sources))
+	}
+	owners := make(map[string]string)
+	for i, err := range errs {
+		switch {
+		case err == nil:
+			r.found[i] = found[i]
+			r.unavailable[i] = false
+		case !r.unavailable[i]:
+			log.Warn().Err(err).Msg("Cannot load destination owners, detections keep the last known ones")
+			r.unavailable[i] = true
+		default:
+			log.Debug().Err(err).Msg("Cannot load destination owners")
+		}
+		for ip, owner := range r.found[i] {
+			if _, ok := owners[ip]; !ok {
+				owners[ip] = owner
+			}
+		}
+	}
+	r.owners = owners
+	r.updated = time.Now()
+	r.refreshing = false
+}
+
+type dockerContainer struct {
+	Names           []string `json:"Names"`
+	NetworkSettings struct {
+		Networks map[string]struct {
+			IPAddress string `json:"IPAddress"`
+		} `json:"Networks"`
+	} `json:"NetworkSettings"`
+}
+
+// dockerOwners lists running containers using Docker Engine API over the unix socket
+func dockerOwners(socket string) ownerSource {
+	client := &http.Client{
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				var d net.Dialer
+				return d.DialContext(ctx, "unix", socket)
+			},
+		},
+	}
+	return func(ctx context.Context) (map[string]string, error) {
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, "http://docker/containers/json", nil)
+		if err != nil {
+			return nil, err
+		}
+		resp, err := client.Do(req)
+		if err != nil {
+			return nil, err
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			return nil, fmt.Errorf("docker API returned %s", resp.Status)
+		}
+		var containers []dockerContainer
+		if err := json.NewDecoder(resp.Body).Decode(&containers); err != nil {
+			return nil, err
+		}
+		owners := make(map[string]string)
+		for _, c := range containers {
+			name := ""
+			if len(c.Names) > 0 {
+				name = strings.TrimPrefix(c.Names[0], "/")
+			}
+			for _, network := range c.NetworkSettings.Networks {
+				if network.IPAddress != "" {
+					owners[network.IPAddress] = fmt.Sprintf(dockerOwnerFmt, name)
+				}
+			}
+		}
+		return owners, nil
+	}
+}
+
+// netnsOwners finds local addresses of every network namespace other than the host one
+// Namespaces are discovered from processes, named ones (ip netns add) are matched by inode with netns bind mounts
+func netnsOwners(proc, named string) ownerSource {
+	return func(_ context.Context) (map[string]string, error) {
+		hostNs, err := os.Readlink(filepath.Join(proc, "self", "ns", "net"))
+		if err != nil {
+			return nil, err
+		}
+		names := namedNetns(named)
+		pids, err := filepath.Glob(filepath.Join(proc, "[0-9]*"))
+		if err != nil {
+			return nil, err
+		}
+		owners := make(map[string]string)
+		seen := map[string]bool{hostNs: true}
+		for _, pid := range pids {
+			ns, err := os.Readlink(filepath.Join(pid, "ns", "net"))
+			if err != nil || seen[ns] {
+				continue
+			}
+			seen[ns] = true
+			owner := names[nsInode(ns)]
+			if owner == "" {
+				comm, _ := os.ReadFile(filepath.Join(pid, "comm"))
+				owner = fmt.Sprintf("%s(%s)", nsInode(ns), strings.TrimSpace(string(comm)))
+			}
+			f, err := os.Open(filepath.Join(pid, "net", "fib_trie"))
+			if err != nil {
+				continue
+			}
+			for _, ip := range localAddresses(f) {
+				owners[ip] = fmt.Sprintf(netnsOwnerFmt, owner)
+			}
+			_ = f.Close()
+		}
+		return owners, nil
+	}
+}
+
+// namedNetns returns inode -> name of the namespaces created with `ip netns add`
+func namedNetns(dir string) map[string]string {
+	names := make(map[string]string)
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return names
+	}
+	for _, e := range entries {
+		info, err := os.Stat(filepath.Join(dir, e.Name()))
+		if err != nil {
+			continue
+		}
+		if st, ok := info.Sys().(*syscall.Stat_t); ok {
+			names[fmt.Sprint(st.Ino)] = e.Name()
+		}
+	}
+	return names
+}
+
+// nsInode takes `net:[4026531992]` and returns `4026531992`
+func nsInode(link string) string {
+	return strings.TrimSuffix(strings.TrimPrefix(link, "net:["), "]")
+}
+
+// localAddresses parses /proc/<pid>/net/fib_trie and returns the non loopback `/32 host LOCAL` addresses
+func localAddresses(r io.Reader) []string {
+	var result []string
+	seen := make(map[string]bool)
+	last := ""
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if strings.HasPrefix(line, "|--") {
+			last = strings.TrimSpace(strings.TrimPrefix(line, "|--"))
+			continue
+		}
+		if strings.HasPrefix(line, "/32 host LOCAL") && last != "" {
+			ip := net.ParseIP(last)
+			if ip != nil && !ip.IsLoopback() && !seen[last] {
+				seen[last] = true
+				result = append(result, last)
+			}
+		}
+	}
+	return result
+}
@@ -0,0 +1,108 @@
+package connectiontracker
+
+import (
+	"context"
+	"errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+const testFibTrie = `Main:
+  +-- 0.0.0.0/0 3 0 5
+     |-- 0.0.0.0
+        /0 universe UNICAST
+     +-- 127.0.0.0/8 2 0 2
+        +-- 127.0.0.0/31 1 0 0
+           |-- 127.0.0.0
+              /8 host LOCAL
+           |-- 127.0.0.1
+              /32 host LOCAL
+     +-- 172.18.0.0/16 2 0 2
+        |-- 172.18.0.0
+           /16 link UNICAST
+        |-- 172.18.0.5
+           /32 host LOCAL
+Local:
+  +-- 0.0.0.0/0 3 0 5
+        |-- 172.18.0.5
+           /32 host LOCAL
+`
+
+func Test_localAddresses(t *testing.T) {
+	assert.Equal(t, []string{"172.18.0.5"}, localAddresses(strings.NewReader(testFibTrie)))
+}
+
+func Test_nsInode(t *testing.T) {
+	assert.Equal(t, "4026531992", nsInode("net:[4026531992]"))
+}
+
+func Test_dockerOwners(t *testing.T) {
+	socket := filepath.Join(t.TempDir(), "docker.sock")
+	listener, err := net.Listen("unix", socket)
+	require.NoError(t, err)
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/containers/json", r.URL.Path)
+		_, _ = w.Write([]byte(`[{"Names":["/web"],"NetworkSettings":{"Networks":{"bridge":{"IPAddress":"172.17.0.2"}}}}]`))
+	}))
+	server.Listener = listener
+	server.Start()
+	defer server.Close()
+
+	owners, err := dockerOwners(socket)(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, map[string]string{"172.17.0.2": "container:web"}, owners)
+}
+
+func Test_ownerResolver(t *testing.T) {
+	var calls int32
+	loading := make(chan struct{})
+	r := &ownerResolver{
+		sources: []ownerSource{
+			func(ctx context.Context) (map[string]string, error) {
+				if atomic.AddInt32(&calls, 1) > 1 {
+					// e.g. the Docker socket after the privileges are dropped
+					<-loading
+					return nil, errors.New("permission denied")
+				}
+				return map[string]string{"10.0.0.2": "container:db"}, nil
+			},
+			func(ctx context.Context) (map[string]string, error) {
+				return nil, errors.New("not available")
+			},
+			func(ctx context.Context) (map[string]string, error) {
+				return map[string]string{"10.0.0.2": "netns:other", "10.0.0.3": "netns:vm1"}, nil
+			},
+		},
+		refresh: time.Minute,
+	}
+	r.load()
+	assert.Equal(t, "container:db", r.Owner("10.0.0.2"))
+	assert.Equal(t, "netns:vm1", r.Owner("10.0.0.3"))
+	assert.Equal(t, "", r.Owner("10.0.0.4"))
+	assert.Equal(t, int32(1), atomic.LoadInt32(&calls))
+
+	// the refresh does not block the detection
+	r.m.Lock()
+	r.updated = time.Now().Add(-2 * time.Minute)
+	r.m.Unlock()
+	assert.Equal(t, "container:db", r.Owner("10.0.0.2"))
+	assert.Equal(t, "container:db", r.Owner("10.0.0.2"))
+	close(loading)
+	require.Eventually(t, func() bool {
+		r.m.Lock()
+		defer r.m.Unlock()
+		return !r.refreshing
+	}, time.Second, 5*time.Millisecond)
+	assert.Equal(t, int32(2), atomic.LoadInt32(&calls), "refreshed once")
+	// the failed source keeps its owners
+	assert.Equal(t, "container:db", r.Owner("10.0.0.2"))
+	assert.Equal(t, []bool{true, true, false}, r.unavailable)
+}
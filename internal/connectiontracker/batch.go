@@ -0,0 +1,208 @@
+package connectiontracker
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/rs/zerolog/log"
+	"os/exec"
+	"regexp"
+	"strconv"
+	"strings"
+	"tcptracker/internal/detection"
+	"tcptracker/internal/events"
+	"time"
+)
+
+const (
+	batchQueueSize = 1024
+	maxBatchSize   = 512
+)
+
+var (
+	batchEntries = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "tcptracker_firewall_batch_entries_total",
+		Help: "Firewall block entries applied with iptables-restore by result",
+	}, []string{"result"})
+	// both legacy `line 3 failed` and nft `line 3: RULE_APPEND failed` formats
+	restoreFailedLine = regexp.MustCompile(`line (\d+)`)
+)
+
+// ruleRestorer applies iptables-restore formatted rules in a single transaction
+type ruleRestorer interface {
+	Restore(rules []byte) error
+}
+
+// iptablesRestore runs `iptables-restore --noflush`, existing rules and chains are kept
+type iptablesRestore struct {
+	path string
+}
+
+func newIptablesRestore() (*iptablesRestore, error) {
+	path, err := exec.LookPath("iptables-restore")
+	if err != nil {
+		return nil, err
+	}
+	return &iptablesRestore{path: path}, nil
+}
+
+func (r *iptablesRestore) Restore(rules []byte) error {
+	cmd := exec.Command(r.path, "--noflush", "--wait")
+	cmd.Stdin = bytes.NewReader(rules)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("%s: %w", strings.TrimSpace(stderr.String()), err)
+	}
+	return nil
+}
+
+// blockRequest is a queued Block, old is the rule to replace when the IP is blocked with a different Action
+type blockRequest struct {
+	d     detection.Detection
+	rule  []string
+	old   []string
+	block detection.Block
+}
+
+// batchLoop collects queued blocks during the window and applies them together
+func (fw *IPTables) batchLoop(done <-chan struct{}, queue <-chan blockRequest, window time.Duration) {
+	var batch []blockRequest
+	timer := time.NewTimer(window)
+	timer.Stop()
+	for {
+		select {
+		case <-done:
+			timer.Stop()
+			return
+		case req := <-queue:
+			if len(batch) == 0 {
+				timer.Reset(window)
+			}
+			batch = append(batch, req)
+			if len(batch) < maxBatchSize {
+				continue
+			}
+			if !timer.Stop() {
+				<-timer.C
+			}
+			fw.applyBatch(batch)
+			batch = nil
+		case <-timer.C:
+			fw.applyBatch(batch)
+			batch = nil
+		}
+	}
+}
+
+// applyBatch applies the blocks with a single iptables-restore transaction, the transaction is atomic,
+// so the failing entry is taken out using the line number from the error and the rest is retried
+func (fw *IPTables) applyBatch(batch []blockRequest) {
+	fw.apply.Lock()
+	defer fw.apply.Unlock()
+	remaining := fw.deleteReplaced(batch)
+	for len(remaining) > 0 {
+		input, lineOwners := restoreInput(fw.chainName(), remaining)
+		err := fw.restorer.Restore(input)
+		if err == nil {
+			for _, req := range remaining {
+				fw.batchResult(req, nil)
+			}
+			log.Info().Msgf("Firewall batch of %d blocks applied", len(remaining))
+			return
+		}
+		idx, ok := failedEntry(err, lineOwners)
+		if !ok {
+			// cannot tell which entry failed, falling back to one by one
+			for _, req := range remaining {
+				fw.batchResult(req, fw.applyOne(req))
+			}
+			return
+		}
+		fw.batchResult(remaining[idx], err)
+		remaining = append(remaining[:idx:idx], remaining[idx+1:]...)
+	}
+}
+
+// deleteReplaced removes the old rules of the IPs blocked with a different Action before the transaction like
+// applyOne does, iptables-restore fails the whole transaction on a -D of a rule removed meanwhile
+func (fw *IPTables) deleteReplaced(batch []blockRequest) []blockRequest {
+	remaining := make([]blockRequest, 0, len(batch))
+	for _, req := range batch {
+		if req.old != nil {
+			if err := fw.iptables.DeleteIfExists(table, fw.chainName(), req.old...); err != nil {
+				fw.batchResult(req, err)
+				continue
+			}
+		}
+		remaining = append(remaining, req)
+	}
+	return remaining
+}
+
+func (fw *IPTables) applyOne(req blockRequest) error {
+	if req.old != nil {
+		if err := fw.iptables.DeleteIfExists(table, fw.chainName(), req.old...); err != nil {
+			return err
+		}
+	}
+	return fw.iptables.AppendUnique(table, fw.chainName(), req.rule...)
+}
+
+func (fw *IPTables) batchResult(req blockRequest, err error) {
+	fw.m.Lock()
+	defer fw.m.Unlock()
+	pending, ok := fw.pending[req.d.IP]
+	if ok && strings.Join(pending, " ") == strings.Join(req.rule, " ") {
+		delete(fw.pending, req.d.IP)
+	}
+	firewallOpResult(opBlock, err)
+	if err != nil {
+		batchEntries.WithLabelValues("failed").Inc()
+		log.Err(err).Msgf("Blocking %s failed, detection %s score %d", req.d.IP, req.d.Type, req.d.Score)
+		return
+	}
+	batchEntries.WithLabelValues("applied").Inc()
+	if fw.closed {
+		return
+	}
+	if !ok {
+		// unblocked while waiting in the batch
+		if errDelete := fw.iptables.DeleteIfExists(table, fw.chainName(), req.rule...); errDelete != nil {
+			log.Err(errDelete).Msgf("Cannot remove cancelled block of %s", req.d.IP)
+		}
+		return
+	}
+	fw.blocked[req.d.IP] = req.rule
+	fw.blocks[req.d.IP] = req.block
+	observeBlockLatency(req.d)
+	fw.publish(events.Block, req.block)
+}
+
+// restoreInput returns iptables-restore input appending the rules and request index for every line number (1 based)
+func restoreInput(chain string, batch []blockRequest) ([]byte, map[int]int) {
+	var b bytes.Buffer
+	lineOwners := make(map[int]int)
+	line := 1
+	b.WriteString("*" + table + "\n")
+	for i, req := range batch {
+		line++
+		lineOwners[line] = i
+		b.WriteString(strings.Join(append([]string{"-A", chain}, req.rule...), " ") + "\n")
+	}
+	b.WriteString("COMMIT\n")
+	return b.Bytes(), lineOwners
+}
+
+func failedEntry(err error, lineOwners map[int]int) (int, bool) {
+	match := restoreFailedLine.FindStringSubmatch(err.Error())
+	if match == nil {
+		return 0, false
+	}
+	line, errConv := strconv.Atoi(match[1])
+	if errConv != nil {
+		return 0, false
+	}
+	idx, ok := lineOwners[line]
+	return idx, ok
+}
@@ -0,0 +1,169 @@
+package connectiontracker
+
+import (
+	"fmt"
+	"github.com/golang/mock/gomock"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"strings"
+	"sync"
+	"tcptracker/internal/detection"
+	mock2 "tcptracker/mock"
+	"testing"
+	"time"
+)
+
+// fakeRestorer fails every transaction containing a line from failing
+type fakeRestorer struct {
+	inputs  []string
+	failing string
+	m       sync.Mutex
+}
+
+func (r *fakeRestorer) Restore(rules []byte) error {
+	r.m.Lock()
+	defer r.m.Unlock()
+	r.inputs = append(r.inputs, string(rules))
+	if r.failing == "" {
+		return nil
+	}
+	for i, line := range strings.Split(string(rules), "\n") {
+		if line == r.failing {
+			return fmt.Errorf("iptables-restore: line %d failed: exit status 1", i+1)
+		}
+	}
+	return nil
+}
+
+func (r *fakeRestorer) calls() []string {
+	r.m.Lock()
+	defer r.m.Unlock()
+	return append([]string(nil), r.inputs...)
+}
+
+func newBatchFirewall(restorer ruleRestorer, iptables ipTableCoreos) *IPTables {
+	return &IPTables{
+		iptables: iptables,
+		policy:   DefaultActionPolicy(),
+		blocked:  make(map[string][]string),
+		pending:  make(map[string][]string),
+		blocks:   make(map[string]detection.Block),
+		restorer: restorer,
+		queue:    make(chan blockRequest, batchQueueSize),
+		done:     make(chan struct{}),
+	}
+}
+
+func TestBlockInBatch(t *testing.T) {
+	restorer := &fakeRestorer{}
+	fw := newBatchFirewall(restorer, nil)
+	go fw.batchLoop(fw.done, fw.queue, 50*time.Millisecond)
+	defer close(fw.done)
+
+	for _, ip := range []string{"10.0.0.1", "10.0.0.2", "10.0.0.1"} {
+		require.NoError(t, fw.Block(detection.Detection{IP: ip, Type: detection.PortScan, Score: 4}))
+	}
+	require.Eventually(t, func() bool { return len(restorer.calls()) == 1 }, time.Second, 10*time.Millisecond)
+	assert.Equal(t, "*filter\n-A tcptracker -s 10.0.0.1 -j DROP\n-A tcptracker -s 10.0.0.2 -j DROP\nCOMMIT\n", restorer.calls()[0])
+	require.Eventually(t, func() bool {
+		fw.m.Lock()
+		defer fw.m.Unlock()
+		return len(fw.blocked) == 2 && len(fw.pending) == 0
+	}, time.Second, 10*time.Millisecond)
+}
+
+func TestApplyBatchReportsFailedEntry(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+	mockIptables := mock2.NewMockIptablesMock(mockCtrl)
+	restorer := &fakeRestorer{failing: "-A tcptracker -s 10.0.0.2 -j DROP"}
+	fw := newBatchFirewall(restorer, mockIptables)
+	mockIptables.EXPECT().DeleteIfExists(table, trackerChain, rejectAction{}.RuleSpec("10.0.0.3")).Return(nil).Times(1)
+	failedBefore := testutil.ToFloat64(batchEntries.WithLabelValues("failed"))
+	appliedBefore := testutil.ToFloat64(batchEntries.WithLabelValues("applied"))
+
+	batch := []blockRequest{
+		{d: detection.Detection{IP: "10.0.0.1"}, rule: dropAction{}.RuleSpec("10.0.0.1")},
+		{d: detection.Detection{IP: "10.0.0.2"}, rule: dropAction{}.RuleSpec("10.0.0.2")},
+		{d: detection.Detection{IP: "10.0.0.3"}, rule: dropAction{}.RuleSpec("10.0.0.3"), old: rejectAction{}.RuleSpec("10.0.0.3")},
+	}
+	for _, req := range batch {
+		fw.pending[req.d.IP] = req.rule
+	}
+	fw.applyBatch(batch)
+
+	calls := restorer.calls()
+	require.Len(t, calls, 2)
+	assert.NotContains(t, calls[1], "10.0.0.2")
+	assert.Contains(t, calls[1], "-A tcptracker -s 10.0.0.3 -j DROP\n")
+	for _, call := range calls {
+		assert.NotContains(t, call, "-D ")
+	}
+	assert.Equal(t, failedBefore+1, testutil.ToFloat64(batchEntries.WithLabelValues("failed")))
+	assert.Equal(t, appliedBefore+2, testutil.ToFloat64(batchEntries.WithLabelValues("applied")))
+	assert.Len(t, fw.blocked, 2)
+	assert.NotContains(t, fw.blocked, "10.0.0.2")
+}
+
+func TestApplyBatchDeleteOfReplacedRuleFails(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+	mockIptables := mock2.NewMockIptablesMock(mockCtrl)
+	restorer := &fakeRestorer{}
+	fw := newBatchFirewall(restorer, mockIptables)
+	old := rejectAction{}.RuleSpec("10.0.0.3")
+	mockIptables.EXPECT().DeleteIfExists(table, trackerChain, old).Return(fmt.Errorf("exit status 4"))
+
+	batch := []blockRequest{
+		{d: detection.Detection{IP: "10.0.0.1"}, rule: dropAction{}.RuleSpec("10.0.0.1")},
+		{d: detection.Detection{IP: "10.0.0.3"}, rule: dropAction{}.RuleSpec("10.0.0.3"), old: old},
+	}
+	for _, req := range batch {
+		fw.pending[req.d.IP] = req.rule
+	}
+	fw.applyBatch(batch)
+
+	assert.Equal(t, []string{"*filter\n-A tcptracker -s 10.0.0.1 -j DROP\nCOMMIT\n"}, restorer.calls())
+	assert.Contains(t, fw.blocked, "10.0.0.1")
+	assert.NotContains(t, fw.blocked, "10.0.0.3")
+	assert.Empty(t, fw.pending)
+}
+
+func TestApplyBatchFallsBackToSingleEntries(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+	mockIptables := mock2.NewMockIptablesMock(mockCtrl)
+
+	restorer := &fakeRestorer{failing: "*filter"}
+	fw := newBatchFirewall(restorer, mockIptables)
+	rule := dropAction{}.RuleSpec("10.0.0.1")
+	mockIptables.EXPECT().AppendUnique(table, trackerChain, rule).Return(nil).Times(1)
+
+	fw.pending["10.0.0.1"] = rule
+	fw.applyBatch([]blockRequest{{d: detection.Detection{IP: "10.0.0.1"}, rule: rule}})
+	assert.Equal(t, rule, fw.blocked["10.0.0.1"])
+}
+
+func TestUnblockCancelsQueuedBlock(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+	mockIptables := mock2.NewMockIptablesMock(mockCtrl)
+
+	fw := newBatchFirewall(&fakeRestorer{}, mockIptables)
+	rule := dropAction{}.RuleSpec("10.0.0.1")
+	mockIptables.EXPECT().DeleteIfExists(table, trackerChain, rule).Return(nil).Times(1)
+
+	require.NoError(t, fw.Block(detection.Detection{IP: "10.0.0.1"}))
+	require.NoError(t, fw.Unblock("10.0.0.1"))
+	fw.applyBatch([]blockRequest{<-fw.queue})
+	assert.Empty(t, fw.Blocks())
+	assert.Empty(t, fw.blocked)
+}
+
+func TestBlockAfterClose(t *testing.T) {
+	fw := newBatchFirewall(&fakeRestorer{}, nil)
+	fw.closed = true
+	err := fw.Block(detection.Detection{IP: "10.0.0.1"})
+	assert.ErrorIs(t, err, errFirewallClosed)
+}
@@ -16,18 +16,27 @@ type connCache struct {
 	// policy and a Sampled LFU eviction policy. You can use the same Cache instance
 	// from as many goroutines as you want.
 	manager  *cache.Cache[*ConnEntry]
+	metrics  *ristretto.Metrics
 	cacheTTL time.Duration
 	m        sync.RWMutex
 }
 
+// cacheStats are cumulative since the cache was created, except Entries
+type cacheStats struct {
+	Hits      uint64
+	Misses    uint64
+	Evictions uint64 // evicted by the policy or expired
+	Entries   uint64
+}
+
 // newCacheManager creates the instance of Cache, currently using gocache + ristretto
 func newCacheManager(ttl time.Duration) *connCache {
 	// TODO: spend some time thinking about cache config
-	// TODO: add prometheus Metrics
 	ristrettoCache, err := ristretto.NewCache(&ristretto.Config{
 		NumCounters: 1000,
 		MaxCost:     100,
 		BufferItems: 64,
+		Metrics:     true,
 	})
 	if err != nil {
 		log.Fatal().Err(err).Send()
@@ -36,10 +45,31 @@ func newCacheManager(ttl time.Duration) *connCache {
 	cacheManager := cache.New[*ConnEntry](ristrettoStore)
 	return &connCache{
 		manager:  cacheManager,
+		metrics:  ristrettoCache.Metrics,
 		cacheTTL: ttl,
 	}
 }
 
+// stats are taken from ristretto, every removed key (evicted, expired or deleted) is counted as eviction
+func (c *connCache) stats() cacheStats {
+	added, evicted := c.metrics.KeysAdded(), c.metrics.KeysEvicted()
+	var entries uint64
+	if added > evicted {
+		entries = added - evicted
+	}
+	return cacheStats{
+		Hits:      c.metrics.Hits(),
+		Misses:    c.metrics.Misses(),
+		Evictions: evicted,
+		Entries:   entries,
+	}
+}
+
+// ping of the in-process cache always succeeds
+func (c *connCache) ping(context.Context) error {
+	return nil
+}
+
 func (c *connCache) getOrSet(ctx context.Context, conn *ConnEntry) *ConnEntry {
 	key := fmt.Sprintf("%s->%s", conn.SrcIP, conn.DstIP)
 	found, err := c.manager.Get(ctx, key)
@@ -0,0 +1,59 @@
+package connectiontracker
+
+import (
+	"sync"
+	"time"
+)
+
+// recentConnectionsSize bounds the connections kept for listing in the APIs
+const recentConnectionsSize = 1024
+
+// Connection is a new connection captured on the device
+type Connection struct {
+	SrcIP   string    `json:"srcIp"`
+	DstIP   string    `json:"dstIp"`
+	DstPort int       `json:"dstPort"`
+	Seen    time.Time `json:"seen"`
+}
+
+// recentConnections is a ring buffer of the last captured connections
+type recentConnections struct {
+	entries []Connection
+	next    int
+	full    bool
+	m       sync.Mutex
+}
+
+func newRecentConnections(size int) *recentConnections {
+	return &recentConnections{entries: make([]Connection, size)}
+}
+
+func (r *recentConnections) add(c Connection) {
+	r.m.Lock()
+	defer r.m.Unlock()
+	r.entries[r.next] = c
+	r.next = (r.next + 1) % len(r.entries)
+	if r.next == 0 {
+		r.full = true
+	}
+}
+
+// list returns the connections newest first
+func (r *recentConnections) list() []Connection {
+	r.m.Lock()
+	defer r.m.Unlock()
+	size := r.next
+	if r.full {
+		size = len(r.entries)
+	}
+	result := make([]Connection, 0, size)
+	for i := 1; i <= size; i++ {
+		result = append(result, r.entries[(r.next-i+len(r.entries))%len(r.entries)])
+	}
+	return result
+}
+
+// Connections returns the recently captured connections, newest first
+func (t *Tracker) Connections() []Connection {
+	return t.recent.list()
+}
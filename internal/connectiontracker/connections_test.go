@@ -0,0 +1,20 @@
+package connectiontracker
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func Test_recentConnections(t *testing.T) {
+	recent := newRecentConnections(3)
+	assert.Empty(t, recent.list())
+
+	for port := 1; port <= 4; port++ {
+		recent.add(Connection{SrcIP: "10.0.0.1", DstPort: port})
+	}
+	ports := make([]int, 0, 3)
+	for _, c := range recent.list() {
+		ports = append(ports, c.DstPort)
+	}
+	assert.Equal(t, []int{4, 3, 2}, ports)
+}
@@ -1,30 +1,89 @@
 package connectiontracker
 
 import (
+	"context"
+	"errors"
+	"fmt"
 	"github.com/coreos/go-iptables/iptables"
 	"github.com/google/gopacket/pcap"
+	"github.com/prometheus/client_golang/prometheus"
 	"github.com/rs/zerolog/log"
 	"golang.org/x/exp/slices"
+	"io"
 	"net"
+	"sort"
+	"strings"
+	"sync"
+	"tcptracker/internal/detection"
+	"tcptracker/internal/events"
+	"time"
 )
 
 const (
-	inputChain = "INPUT"
-	// separate chain for isolation
+	inputChain   = "INPUT"
+	forwardChain = "FORWARD"
+	// Docker evaluates DOCKER-USER before its own FORWARD rules, when present the jump rule is added there too
+	dockerUserChain = "DOCKER-USER"
+	// separate chain for isolation, the name is configurable
 	trackerChain = "tcptracker"
 	table        = "filter"
-	drop         = "DROP"
+	// how often blocks with TTL are checked
+	expiryInterval = time.Second
 )
 
-//Firewall interface for Blocking IPs
+const (
+	driftChain          = "chain"
+	driftJump           = "jump"
+	driftBlock          = "block"
+	driftUnexpectedRule = "unexpected_rule"
+)
+
+const (
+	opBlock   = "block"
+	opUnblock = "unblock"
+
+	resultSuccess = "success"
+	resultError   = "error"
+	// allow listed, already blocked or not blocked at all
+	resultSkipped = "skipped"
+)
+
+var errFirewallClosed = errors.New("firewall is closed")
+
+var (
+	firewallDrift = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "tcptracker_firewall_drift_total",
+		Help: "Drift between desired and real firewall state repaired by reconciliation, by kind",
+	}, []string{"kind"})
+	firewallReconciles = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "tcptracker_firewall_reconciles_total",
+		Help: "Firewall reconciliation runs by result",
+	}, []string{"result"})
+	firewallOperations = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "tcptracker_firewall_operations_total",
+		Help: "Firewall block and unblock operations by result, batched blocks are counted when the batch is applied",
+	}, []string{"operation", "result"})
+)
+
+// Firewall interface for Blocking IPs
+//
 //go:generate mockgen -source=firewall.go -package=mock -destination=../../mock/gomock_firewall.go Firewall
 type Firewall interface {
-	Block(ip string) error
+	Block(d detection.Detection) error
+	Unblock(ip string) error
+	Blocks() []detection.Block
+	// Allow adds the IP to the allow list, allowed IPs are never blocked
+	Allow(ip string) error
+	Disallow(ip string) error
+	AllowList() []string
+	// Check tells if the chain and the jump rules are in place, used by the readiness probe
+	Check(ctx context.Context) error
 	Close() error
 }
 
-//go:generate mockgen -source=firewall.go -package=mock -destination=../../mock/gomock_ipTableCoreos.go ipTableCoreos
 // ipTableCoreos is matching implementation of coreos/go-iptables/iptables
+//
+//go:generate mockgen -source=firewall.go -package=mock -destination=../../mock/gomock_ipTableCoreos.go ipTableCoreos
 type ipTableCoreos interface {
 	ChainExists(string, string) (bool, error)
 	NewChain(string, string) error
@@ -32,6 +91,9 @@ type ipTableCoreos interface {
 	AppendUnique(string, string, ...string) error
 	DeleteIfExists(string, string, ...string) error
 	ClearAndDeleteChain(string, string) error
+	List(string, string) ([]string, error)
+	Exists(string, string, ...string) (bool, error)
+	ClearChain(string, string) error
 }
 
 // IPTables gives functionalities to Block IP addresses
@@ -39,26 +101,102 @@ type IPTables struct {
 	iptables     ipTableCoreos
 	jumpRuleSpec []string
 	allowList    []string // TODO: something to investigate more
+	policy       ActionPolicy
+	blocked      map[string][]string // source IP -> rule spec currently in the chain
+	forward      bool
+	hookChains   []string // chains with the jump rule to the tracker chain
+	chain        string   // tracker chain, trackerChain when empty
+	restorer     ruleRestorer
+	queue        chan blockRequest
+	pending      map[string][]string        // source IP -> rule spec queued for the next batch
+	blocks       map[string]detection.Block // source IP -> details of the applied block, used for listing and expiry
+	blockTTL     time.Duration
+	events       *events.Broker
+	done         chan struct{}
+	closed       bool
+	m            sync.Mutex
+	// apply serializes the batch transactions with Reconcile and Close, a batch is applied without m
+	apply sync.Mutex
+}
+
+// FirewallParams required params to create Firewall
+type FirewallParams struct {
+	DeviceName string
+	// Policy decides how detected IPs are blocked
+	Policy ActionPolicy
+	// Forward hooks trackerChain into FORWARD and DOCKER-USER chains to protect routed containers and VMs
+	Forward bool
+	Metrics *prometheus.Registry
+	// ReconcileInterval of comparing desired blocks with the real chains, 0 disables reconciliation
+	ReconcileInterval time.Duration
+	// BatchWindow of collecting blocks applied together with iptables-restore, 0 disables batching
+	BatchWindow time.Duration
+	// BlockTTL is used when Detection has no TTL, 0 blocks forever
+	BlockTTL time.Duration
+	// Events is optional, applied blocks and unblocks are published there
+	Events *events.Broker
+	// Chain holding the blocks, trackerChain when empty
+	Chain string
+	// Helper is the connection to the privileged firewall helper (ServeFirewallHelper), iptables and iptables-restore
+	// run there when set, so the tracker itself needs no capabilities
+	Helper io.ReadWriteCloser
 }
 
 // NewFirewall returns and instance of IPTables
-func NewFirewall(deviceName string) (Firewall, error) {
-	localIP, ok := getLocalIP(deviceName)
+func NewFirewall(p FirewallParams) (*IPTables, error) {
+	localIP, ok := getLocalIP(p.DeviceName)
 	if !ok {
-		log.Fatal().Msgf("Cannot track packets for non existing device: %s", deviceName)
+		log.Fatal().Msgf("Cannot track packets for non existing device: %s", p.DeviceName)
 	}
-	ipv4, err := iptables.NewWithProtocol(iptables.ProtocolIPv4)
-	if err != nil {
-		return nil, err
+	var ipv4 ipTableCoreos
+	var remote *remoteIPTables
+	if p.Helper != nil {
+		remote = newRemoteIPTables(p.Helper)
+		ipv4 = remote
+	} else {
+		local, err := iptables.NewWithProtocol(iptables.ProtocolIPv4)
+		if err != nil {
+			return nil, err
+		}
+		ipv4 = local
 	}
-	fw := newFW(ipv4, getLocalIPString(localIP))
+	fw := newFW(ipv4, getLocalIPString(localIP), orDefault(p.Chain, trackerChain))
+	fw.policy = p.Policy
+	fw.forward = p.Forward
+	fw.blockTTL = p.BlockTTL
+	fw.events = p.Events
 	errInit := initialise(fw)
 	if errInit != nil {
 		return nil, errInit
 	}
+	if p.Metrics != nil {
+		p.Metrics.MustRegister(firewallDrift, firewallReconciles, firewallOperations, batchEntries, blockLatency)
+	}
+	go fw.expiryLoop(fw.done, expiryInterval)
+	if p.ReconcileInterval > 0 {
+		go fw.reconcileLoop(fw.done, p.ReconcileInterval)
+	}
+	if p.BatchWindow > 0 {
+		if remote != nil {
+			fw.restorer = remote
+		} else {
+			restorer, errRestore := newIptablesRestore()
+			if errRestore != nil {
+				return nil, errRestore
+			}
+			fw.restorer = restorer
+		}
+		fw.queue = make(chan blockRequest, batchQueueSize)
+		go fw.batchLoop(fw.done, fw.queue, p.BatchWindow)
+	}
 	return fw, nil
 }
 
+// jumpRuleSpec of the hook chains, new connections are passed to the tracker chain
+func jumpRuleSpec(chain string) []string {
+	return []string{"-m", "state", "--state", "NEW", "-j", chain}
+}
+
 func getLocalIPString(localIP net.IP) string {
 	localIPString := ""
 	if localIP != nil {
@@ -67,63 +205,383 @@ func getLocalIPString(localIP net.IP) string {
 	return localIPString
 }
 
-func newFW(ipv4 *iptables.IPTables, localIP string) *IPTables {
+func newFW(ipv4 ipTableCoreos, localIP, chain string) *IPTables {
 	fw := &IPTables{
 		iptables:     ipv4,
-		jumpRuleSpec: []string{"-m", "state", "--state", "NEW", "-j", trackerChain},
+		chain:        chain,
+		jumpRuleSpec: jumpRuleSpec(chain),
 		allowList:    []string{localIP},
+		policy:       DefaultActionPolicy(),
+		blocked:      make(map[string][]string),
+		pending:      make(map[string][]string),
+		blocks:       make(map[string]detection.Block),
+		hookChains:   []string{inputChain},
+		done:         make(chan struct{}),
 	}
 	return fw
 }
 
-// Block takes the IP address and adding it to chain as DROP = block
-func (fw *IPTables) Block(ip string) error {
-	rule := []string{"-s", ip, "-j", drop}
-	if slices.Contains(fw.allowList, ip) {
-		log.Warn().Msgf("%s IP is on the allow list... skipping...", ip)
+// Block takes the detected IP address and adding it to chain with the Action resolved by the policy
+// When the IP is already blocked with a different Action, the old rule is replaced
+// With batching enabled the block is only queued, result of applying it is logged and counted in metrics
+func (fw *IPTables) Block(d detection.Detection) error {
+	fw.m.Lock()
+	// policy and TTL can be changed by Reconfigure
+	action := fw.policy.Resolve(d)
+	rule := action.RuleSpec(d.IP)
+	req := blockRequest{d: d, rule: rule, block: fw.newBlock(d, action, time.Now())}
+	if slices.Contains(fw.allowList, d.IP) {
+		fw.m.Unlock()
+		log.Warn().Msgf("%s IP is on the allow list... skipping...", d.IP)
+		firewallOp(opBlock, resultSkipped)
+		return nil
+	}
+	if fw.closed {
+		fw.m.Unlock()
+		firewallOp(opBlock, resultError)
+		return errFirewallClosed
+	}
+	if fw.blocked == nil {
+		fw.blocked = make(map[string][]string)
+	}
+	if fw.blocks == nil {
+		fw.blocks = make(map[string]detection.Block)
+	}
+	old, ok := fw.pending[d.IP]
+	if !ok {
+		old, ok = fw.blocked[d.IP]
+	}
+	if ok && slices.Equal(old, rule) {
+		fw.extend(req.block)
+		fw.m.Unlock()
+		firewallOp(opBlock, resultSkipped)
+		return nil
+	}
+	req.old = old
+	log.Info().Msgf("Blocking %s with %s action, detection %s %s score %d", d.IP, action.Name(), d.Type, d.ID, d.Score)
+	if fw.queue == nil {
+		defer fw.m.Unlock()
+		err := fw.blockNow(req)
+		firewallOpResult(opBlock, err)
+		return err
+	}
+	fw.pending[d.IP] = rule
+	queue, done := fw.queue, fw.done
+	fw.m.Unlock()
+
+	// the lock is released, applying the batch needs it and the queue can be full
+	select {
+	case queue <- req:
 		return nil
+	case <-done:
+		firewallOp(opBlock, resultError)
+		return errFirewallClosed
+	}
+}
+
+// Changes tells Block of the detection would add or replace the rule of the IP, not only extend the block
+func (fw *IPTables) Changes(d detection.Detection) bool {
+	fw.m.Lock()
+	defer fw.m.Unlock()
+	if fw.closed || slices.Contains(fw.allowList, d.IP) {
+		return false
+	}
+	rule := fw.policy.Resolve(d).RuleSpec(d.IP)
+	current, ok := fw.pending[d.IP]
+	if !ok {
+		current, ok = fw.blocked[d.IP]
+	}
+	return !ok || !slices.Equal(current, rule)
+}
+
+// Batching tells Block only queues the blocks, they are applied with the next batch
+func (fw *IPTables) Batching() bool {
+	return fw.queue != nil
+}
+
+// Reconfigure applies the policy and the default TTL to the next blocks, applied blocks are kept as they are
+func (fw *IPTables) Reconfigure(policy ActionPolicy, blockTTL time.Duration) {
+	fw.m.Lock()
+	defer fw.m.Unlock()
+	fw.policy = policy
+	fw.blockTTL = blockTTL
+}
+
+// ExpiresAt of the block of the detection created now, zero when it never expires
+func (fw *IPTables) ExpiresAt(d detection.Detection, now time.Time) time.Time {
+	fw.m.Lock()
+	defer fw.m.Unlock()
+	return fw.newBlock(d, fw.policy.Resolve(d), now).ExpiresAt
+}
+
+func (fw *IPTables) newBlock(d detection.Detection, action Action, now time.Time) detection.Block {
+	b := detection.Block{
+		IP:          d.IP,
+		DetectionID: d.ID,
+		Type:        d.Type,
+		Score:       d.Score,
+		Action:      action.Name(),
+		CreatedAt:   now,
+	}
+	ttl := d.TTL
+	if ttl == 0 {
+		ttl = fw.blockTTL
+	}
+	if ttl > 0 {
+		b.ExpiresAt = now.Add(ttl)
+	}
+	return b
+}
+
+// extend moves the expiry of already applied block when detected again, fw.m must be held
+func (fw *IPTables) extend(b detection.Block) {
+	current, ok := fw.blocks[b.IP]
+	if !ok || current.ExpiresAt.IsZero() {
+		return
+	}
+	if b.ExpiresAt.IsZero() || b.ExpiresAt.After(current.ExpiresAt) {
+		current.ExpiresAt = b.ExpiresAt
+		fw.blocks[b.IP] = current
+	}
+}
+
+// blockNow is applying the rule directly with go-iptables, fw.m must be held
+func (fw *IPTables) blockNow(req blockRequest) error {
+	ip := req.d.IP
+	if req.old != nil {
+		if err := fw.iptables.DeleteIfExists(table, fw.chainName(), req.old...); err != nil {
+			return err
+		}
+		delete(fw.blocked, ip)
 	}
 	// AppendUnique acts like Append except that it won't add a duplicate
-	return fw.iptables.AppendUnique(table, trackerChain, rule...)
+	if err := fw.iptables.AppendUnique(table, fw.chainName(), req.rule...); err != nil {
+		return err
+	}
+	fw.blocked[ip] = req.rule
+	fw.blocks[ip] = req.block
+	observeBlockLatency(req.d)
+	fw.publish(events.Block, req.block)
+	return nil
+}
+
+// observeBlockLatency is skipped for detections without the time, e.g. received from the cluster peers
+func observeBlockLatency(d detection.Detection) {
+	if d.DetectedAt.IsZero() {
+		return
+	}
+	observe(blockLatency, time.Since(d.DetectedAt), prometheus.Labels{"detection_id": d.ID})
+}
+
+// Unblock removes the IP from the chain, it is also cancelling the block waiting in the batch
+func (fw *IPTables) Unblock(ip string) error {
+	return fw.unblock(ip, events.Unblock)
+}
+
+// unblock publishes the event of the removed rule, Unblock or Expiry
+func (fw *IPTables) unblock(ip string, eventType events.Type) error {
+	fw.m.Lock()
+	defer fw.m.Unlock()
+	delete(fw.pending, ip)
+	block := fw.blocks[ip]
+	delete(fw.blocks, ip)
+	rule, ok := fw.blocked[ip]
+	if !ok {
+		firewallOp(opUnblock, resultSkipped)
+		return nil
+	}
+	if err := fw.iptables.DeleteIfExists(table, fw.chainName(), rule...); err != nil {
+		firewallOp(opUnblock, resultError)
+		return err
+	}
+	delete(fw.blocked, ip)
+	firewallOp(opUnblock, resultSuccess)
+	block.IP = ip
+	fw.publish(eventType, block)
+	log.Info().Msgf("Unblocked %s", ip)
+	return nil
+}
+
+func (fw *IPTables) publish(eventType events.Type, b detection.Block) {
+	e := events.Event{
+		Type:          eventType,
+		Time:          time.Now(),
+		SrcIP:         b.IP,
+		DetectionID:   b.DetectionID,
+		DetectionType: b.Type,
+		Score:         b.Score,
+		Action:        b.Action,
+	}
+	if !b.ExpiresAt.IsZero() {
+		expiresAt := b.ExpiresAt
+		e.ExpiresAt = &expiresAt
+	}
+	fw.events.Publish(e)
+}
+
+// Allow adds the IP to the allow list, the IP is unblocked when blocked already
+func (fw *IPTables) Allow(ip string) error {
+	fw.m.Lock()
+	if !slices.Contains(fw.allowList, ip) {
+		fw.allowList = append(fw.allowList, ip)
+	}
+	fw.m.Unlock()
+	log.Info().Msgf("%s added to the allow list", ip)
+	return fw.Unblock(ip)
+}
+
+// Disallow removes the IP from the allow list, it can be blocked again on the next detection
+func (fw *IPTables) Disallow(ip string) error {
+	fw.m.Lock()
+	defer fw.m.Unlock()
+	if idx := slices.Index(fw.allowList, ip); idx >= 0 {
+		fw.allowList = slices.Delete(fw.allowList, idx, idx+1)
+		log.Info().Msgf("%s removed from the allow list", ip)
+	}
+	return nil
+}
+
+// AllowList returns the allowed IPs sorted
+func (fw *IPTables) AllowList() []string {
+	fw.m.Lock()
+	defer fw.m.Unlock()
+	allowed := make([]string, 0, len(fw.allowList))
+	for _, ip := range fw.allowList {
+		// local IP is empty when the device has no address
+		if ip != "" {
+			allowed = append(allowed, ip)
+		}
+	}
+	sort.Strings(allowed)
+	return allowed
+}
+
+func firewallOp(operation, result string) {
+	firewallOperations.WithLabelValues(operation, result).Inc()
+}
+
+func firewallOpResult(operation string, err error) {
+	if err != nil {
+		firewallOp(operation, resultError)
+		return
+	}
+	firewallOp(operation, resultSuccess)
+}
+
+// Blocks returns the applied blocks sorted by IP
+func (fw *IPTables) Blocks() []detection.Block {
+	fw.m.Lock()
+	defer fw.m.Unlock()
+	blocks := make([]detection.Block, 0, len(fw.blocks))
+	for _, b := range fw.blocks {
+		blocks = append(blocks, b)
+	}
+	sort.Slice(blocks, func(i, j int) bool {
+		return blocks[i].IP < blocks[j].IP
+	})
+	return blocks
+}
+
+// expiryLoop lifts the blocks with TTL
+func (fw *IPTables) expiryLoop(done <-chan struct{}, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case now := <-ticker.C:
+			fw.expire(now)
+		}
+	}
+}
+
+func (fw *IPTables) expire(now time.Time) {
+	var expired []string
+	fw.m.Lock()
+	for ip, b := range fw.blocks {
+		if b.Expired(now) {
+			expired = append(expired, ip)
+		}
+	}
+	fw.m.Unlock()
+	for _, ip := range expired {
+		log.Info().Msgf("Block of %s expired", ip)
+		if err := fw.unblock(ip, events.Expiry); err != nil {
+			log.Err(err).Msgf("Cannot lift expired block of %s", ip)
+		}
+	}
 }
 
 func initialise(fw *IPTables) error {
-	if err := clear(fw.iptables, fw.jumpRuleSpec); err != nil {
+	// previous run could be started with a different mode, all the possible jump rules are removed
+	stale, err := hookChains(fw.iptables, true)
+	if err != nil {
+		return err
+	}
+	if err := clear(fw.iptables, fw.chainName(), fw.jumpRuleSpec, stale); err != nil {
+		return err
+	}
+	chains, err := hookChains(fw.iptables, fw.forward)
+	if err != nil {
 		return err
 	}
-	if errCreate := create(fw.iptables, fw.jumpRuleSpec); errCreate != nil {
+	if errCreate := create(fw.iptables, fw.chainName(), fw.jumpRuleSpec, chains); errCreate != nil {
 		return errCreate
 	}
+	fw.hookChains = chains
+	log.Info().Msgf("Firewall chain %s is hooked into %v", fw.chainName(), chains)
 	return nil
 }
 
-func create(iptables ipTableCoreos, jumpRuleSpec []string) error {
-	ok, err := iptables.ChainExists(table, trackerChain)
+// hookChains returns the chains which should jump to trackerChain, DOCKER-USER only when Docker created it
+func hookChains(iptables ipTableCoreos, forward bool) ([]string, error) {
+	chains := []string{inputChain}
+	if !forward {
+		return chains, nil
+	}
+	chains = append(chains, forwardChain)
+	ok, err := iptables.ChainExists(table, dockerUserChain)
+	if err != nil {
+		return nil, err
+	}
+	if ok {
+		chains = append(chains, dockerUserChain)
+	}
+	return chains, nil
+}
+
+func create(iptables ipTableCoreos, name string, jumpRuleSpec []string, chains []string) error {
+	ok, err := iptables.ChainExists(table, name)
 	if err != nil {
 		return err
 	}
 	if !ok {
-		if err := iptables.NewChain(table, trackerChain); err != nil {
+		if err := iptables.NewChain(table, name); err != nil {
 			return err
 		}
 	}
-	if err := iptables.Insert(table, inputChain, 1, jumpRuleSpec...); err != nil {
-		return err
+	for _, chain := range chains {
+		if err := iptables.Insert(table, chain, 1, jumpRuleSpec...); err != nil {
+			return err
+		}
 	}
 	return nil
 
 }
 
-func clear(iptables ipTableCoreos, jumpRuleSpec []string) error {
-	ok, err := iptables.ChainExists(table, trackerChain)
+func clear(iptables ipTableCoreos, name string, jumpRuleSpec []string, chains []string) error {
+	ok, err := iptables.ChainExists(table, name)
 	if err != nil {
 		return err
 	}
 	if ok {
-		if err := iptables.DeleteIfExists(table, inputChain, jumpRuleSpec...); err != nil {
-			return err
+		for _, chain := range chains {
+			if err := iptables.DeleteIfExists(table, chain, jumpRuleSpec...); err != nil {
+				return err
+			}
 		}
-		if err := iptables.ClearAndDeleteChain(table, trackerChain); err != nil {
+		if err := iptables.ClearAndDeleteChain(table, name); err != nil {
 			return err
 		}
 	}
@@ -145,6 +603,228 @@ func getLocalIP(deviceName string) (net.IP, bool) {
 	return nil, false
 }
 
+// deviceAddresses returns all the addresses of the device
+func deviceAddresses(deviceName string) map[string]bool {
+	addresses := make(map[string]bool)
+	devices, err := pcap.FindAllDevs()
+	if err != nil {
+		log.Err(err).Msg("Cannot list device addresses")
+		return addresses
+	}
+	for _, d := range devices {
+		if d.Name == deviceName {
+			for _, addr := range d.Addresses {
+				addresses[addr.IP.String()] = true
+			}
+		}
+	}
+	return addresses
+}
+
 func (fw *IPTables) Close() error {
-	return clear(fw.iptables, fw.jumpRuleSpec)
+	// the batch in flight is applied before the chain is removed
+	fw.apply.Lock()
+	defer fw.apply.Unlock()
+	fw.m.Lock()
+	defer fw.m.Unlock()
+	if fw.done != nil {
+		close(fw.done)
+		fw.done = nil
+	}
+	fw.closed = true
+	fw.blocked = make(map[string][]string)
+	fw.pending = make(map[string][]string)
+	fw.blocks = make(map[string]detection.Block)
+	return clear(fw.iptables, fw.chainName(), fw.jumpRuleSpec, fw.hookChains)
+}
+
+// chainName of the tracker chain, struct literals without chain use trackerChain
+func (fw *IPTables) chainName() string {
+	return orDefault(fw.chain, trackerChain)
+}
+
+// Check doesn't repair anything, missing rules are restored by Reconcile
+func (fw *IPTables) Check(context.Context) error {
+	fw.m.Lock()
+	defer fw.m.Unlock()
+	if fw.closed {
+		return errFirewallClosed
+	}
+	ok, err := fw.iptables.ChainExists(table, fw.chainName())
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return fmt.Errorf("chain %s is missing", fw.chainName())
+	}
+	for _, chain := range fw.hookChains {
+		ok, err := fw.iptables.Exists(table, chain, fw.jumpRuleSpec...)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			return fmt.Errorf("jump rule to %s is missing in %s", fw.chainName(), chain)
+		}
+	}
+	return nil
+}
+
+// reconcileLoop repairs the firewall periodically, other tools (Docker, firewalld, kube-proxy) or admins
+// can flush rules or reorder the chains and blocking would stop silently
+func (fw *IPTables) reconcileLoop(done <-chan struct{}, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+			if err := fw.Reconcile(); err != nil {
+				firewallReconciles.WithLabelValues("error").Inc()
+				log.Err(err).Msg("Firewall reconciliation failed")
+				continue
+			}
+			firewallReconciles.WithLabelValues("ok").Inc()
+		}
+	}
+}
+
+// Reconcile compares desired blocks with the real chain and restores the missing state,
+// jump rules are moved back to position 1
+func (fw *IPTables) Reconcile() error {
+	fw.apply.Lock()
+	defer fw.apply.Unlock()
+	fw.m.Lock()
+	defer fw.m.Unlock()
+	if fw.closed {
+		return nil
+	}
+	ok, err := fw.iptables.ChainExists(table, fw.chainName())
+	if err != nil {
+		return err
+	}
+	if !ok {
+		fw.drift(driftChain, 1)
+		if err := fw.iptables.NewChain(table, fw.chainName()); err != nil {
+			return err
+		}
+	}
+	for _, chain := range fw.hookChains {
+		if err := fw.reconcileJump(chain); err != nil {
+			return err
+		}
+	}
+	rules, err := fw.iptables.List(table, fw.chainName())
+	if err != nil {
+		return err
+	}
+	// only the foreign rules are deleted, the blocks stay in place
+	if unexpected := fw.unexpectedRules(rules); len(unexpected) > 0 {
+		fw.drift(driftUnexpectedRule, len(unexpected))
+		for _, rule := range unexpected {
+			if err := fw.iptables.DeleteIfExists(table, fw.chainName(), rule...); err != nil {
+				return err
+			}
+		}
+	}
+	for _, rule := range fw.blocked {
+		exists, err := fw.iptables.Exists(table, fw.chainName(), rule...)
+		if err != nil {
+			return err
+		}
+		if exists {
+			continue
+		}
+		fw.drift(driftBlock, 1)
+		if err := fw.iptables.AppendUnique(table, fw.chainName(), rule...); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// unexpectedRules returns the specs of the listed rules of the chain that are neither blocked nor pending, or repeat a rule.
+// Pending rules are not in the chain while the batch is not applied, they are expected to cover a batch applied meanwhile.
+func (fw *IPTables) unexpectedRules(rules []string) [][]string {
+	expected := make(map[string]int, len(fw.blocked)+len(fw.pending))
+	for _, rule := range fw.blocked {
+		expected[ruleKey(rule)] = 1
+	}
+	for _, rule := range fw.pending {
+		expected[ruleKey(rule)] = 1
+	}
+	var unexpected [][]string
+	for _, rule := range rules {
+		fields := strings.Fields(rule)
+		// first entry is the chain definition `-N tcptracker`
+		if len(fields) < 2 || fields[0] != "-A" {
+			continue
+		}
+		key := ruleKey(fields[2:])
+		if expected[key] == 0 {
+			unexpected = append(unexpected, fields[2:])
+			continue
+		}
+		expected[key]--
+	}
+	return unexpected
+}
+
+// ruleKey identifies the rule by its source, matches, hashlimit rate and target, iptables lists the rules normalized,
+// e.g. `-s 10.0.0.1/32 -p tcp -m tcp -j REJECT --reject-with tcp-reset` or `--hashlimit-above 5/min`
+func ruleKey(spec []string) string {
+	var source, target string
+	var matches []string
+	for i := 0; i+1 < len(spec); i++ {
+		switch spec[i] {
+		case "-s":
+			source = strings.TrimSuffix(spec[i+1], "/32")
+		case "-m":
+			if spec[i+1] != "tcp" {
+				matches = append(matches, spec[i+1])
+			}
+		case "--hashlimit-above":
+			matches = append(matches, rateKey(spec[i+1]))
+		case "-j":
+			target = spec[i+1]
+		}
+	}
+	return strings.Join(append([]string{source, target}, matches...), " ")
+}
+
+// rateKey shortens the unit of the rate like iptables lists it, e.g. 5/minute is 5/min
+func rateKey(rate string) string {
+	amount, unit, _ := strings.Cut(rate, "/")
+	switch unit {
+	case "second":
+		unit = "sec"
+	case "minute":
+		unit = "min"
+	}
+	return amount + "/" + unit
+}
+
+// reconcileJump makes sure the jump rule is the first rule of the chain, position 0 is the chain policy or definition
+func (fw *IPTables) reconcileJump(chain string) error {
+	rules, err := fw.iptables.List(table, chain)
+	if err != nil {
+		return err
+	}
+	expected := strings.Join(append([]string{"-A", chain}, fw.jumpRuleSpec...), " ")
+	position := slices.Index(rules, expected)
+	if position == 1 {
+		return nil
+	}
+	fw.drift(driftJump, 1)
+	if position > 1 {
+		if err := fw.iptables.DeleteIfExists(table, chain, fw.jumpRuleSpec...); err != nil {
+			return err
+		}
+	}
+	return fw.iptables.Insert(table, chain, 1, fw.jumpRuleSpec...)
+}
+
+func (fw *IPTables) drift(kind string, count int) {
+	log.Warn().Msgf("Firewall drift detected: %s x%d, repairing...", kind, count)
+	firewallDrift.WithLabelValues(kind).Add(float64(count))
 }
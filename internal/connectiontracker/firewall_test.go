@@ -1,13 +1,18 @@
 package connectiontracker
 
 import (
+	"context"
 	"github.com/coreos/go-iptables/iptables"
 	"github.com/golang/mock/gomock"
+	"github.com/prometheus/client_golang/prometheus/testutil"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 	"net"
+	"tcptracker/internal/detection"
+	"tcptracker/internal/events"
 	mock2 "tcptracker/mock"
 	"testing"
+	"time"
 )
 
 func Test_deviceExists(t *testing.T) {
@@ -39,12 +44,157 @@ func TestBlockIpv4(t *testing.T) {
 	}
 	ip := "192.169.0.1"
 	mockIptables.EXPECT().AppendUnique(table, trackerChain, []string{"-s", ip, "-j", drop}).Return(nil).Times(1)
-	err := firewall.Block(ip)
-	errAllowed := firewall.Block(ipAllowed)
+	err := firewall.Block(detection.Detection{IP: ip, Type: detection.PortScan, Score: 4})
+	errAllowed := firewall.Block(detection.Detection{IP: ipAllowed, Type: detection.PortScan, Score: 4})
 	require.NoError(t, err)
 	require.NoError(t, errAllowed)
 }
 
+func TestBlockReplacesRuleOnDifferentAction(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+	mockIptables := mock2.NewMockIptablesMock(mockCtrl)
+
+	firewall := IPTables{
+		iptables: mockIptables,
+		policy: ActionPolicy{
+			Default: dropAction{},
+			Tiers:   []ScoreTier{{MinScore: 10, Action: rejectAction{}}},
+		},
+	}
+	ip := "192.169.0.1"
+	dropRule := dropAction{}.RuleSpec(ip)
+	rejectRule := rejectAction{}.RuleSpec(ip)
+	gomock.InOrder(
+		mockIptables.EXPECT().AppendUnique(table, trackerChain, dropRule).Return(nil).Times(1),
+		mockIptables.EXPECT().DeleteIfExists(table, trackerChain, dropRule).Return(nil).Times(1),
+		mockIptables.EXPECT().AppendUnique(table, trackerChain, rejectRule).Return(nil).Times(1),
+	)
+	require.NoError(t, firewall.Block(detection.Detection{IP: ip, Type: detection.PortScan, Score: 4}))
+	// same action again is a no-op
+	require.NoError(t, firewall.Block(detection.Detection{IP: ip, Type: detection.PortScan, Score: 5}))
+	require.NoError(t, firewall.Block(detection.Detection{IP: ip, Type: detection.PortScan, Score: 12}))
+	assert.Equal(t, rejectRule, firewall.blocked[ip])
+}
+
+func TestBlockWithTTLExpires(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+	mockIptables := mock2.NewMockIptablesMock(mockCtrl)
+
+	broker := events.NewBroker("node-1", nil)
+	published, unsubscribe := broker.Subscribe(events.Filter{})
+	defer unsubscribe()
+	firewall := IPTables{
+		iptables: mockIptables,
+		blockTTL: time.Hour,
+		events:   broker,
+	}
+	ip1, ip2 := "192.169.0.1", "192.169.0.2"
+	mockIptables.EXPECT().AppendUnique(table, trackerChain, dropAction{}.RuleSpec(ip1)).Return(nil).Times(1)
+	mockIptables.EXPECT().AppendUnique(table, trackerChain, dropAction{}.RuleSpec(ip2)).Return(nil).Times(1)
+	mockIptables.EXPECT().DeleteIfExists(table, trackerChain, dropAction{}.RuleSpec(ip1)).Return(nil).Times(1)
+
+	require.NoError(t, firewall.Block(detection.Detection{IP: ip1, Type: detection.Manual, TTL: time.Minute}))
+	require.NoError(t, firewall.Block(detection.Detection{IP: ip2, Type: detection.PortScan, Score: 4}))
+	blocks := firewall.Blocks()
+	require.Len(t, blocks, 2)
+	assert.Equal(t, ip1, blocks[0].IP)
+	assert.Equal(t, drop, blocks[0].Action)
+	assert.Equal(t, detection.Manual, blocks[0].Type)
+	assert.WithinDuration(t, time.Now().Add(time.Minute), blocks[0].ExpiresAt, time.Second)
+	assert.WithinDuration(t, time.Now().Add(time.Hour), blocks[1].ExpiresAt, time.Second)
+
+	firewall.expire(time.Now().Add(2 * time.Minute))
+	blocks = firewall.Blocks()
+	require.Len(t, blocks, 1)
+	assert.Equal(t, ip2, blocks[0].IP)
+
+	require.Len(t, published, 3)
+	blocked := <-published
+	require.NotNil(t, blocked.ExpiresAt)
+	assert.WithinDuration(t, time.Now().Add(time.Minute), *blocked.ExpiresAt, time.Second)
+	<-published
+	expired := <-published
+	assert.Equal(t, events.Expiry, expired.Type)
+	assert.Equal(t, ip1, expired.SrcIP)
+}
+
+func TestReconfigureKeepsAppliedBlocks(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+	mockIptables := mock2.NewMockIptablesMock(mockCtrl)
+
+	firewall := IPTables{iptables: mockIptables}
+	ip1, ip2 := "192.169.0.1", "192.169.0.2"
+	mockIptables.EXPECT().AppendUnique(table, trackerChain, dropAction{}.RuleSpec(ip1)).Return(nil).Times(1)
+	mockIptables.EXPECT().AppendUnique(table, trackerChain, rejectAction{}.RuleSpec(ip2)).Return(nil).Times(1)
+
+	require.NoError(t, firewall.Block(detection.Detection{IP: ip1, Type: detection.PortScan, Score: 4}))
+	firewall.Reconfigure(ActionPolicy{Default: rejectAction{}}, time.Hour)
+	require.NoError(t, firewall.Block(detection.Detection{IP: ip2, Type: detection.PortScan, Score: 4}))
+	blocks := firewall.Blocks()
+	require.Len(t, blocks, 2)
+	assert.Equal(t, drop, blocks[0].Action)
+	assert.True(t, blocks[0].ExpiresAt.IsZero())
+	assert.Equal(t, rejectAction{}.RuleSpec(ip2), firewall.blocked[ip2])
+	assert.WithinDuration(t, time.Now().Add(time.Hour), blocks[1].ExpiresAt, time.Second)
+}
+
+func TestUnblock(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+	mockIptables := mock2.NewMockIptablesMock(mockCtrl)
+
+	broker := events.NewBroker("node-1", nil)
+	published, unsubscribe := broker.Subscribe(events.Filter{})
+	defer unsubscribe()
+	firewall := IPTables{iptables: mockIptables, events: broker}
+	ip := "192.169.0.1"
+	mockIptables.EXPECT().AppendUnique(table, trackerChain, dropAction{}.RuleSpec(ip)).Return(nil).Times(1)
+	mockIptables.EXPECT().DeleteIfExists(table, trackerChain, dropAction{}.RuleSpec(ip)).Return(nil).Times(1)
+
+	require.NoError(t, firewall.Block(detection.Detection{ID: "1", IP: ip, Type: detection.PortScan, Score: 4}))
+	require.NoError(t, firewall.Unblock(ip))
+	// not blocked anymore, nothing to remove
+	require.NoError(t, firewall.Unblock(ip))
+	assert.Empty(t, firewall.Blocks())
+
+	require.Len(t, published, 2)
+	blocked, unblocked := <-published, <-published
+	assert.Equal(t, events.Block, blocked.Type)
+	assert.Equal(t, "DROP", blocked.Action)
+	assert.Equal(t, "1", blocked.DetectionID)
+	assert.Equal(t, events.Unblock, unblocked.Type)
+	assert.Equal(t, ip, unblocked.SrcIP)
+}
+
+func TestAllowUnblocksAndSkipsBlocks(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+	mockIptables := mock2.NewMockIptablesMock(mockCtrl)
+
+	firewall := IPTables{iptables: mockIptables, allowList: []string{""}}
+	ip := "192.169.0.1"
+	mockIptables.EXPECT().AppendUnique(table, trackerChain, dropAction{}.RuleSpec(ip)).Return(nil).Times(2)
+	mockIptables.EXPECT().DeleteIfExists(table, trackerChain, dropAction{}.RuleSpec(ip)).Return(nil).Times(1)
+
+	require.NoError(t, firewall.Block(detection.Detection{IP: ip, Type: detection.PortScan, Score: 4}))
+	require.NoError(t, firewall.Allow(ip))
+	require.NoError(t, firewall.Allow(ip))
+	assert.Equal(t, []string{ip}, firewall.AllowList())
+	assert.Empty(t, firewall.Blocks())
+
+	// allowed IP is not blocked
+	require.NoError(t, firewall.Block(detection.Detection{IP: ip, Type: detection.PortScan, Score: 4}))
+	assert.Empty(t, firewall.Blocks())
+
+	require.NoError(t, firewall.Disallow(ip))
+	assert.Empty(t, firewall.AllowList())
+	require.NoError(t, firewall.Block(detection.Detection{IP: ip, Type: detection.PortScan, Score: 4}))
+	assert.Len(t, firewall.Blocks(), 1)
+}
+
 func TestClearWhenExists(t *testing.T) {
 	mockCtrl := gomock.NewController(t)
 	defer mockCtrl.Finish()
@@ -58,7 +208,7 @@ func TestClearWhenExists(t *testing.T) {
 	mockIptables.EXPECT().DeleteIfExists(table, inputChain, firewall.jumpRuleSpec).Return(nil).Times(1)
 	mockIptables.EXPECT().ClearAndDeleteChain(table, trackerChain).Return(nil).Times(1)
 
-	err := clear(mockIptables, firewall.jumpRuleSpec)
+	err := clear(mockIptables, trackerChain, firewall.jumpRuleSpec, []string{inputChain})
 	require.NoError(t, err)
 }
 
@@ -75,7 +225,7 @@ func TestClearOnNonExistingChain(t *testing.T) {
 	mockIptables.EXPECT().DeleteIfExists(gomock.Any(), gomock.Any(), gomock.Any()).Times(0)
 	mockIptables.EXPECT().ClearAndDeleteChain(gomock.Any(), gomock.Any()).Times(0)
 
-	err := clear(mockIptables, firewall.jumpRuleSpec)
+	err := clear(mockIptables, trackerChain, firewall.jumpRuleSpec, []string{inputChain})
 	require.NoError(t, err)
 }
 
@@ -92,14 +242,242 @@ func TestCreateInteractions(t *testing.T) {
 	mockIptables.EXPECT().NewChain(table, trackerChain).Return(nil).Times(1)
 	mockIptables.EXPECT().Insert(table, inputChain, 1, firewall.jumpRuleSpec).Return(nil).Times(1)
 
-	err := create(mockIptables, firewall.jumpRuleSpec)
+	err := create(mockIptables, trackerChain, firewall.jumpRuleSpec, []string{inputChain})
+	require.NoError(t, err)
+}
+
+func TestCreateForwardWithDockerUser(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+	mockIptables := mock2.NewMockIptablesMock(mockCtrl)
+
+	jumpRuleSpec := []string{"-m", "state", "--state", "NEW", "-j", trackerChain}
+	mockIptables.EXPECT().ChainExists(table, dockerUserChain).Return(true, nil).Times(1)
+	mockIptables.EXPECT().ChainExists(table, trackerChain).Return(true, nil).Times(1)
+	mockIptables.EXPECT().NewChain(gomock.Any(), gomock.Any()).Times(0)
+	mockIptables.EXPECT().Insert(table, inputChain, 1, jumpRuleSpec).Return(nil).Times(1)
+	mockIptables.EXPECT().Insert(table, forwardChain, 1, jumpRuleSpec).Return(nil).Times(1)
+	mockIptables.EXPECT().Insert(table, dockerUserChain, 1, jumpRuleSpec).Return(nil).Times(1)
+
+	chains, err := hookChains(mockIptables, true)
 	require.NoError(t, err)
+	assert.Equal(t, []string{inputChain, forwardChain, dockerUserChain}, chains)
+	require.NoError(t, create(mockIptables, trackerChain, jumpRuleSpec, chains))
+}
+
+func TestHookChainsWithoutForward(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+	mockIptables := mock2.NewMockIptablesMock(mockCtrl)
+	mockIptables.EXPECT().ChainExists(gomock.Any(), gomock.Any()).Times(0)
+
+	chains, err := hookChains(mockIptables, false)
+	require.NoError(t, err)
+	assert.Equal(t, []string{inputChain}, chains)
+}
+
+func TestReconcileNoDrift(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+	mockIptables := mock2.NewMockIptablesMock(mockCtrl)
+
+	ip := "192.169.0.1"
+	rule := dropAction{}.RuleSpec(ip)
+	firewall := IPTables{
+		iptables:     mockIptables,
+		jumpRuleSpec: []string{"-m", "state", "--state", "NEW", "-j", trackerChain},
+		hookChains:   []string{inputChain},
+		blocked:      map[string][]string{ip: rule},
+	}
+	mockIptables.EXPECT().ChainExists(table, trackerChain).Return(true, nil).Times(1)
+	mockIptables.EXPECT().List(table, inputChain).Return([]string{
+		"-P INPUT ACCEPT",
+		"-A INPUT -m state --state NEW -j tcptracker",
+	}, nil).Times(1)
+	mockIptables.EXPECT().List(table, trackerChain).Return([]string{
+		"-N tcptracker",
+		"-A tcptracker -s 192.169.0.1/32 -j DROP",
+	}, nil).Times(1)
+	mockIptables.EXPECT().Exists(table, trackerChain, rule).Return(true, nil).Times(1)
+	mockIptables.EXPECT().Insert(gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any()).Times(0)
+	mockIptables.EXPECT().AppendUnique(gomock.Any(), gomock.Any(), gomock.Any()).Times(0)
+
+	require.NoError(t, firewall.Reconcile())
+}
+
+func TestFirewallCheck(t *testing.T) {
+	jumpRuleSpec := []string{"-m", "state", "--state", "NEW", "-j", trackerChain}
+	tests := []struct {
+		name        string
+		chainExists bool
+		jumpExists  bool
+		closed      bool
+		wantErr     bool
+	}{
+		{name: "rules in place", chainExists: true, jumpExists: true},
+		{name: "chain flushed", chainExists: false, wantErr: true},
+		{name: "jump rule removed", chainExists: true, jumpExists: false, wantErr: true},
+		{name: "closed", closed: true, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mockCtrl := gomock.NewController(t)
+			defer mockCtrl.Finish()
+			mockIptables := mock2.NewMockIptablesMock(mockCtrl)
+			firewall := IPTables{
+				iptables:     mockIptables,
+				jumpRuleSpec: jumpRuleSpec,
+				hookChains:   []string{inputChain},
+				closed:       tt.closed,
+			}
+			if !tt.closed {
+				mockIptables.EXPECT().ChainExists(table, trackerChain).Return(tt.chainExists, nil).Times(1)
+			}
+			if tt.chainExists {
+				mockIptables.EXPECT().Exists(table, inputChain, jumpRuleSpec).Return(tt.jumpExists, nil).Times(1)
+			}
+			err := firewall.Check(context.Background())
+			if tt.wantErr {
+				require.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+		})
+	}
+}
+
+func TestReconcileRepairsDrift(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+	mockIptables := mock2.NewMockIptablesMock(mockCtrl)
+
+	ip := "192.169.0.1"
+	rule := dropAction{}.RuleSpec(ip)
+	jumpRuleSpec := []string{"-m", "state", "--state", "NEW", "-j", trackerChain}
+	firewall := IPTables{
+		iptables:     mockIptables,
+		jumpRuleSpec: jumpRuleSpec,
+		hookChains:   []string{inputChain, forwardChain},
+		blocked:      map[string][]string{ip: rule},
+	}
+	jumpBefore := testutil.ToFloat64(firewallDrift.WithLabelValues(driftJump))
+	blockBefore := testutil.ToFloat64(firewallDrift.WithLabelValues(driftBlock))
+	unexpectedBefore := testutil.ToFloat64(firewallDrift.WithLabelValues(driftUnexpectedRule))
+
+	mockIptables.EXPECT().ChainExists(table, trackerChain).Return(true, nil).Times(1)
+	// reordered by another tool
+	mockIptables.EXPECT().List(table, inputChain).Return([]string{
+		"-P INPUT ACCEPT",
+		"-A INPUT -j DOCKER-USER",
+		"-A INPUT -m state --state NEW -j tcptracker",
+	}, nil).Times(1)
+	mockIptables.EXPECT().DeleteIfExists(table, inputChain, jumpRuleSpec).Return(nil).Times(1)
+	mockIptables.EXPECT().Insert(table, inputChain, 1, jumpRuleSpec).Return(nil).Times(1)
+	// flushed
+	mockIptables.EXPECT().List(table, forwardChain).Return([]string{"-P FORWARD DROP"}, nil).Times(1)
+	mockIptables.EXPECT().Insert(table, forwardChain, 1, jumpRuleSpec).Return(nil).Times(1)
+	// rule added by someone else, ours removed
+	mockIptables.EXPECT().List(table, trackerChain).Return([]string{
+		"-N tcptracker",
+		"-A tcptracker -s 10.0.0.1/32 -j ACCEPT",
+		"-A tcptracker -s 10.0.0.2/32 -j ACCEPT",
+	}, nil).Times(1)
+	mockIptables.EXPECT().DeleteIfExists(table, trackerChain, "-s", "10.0.0.1/32", "-j", "ACCEPT").Return(nil).Times(1)
+	mockIptables.EXPECT().DeleteIfExists(table, trackerChain, "-s", "10.0.0.2/32", "-j", "ACCEPT").Return(nil).Times(1)
+	mockIptables.EXPECT().Exists(table, trackerChain, rule).Return(false, nil).Times(1)
+	mockIptables.EXPECT().AppendUnique(table, trackerChain, rule).Return(nil).Times(1)
+
+	require.NoError(t, firewall.Reconcile())
+	assert.Equal(t, jumpBefore+2, testutil.ToFloat64(firewallDrift.WithLabelValues(driftJump)))
+	assert.Equal(t, blockBefore+1, testutil.ToFloat64(firewallDrift.WithLabelValues(driftBlock)))
+	assert.Equal(t, unexpectedBefore+2, testutil.ToFloat64(firewallDrift.WithLabelValues(driftUnexpectedRule)))
+}
+
+func TestFirewallUnexpectedRules(t *testing.T) {
+	firewall := IPTables{
+		blocked: map[string][]string{
+			"10.0.0.1": dropAction{}.RuleSpec("10.0.0.1"),
+			"10.0.0.2": rejectAction{}.RuleSpec("10.0.0.2"),
+			"10.0.0.3": rateLimitAction{rate: "5/minute"}.RuleSpec("10.0.0.3"),
+		},
+		pending: map[string][]string{"10.0.0.4": dropAction{}.RuleSpec("10.0.0.4")},
+	}
+	tests := []struct {
+		name  string
+		rules []string
+		want  [][]string
+	}{
+		{
+			name: "blocked and pending rules listed normalized",
+			rules: []string{
+				"-N tcptracker",
+				"-A tcptracker -s 10.0.0.1/32 -j DROP",
+				"-A tcptracker -s 10.0.0.2/32 -p tcp -m tcp -j REJECT --reject-with tcp-reset",
+				"-A tcptracker -s 10.0.0.3/32 -m hashlimit --hashlimit-above 5/min --hashlimit-burst 5 " +
+					"--hashlimit-mode srcip --hashlimit-name tcptracker -j DROP",
+				"-A tcptracker -s 10.0.0.4/32 -j DROP",
+			},
+		},
+		{
+			name:  "missing rules are not unexpected",
+			rules: []string{"-N tcptracker"},
+		},
+		{
+			name:  "foreign rule replacing a missing one",
+			rules: []string{"-N tcptracker", "-A tcptracker -s 10.0.0.9/32 -j ACCEPT", "-A tcptracker -s 10.0.0.2/32 -j DROP"},
+			want:  [][]string{{"-s", "10.0.0.9/32", "-j", "ACCEPT"}, {"-s", "10.0.0.2/32", "-j", "DROP"}},
+		},
+		{
+			name:  "repeated rule",
+			rules: []string{"-N tcptracker", "-A tcptracker -s 10.0.0.1/32 -j DROP", "-A tcptracker -s 10.0.0.1/32 -j DROP"},
+			want:  [][]string{{"-s", "10.0.0.1/32", "-j", "DROP"}},
+		},
+		{
+			name: "other rate",
+			rules: []string{"-N tcptracker", "-A tcptracker -s 10.0.0.3/32 -m hashlimit --hashlimit-above 50/sec " +
+				"--hashlimit-burst 5 --hashlimit-mode srcip --hashlimit-name tcptracker -j DROP"},
+			want: [][]string{{"-s", "10.0.0.3/32", "-m", "hashlimit", "--hashlimit-above", "50/sec", "--hashlimit-burst", "5",
+				"--hashlimit-mode", "srcip", "--hashlimit-name", "tcptracker", "-j", "DROP"}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.want, firewall.unexpectedRules(tt.rules))
+		})
+	}
+}
+
+func TestReconcileWaitsForBatch(t *testing.T) {
+	firewall := IPTables{closed: true}
+	firewall.apply.Lock()
+	reconciled := make(chan error)
+	go func() { reconciled <- firewall.Reconcile() }()
+	select {
+	case <-reconciled:
+		t.Fatal("reconciled while the batch was applied")
+	case <-time.After(50 * time.Millisecond):
+	}
+	firewall.apply.Unlock()
+	require.NoError(t, <-reconciled)
+}
+
+func TestReconcileAfterClose(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+	mockIptables := mock2.NewMockIptablesMock(mockCtrl)
+
+	firewall := IPTables{
+		iptables: mockIptables,
+		closed:   true,
+	}
+	mockIptables.EXPECT().ChainExists(gomock.Any(), gomock.Any()).Times(0)
+	require.NoError(t, firewall.Reconcile())
 }
 
 func Test_newFW(t *testing.T) {
 	ipv4, err := iptables.NewWithProtocol(iptables.ProtocolIPv4)
 	require.NoError(t, err)
-	fw := newFW(ipv4, "192.168.0.147")
+	fw := newFW(ipv4, "192.168.0.147", trackerChain)
 	require.NotNil(t, fw)
 }
 
@@ -112,3 +490,19 @@ func Test_getLocalIPString(t *testing.T) {
 	actual2 := getLocalIPString(localIP)
 	assert.Equal(t, localIPString, actual2)
 }
+
+func TestFirewallChanges(t *testing.T) {
+	policy := DefaultActionPolicy()
+	policy.Tiers = []ScoreTier{{MinScore: 10, Action: rejectAction{}}}
+	firewall := IPTables{
+		policy:    policy,
+		blocked:   map[string][]string{"10.0.0.1": dropAction{}.RuleSpec("10.0.0.1")},
+		pending:   map[string][]string{"10.0.0.2": dropAction{}.RuleSpec("10.0.0.2")},
+		allowList: []string{"10.0.0.3"},
+	}
+	assert.False(t, firewall.Changes(detection.Detection{IP: "10.0.0.1", Type: detection.PortScan, Score: 4}))
+	assert.False(t, firewall.Changes(detection.Detection{IP: "10.0.0.2", Type: detection.PortScan, Score: 4}))
+	assert.True(t, firewall.Changes(detection.Detection{IP: "10.0.0.1", Type: detection.PortScan, Score: 12}), "higher tier")
+	assert.False(t, firewall.Changes(detection.Detection{IP: "10.0.0.3", Type: detection.PortScan, Score: 4}), "allowed")
+	assert.True(t, firewall.Changes(detection.Detection{IP: "10.0.0.4", Type: detection.PortScan, Score: 4}), "new block")
+}
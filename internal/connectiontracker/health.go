@@ -0,0 +1,148 @@
+package connectiontracker
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// heartbeatTimeout of the capture, the loop beats after every read of the handle, the reads return
+// within captureTimeout, and while it waits for reopening the device
+const heartbeatTimeout = 10 * time.Second
+
+var (
+	errCaptureNotRunning = errors.New("capture is not running")
+	errDetectorStopped   = errors.New("detector goroutines are not running")
+)
+
+// probes keep the state of the Tracker goroutines read by liveness and readiness probes
+type probes struct {
+	capturing bool
+	// reopening is the error of the failed capture handle while the device is being reopened
+	reopening error
+	// failed is the error of the capture handle which cannot be reopened, the capture has stopped
+	failed    error
+	tracking  bool
+	detecting bool
+	// heartbeat is unix nanoseconds of the last beat, the capture loop beats without the lock
+	heartbeat int64
+	m         sync.Mutex
+}
+
+func (p *probes) setCapturing(running bool) {
+	p.m.Lock()
+	defer p.m.Unlock()
+	p.capturing = running
+	p.reopening = nil
+	if running {
+		p.beat(time.Now())
+	}
+}
+
+// setReopening keeps the capture alive for liveness, readiness fails until the device is reopened
+func (p *probes) setReopening(err error) {
+	p.m.Lock()
+	defer p.m.Unlock()
+	p.capturing = false
+	p.reopening = err
+}
+
+// setFailed stops the capture for liveness and readiness, the device cannot be reopened
+func (p *probes) setFailed(err error) {
+	p.m.Lock()
+	defer p.m.Unlock()
+	p.capturing = false
+	p.reopening = nil
+	p.failed = err
+}
+
+func (p *probes) beat(now time.Time) {
+	atomic.StoreInt64(&p.heartbeat, now.UnixNano())
+}
+
+func (p *probes) lastBeat() time.Time {
+	return time.Unix(0, atomic.LoadInt64(&p.heartbeat))
+}
+
+func (p *probes) setTracking(running bool) {
+	p.m.Lock()
+	defer p.m.Unlock()
+	p.tracking = running
+}
+
+func (p *probes) setDetecting(running bool) {
+	p.m.Lock()
+	defer p.m.Unlock()
+	p.detecting = running
+}
+
+func (p *probes) capture(now time.Time) error {
+	p.m.Lock()
+	defer p.m.Unlock()
+	if p.failed != nil {
+		return fmt.Errorf("capture cannot be reopened: %w", p.failed)
+	}
+	if p.reopening != nil {
+		return nil
+	}
+	if !p.capturing {
+		return errCaptureNotRunning
+	}
+	if since := now.Sub(p.lastBeat()); since > heartbeatTimeout {
+		return fmt.Errorf("capture heartbeat is %s old", since.Round(time.Second))
+	}
+	return nil
+}
+
+func (p *probes) device() error {
+	p.m.Lock()
+	defer p.m.Unlock()
+	if p.reopening != nil {
+		return fmt.Errorf("reopening the capture device: %w", p.reopening)
+	}
+	if p.failed != nil {
+		return fmt.Errorf("capture cannot be reopened: %w", p.failed)
+	}
+	if !p.capturing {
+		return errCaptureNotRunning
+	}
+	return nil
+}
+
+func (p *probes) detector() error {
+	p.m.Lock()
+	defer p.m.Unlock()
+	if !p.tracking || !p.detecting {
+		return errDetectorStopped
+	}
+	return nil
+}
+
+// CheckCapture fails when the capture loop has stopped or got stuck, reopening the device is not a failure of the loop,
+// the device which cannot be reopened without CAP_NET_RAW is
+func (t *Tracker) CheckCapture(context.Context) error {
+	return t.probes.capture(time.Now())
+}
+
+// Heartbeat is the time the capture loop was last seen running, it drives the systemd watchdog
+func (t *Tracker) Heartbeat() time.Time {
+	return t.probes.lastBeat()
+}
+
+// CheckDevice fails while the capture device is being reopened, e.g. after the link went down
+func (t *Tracker) CheckDevice(context.Context) error {
+	return t.probes.device()
+}
+
+// CheckDetector fails when the goroutines tracking connections and blocking port scans have stopped
+func (t *Tracker) CheckDetector(context.Context) error {
+	return t.probes.detector()
+}
+
+// CheckCache fails when the connection store is not reachable, local cache is always reachable
+func (t *Tracker) CheckCache(ctx context.Context) error {
+	return t.cache.ping(ctx)
+}
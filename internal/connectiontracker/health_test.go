@@ -0,0 +1,46 @@
+package connectiontracker
+
+import (
+	"errors"
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func Test_probes(t *testing.T) {
+	var p probes
+	now := time.Now()
+	assert.ErrorIs(t, p.capture(now), errCaptureNotRunning)
+	assert.ErrorIs(t, p.detector(), errDetectorStopped)
+
+	p.setCapturing(true)
+	p.setTracking(true)
+	p.setDetecting(true)
+	assert.NoError(t, p.capture(time.Now()))
+	assert.NoError(t, p.detector())
+
+	// pcap handle stopped responding
+	assert.Error(t, p.capture(time.Now().Add(heartbeatTimeout+time.Second)))
+	p.beat(time.Now().Add(heartbeatTimeout))
+	assert.NoError(t, p.capture(time.Now().Add(heartbeatTimeout+time.Second)))
+
+	p.setDetecting(false)
+	assert.ErrorIs(t, p.detector(), errDetectorStopped)
+	// device is reopened by the running capture loop
+	errDown := errors.New("The interface went down")
+	p.setReopening(errDown)
+	assert.NoError(t, p.capture(time.Now()))
+	assert.ErrorIs(t, p.device(), errDown)
+	p.setCapturing(true)
+	assert.NoError(t, p.device())
+
+	p.setCapturing(false)
+	assert.ErrorIs(t, p.capture(time.Now()), errCaptureNotRunning)
+	assert.ErrorIs(t, p.device(), errCaptureNotRunning)
+
+	// device cannot be reopened without CAP_NET_RAW
+	p.setCapturing(true)
+	p.setFailed(errDown)
+	assert.ErrorIs(t, p.capture(time.Now()), errDown)
+	assert.ErrorIs(t, p.device(), errDown)
+}
@@ -0,0 +1,251 @@
+package connectiontracker
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"github.com/coreos/go-iptables/iptables"
+	"github.com/rs/zerolog/log"
+	"golang.org/x/exp/slices"
+	"io"
+	"net/rpc"
+	"strconv"
+	"strings"
+	"tcptracker/internal/detection"
+)
+
+// helperService is the name of the iptables service of the firewall helper
+const helperService = "Firewall"
+
+var errHelperDenied = errors.New("firewall helper: operation is not allowed")
+
+// ServeFirewallHelper runs iptables and iptables-restore for the unprivileged tracker connected to conn until
+// it disconnects. The helper is the only process keeping CAP_NET_ADMIN, so it changes only the filter table:
+// the block rules of the Actions in the tracker chain and the jump rules to it in the hook chains.
+func ServeFirewallHelper(conn io.ReadWriteCloser, chain string) error {
+	ipv4, err := iptables.NewWithProtocol(iptables.ProtocolIPv4)
+	if err != nil {
+		return err
+	}
+	restorer, err := newIptablesRestore()
+	if err != nil {
+		return err
+	}
+	server := rpc.NewServer()
+	if err := server.RegisterName(helperService, newFirewallHelper(ipv4, restorer, chain)); err != nil {
+		return err
+	}
+	server.ServeConn(conn)
+	return nil
+}
+
+// FirewallHelper executes the calls of remoteIPTables, the exported methods are the RPC methods
+type FirewallHelper struct {
+	iptables     ipTableCoreos
+	restorer     ruleRestorer
+	chain        string
+	jumpRuleSpec []string
+}
+
+func newFirewallHelper(ipv4 ipTableCoreos, restorer ruleRestorer, chain string) *FirewallHelper {
+	chain = orDefault(chain, trackerChain)
+	return &FirewallHelper{
+		iptables:     ipv4,
+		restorer:     restorer,
+		chain:        chain,
+		jumpRuleSpec: jumpRuleSpec(chain),
+	}
+}
+
+// Run executes the iptables call, args are the method, table, chain and the rule spec (position first for Insert)
+func (h *FirewallHelper) Run(args []string, reply *[]string) error {
+	if err := h.permit(args); err != nil {
+		log.Warn().Msgf("Firewall helper: denied %q", args)
+		return err
+	}
+	method, table, chain, spec := args[0], args[1], args[2], args[3:]
+	var err error
+	switch method {
+	case "ChainExists", "Exists":
+		var ok bool
+		if method == "ChainExists" {
+			ok, err = h.iptables.ChainExists(table, chain)
+		} else {
+			ok, err = h.iptables.Exists(table, chain, spec...)
+		}
+		*reply = []string{strconv.FormatBool(ok)}
+	case "NewChain":
+		err = h.iptables.NewChain(table, chain)
+	case "Insert":
+		var pos int
+		if pos, err = strconv.Atoi(spec[0]); err == nil {
+			err = h.iptables.Insert(table, chain, pos, spec[1:]...)
+		}
+	case "AppendUnique":
+		err = h.iptables.AppendUnique(table, chain, spec...)
+	case "DeleteIfExists":
+		err = h.iptables.DeleteIfExists(table, chain, spec...)
+	case "ClearAndDeleteChain":
+		err = h.iptables.ClearAndDeleteChain(table, chain)
+	case "ClearChain":
+		err = h.iptables.ClearChain(table, chain)
+	case "List":
+		*reply, err = h.iptables.List(table, chain)
+	}
+	return err
+}
+
+// permit allows the calls of the tracker chain adding only the block rules, the hook chains are only listed
+// and their jump rules changed. Any rule of the tracker chain can be deleted, so Reconcile removes the foreign ones.
+func (h *FirewallHelper) permit(args []string) error {
+	if len(args) < 3 || args[1] != table {
+		return errHelperDenied
+	}
+	method, chain, spec := args[0], args[2], args[3:]
+	switch method {
+	case "ChainExists", "List", "NewChain", "ClearAndDeleteChain", "ClearChain":
+		if len(spec) > 0 {
+			return errHelperDenied
+		}
+	case "Insert":
+		if len(spec) == 0 {
+			return errHelperDenied
+		}
+		spec = spec[1:]
+	case "Exists", "AppendUnique", "DeleteIfExists":
+	default:
+		return errHelperDenied
+	}
+	if chain == h.chain {
+		if (method == "AppendUnique" || method == "Insert") && !blockRule(spec) {
+			return errHelperDenied
+		}
+		return nil
+	}
+	if chain != inputChain && chain != forwardChain && chain != dockerUserChain {
+		return errHelperDenied
+	}
+	switch method {
+	case "ChainExists", "List":
+		return nil
+	case "Exists", "Insert", "DeleteIfExists":
+		if slices.Equal(spec, h.jumpRuleSpec) {
+			return nil
+		}
+	}
+	return errHelperDenied
+}
+
+// Restore applies the iptables-restore input, every rule must be a block rule appended to the tracker chain
+func (h *FirewallHelper) Restore(rules []byte, reply *bool) error {
+	for _, line := range bytes.Split(rules, []byte("\n")) {
+		fields := strings.Fields(string(line))
+		switch {
+		case len(line) == 0, string(line) == "*"+table, string(line) == "COMMIT":
+		case len(fields) > 2 && fields[0] == "-A" && fields[1] == h.chain && blockRule(fields[2:]):
+		default:
+			log.Warn().Msgf("Firewall helper: denied restore line %q", line)
+			return errHelperDenied
+		}
+	}
+	*reply = true
+	return h.restorer.Restore(rules)
+}
+
+// blockRule tells the spec is the rule of an Action for an IPv4 source, e.g. -s 10.0.0.1 -j DROP,
+// the source can have /32 as iptables lists it
+func blockRule(spec []string) bool {
+	if len(spec) < 4 || spec[0] != "-s" {
+		return false
+	}
+	ip := strings.TrimSuffix(spec[1], "/32")
+	if !detection.ValidIPv4(ip) {
+		return false
+	}
+	actions := []Action{dropAction{}, rejectAction{}, tarpitAction{}}
+	// the rate is the only argument of the rules
+	if len(spec) > 5 && spec[4] == "--hashlimit-above" && validRate(spec[5]) == nil {
+		actions = append(actions, rateLimitAction{rate: spec[5]})
+	}
+	for _, a := range actions {
+		if slices.Equal(spec[2:], a.RuleSpec(ip)[2:]) {
+			return true
+		}
+	}
+	return false
+}
+
+// remoteIPTables calls the firewall helper, it implements ipTableCoreos and ruleRestorer
+type remoteIPTables struct {
+	client *rpc.Client
+}
+
+func newRemoteIPTables(conn io.ReadWriteCloser) *remoteIPTables {
+	return &remoteIPTables{client: rpc.NewClient(conn)}
+}
+
+func (r *remoteIPTables) call(args ...string) ([]string, error) {
+	var reply []string
+	if err := r.client.Call(helperService+".Run", args, &reply); err != nil {
+		return nil, fmt.Errorf("firewall helper: %w", err)
+	}
+	return reply, nil
+}
+
+func (r *remoteIPTables) exists(args ...string) (bool, error) {
+	reply, err := r.call(args...)
+	if err != nil {
+		return false, err
+	}
+	return len(reply) == 1 && reply[0] == "true", nil
+}
+
+func (r *remoteIPTables) ChainExists(table, chain string) (bool, error) {
+	return r.exists("ChainExists", table, chain)
+}
+
+func (r *remoteIPTables) NewChain(table, chain string) error {
+	_, err := r.call("NewChain", table, chain)
+	return err
+}
+
+func (r *remoteIPTables) Insert(table, chain string, pos int, rulespec ...string) error {
+	_, err := r.call(append([]string{"Insert", table, chain, strconv.Itoa(pos)}, rulespec...)...)
+	return err
+}
+
+func (r *remoteIPTables) AppendUnique(table, chain string, rulespec ...string) error {
+	_, err := r.call(append([]string{"AppendUnique", table, chain}, rulespec...)...)
+	return err
+}
+
+func (r *remoteIPTables) DeleteIfExists(table, chain string, rulespec ...string) error {
+	_, err := r.call(append([]string{"DeleteIfExists", table, chain}, rulespec...)...)
+	return err
+}
+
+func (r *remoteIPTables) ClearAndDeleteChain(table, chain string) error {
+	_, err := r.call("ClearAndDeleteChain", table, chain)
+	return err
+}
+
+func (r *remoteIPTables) List(table, chain string) ([]string, error) {
+	return r.call("List", table, chain)
+}
+
+func (r *remoteIPTables) Exists(table, chain string, rulespec ...string) (bool, error) {
+	return r.exists(append([]string{"Exists", table, chain}, rulespec...)...)
+}
+
+func (r *remoteIPTables) ClearChain(table, chain string) error {
+	_, err := r.call("ClearChain", table, chain)
+	return err
+}
+
+func (r *remoteIPTables) Restore(rules []byte) error {
+	var applied bool
+	if err := r.client.Call(helperService+".Restore", rules, &applied); err != nil {
+		return fmt.Errorf("firewall helper: %w", err)
+	}
+	return nil
+}
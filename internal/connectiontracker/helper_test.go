@@ -0,0 +1,112 @@
+package connectiontracker
+
+import (
+	"errors"
+	"github.com/golang/mock/gomock"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"net"
+	"net/rpc"
+	"strings"
+	mock2 "tcptracker/mock"
+	"testing"
+)
+
+func serveHelper(t *testing.T, helper *FirewallHelper) *remoteIPTables {
+	client, server := net.Pipe()
+	rpcServer := rpc.NewServer()
+	require.NoError(t, rpcServer.RegisterName(helperService, helper))
+	go rpcServer.ServeConn(server)
+	t.Cleanup(func() { _ = client.Close() })
+	return newRemoteIPTables(client)
+}
+
+func TestFirewallHelperForwardsCalls(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+	mockIptables := mock2.NewMockIptablesMock(mockCtrl)
+	restorer := &fakeRestorer{}
+	remote := serveHelper(t, newFirewallHelper(mockIptables, restorer, "tracker"))
+	jump := jumpRuleSpec("tracker")
+
+	mockIptables.EXPECT().ChainExists(table, "tracker").Return(true, nil)
+	mockIptables.EXPECT().Insert(table, inputChain, 1, jump).Return(nil)
+	mockIptables.EXPECT().AppendUnique(table, "tracker", "-s", "10.0.0.1", "-j", "DROP").Return(nil)
+	mockIptables.EXPECT().List(table, "tracker").Return([]string{"-N tracker"}, nil)
+	mockIptables.EXPECT().ClearChain(table, "tracker").Return(errors.New("chain is busy"))
+
+	ok, err := remote.ChainExists(table, "tracker")
+	require.NoError(t, err)
+	assert.True(t, ok)
+	require.NoError(t, remote.Insert(table, inputChain, 1, jump...))
+	require.NoError(t, remote.AppendUnique(table, "tracker", "-s", "10.0.0.1", "-j", "DROP"))
+	rules, err := remote.List(table, "tracker")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"-N tracker"}, rules)
+	assert.ErrorContains(t, remote.ClearChain(table, "tracker"), "chain is busy")
+
+	input := "*filter\n-A tracker -s 10.0.0.2/32 -j DROP\nCOMMIT\n"
+	require.NoError(t, remote.Restore([]byte(input)))
+	assert.Equal(t, []string{input}, restorer.calls())
+}
+
+func TestFirewallHelperDeniesOtherRules(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+	// no call reaches iptables
+	restorer := &fakeRestorer{}
+	remote := serveHelper(t, newFirewallHelper(mock2.NewMockIptablesMock(mockCtrl), restorer, "tracker"))
+
+	assert.ErrorContains(t, remote.AppendUnique(table, inputChain, "-j", "ACCEPT"), "not allowed")
+	assert.ErrorContains(t, remote.Insert(table, forwardChain, 1, "-j", "ACCEPT"), "not allowed")
+	assert.ErrorContains(t, remote.ClearChain(table, inputChain), "not allowed")
+	assert.ErrorContains(t, remote.NewChain("nat", "tracker"), "not allowed")
+	assert.ErrorContains(t, remote.DeleteIfExists(table, "OUTPUT", jumpRuleSpec("tracker")...), "not allowed")
+	assert.ErrorContains(t, remote.Restore([]byte("*filter\n-F INPUT\nCOMMIT\n")), "not allowed")
+	assert.ErrorContains(t, remote.Restore([]byte("*filter\n-A trackerX -j ACCEPT\nCOMMIT\n")), "not allowed")
+	assert.ErrorContains(t, remote.Restore([]byte("*filter\n-D tracker -s 10.0.0.1 -j DROP\nCOMMIT\n")), "not allowed")
+	assert.Empty(t, restorer.calls())
+}
+
+func TestFirewallHelperAllowsOnlyBlockRules(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+	mockIptables := mock2.NewMockIptablesMock(mockCtrl)
+	restorer := &fakeRestorer{}
+	remote := serveHelper(t, newFirewallHelper(mockIptables, restorer, "tracker"))
+
+	rateLimit := rateLimitAction{rate: "5/minute"}.RuleSpec("10.0.0.4")
+	for _, rule := range [][]string{
+		dropAction{}.RuleSpec("10.0.0.1"),
+		rejectAction{}.RuleSpec("10.0.0.2"),
+		tarpitAction{}.RuleSpec("10.0.0.3/32"),
+		rateLimit,
+	} {
+		mockIptables.EXPECT().AppendUnique(table, "tracker", rule).Return(nil)
+		assert.NoError(t, remote.AppendUnique(table, "tracker", rule...), rule)
+	}
+	// foreign rules are deleted by Reconcile
+	mockIptables.EXPECT().DeleteIfExists(table, "tracker", "-j", "ACCEPT").Return(nil)
+	assert.NoError(t, remote.DeleteIfExists(table, "tracker", "-j", "ACCEPT"))
+
+	for name, rule := range map[string][]string{
+		"accept":          {"-j", "ACCEPT"},
+		"accept source":   {"-s", "10.0.0.1", "-j", "ACCEPT"},
+		"other match":     {"-s", "10.0.0.1", "-m", "owner", "--uid-owner", "0", "-j", "DROP"},
+		"extra flag":      {"-s", "10.0.0.1", "-j", "DROP", "-i", "lo"},
+		"network":         {"-s", "10.0.0.0/8", "-j", "DROP"},
+		"IPv6":            {"-s", "2001:db8::1", "-j", "DROP"},
+		"negated source":  {"!", "-s", "10.0.0.1", "-j", "DROP"},
+		"reject icmp":     {"-s", "10.0.0.1", "-p", "tcp", "-j", "REJECT", "--reject-with", "icmp-port-unreachable"},
+		"invalid rate":    append(append([]string{}, rateLimit[:5]...), append([]string{"5/week"}, rateLimit[6:]...)...),
+		"other hashlimit": append(append([]string{}, rateLimit[:len(rateLimit)-2]...), "-j", "ACCEPT"),
+	} {
+		t.Run(name, func(t *testing.T) {
+			assert.ErrorContains(t, remote.AppendUnique(table, "tracker", rule...), "not allowed")
+			assert.ErrorContains(t, remote.Insert(table, "tracker", 1, rule...), "not allowed")
+			input := "*filter\n-A tracker " + strings.Join(rule, " ") + "\nCOMMIT\n"
+			assert.ErrorContains(t, remote.Restore([]byte(input)), "not allowed")
+		})
+	}
+	assert.Empty(t, restorer.calls())
+}
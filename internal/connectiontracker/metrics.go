@@ -0,0 +1,248 @@
+package connectiontracker
+
+import (
+	"github.com/google/gopacket/pcap"
+	"github.com/prometheus/client_golang/prometheus"
+	"net"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	directionInbound  = "inbound"
+	directionOutbound = "outbound"
+	// neither source nor destination is the device address, e.g. routed to containers
+	directionForwarded = "forwarded"
+
+	otherPort = "other"
+
+	// topSourcesCount is the number of sources exported in tcptracker_top_source_connections
+	topSourcesCount = 10
+	// topSourcesCapacity bounds the memory of counting sources, see topSources
+	topSourcesCapacity = 100
+)
+
+// wellKnownPorts are exported as `port` label, the rest is `other`, it keeps cardinality bounded
+var wellKnownPorts = map[int]bool{
+	21: true, 22: true, 23: true, 25: true, 53: true, 80: true, 110: true, 111: true, 135: true, 139: true,
+	143: true, 443: true, 445: true, 465: true, 587: true, 993: true, 995: true, 1433: true, 1521: true,
+	2049: true, 2375: true, 3306: true, 3389: true, 5432: true, 5900: true, 6379: true, 8080: true,
+	8443: true, 9200: true, 11211: true, 27017: true,
+}
+
+var (
+	detections = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "tcptracker_detections_total",
+		Help: "Detections by type",
+	}, []string{"type"})
+	// exemplars carry source_ip, from the latency spike the logs of the source can be found
+	detectionLatency = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Name:    "tcptracker_packet_to_detection_seconds",
+		Help:    "Latency from capturing the packet to detecting the port scan it completes",
+		Buckets: prometheus.ExponentialBuckets(0.0001, 4, 9),
+	})
+	captureUp = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "tcptracker_capture_up",
+		Help: "Whether the capture handle of the device is open",
+	})
+	captureReopens = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "tcptracker_capture_reopens_total",
+		Help: "Failures of the capture handle, the device is reopened with backoff after each of them",
+	})
+	captureDecodeErrors = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "tcptracker_capture_decode_errors_total",
+		Help: "Captured packets skipped without decodable IPv4 and TCP layers",
+	})
+	// exemplars carry detection_id, logged with the detection and listed with the block
+	blockLatency = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Name:    "tcptracker_detection_to_block_seconds",
+		Help:    "Latency from the detection to the firewall rule applied, including the batch window",
+		Buckets: prometheus.ExponentialBuckets(0.001, 3, 10),
+	})
+)
+
+var (
+	cacheHitsDesc = prometheus.NewDesc("tcptracker_cache_hits_total",
+		"Connection cache lookups finding the source already tracked", nil, nil)
+	cacheMissesDesc = prometheus.NewDesc("tcptracker_cache_misses_total",
+		"Connection cache lookups of not tracked sources", nil, nil)
+	cacheEvictionsDesc = prometheus.NewDesc("tcptracker_cache_evictions_total",
+		"Connection cache entries evicted or expired", nil, nil)
+	cacheEntriesDesc = prometheus.NewDesc("tcptracker_cache_entries",
+		"Connection cache entries currently stored", nil, nil)
+	channelDepthDesc = prometheus.NewDesc("tcptracker_channel_depth",
+		"Entries waiting in the pipeline channels, the capture blocks when the channel is full", []string{"channel"}, nil)
+	pcapReceivedDesc = prometheus.NewDesc("tcptracker_pcap_packets_received_total",
+		"Packets received by the capture handle, reported by pcap", nil, nil)
+	pcapDroppedDesc = prometheus.NewDesc("tcptracker_pcap_packets_dropped_total",
+		"Packets dropped because there was no room in the capture buffer, reported by pcap", nil, nil)
+	pcapIfDroppedDesc = prometheus.NewDesc("tcptracker_pcap_packets_if_dropped_total",
+		"Packets dropped by the network interface or its driver, reported by pcap", nil, nil)
+	topSourceDesc = prometheus.NewDesc("tcptracker_top_source_connections",
+		"New connections of the busiest sources in the last complete minute", []string{"source"}, nil)
+)
+
+// observe records the latency with the exemplar, histograms created with prometheus.NewHistogram support exemplars
+func observe(h prometheus.Histogram, latency time.Duration, exemplar prometheus.Labels) {
+	if observer, ok := h.(prometheus.ExemplarObserver); ok {
+		observer.ObserveWithExemplar(latency.Seconds(), exemplar)
+		return
+	}
+	h.Observe(latency.Seconds())
+}
+
+func portBucket(port int) string {
+	if wellKnownPorts[port] {
+		return strconv.Itoa(port)
+	}
+	return otherPort
+}
+
+func direction(localIPs map[string]bool, src, dst net.IP) string {
+	switch {
+	case localIPs[dst.String()]:
+		return directionInbound
+	case localIPs[src.String()]:
+		return directionOutbound
+	}
+	return directionForwarded
+}
+
+type sourceCount struct {
+	source string
+	count  uint64
+}
+
+// topSources counts connections per source in windows with Space-Saving algorithm, at most capacity sources are kept,
+// when full the least counted source is replaced, so a flood from random sources cannot grow the memory
+// Counts are approximate, overestimated by at most the count of the replaced source
+type topSources struct {
+	capacity int
+	window   time.Duration
+	counts   map[string]uint64
+	started  time.Time
+	last     []sourceCount // top of the last complete window
+	m        sync.Mutex
+}
+
+func newTopSources(capacity int, window time.Duration) *topSources {
+	return &topSources{
+		capacity: capacity,
+		window:   window,
+		counts:   make(map[string]uint64, capacity),
+	}
+}
+
+func (s *topSources) add(source string, now time.Time) {
+	s.m.Lock()
+	defer s.m.Unlock()
+	s.rotate(now)
+	if _, ok := s.counts[source]; ok || len(s.counts) < s.capacity {
+		s.counts[source]++
+		return
+	}
+	minSource, minCount := "", uint64(0)
+	for src, count := range s.counts {
+		if minSource == "" || count < minCount {
+			minSource, minCount = src, count
+		}
+	}
+	delete(s.counts, minSource)
+	s.counts[source] = minCount + 1
+}
+
+// top returns at most n sources of the last complete window ordered by count
+func (s *topSources) top(n int, now time.Time) []sourceCount {
+	s.m.Lock()
+	defer s.m.Unlock()
+	s.rotate(now)
+	if len(s.last) > n {
+		return append([]sourceCount(nil), s.last[:n]...)
+	}
+	return append([]sourceCount(nil), s.last...)
+}
+
+// rotate starts the new window when the current one is over, s.m must be held
+func (s *topSources) rotate(now time.Time) {
+	if s.started.IsZero() {
+		s.started = now
+	}
+	if now.Sub(s.started) < s.window {
+		return
+	}
+	// nothing was counted during the window following the complete one
+	if now.Sub(s.started) >= 2*s.window {
+		s.counts = make(map[string]uint64, s.capacity)
+	}
+	s.last = make([]sourceCount, 0, len(s.counts))
+	for source, count := range s.counts {
+		s.last = append(s.last, sourceCount{source: source, count: count})
+	}
+	sort.Slice(s.last, func(i, j int) bool {
+		if s.last[i].count == s.last[j].count {
+			return s.last[i].source < s.last[j].source
+		}
+		return s.last[i].count > s.last[j].count
+	})
+	s.counts = make(map[string]uint64, s.capacity)
+	s.started = now
+}
+
+// captureStats keeps the last handle.Stats(), the handle is owned by the capture loop and is not read on scrape
+type captureStats struct {
+	stats pcap.Stats
+	m     sync.Mutex
+}
+
+func (c *captureStats) set(stats *pcap.Stats) {
+	c.m.Lock()
+	defer c.m.Unlock()
+	c.stats = *stats
+}
+
+func (c *captureStats) get() pcap.Stats {
+	c.m.Lock()
+	defer c.m.Unlock()
+	return c.stats
+}
+
+// trackerCollector reads cache stats, channel depths and pcap stats of the Tracker on every scrape
+type trackerCollector struct {
+	t *Tracker
+}
+
+func (c trackerCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- cacheHitsDesc
+	ch <- cacheMissesDesc
+	ch <- cacheEvictionsDesc
+	ch <- cacheEntriesDesc
+	ch <- channelDepthDesc
+	ch <- pcapReceivedDesc
+	ch <- pcapDroppedDesc
+	ch <- pcapIfDroppedDesc
+	ch <- topSourceDesc
+}
+
+func (c trackerCollector) Collect(ch chan<- prometheus.Metric) {
+	cache := c.t.cache.stats()
+	ch <- prometheus.MustNewConstMetric(cacheHitsDesc, prometheus.CounterValue, float64(cache.Hits))
+	ch <- prometheus.MustNewConstMetric(cacheMissesDesc, prometheus.CounterValue, float64(cache.Misses))
+	ch <- prometheus.MustNewConstMetric(cacheEvictionsDesc, prometheus.CounterValue, float64(cache.Evictions))
+	ch <- prometheus.MustNewConstMetric(cacheEntriesDesc, prometheus.GaugeValue, float64(cache.Entries))
+
+	ch <- prometheus.MustNewConstMetric(channelDepthDesc, prometheus.GaugeValue,
+		float64(len(c.t.newConnections)), "new_connections")
+	ch <- prometheus.MustNewConstMetric(channelDepthDesc, prometheus.GaugeValue,
+		float64(len(c.t.portScans)), "port_scans")
+
+	capture := c.t.captureStats.get()
+	ch <- prometheus.MustNewConstMetric(pcapReceivedDesc, prometheus.CounterValue, float64(capture.PacketsReceived))
+	ch <- prometheus.MustNewConstMetric(pcapDroppedDesc, prometheus.CounterValue, float64(capture.PacketsDropped))
+	ch <- prometheus.MustNewConstMetric(pcapIfDroppedDesc, prometheus.CounterValue, float64(capture.PacketsIfDropped))
+
+	for _, top := range c.t.topSources.top(topSourcesCount, time.Now()) {
+		ch <- prometheus.MustNewConstMetric(topSourceDesc, prometheus.GaugeValue, float64(top.count), top.source)
+	}
+}
@@ -0,0 +1,114 @@
+package connectiontracker
+
+import (
+	"context"
+	"github.com/google/gopacket/pcap"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTrackerCollector(t *testing.T) {
+	tracker := NewTracker(TrackerParams{Metrics: prometheus.NewRegistry()})
+	ctx := context.Background()
+	srcIP := net.ParseIP("172.217.16.14")
+	dstIP := net.ParseIP("192.217.16.14")
+	tracker.cache.getOrSet(ctx, &ConnEntry{SrcIP: &srcIP, DstIP: &dstIP, Ports: map[int]bool{80: true}})
+	// ristretto applies Set asynchronously
+	time.Sleep(10 * time.Millisecond)
+	tracker.cache.getOrSet(ctx, &ConnEntry{SrcIP: &srcIP, DstIP: &dstIP, Ports: map[int]bool{443: true}})
+	tracker.newConnections <- &ConnEntry{SrcIP: &srcIP, DstIP: &dstIP}
+	tracker.captureStats.set(&pcap.Stats{PacketsReceived: 10, PacketsDropped: 2, PacketsIfDropped: 1})
+
+	expected := `
+# HELP tcptracker_cache_hits_total Connection cache lookups finding the source already tracked
+# TYPE tcptracker_cache_hits_total counter
+tcptracker_cache_hits_total 1
+# HELP tcptracker_cache_misses_total Connection cache lookups of not tracked sources
+# TYPE tcptracker_cache_misses_total counter
+tcptracker_cache_misses_total 1
+# HELP tcptracker_channel_depth Entries waiting in the pipeline channels, the capture blocks when the channel is full
+# TYPE tcptracker_channel_depth gauge
+tcptracker_channel_depth{channel="new_connections"} 1
+tcptracker_channel_depth{channel="port_scans"} 0
+# HELP tcptracker_pcap_packets_dropped_total Packets dropped because there was no room in the capture buffer, reported by pcap
+# TYPE tcptracker_pcap_packets_dropped_total counter
+tcptracker_pcap_packets_dropped_total 2
+# HELP tcptracker_pcap_packets_if_dropped_total Packets dropped by the network interface or its driver, reported by pcap
+# TYPE tcptracker_pcap_packets_if_dropped_total counter
+tcptracker_pcap_packets_if_dropped_total 1
+# HELP tcptracker_pcap_packets_received_total Packets received by the capture handle, reported by pcap
+# TYPE tcptracker_pcap_packets_received_total counter
+tcptracker_pcap_packets_received_total 10
+`
+	err := testutil.CollectAndCompare(trackerCollector{t: tracker}, strings.NewReader(expected),
+		"tcptracker_cache_hits_total", "tcptracker_cache_misses_total", "tcptracker_channel_depth",
+		"tcptracker_pcap_packets_received_total", "tcptracker_pcap_packets_dropped_total",
+		"tcptracker_pcap_packets_if_dropped_total")
+	require.NoError(t, err)
+	assert.Equal(t, uint64(1), tracker.cache.stats().Entries)
+}
+
+func Test_portBucket(t *testing.T) {
+	assert.Equal(t, "22", portBucket(22))
+	assert.Equal(t, "443", portBucket(443))
+	assert.Equal(t, otherPort, portBucket(31337))
+}
+
+func Test_direction(t *testing.T) {
+	local := map[string]bool{"192.168.0.10": true}
+	tests := []struct {
+		name string
+		src  string
+		dst  string
+		want string
+	}{
+		{name: "inbound", src: "10.0.0.1", dst: "192.168.0.10", want: directionInbound},
+		{name: "outbound", src: "192.168.0.10", dst: "10.0.0.1", want: directionOutbound},
+		{name: "forwarded", src: "10.0.0.1", dst: "172.17.0.2", want: directionForwarded},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.want, direction(local, net.ParseIP(tt.src), net.ParseIP(tt.dst)))
+		})
+	}
+}
+
+func Test_topSources(t *testing.T) {
+	now := time.Now()
+	top := newTopSources(3, time.Minute)
+	for i := 0; i < 5; i++ {
+		top.add("10.0.0.1", now)
+	}
+	for i := 0; i < 3; i++ {
+		top.add("10.0.0.2", now)
+	}
+	top.add("10.0.0.3", now)
+	// capacity is full, replaces the least counted 10.0.0.3
+	top.add("10.0.0.4", now)
+	assert.Len(t, top.counts, 3)
+	assert.Empty(t, top.top(2, now), "window is not complete")
+
+	got := top.top(2, now.Add(time.Minute))
+	assert.Equal(t, []sourceCount{{source: "10.0.0.1", count: 5}, {source: "10.0.0.2", count: 3}}, got)
+	assert.Empty(t, top.top(2, now.Add(3*time.Minute)), "nothing counted in the last window")
+}
+
+func Test_observeWithExemplar(t *testing.T) {
+	h := prometheus.NewHistogram(prometheus.HistogramOpts{Name: "latency", Buckets: []float64{1}})
+	observe(h, 100*time.Millisecond, prometheus.Labels{"detection_id": "abc"})
+
+	m := &dto.Metric{}
+	require.NoError(t, h.Write(m))
+	exemplar := m.GetHistogram().GetBucket()[0].GetExemplar()
+	require.NotNil(t, exemplar)
+	assert.Equal(t, "detection_id", exemplar.GetLabel()[0].GetName())
+	assert.Equal(t, "abc", exemplar.GetLabel()[0].GetValue())
+	assert.InDelta(t, 0.1, exemplar.GetValue(), 0.001)
+}
@@ -0,0 +1,92 @@
+package connectiontracker
+
+import (
+	"context"
+	"github.com/go-redis/redis/v8"
+	"github.com/rs/zerolog/log"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+const redisKeyPrefix = "tcptracker:ports:"
+
+// connStore keeps the Ports seen per connection in the time window
+type connStore interface {
+	getOrSet(ctx context.Context, conn *ConnEntry) *ConnEntry
+	stats() cacheStats
+	ping(ctx context.Context) error
+}
+
+// redisStore shares the observed Ports between tracker nodes, so a scan spread across the fleet trips detection everywhere
+// Ports are merged per source IP, because every node sees the scan against its own destination IP
+// gocache Redis store is not used, Get and Set from many nodes would override each other, SADD is atomic
+type redisStore struct {
+	client   *redis.Client
+	cacheTTL time.Duration
+	// local is used when Redis is not available, detection keeps working with the node own observations
+	local *connCache
+	// hit is counted when the source IP was already seen by any node
+	hits, misses uint64
+}
+
+func newRedisStore(client *redis.Client, ttl time.Duration) *redisStore {
+	return &redisStore{
+		client:   client,
+		cacheTTL: ttl,
+		local:    newCacheManager(ttl),
+	}
+}
+
+func (r *redisStore) getOrSet(ctx context.Context, conn *ConnEntry) *ConnEntry {
+	key := redisKeyPrefix + conn.SrcIP.String()
+	ports := make([]interface{}, 0, len(conn.Ports))
+	for port := range conn.Ports {
+		ports = append(ports, strconv.Itoa(port))
+	}
+	var added *redis.IntCmd
+	var members *redis.StringSliceCmd
+	_, err := r.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		added = pipe.SAdd(ctx, key, ports...)
+		pipe.Expire(ctx, key, r.cacheTTL)
+		members = pipe.SMembers(ctx, key)
+		return nil
+	})
+	if err != nil {
+		log.Err(err).Msg("Shared state is not available, using local cache")
+		return r.local.getOrSet(ctx, conn)
+	}
+	if added.Val() < int64(len(members.Val())) {
+		atomic.AddUint64(&r.hits, 1)
+	} else {
+		atomic.AddUint64(&r.misses, 1)
+	}
+	merged := make(map[int]bool)
+	for _, member := range members.Val() {
+		port, errConv := strconv.Atoi(member)
+		if errConv != nil {
+			continue
+		}
+		merged[port] = true
+	}
+	return &ConnEntry{
+		SrcIP: conn.SrcIP,
+		DstIP: conn.DstIP,
+		Ports: merged,
+	}
+}
+
+// stats of the shared state, Redis expires the keys on its own, so evictions and entries are only of the local fallback
+func (r *redisStore) stats() cacheStats {
+	local := r.local.stats()
+	return cacheStats{
+		Hits:      atomic.LoadUint64(&r.hits) + local.Hits,
+		Misses:    atomic.LoadUint64(&r.misses) + local.Misses,
+		Evictions: local.Evictions,
+		Entries:   local.Entries,
+	}
+}
+
+func (r *redisStore) ping(ctx context.Context) error {
+	return r.client.Ping(ctx).Err()
+}
@@ -0,0 +1,54 @@
+package connectiontracker
+
+import (
+	"context"
+	"github.com/alicebob/miniredis/v2"
+	"github.com/go-redis/redis/v8"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"net"
+	"testing"
+	"time"
+)
+
+func Test_redisStore_mergesNodes(t *testing.T) {
+	ctx := context.Background()
+	server := miniredis.RunT(t)
+	node1 := newRedisStore(redis.NewClient(&redis.Options{Addr: server.Addr()}), time.Minute)
+	node2 := newRedisStore(redis.NewClient(&redis.Options{Addr: server.Addr()}), time.Minute)
+
+	srcIP := net.ParseIP("172.44.55.76")
+	dstNode1 := net.ParseIP("192.44.55.1")
+	dstNode2 := net.ParseIP("192.44.55.2")
+	node1.getOrSet(ctx, &ConnEntry{SrcIP: &srcIP, DstIP: &dstNode1, Ports: map[int]bool{7070: true}})
+	node1.getOrSet(ctx, &ConnEntry{SrcIP: &srcIP, DstIP: &dstNode1, Ports: map[int]bool{8080: true}})
+	got := node2.getOrSet(ctx, &ConnEntry{SrcIP: &srcIP, DstIP: &dstNode2, Ports: map[int]bool{9090: true}})
+
+	assert.Equal(t, map[int]bool{7070: true, 8080: true, 9090: true}, got.Ports)
+	assert.Equal(t, dstNode2.String(), got.DstIP.String())
+	assert.False(t, isPortScanning(len(got.Ports), 3))
+
+	server.FastForward(2 * time.Minute)
+	expired := node1.getOrSet(ctx, &ConnEntry{SrcIP: &srcIP, DstIP: &dstNode1, Ports: map[int]bool{6060: true}})
+	assert.Equal(t, map[int]bool{6060: true}, expired.Ports)
+	// first and the expired lookups of node1 are misses
+	assert.Equal(t, uint64(1), node1.stats().Hits)
+	assert.Equal(t, uint64(2), node1.stats().Misses)
+	assert.Equal(t, uint64(1), node2.stats().Hits)
+}
+
+func Test_redisStore_fallbackToLocal(t *testing.T) {
+	ctx := context.Background()
+	server := miniredis.RunT(t)
+	store := newRedisStore(redis.NewClient(&redis.Options{Addr: server.Addr(), MaxRetries: -1}), time.Minute)
+	require.NoError(t, store.ping(ctx))
+	server.Close()
+	require.Error(t, store.ping(ctx))
+
+	srcIP := net.ParseIP("172.44.55.76")
+	dstIP := net.ParseIP("192.44.55.1")
+	conn := &ConnEntry{SrcIP: &srcIP, DstIP: &dstIP, Ports: map[int]bool{7070: true}}
+	got := store.getOrSet(ctx, conn)
+	require.NotNil(t, got)
+	assert.Equal(t, conn, got)
+}
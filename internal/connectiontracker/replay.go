@@ -0,0 +1,56 @@
+package connectiontracker
+
+import (
+	"context"
+	"fmt"
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcap"
+	"github.com/google/gopacket/pcapgo"
+	"io"
+)
+
+// Replay feeds the TCP packets of the pcap file through the running detection, the capture BPF filter is applied,
+// detected sources are blocked as if they were captured. It returns the number of replayed connections.
+func (t *Tracker) Replay(ctx context.Context, r io.Reader) (int, error) {
+	if err := t.CheckDetector(ctx); err != nil {
+		return 0, err
+	}
+	reader, err := pcapgo.NewReader(r)
+	if err != nil {
+		return 0, fmt.Errorf("reading pcap: %w", err)
+	}
+	filter, err := pcap.NewBPF(reader.LinkType(), t.snapLen, t.bpfFilter)
+	if err != nil {
+		return 0, err
+	}
+	replayed := 0
+	for {
+		data, ci, err := reader.ReadPacketData()
+		if err == io.EOF {
+			return replayed, nil
+		}
+		if err != nil {
+			return replayed, fmt.Errorf("reading pcap: %w", err)
+		}
+		if ctx.Err() != nil {
+			return replayed, ctx.Err()
+		}
+		if !filter.Matches(ci, data) {
+			continue
+		}
+		packet := gopacket.NewPacket(data, reader.LinkType(), gopacket.NoCopy)
+		ip4, ok := packet.Layer(layers.LayerTypeIPv4).(*layers.IPv4)
+		if !ok {
+			continue
+		}
+		tcp, ok := packet.Layer(layers.LayerTypeTCP).(*layers.TCP)
+		if !ok {
+			continue
+		}
+		if !t.track(ip4, tcp, ci.Timestamp, t.newConnections) {
+			return replayed, errCaptureNotRunning
+		}
+		replayed++
+	}
+}
@@ -0,0 +1,80 @@
+package connectiontracker
+
+import (
+	"bytes"
+	"context"
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcapgo"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"net"
+	"testing"
+	"time"
+)
+
+// serializePacket returns the Ethernet frame of 10.0.0.1 -> 10.0.0.2 with the TCP or UDP layer
+func serializePacket(t *testing.T, transport gopacket.SerializableLayer) []byte {
+	eth := &layers.Ethernet{
+		SrcMAC:       net.HardwareAddr{0, 0, 0, 0, 0, 1},
+		DstMAC:       net.HardwareAddr{0, 0, 0, 0, 0, 2},
+		EthernetType: layers.EthernetTypeIPv4,
+	}
+	ip := &layers.IPv4{Version: 4, TTL: 64, SrcIP: net.IPv4(10, 0, 0, 1), DstIP: net.IPv4(10, 0, 0, 2)}
+	switch l := transport.(type) {
+	case *layers.TCP:
+		ip.Protocol = layers.IPProtocolTCP
+		require.NoError(t, l.SetNetworkLayerForChecksum(ip))
+	case *layers.UDP:
+		ip.Protocol = layers.IPProtocolUDP
+		require.NoError(t, l.SetNetworkLayerForChecksum(ip))
+	}
+	buf := gopacket.NewSerializeBuffer()
+	opts := gopacket.SerializeOptions{FixLengths: true, ComputeChecksums: true}
+	require.NoError(t, gopacket.SerializeLayers(buf, opts, eth, ip, transport))
+	return buf.Bytes()
+}
+
+func writePcap(t *testing.T, packets ...gopacket.SerializableLayer) *bytes.Buffer {
+	var b bytes.Buffer
+	w := pcapgo.NewWriter(&b)
+	require.NoError(t, w.WriteFileHeader(snapLen, layers.LinkTypeEthernet))
+	for i, transport := range packets {
+		data := serializePacket(t, transport)
+		ci := gopacket.CaptureInfo{
+			Timestamp:     time.Unix(1700000000, 0).Add(time.Duration(i) * time.Millisecond),
+			CaptureLength: len(data),
+			Length:        len(data),
+		}
+		require.NoError(t, w.WritePacket(ci, data))
+	}
+	return &b
+}
+
+func TestReplay(t *testing.T) {
+	tracker := NewTracker(TrackerParams{DeviceName: "eth0", Metrics: prometheus.NewRegistry()})
+	pcapFile := writePcap(t,
+		&layers.TCP{SrcPort: 40000, DstPort: 22, SYN: true},
+		&layers.UDP{SrcPort: 40000, DstPort: 53},
+		&layers.TCP{SrcPort: 40000, DstPort: 80, SYN: true},
+	)
+
+	_, err := tracker.Replay(context.Background(), pcapFile)
+	assert.ErrorIs(t, err, errDetectorStopped)
+
+	tracker.probes.setTracking(true)
+	tracker.probes.setDetecting(true)
+	replayed, err := tracker.Replay(context.Background(), pcapFile)
+	require.NoError(t, err)
+	assert.Equal(t, 2, replayed)
+	require.Len(t, tracker.newConnections, 2)
+	first, second := <-tracker.newConnections, <-tracker.newConnections
+	assert.Equal(t, "10.0.0.1", first.SrcIP.String())
+	assert.Equal(t, map[int]bool{22: true}, first.Ports)
+	assert.Equal(t, map[int]bool{80: true}, second.Ports)
+	assert.True(t, second.Seen.Equal(time.Unix(1700000000, 0).Add(2*time.Millisecond)), "packet timestamp is kept")
+
+	_, err = tracker.Replay(context.Background(), bytes.NewBufferString("not a pcap"))
+	assert.Error(t, err)
+}
@@ -0,0 +1,323 @@
+package connectiontracker
+
+import (
+	"context"
+	"errors"
+	"github.com/golang/mock/gomock"
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcap"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"io"
+	"sync"
+	"sync/atomic"
+	"tcptracker/internal/detection"
+	"tcptracker/mock"
+	"testing"
+	"time"
+)
+
+// fakeHandle is fed by the test, reads time out like *pcap.Handle and return io.EOF once it is closed
+type fakeHandle struct {
+	packets chan []byte
+	errs    chan error
+	closed  chan struct{}
+	once    sync.Once
+}
+
+func newFakeHandle() *fakeHandle {
+	return &fakeHandle{packets: make(chan []byte), errs: make(chan error), closed: make(chan struct{})}
+}
+
+func (h *fakeHandle) ReadPacketData() ([]byte, gopacket.CaptureInfo, error) {
+	select {
+	case data := <-h.packets:
+		return data, gopacket.CaptureInfo{Timestamp: time.Now(), CaptureLength: len(data), Length: len(data)}, nil
+	case err := <-h.errs:
+		return nil, gopacket.CaptureInfo{}, err
+	case <-h.closed:
+		return nil, gopacket.CaptureInfo{}, io.EOF
+	case <-time.After(10 * time.Millisecond):
+		return nil, gopacket.CaptureInfo{}, pcap.NextErrorTimeoutExpired
+	}
+}
+
+func (h *fakeHandle) LinkType() layers.LinkType { return layers.LinkTypeEthernet }
+
+func (h *fakeHandle) Stats() (*pcap.Stats, error) { return &pcap.Stats{}, nil }
+
+func (h *fakeHandle) Close() { h.once.Do(func() { close(h.closed) }) }
+
+func TestExecuteShutdownDrainsPipeline(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	mockFw := mock.NewMockFirewall(ctrl)
+	tracker := NewTracker(TrackerParams{DeviceName: "eth0", Firewall: mockFw, Metrics: prometheus.NewRegistry()})
+	handle := newFakeHandle()
+	tracker.openHandle = func() (packetHandle, error) { return handle, nil }
+
+	var blocked []detection.Detection
+	var m sync.Mutex
+	mockFw.EXPECT().Block(gomock.Any()).DoAndReturn(func(d detection.Detection) error {
+		// slow firewall, the shutdown has to wait for it
+		time.Sleep(50 * time.Millisecond)
+		m.Lock()
+		defer m.Unlock()
+		blocked = append(blocked, d)
+		return nil
+	}).MinTimes(1)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		tracker.Execute(ctx)
+	}()
+	// the cache applies the ports asynchronously and the scan is found once more than 3 ports were seen before
+	ports := []layers.TCPPort{22, 80, 443, 8080, 8443}
+	for _, port := range ports {
+		handle.packets <- serializePacket(t, &layers.TCP{SrcPort: 40000, DstPort: port, SYN: true})
+		time.Sleep(20 * time.Millisecond)
+	}
+	require.Eventually(t, func() bool { return len(tracker.Connections()) == len(ports) }, time.Second, 5*time.Millisecond)
+	cancel()
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Execute did not return after cancel")
+	}
+	m.Lock()
+	require.NotEmpty(t, blocked, "port scan captured before the cancel is blocked before Execute returns")
+	assert.Equal(t, "10.0.0.1", blocked[0].IP)
+	m.Unlock()
+	select {
+	case <-handle.closed:
+	default:
+		t.Fatal("capture handle is not closed")
+	}
+	assert.Error(t, tracker.CheckCapture(context.Background()))
+	assert.Error(t, tracker.CheckDetector(context.Background()))
+	_, err := tracker.Replay(context.Background(), writePcap(t, &layers.TCP{SrcPort: 40000, DstPort: 22, SYN: true}))
+	assert.Error(t, err, "replay after shutdown does not send to the closed channel")
+}
+
+func TestExecuteStopsIdleCapture(t *testing.T) {
+	tracker := NewTracker(TrackerParams{DeviceName: "eth0", Metrics: prometheus.NewRegistry()})
+	handle := newFakeHandle()
+	tracker.openHandle = func() (packetHandle, error) { return handle, nil }
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		tracker.Execute(ctx)
+	}()
+	require.Eventually(t, func() bool { return tracker.CheckDetector(ctx) == nil }, time.Second, 5*time.Millisecond)
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("Execute did not return after cancel")
+	}
+}
+
+func TestCaptureBeatsOnQuietHost(t *testing.T) {
+	tracker := NewTracker(TrackerParams{DeviceName: "eth0", Metrics: prometheus.NewRegistry()})
+	handle := newFakeHandle()
+	tracker.openHandle = func() (packetHandle, error) { return handle, nil }
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		tracker.capture(ctx, tracker.newConnections)
+	}()
+	<-tracker.Started()
+	// only the read timeouts, no packet and no pcap stats
+	started := tracker.Heartbeat()
+	require.Eventually(t, func() bool { return tracker.Heartbeat().After(started) }, time.Second, 5*time.Millisecond)
+	assert.NoError(t, tracker.CheckCapture(ctx))
+
+	// stuck in a read
+	stuck := started.Add(heartbeatTimeout + time.Second)
+	assert.Error(t, tracker.probes.capture(stuck))
+	cancel()
+	<-done
+}
+
+func TestCaptureBeatsWhileReopening(t *testing.T) {
+	tracker := NewTracker(TrackerParams{DeviceName: "eth0", Metrics: prometheus.NewRegistry()})
+	tracker.reopenBackoff = time.Hour
+	tracker.canReopen = func() bool { return true }
+	tracker.openHandle = func() (packetHandle, error) { return nil, errors.New("eth0: No such device exists") }
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		tracker.capture(ctx, tracker.newConnections)
+	}()
+	require.Eventually(t, func() bool { return tracker.Heartbeat().Unix() > 0 },
+		time.Second, 5*time.Millisecond)
+	first := tracker.Heartbeat()
+	require.Eventually(t, func() bool { return tracker.Heartbeat().After(first) }, time.Second, 5*time.Millisecond)
+	cancel()
+	<-done
+}
+
+func TestCaptureUsesOpenedHandle(t *testing.T) {
+	tracker := NewTracker(TrackerParams{DeviceName: "eth0", Metrics: prometheus.NewRegistry()})
+	tracker.reopenBackoff = time.Hour
+	tracker.canReopen = func() bool { return true }
+	opened := newFakeHandle()
+	tracker.openHandle = func() (packetHandle, error) { return opened, nil }
+	require.NoError(t, tracker.Open())
+	// privileges are dropped, the device cannot be opened again
+	tracker.openHandle = func() (packetHandle, error) { return nil, errors.New("eth0: Operation not permitted") }
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		tracker.capture(ctx, tracker.newConnections)
+	}()
+	opened.packets <- serializePacket(t, &layers.TCP{SrcPort: 40000, DstPort: 22, SYN: true})
+	entry := <-tracker.newConnections
+	assert.Equal(t, map[int]bool{22: true}, entry.Ports)
+	cancel()
+	<-done
+}
+
+func TestCaptureFailsWithoutNetRaw(t *testing.T) {
+	tracker := NewTracker(TrackerParams{DeviceName: "eth0", Metrics: prometheus.NewRegistry()})
+	tracker.reopenBackoff = 10 * time.Millisecond
+	opened := newFakeHandle()
+	tracker.openHandle = func() (packetHandle, error) { return opened, nil }
+	require.NoError(t, tracker.Open())
+	// privileges are dropped
+	tracker.canReopen = func() bool { return false }
+	var reopened atomic.Bool
+	tracker.openHandle = func() (packetHandle, error) {
+		reopened.Store(true)
+		return nil, errors.New("eth0: Operation not permitted")
+	}
+	reopens := testutil.ToFloat64(captureReopens)
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		tracker.capture(ctx, tracker.newConnections)
+	}()
+	<-tracker.Started()
+	errDown := errors.New("The interface went down")
+	opened.errs <- errDown
+
+	require.Eventually(t, func() bool { return tracker.CheckCapture(ctx) != nil }, time.Second, 5*time.Millisecond)
+	assert.ErrorIs(t, tracker.CheckCapture(ctx), errDown)
+	assert.ErrorIs(t, tracker.CheckDevice(ctx), errDown)
+	// the heartbeat stops, so the systemd watchdog fails too
+	beat := tracker.Heartbeat()
+	time.Sleep(5 * captureTimeout)
+	assert.Equal(t, beat, tracker.Heartbeat())
+	assert.False(t, reopened.Load(), "handle is reopened without CAP_NET_RAW")
+	assert.Equal(t, reopens, testutil.ToFloat64(captureReopens))
+	cancel()
+	<-done
+}
+
+func TestCaptureReopensDevice(t *testing.T) {
+	tracker := NewTracker(TrackerParams{DeviceName: "eth0", Metrics: prometheus.NewRegistry()})
+	tracker.reopenBackoff = 10 * time.Millisecond
+	tracker.canReopen = func() bool { return true }
+	errNoDevice := errors.New("eth0: No such device exists")
+	first, second := newFakeHandle(), newFakeHandle()
+	var opened []*fakeHandle
+	var m sync.Mutex
+	tracker.openHandle = func() (packetHandle, error) {
+		m.Lock()
+		defer m.Unlock()
+		switch len(opened) {
+		case 1:
+			// interface is being recreated
+			opened = append(opened, nil)
+			return nil, errNoDevice
+		case 0:
+			opened = append(opened, first)
+			return first, nil
+		}
+		opened = append(opened, second)
+		return second, nil
+	}
+	reopens := testutil.ToFloat64(captureReopens)
+	decodeErrors := testutil.ToFloat64(captureDecodeErrors)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		tracker.capture(ctx, tracker.newConnections)
+	}()
+
+	// broken and non TCP packets do not stop the capture
+	first.packets <- []byte{0x01, 0x02}
+	first.packets <- serializePacket(t, &layers.UDP{SrcPort: 40000, DstPort: 53})
+	first.packets <- serializePacket(t, &layers.TCP{SrcPort: 40000, DstPort: 22, SYN: true})
+	entry := <-tracker.newConnections
+	assert.Equal(t, map[int]bool{22: true}, entry.Ports)
+	assert.Equal(t, decodeErrors+2, testutil.ToFloat64(captureDecodeErrors))
+	assert.NoError(t, tracker.CheckDevice(ctx))
+	assert.Equal(t, 1.0, testutil.ToFloat64(captureUp))
+	select {
+	case <-tracker.Started():
+	default:
+		t.Fatal("capture is not started")
+	}
+
+	// link went down
+	first.errs <- errors.New("The interface went down")
+	second.packets <- serializePacket(t, &layers.TCP{SrcPort: 40000, DstPort: 80, SYN: true})
+	entry = <-tracker.newConnections
+	assert.Equal(t, map[int]bool{80: true}, entry.Ports)
+	assert.Equal(t, reopens+2, testutil.ToFloat64(captureReopens))
+	assert.NoError(t, tracker.CheckDevice(ctx))
+	assert.NoError(t, tracker.CheckCapture(ctx))
+	select {
+	case <-first.closed:
+	default:
+		t.Fatal("failed handle is not closed")
+	}
+
+	cancel()
+	<-done
+	assert.Equal(t, 0.0, testutil.ToFloat64(captureUp))
+	assert.ErrorIs(t, tracker.CheckDevice(context.Background()), errCaptureNotRunning)
+}
+
+func TestCaptureReportsReopening(t *testing.T) {
+	tracker := NewTracker(TrackerParams{DeviceName: "eth0", Metrics: prometheus.NewRegistry()})
+	tracker.reopenBackoff = time.Hour
+	tracker.canReopen = func() bool { return true }
+	errNoDevice := errors.New("eth0: No such device exists")
+	tracker.openHandle = func() (packetHandle, error) { return nil, errNoDevice }
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		tracker.capture(ctx, tracker.newConnections)
+	}()
+	require.Eventually(t, func() bool { return tracker.CheckDevice(ctx) != nil }, time.Second, 5*time.Millisecond)
+	assert.ErrorIs(t, tracker.CheckDevice(ctx), errNoDevice)
+	assert.NoError(t, tracker.CheckCapture(ctx), "capture loop is alive while waiting for the device")
+	select {
+	case <-tracker.Started():
+		t.Fatal("capture is started without the device")
+	default:
+	}
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("capture did not stop during the backoff")
+	}
+}
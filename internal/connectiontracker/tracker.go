@@ -1,60 +1,114 @@
 package connectiontracker
 
 import (
+	"bufio"
 	"context"
+	"github.com/go-redis/redis/v8"
 	"github.com/google/gopacket"
 	"github.com/google/gopacket/layers"
 	"github.com/google/gopacket/pcap"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/rs/zerolog/log"
 	"net"
+	"os"
 	"sort"
 	"strconv"
 	"strings"
 	"sync"
+	"tcptracker/internal/detection"
+	"tcptracker/internal/events"
 	"time"
 )
 
-const snapLen = 80 // enough to read ipv6 but parsing only ipv4
+const (
+	snapLen = 80 // enough to read ipv6 but parsing only ipv4
+	// window of remembering the ports per source
+	defaultCacheTTL         = time.Minute
+	defaultMinimumPortScans = 3
+)
+
+const (
+	// channelSize gives some room for bursts, depth of the channels is exported in metrics
+	channelSize = 1024
+	// how often pcap stats are read from the handle
+	statsInterval = 5 * time.Second
+	// captureTimeout bounds the reads of the handle, so the capture notices the cancellation
+	captureTimeout = 100 * time.Millisecond
+	// backoff of reopening the failed capture device
+	minReopenBackoff = time.Second
+	maxReopenBackoff = 30 * time.Second
+	// capNetRaw is the bit of CAP_NET_RAW in the capability sets, it is required to open the device
+	capNetRaw = 13
+)
 
 // quick reference https://serverfault.com/a/1000310
 // capturing inbound and outbound traffic
 const bpfFilter = `tcp[tcpflags] &(tcp-syn) != 0 and tcp[tcpflags] &(tcp-ack) = 0`
 
 var (
-	counter = prometheus.NewCounter(prometheus.CounterOpts{
+	counter = prometheus.NewCounterVec(prometheus.CounterOpts{
 		Name: "tcptracker_new_connections",
-		Help: "The current number of tracked requests, take a look at rate(tcptracker_new_connections[5m])",
-	})
+		Help: "The current number of tracked requests, take a look at sum by (port) (rate(tcptracker_new_connections[5m]))",
+	}, []string{"port", "interface", "direction"})
 )
 
 // ConnEntry is used for tracking the connections SourceIP -> DestinationIP : map/set of destination Ports[]
 // `Add the ability to detect a port scan, where a single source IP connects to more than 3 host Ports in the previous minute.`
+// Seen is the capture timestamp of the packet, it is used to measure the detection latency
 type ConnEntry struct {
 	SrcIP *net.IP
 	DstIP *net.IP
 	Ports map[int]bool
+	Seen  time.Time
 }
 
-var (
-	ethLayer layers.Ethernet
-	ipLayer  layers.IPv4
-	tcpLayer layers.TCP
-	tlsLayer layers.TLS
-	udpLayer layers.UDP
-)
-
 // Tracker contains methods to track Connections and Block IPs
 type Tracker struct {
 	deviceName       string
-	cache            *connCache
+	cache            connStore
 	bpfFilter        string
-	parser           *gopacket.DecodingLayerParser
 	snapLen          int
 	minimumPortScans int
 	firewall         Firewall
+	attributor       Attributor
 	timeout          time.Duration
-	m                sync.RWMutex
+	openHandle       func() (packetHandle, error)
+	// opened by Open before Execute, it is used by the first capture
+	opened        packetHandle
+	reopenBackoff time.Duration
+	// canReopen tells the failed handle can be opened again, it cannot without CAP_NET_RAW
+	canReopen func() bool
+	// started is closed once the capture handle is opened for the first time
+	started        chan struct{}
+	startOnce      sync.Once
+	newConnections chan *ConnEntry
+	portScans      chan *ConnEntry
+	// stopped is set under sending when newConnections is closed, Replay cannot send after it
+	stopped      bool
+	sending      sync.RWMutex
+	captureStats captureStats
+	localIPs     map[string]bool // addresses of the device, tells the direction of connections
+	topSources   *topSources
+	recent       *recentConnections
+	events       *events.Broker
+	probes       probes
+	m            sync.RWMutex
+	// window of remembering the ports per source, a source is detected again after it
+	window time.Duration
+	// detected sources in the window, used only by onDetectedPortScan
+	detected   map[string]detectedSource
+	lastPruned time.Time
+}
+
+// detectedSource is the last published detection of the source, the SYNs past the threshold extend its block
+type detectedSource struct {
+	id     string
+	lastAt time.Time
+}
+
+// blockChanger tells Block would add or replace the rule of the IP, e.g. *IPTables
+type blockChanger interface {
+	Changes(d detection.Detection) bool
 }
 
 // TrackerParams required params to run Tracker
@@ -62,70 +116,322 @@ type TrackerParams struct {
 	DeviceName string
 	Firewall   Firewall
 	Metrics    *prometheus.Registry
+	// Attributor is optional, when set detections are attributed to the container or namespace owning destination IP
+	Attributor Attributor
+	// Redis is optional, when set the observed Ports are shared with other tracker nodes
+	Redis *redis.Client
+	// Events is optional, new connections and detections are published there
+	Events *events.Broker
+	// SnapLen, BPFFilter, CacheTTL and MinimumPortScans use the defaults when zero
+	SnapLen   int
+	BPFFilter string
+	// CacheTTL is the window of remembering the ports per source
+	CacheTTL time.Duration
+	// MinimumPortScans is the number of ports in the window above which the source is blocked
+	MinimumPortScans int
 }
 
 func NewTracker(p TrackerParams) *Tracker {
-	p.Metrics.MustRegister(counter)
-	// TODO: pass values via config, env vars
-	return &Tracker{
+	cacheTTL := orDefault(p.CacheTTL, defaultCacheTTL)
+	var cache connStore = newCacheManager(cacheTTL)
+	if p.Redis != nil {
+		cache = newRedisStore(p.Redis, cacheTTL)
+	}
+	t := &Tracker{
 		deviceName:       p.DeviceName,
-		cache:            newCacheManager(1 * time.Minute),
-		bpfFilter:        bpfFilter,
-		snapLen:          snapLen,
-		parser:           newPacketParser(),
-		minimumPortScans: 3,
+		cache:            cache,
+		bpfFilter:        orDefault(p.BPFFilter, bpfFilter),
+		snapLen:          orDefault(p.SnapLen, snapLen),
+		minimumPortScans: orDefault(p.MinimumPortScans, defaultMinimumPortScans),
 		firewall:         p.Firewall,
-		timeout:          pcap.BlockForever,
+		attributor:       p.Attributor,
+		timeout:          captureTimeout,
+		reopenBackoff:    minReopenBackoff,
+		canReopen:        hasNetRaw,
+		started:          make(chan struct{}),
+		newConnections:   make(chan *ConnEntry, channelSize),
+		portScans:        make(chan *ConnEntry, channelSize),
+		topSources:       newTopSources(topSourcesCapacity, cacheTTL),
+		recent:           newRecentConnections(recentConnectionsSize),
+		events:           p.Events,
+		window:           cacheTTL,
+		detected:         make(map[string]detectedSource),
 	}
+	t.openHandle = t.openLive
+	p.Metrics.MustRegister(counter, detections, detectionLatency, captureUp, captureReopens, captureDecodeErrors,
+		trackerCollector{t: t})
+	return t
 }
 
-func newPacketParser() *gopacket.DecodingLayerParser {
-	parser := gopacket.NewDecodingLayerParser(
-		layers.LayerTypeEthernet,
-		&ethLayer,
-		&ipLayer,
-		&tcpLayer,
-		&tlsLayer,
-		&udpLayer,
-	)
-	return parser
+// packetHandle is implemented by *pcap.Handle
+type packetHandle interface {
+	gopacket.PacketDataSource
+	LinkType() layers.LinkType
+	Stats() (*pcap.Stats, error)
+	Close()
 }
 
+func (t *Tracker) openLive() (packetHandle, error) {
+	handle, err := pcap.OpenLive(t.deviceName, int32(t.snapLen), false, t.timeout)
+	if err != nil {
+		return nil, err
+	}
+	if err := handle.SetBPFFilter(t.bpfFilter); err != nil {
+		handle.Close()
+		return nil, err
+	}
+	return handle, nil
+}
+
+// Open opens the capture handle ahead of Execute, e.g. before the privileges are dropped.
+// Without CAP_NET_RAW a failed handle is not reopened, the capture stops and its liveness check fails,
+// so the tracker is restarted with the privileges.
+func (t *Tracker) Open() error {
+	handle, err := t.openHandle()
+	if err != nil {
+		return err
+	}
+	t.m.Lock()
+	defer t.m.Unlock()
+	t.opened = handle
+	return nil
+}
+
+// handle returns the handle opened by Open once, then it opens a new one
+func (t *Tracker) handle() (packetHandle, error) {
+	t.m.Lock()
+	handle := t.opened
+	t.opened = nil
+	t.m.Unlock()
+	if handle != nil {
+		return handle, nil
+	}
+	return t.openHandle()
+}
+
+func orDefault[T comparable](value, fallback T) T {
+	var zero T
+	if value == zero {
+		return fallback
+	}
+	return value
+}
+
+// Execute captures until ctx is cancelled, then the pipeline is drained in order: the capture stops,
+// captured connections are tracked and detected port scans are blocked before it returns.
+// Every channel is closed only after all of its senders are done.
 func (t *Tracker) Execute(ctx context.Context) {
-	newConnections := make(chan *ConnEntry)
-	defer close(newConnections)
-	portScans := make(chan *ConnEntry)
-	defer close(portScans)
+	tracked := make(chan struct{})
+	detected := make(chan struct{})
+	// the cache keeps working while the captured connections are drained
+	drainCtx, cancelDrain := context.WithCancel(context.Background())
+	defer cancelDrain()
+	go func() {
+		defer close(tracked)
+		t.trackConnections(drainCtx, t.newConnections, t.portScans)
+	}()
+	go func() {
+		defer close(detected)
+		t.onDetectedPortScan(t.portScans)
+	}()
+
+	t.capture(ctx, t.newConnections)
+	t.stopSending()
+	<-tracked
+	close(t.portScans)
+	<-detected
+	log.Info().Msg("TCPTracker: pipeline is drained")
+}
 
-	go t.trackConnections(ctx, newConnections, portScans)
-	go t.onDetectedPortScan(portScans)
-	t.capture(newConnections)
+// send is used by the capture and Replay, false is returned once the capture stopped
+func (t *Tracker) send(entry *ConnEntry, newConnections chan *ConnEntry) bool {
+	t.sending.RLock()
+	defer t.sending.RUnlock()
+	if t.stopped {
+		return false
+	}
+	newConnections <- entry
+	return true
+}
+
+func (t *Tracker) stopSending() {
+	t.sending.Lock()
+	defer t.sending.Unlock()
+	t.stopped = true
+	close(t.newConnections)
 }
 
-// capture is using gopacket lib to capture connections and send it to another channel
-func (t *Tracker) capture(newConnections chan *ConnEntry) {
+// Started is closed once Execute opened the capture handle, a failed device is not started until it is reopened
+func (t *Tracker) Started() <-chan struct{} {
+	return t.started
+}
+
+// capture reads the device until ctx is cancelled, the failed handle is reopened with exponential backoff,
+// e.g. after the link went down or the interface was recreated
+func (t *Tracker) capture(ctx context.Context, newConnections chan *ConnEntry) {
 	log.Info().Msg("TCPTracker: capture is running...")
-	handle, err := pcap.OpenLive(t.deviceName, snapLen, false, t.timeout)
+	defer t.probes.setCapturing(false)
+	backoff := t.reopenBackoff
+	for {
+		started := time.Now()
+		err := t.captureHandle(ctx, newConnections)
+		captureUp.Set(0)
+		if ctx.Err() != nil {
+			log.Info().Msg("TCPTracker: capture is stopping...")
+			return
+		}
+		// the handle was working, it is a new failure
+		if time.Since(started) > maxReopenBackoff {
+			backoff = t.reopenBackoff
+		}
+		if !t.canReopen() {
+			t.probes.setFailed(err)
+			log.Error().Err(err).Msgf("TCPTracker: capture of %s failed, it cannot be reopened without CAP_NET_RAW", t.deviceName)
+			<-ctx.Done()
+			return
+		}
+		t.probes.setReopening(err)
+		captureReopens.Inc()
+		log.Err(err).Msgf("TCPTracker: capture of %s failed, reopening in %s", t.deviceName, backoff)
+		if !t.waitReopening(ctx, backoff) {
+			return
+		}
+		backoff *= 2
+		if backoff > maxReopenBackoff {
+			backoff = maxReopenBackoff
+		}
+	}
+}
+
+// hasNetRaw tells CAP_NET_RAW is in the effective set of the process, e.g. it was dropped with the privileges
+func hasNetRaw() bool {
+	f, err := os.Open("/proc/self/status")
 	if err != nil {
-		log.Fatal().Err(err).Send()
+		// the device is reopened as before
+		return true
 	}
-	defer handle.Close()
-	errBPF := handle.SetBPFFilter(t.bpfFilter)
-	if errBPF != nil {
-		log.Fatal().Err(errBPF).Send()
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		if value, ok := strings.CutPrefix(scanner.Text(), "CapEff:"); ok {
+			caps, err := strconv.ParseUint(strings.TrimSpace(value), 16, 64)
+			return err != nil || caps&(1<<capNetRaw) != 0
+		}
 	}
-	var foundLayerTypes []gopacket.LayerType
-	source := gopacket.NewPacketSource(handle, handle.LinkType())
+	return true
+}
 
-	for packet := range source.Packets() {
-		err := t.parser.DecodeLayers(packet.Data(), &foundLayerTypes)
+// waitReopening beats while waiting for reopening the device, false is returned when ctx is cancelled
+func (t *Tracker) waitReopening(ctx context.Context, backoff time.Duration) bool {
+	ticker := time.NewTicker(captureTimeout)
+	defer ticker.Stop()
+	reopen := time.NewTimer(backoff)
+	defer reopen.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return false
+		case <-reopen.C:
+			return true
+		case now := <-ticker.C:
+			t.probes.beat(now)
+		}
+	}
+}
+
+// captureHandle opens the device and reads it until ctx is cancelled or the handle fails,
+// packets without IPv4 and TCP layers are counted and skipped
+func (t *Tracker) captureHandle(ctx context.Context, newConnections chan *ConnEntry) error {
+	handle, err := t.handle()
+	if err != nil {
+		return err
+	}
+	defer handle.Close()
+	t.setLocalIPs(deviceAddresses(t.deviceName))
+	t.probes.setCapturing(true)
+	captureUp.Set(1)
+	t.startOnce.Do(func() { close(t.started) })
+	done := make(chan struct{})
+	defer close(done)
+	go t.readStats(handle, done)
+	log.Info().Msgf("TCPTracker: capturing on %s", t.deviceName)
+
+	// reads return within the capture timeout, so the cancellation is noticed and the loop beats on quiet hosts
+	for ctx.Err() == nil {
+		data, ci, err := handle.ReadPacketData()
+		t.probes.beat(time.Now())
+		if err == pcap.NextErrorTimeoutExpired {
+			continue
+		}
 		if err != nil {
-			log.Error().Err(err)
-			return
+			return err
 		}
+		packet := gopacket.NewPacket(data, handle.LinkType(), gopacket.DecodeOptions{Lazy: true, NoCopy: true})
 		ip4, tcp := decodeLayers(packet)
-		counter.Inc()
-		newConnections <- prepareEntry(ip4, tcp, &t.m)
+		if ip4 == nil || tcp == nil {
+			captureDecodeErrors.Inc()
+			log.Debug().Msgf("TCPTracker: skipping packet without IPv4 and TCP layers: %v", packet.ErrorLayer())
+			continue
+		}
+		t.track(ip4, tcp, ci.Timestamp, newConnections)
+	}
+	return nil
+}
+
+func (t *Tracker) setLocalIPs(ips map[string]bool) {
+	t.m.Lock()
+	defer t.m.Unlock()
+	t.localIPs = ips
+}
+
+// track counts, publishes and sends the new connection to the detection, false is returned once the capture stopped
+func (t *Tracker) track(ip4 *layers.IPv4, tcp *layers.TCP, seen time.Time, newConnections chan *ConnEntry) bool {
+	t.countConnection(ip4, tcp)
+	entry := prepareEntry(ip4, tcp, &t.m)
+	entry.Seen = seen
+	conn := Connection{
+		SrcIP:   ip4.SrcIP.String(),
+		DstIP:   ip4.DstIP.String(),
+		DstPort: int(tcp.DstPort),
+		Seen:    entry.Seen,
+	}
+	t.recent.add(conn)
+	t.events.Publish(events.Event{
+		Type:    events.Connection,
+		Time:    conn.Seen,
+		SrcIP:   conn.SrcIP,
+		SrcPort: int(tcp.SrcPort),
+		DstIP:   conn.DstIP,
+		DstPort: conn.DstPort,
+	})
+	return t.send(entry, newConnections)
+}
+
+// countConnection labels the connection with bucketed destination port, interface and direction
+func (t *Tracker) countConnection(ip4 *layers.IPv4, tcp *layers.TCP) {
+	t.m.RLock()
+	localIPs := t.localIPs
+	t.m.RUnlock()
+	counter.WithLabelValues(portBucket(int(tcp.DstPort)), t.deviceName, direction(localIPs, ip4.SrcIP, ip4.DstIP)).Inc()
+	t.topSources.add(ip4.SrcIP.String(), time.Now())
+}
+
+// readStats is polling pcap stats of the handle for the metrics until the capture is done
+func (t *Tracker) readStats(handle packetHandle, done <-chan struct{}) {
+	ticker := time.NewTicker(statsInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+			stats, err := handle.Stats()
+			if err != nil {
+				log.Debug().Err(err).Msg("Cannot read capture stats")
+				continue
+			}
+			t.captureStats.set(stats)
+		}
 	}
 }
 
@@ -144,56 +450,134 @@ func prepareEntry(ip4 *layers.IPv4, tcp *layers.TCP, m *sync.RWMutex) *ConnEntry
 
 }
 
+// decodeLayers returns nil layers when the packet is not IPv4 and TCP or it cannot be decoded
 func decodeLayers(packet gopacket.Packet) (*layers.IPv4, *layers.TCP) {
-	ipv4Layer := packet.Layer(layers.LayerTypeIPv4)
-	if ipv4Layer == nil {
-		log.Error().Msgf("IPv4Layer is nil")
-	}
-	tcpTypeLayer := packet.Layer(layers.LayerTypeTCP)
-	if tcpTypeLayer == nil {
-		log.Error().Msgf("TCPTypeLayer is nil")
-	}
-	ip4 := ipv4Layer.(*layers.IPv4)
-	tcp := tcpTypeLayer.(*layers.TCP)
+	ip4, _ := packet.Layer(layers.LayerTypeIPv4).(*layers.IPv4)
+	tcp, _ := packet.Layer(layers.LayerTypeTCP).(*layers.TCP)
 	return ip4, tcp
 }
 
 // trackConnections is getting new connections from capture and checking isPortScanning
 func (t *Tracker) trackConnections(ctx context.Context, newConnections chan *ConnEntry, portScans chan *ConnEntry) {
 	log.Info().Msg("TCPTracker: trackConnections is running...")
+	t.probes.setTracking(true)
+	defer t.probes.setTracking(false)
 	var wg sync.WaitGroup
 	for conn := range newConnections {
 		log.Info().Msgf("Tracking connection from %s:%s", conn.SrcIP.String(), intMapToString(conn.Ports))
 		wg.Add(1)
 		go func(conn *ConnEntry) {
-			wg.Done()
+			defer wg.Done()
 			found := t.cache.getOrSet(ctx, conn)
-			if isPortScanning(len(found.Ports), t.minimumPortScans) {
-				portScans <- found
+			if isPortScanning(len(found.Ports), t.portScanThreshold()) {
+				// the latency is measured from the packet completing the scan
+				portScans <- &ConnEntry{SrcIP: found.SrcIP, DstIP: found.DstIP, Ports: found.Ports, Seen: conn.Seen}
 			}
 		}(conn)
 	}
+	// port scans are sent until the last tracked connection is checked
 	wg.Wait()
+}
 
+// SetMinimumPortScans changes the detection threshold of the running Tracker, used by config reload
+func (t *Tracker) SetMinimumPortScans(n int) {
+	t.m.Lock()
+	defer t.m.Unlock()
+	t.minimumPortScans = n
+}
+
+func (t *Tracker) portScanThreshold() int {
+	t.m.RLock()
+	defer t.m.RUnlock()
+	return t.minimumPortScans
 }
 
 func isPortScanning(foundPorts, minimumPortScans int) bool {
 	return foundPorts > minimumPortScans
 }
 
-// onDetectedPortScan is blocking IP in Host Firewall
+// onDetectedPortScan is blocking IP in Host Firewall. Every SYN past the threshold comes here, the detection is
+// published only when the source crosses the threshold in a new window or its block changes, e.g. a higher score
+// tier, the other scans only extend the block.
 func (t *Tracker) onDetectedPortScan(portScans chan *ConnEntry) {
 	log.Info().Msg("TCPTracker: onDetectedPortScan is running...")
+	t.probes.setDetecting(true)
+	defer t.probes.setDetecting(false)
 	for v := range portScans {
-		log.Warn().Msgf("TCPTracker: Port scan detected: %s -> %s on Ports %v", v.SrcIP, v.DstIP, intMapToString(v.Ports))
-		ip := v.SrcIP.String()
-		err := t.firewall.Block(ip)
+		d := detection.Detection{
+			IP:         v.SrcIP.String(),
+			Type:       detection.PortScan,
+			Score:      len(v.Ports),
+			DstIP:      v.DstIP.String(),
+			DetectedAt: time.Now(),
+		}
+		if last, ok := t.detectedBefore(d); ok {
+			d.ID = last.id
+			if err := t.firewall.Block(d); err != nil {
+				log.Err(err).Send()
+			}
+			continue
+		}
+		d.ID = detection.NewID()
+		t.detected[d.IP] = detectedSource{id: d.ID, lastAt: d.DetectedAt}
+		if t.attributor != nil {
+			d.DstOwner = t.attributor.Owner(d.DstIP)
+		}
+		detections.WithLabelValues(string(d.Type)).Inc()
+		if !v.Seen.IsZero() {
+			observe(detectionLatency, d.DetectedAt.Sub(v.Seen), prometheus.Labels{"source_ip": d.IP})
+		}
+		// logged by the log sink
+		t.events.Publish(events.Event{
+			Type:          events.Detection,
+			Time:          d.DetectedAt,
+			SrcIP:         d.IP,
+			DstIP:         d.DstIP,
+			DstOwner:      d.DstOwner,
+			Ports:         sortedPorts(v.Ports),
+			DetectionID:   d.ID,
+			DetectionType: d.Type,
+			Score:         d.Score,
+		})
+		err := t.firewall.Block(d)
 		if err != nil {
 			log.Err(err).Send()
 		}
 	}
 }
 
+// detectedBefore returns the detection of the source published in the window when the block stays the same,
+// the window slides with every scan of the source
+func (t *Tracker) detectedBefore(d detection.Detection) (detectedSource, bool) {
+	if d.DetectedAt.Sub(t.lastPruned) > t.window {
+		for ip, source := range t.detected {
+			if d.DetectedAt.Sub(source.lastAt) > t.window {
+				delete(t.detected, ip)
+			}
+		}
+		t.lastPruned = d.DetectedAt
+	}
+	last, ok := t.detected[d.IP]
+	if !ok || d.DetectedAt.Sub(last.lastAt) > t.window {
+		return detectedSource{}, false
+	}
+	if changer, ok := t.firewall.(blockChanger); ok && changer.Changes(d) {
+		return detectedSource{}, false
+	}
+	last.lastAt = d.DetectedAt
+	t.detected[d.IP] = last
+	return last, true
+}
+
+func sortedPorts(portsMap map[int]bool) []int {
+	ports := make([]int, 0, len(portsMap))
+	for k := range portsMap {
+		ports = append(ports, k)
+	}
+	sort.Ints(ports)
+	return ports
+}
+
 func intMapToString(portsMap map[int]bool) string {
 	ports := make([]string, 0, len(portsMap))
 	for k := range portsMap {
@@ -203,6 +587,7 @@ func intMapToString(portsMap map[int]bool) string {
 	return strings.Join(ports, ",")
 }
 
+// Close removes the firewall chain, it is called after Execute returned so the drained blocks are applied first
 func (t *Tracker) Close() error {
 	err := t.firewall.Close()
 	if err != nil {
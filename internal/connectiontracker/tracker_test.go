@@ -12,6 +12,8 @@ import (
 	"golang.org/x/exp/maps"
 	"net"
 	"sync"
+	"tcptracker/internal/detection"
+	"tcptracker/internal/events"
 	"tcptracker/mock"
 	"testing"
 	"time"
@@ -121,6 +123,18 @@ func Test_decodeLayers(t *testing.T) {
 	}
 }
 
+func TestNewTrackerDefaults(t *testing.T) {
+	tracker := NewTracker(TrackerParams{Metrics: prometheus.NewRegistry()})
+	assert.Equal(t, snapLen, tracker.snapLen)
+	assert.Equal(t, bpfFilter, tracker.bpfFilter)
+	assert.Equal(t, defaultMinimumPortScans, tracker.minimumPortScans)
+
+	configured := NewTracker(TrackerParams{Metrics: prometheus.NewRegistry(), SnapLen: 128, BPFFilter: "tcp", MinimumPortScans: 10})
+	assert.Equal(t, 128, configured.snapLen)
+	assert.Equal(t, "tcp", configured.bpfFilter)
+	assert.Equal(t, 10, configured.minimumPortScans)
+}
+
 func Test_Tracker(t *testing.T) {
 	ctrl := gomock.NewController(t)
 	defer ctrl.Finish()
@@ -137,7 +151,14 @@ func Test_Tracker(t *testing.T) {
 	dstIP := net.ParseIP("192.44.55.66")
 	srcIP := net.ParseIP("172.44.55.76")
 	ip := srcIP.String()
-	mockFw.EXPECT().Block(gomock.Eq(ip)).Return(nil).Times(1)
+	expected := detection.Detection{IP: ip, Type: detection.PortScan, Score: 4, DstIP: dstIP.String()}
+	mockFw.EXPECT().Block(gomock.Any()).DoAndReturn(func(d detection.Detection) error {
+		assert.NotEmpty(t, d.ID)
+		assert.False(t, d.DetectedAt.IsZero())
+		d.ID, d.DetectedAt = "", time.Time{}
+		assert.Equal(t, expected, d)
+		return nil
+	}).Times(1)
 
 	newConnections := make(chan *ConnEntry, 4)
 	testPortScans := make(chan *ConnEntry, 1)
@@ -244,3 +265,57 @@ func Test_prepareEntry(t *testing.T) {
 	assert.Equal(t, 80, maps.Keys(entry.Ports)[0])
 	assert.True(t, entry.Ports[80])
 }
+
+// changingFirewall reports the block of the detection with the score changes, e.g. a score tier with another Action
+type changingFirewall struct {
+	*mock.MockFirewall
+	changesAt int
+}
+
+func (f changingFirewall) Changes(d detection.Detection) bool { return d.Score == f.changesAt }
+
+func TestDetectionPublishedOncePerWindow(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	mockFw := mock.NewMockFirewall(ctrl)
+	broker := events.NewBroker("node-1", nil)
+	published, unsubscribe := broker.Subscribe(events.Filter{Types: map[events.Type]bool{events.Detection: true}})
+	defer unsubscribe()
+	tracker := NewTracker(TrackerParams{
+		Firewall: changingFirewall{MockFirewall: mockFw, changesAt: 6},
+		Metrics:  prometheus.NewRegistry(),
+		Events:   broker,
+	})
+	var blocked []detection.Detection
+	mockFw.EXPECT().Block(gomock.Any()).DoAndReturn(func(d detection.Detection) error {
+		blocked = append(blocked, d)
+		return nil
+	}).Times(5)
+
+	srcIP, otherIP, dstIP := net.ParseIP("172.44.55.76"), net.ParseIP("172.44.55.77"), net.ParseIP("192.44.55.66")
+	portScans := make(chan *ConnEntry, 5)
+	for _, scan := range []struct {
+		src   *net.IP
+		ports int
+	}{{&srcIP, 4}, {&srcIP, 5}, {&otherIP, 4}, {&srcIP, 6}, {&srcIP, 7}} {
+		ports := make(map[int]bool)
+		for port := 0; port < scan.ports; port++ {
+			ports[port] = true
+		}
+		portScans <- &ConnEntry{SrcIP: scan.src, DstIP: &dstIP, Ports: ports}
+	}
+	close(portScans)
+	tracker.onDetectedPortScan(portScans)
+
+	var scores []int
+	for len(published) > 0 {
+		scores = append(scores, (<-published).Score)
+	}
+	// the first scan of every source and the scan changing the block
+	assert.Equal(t, []int{4, 4, 6}, scores)
+	require.Len(t, blocked, 5)
+	assert.Equal(t, blocked[0].ID, blocked[1].ID, "repeated scan extends the published detection")
+	assert.NotEqual(t, blocked[0].ID, blocked[2].ID)
+	assert.NotEqual(t, blocked[0].ID, blocked[3].ID)
+	assert.Equal(t, blocked[3].ID, blocked[4].ID)
+}
@@ -0,0 +1,67 @@
+package detection
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+)
+
+// Type tells which detector found the suspicious source
+type Type string
+
+const (
+	// PortScan is a single source IP connecting to more than the minimum number of host Ports
+	PortScan Type = "portscan"
+	// Manual is a block requested by an operator
+	Manual Type = "manual"
+)
+
+// Detection is passed to the Firewall to block the source IP
+// Score is detector specific, for port scans it is the number of scanned Ports
+// DstOwner is the container or network namespace owning DstIP, empty for the host itself
+// TTL of the block, 0 means the Firewall default
+// ID and DetectedAt are set by detectors, they are used to trace the detection in logs and latency exemplars
+type Detection struct {
+	ID         string
+	IP         string
+	Type       Type
+	Score      int
+	DstIP      string
+	DstOwner   string
+	TTL        time.Duration
+	DetectedAt time.Time
+}
+
+// NewID returns random ID of the detection
+func NewID() string {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return fmt.Sprint(time.Now().UnixNano())
+	}
+	return hex.EncodeToString(b)
+}
+
+// ValidIPv4 tells the IP is a dotted IPv4 address, the firewall blocks only IPv4 sources
+func ValidIPv4(ip string) bool {
+	parsed := net.ParseIP(ip)
+	return parsed != nil && parsed.To4() != nil && !strings.Contains(ip, ":")
+}
+
+// Block is a source IP blocked by the Firewall, zero ExpiresAt never expires
+type Block struct {
+	IP          string    `json:"ip"`
+	DetectionID string    `json:"detectionId,omitempty"`
+	Type        Type      `json:"type"`
+	Score       int       `json:"score"`
+	Action      string    `json:"action"`
+	CreatedAt   time.Time `json:"createdAt"`
+	ExpiresAt   time.Time `json:"expiresAt,omitempty"`
+}
+
+// Expired tells if the Block should be lifted at the given time
+func (b Block) Expired(now time.Time) bool {
+	return !b.ExpiresAt.IsZero() && !now.Before(b.ExpiresAt)
+}
@@ -0,0 +1,314 @@
+package events
+
+import (
+	"context"
+	_ "embed"
+	"fmt"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/rs/zerolog/log"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"tcptracker/internal/detection"
+	"time"
+)
+
+// Type of the Event
+type Type string
+
+const (
+	// Connection is a new connection captured on the device
+	Connection Type = "connection"
+	// Detection is a source found by the detector
+	Detection Type = "detection"
+	// Block is a firewall rule applied for the source
+	Block Type = "block"
+	// Unblock is a firewall rule removed for the source by an operator or a cluster peer
+	Unblock Type = "unblock"
+	// Expiry is a firewall rule removed for the source because its TTL passed
+	Expiry Type = "expiry"
+)
+
+// SchemaVersion of the Event JSON, fields are only added within a version, removing or changing one bumps it
+const SchemaVersion = 1
+
+// Schema is JSON Schema of the Event, served on /events/schema
+//
+//go:embed schema.json
+var Schema []byte
+
+const (
+	// subscriberBuffer is the number of events waiting for a slow subscriber, next ones are dropped
+	subscriberBuffer = 256
+	// sinkDrainTimeout bounds sending the events left in the buffer of a sink on shutdown
+	sinkDrainTimeout = 5 * time.Second
+)
+
+var (
+	dropped = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "tcptracker_events_dropped_total",
+		Help: "Events not delivered to the subscribers because they were too slow",
+	})
+	sinkEvents = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "tcptracker_sink_events_total",
+		Help: "Events of the sinks, by result: sent, failed or dropped because the sink buffer was full",
+	}, []string{"sink", "result"})
+)
+
+// Event is published by the Tracker and the Firewall, Version, ID, Time and Host are set by the Broker.
+// DetectionType names the detector, ExpiresAt is set on blocks with TTL.
+type Event struct {
+	Version       int            `json:"version"`
+	ID            string         `json:"id"`
+	Type          Type           `json:"type"`
+	Time          time.Time      `json:"time"`
+	Host          string         `json:"host"`
+	SrcIP         string         `json:"srcIp"`
+	SrcPort       int            `json:"srcPort,omitempty"`
+	DstIP         string         `json:"dstIp,omitempty"`
+	DstOwner      string         `json:"dstOwner,omitempty"`
+	DstPort       int            `json:"dstPort,omitempty"`
+	Ports         []int          `json:"ports,omitempty"`
+	DetectionID   string         `json:"detectionId,omitempty"`
+	DetectionType detection.Type `json:"detectionType,omitempty"`
+	Score         int            `json:"score,omitempty"`
+	Action        string         `json:"action,omitempty"`
+	ExpiresAt     *time.Time     `json:"expiresAt,omitempty"`
+}
+
+// Summary is one line describing the event for humans, e.g. in logs, syslog or chat messages
+func (e Event) Summary() string {
+	switch e.Type {
+	case Connection:
+		return fmt.Sprintf("connection %s:%d -> %s:%d", e.SrcIP, e.SrcPort, e.DstIP, e.DstPort)
+	case Detection:
+		dst := e.DstIP
+		if e.DstOwner != "" {
+			dst += " (" + e.DstOwner + ")"
+		}
+		return fmt.Sprintf("%s detected: %s -> %s on ports %s, score %d, detection %s",
+			e.DetectionType, e.SrcIP, dst, joinPorts(e.Ports), e.Score, e.DetectionID)
+	case Block:
+		expires := "never expires"
+		if e.ExpiresAt != nil {
+			expires = "expires " + e.ExpiresAt.UTC().Format(time.RFC3339)
+		}
+		return fmt.Sprintf("%s blocked with %s action, %s score %d, %s", e.SrcIP, e.Action, e.DetectionType, e.Score, expires)
+	case Unblock:
+		return fmt.Sprintf("%s unblocked", e.SrcIP)
+	case Expiry:
+		return fmt.Sprintf("block of %s expired", e.SrcIP)
+	}
+	return fmt.Sprintf("%s %s", e.Type, e.SrcIP)
+}
+
+func joinPorts(ports []int) string {
+	s := make([]string, 0, len(ports))
+	for _, p := range ports {
+		s = append(s, strconv.Itoa(p))
+	}
+	return strings.Join(s, ",")
+}
+
+// Filter selects the events of a subscriber, zero value matches everything
+type Filter struct {
+	Types  map[Type]bool
+	Source *net.IPNet
+	// Port matches the connection destination port or any of the scanned ports
+	Port int
+}
+
+// ParseFilter reads `type` (comma separated or repeated), `source` CIDR or IP and `port` query params
+func ParseFilter(query url.Values) (Filter, error) {
+	var f Filter
+	for _, value := range query["type"] {
+		for _, t := range strings.Split(value, ",") {
+			switch Type(t) {
+			case Connection, Detection, Block, Unblock, Expiry:
+				if f.Types == nil {
+					f.Types = make(map[Type]bool)
+				}
+				f.Types[Type(t)] = true
+			default:
+				return Filter{}, fmt.Errorf("unknown event type: %q", t)
+			}
+		}
+	}
+	if source := query.Get("source"); source != "" {
+		if !strings.Contains(source, "/") {
+			source += "/32"
+		}
+		_, network, err := net.ParseCIDR(source)
+		if err != nil {
+			return Filter{}, fmt.Errorf("invalid source: %w", err)
+		}
+		f.Source = network
+	}
+	if port := query.Get("port"); port != "" {
+		p, err := strconv.Atoi(port)
+		if err != nil || p < 1 || p > 65535 {
+			return Filter{}, fmt.Errorf("invalid port: %q", port)
+		}
+		f.Port = p
+	}
+	return f, nil
+}
+
+// Match tells if the Event passes the Filter
+func (f Filter) Match(e Event) bool {
+	if f.Types != nil && !f.Types[e.Type] {
+		return false
+	}
+	if f.Source != nil && !f.Source.Contains(net.ParseIP(e.SrcIP)) {
+		return false
+	}
+	if f.Port != 0 && e.DstPort != f.Port && !containsPort(e.Ports, f.Port) {
+		return false
+	}
+	return true
+}
+
+func containsPort(ports []int, port int) bool {
+	for _, p := range ports {
+		if p == port {
+			return true
+		}
+	}
+	return false
+}
+
+type subscriber struct {
+	filter Filter
+	events chan Event
+	// sink name of the attached sink, its dropped events are counted in sinkEvents
+	sink string
+}
+
+// Broker fans out the events to the subscribers and the sinks, publishing never blocks the capture
+type Broker struct {
+	host        string
+	subscribers map[*subscriber]bool
+	m           sync.RWMutex
+}
+
+// NewBroker creates Broker, host identifies the tracker in the events, metrics are optional
+func NewBroker(host string, metrics *prometheus.Registry) *Broker {
+	if metrics != nil {
+		metrics.MustRegister(dropped, sinkEvents)
+	}
+	return &Broker{host: host, subscribers: make(map[*subscriber]bool)}
+}
+
+// Publish delivers the Event to the matching subscribers, it is a no-op on nil Broker,
+// so the publishers don't need to check if the events are enabled
+func (b *Broker) Publish(e Event) {
+	if b == nil {
+		return
+	}
+	b.m.RLock()
+	defer b.m.RUnlock()
+	if len(b.subscribers) == 0 {
+		return
+	}
+	e.Version = SchemaVersion
+	e.ID = detection.NewID()
+	e.Host = b.host
+	if e.Time.IsZero() {
+		e.Time = time.Now()
+	}
+	for s := range b.subscribers {
+		if !s.filter.Match(e) {
+			continue
+		}
+		select {
+		case s.events <- e:
+		default:
+			dropped.Inc()
+			if s.sink != "" {
+				sinkEvents.WithLabelValues(s.sink, "dropped").Inc()
+			}
+		}
+	}
+}
+
+// Subscribe returns the channel of matching events and the function to unsubscribe, it closes the channel
+func (b *Broker) Subscribe(filter Filter) (<-chan Event, func()) {
+	return b.subscribe(filter, subscriberBuffer, "")
+}
+
+func (b *Broker) subscribe(filter Filter, buffer int, sink string) (<-chan Event, func()) {
+	s := &subscriber{filter: filter, events: make(chan Event, buffer), sink: sink}
+	b.m.Lock()
+	b.subscribers[s] = true
+	b.m.Unlock()
+	var once sync.Once
+	return s.events, func() {
+		once.Do(func() {
+			b.m.Lock()
+			delete(b.subscribers, s)
+			b.m.Unlock()
+			close(s.events)
+		})
+	}
+}
+
+// Sink delivers the events outside the tracker, e.g. to the log, syslog or webhooks
+type Sink interface {
+	// Name labels the logs and the metrics of the sink
+	Name() string
+	// Send delivers the event, it may block, meanwhile the next events wait in the subscription buffer
+	Send(ctx context.Context, e Event) error
+	Close() error
+}
+
+// Attach subscribes the sink to the events matching the filter and sends them in the background until ctx
+// is cancelled, the events published before are still sent within sinkDrainTimeout. Buffer is the number
+// of events waiting while the sink is sending or retrying, 0 uses the default of the subscribers, events
+// published to the full buffer are dropped and counted.
+// The returned channel is closed once the sink is closed.
+func (b *Broker) Attach(ctx context.Context, s Sink, filter Filter, buffer int) <-chan struct{} {
+	if buffer <= 0 {
+		buffer = subscriberBuffer
+	}
+	published, unsubscribe := b.subscribe(filter, buffer, s.Name())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		log.Info().Msgf("Events: %s sink is running...", s.Name())
+		forward(ctx, s, published)
+		// unsubscribe closes the channel, the buffered events are left
+		unsubscribe()
+		drainCtx, cancel := context.WithTimeout(context.Background(), sinkDrainTimeout)
+		defer cancel()
+		for e := range published {
+			send(drainCtx, s, e)
+		}
+		if err := s.Close(); err != nil {
+			log.Err(err).Msgf("Events: closing %s sink failed", s.Name())
+		}
+		log.Info().Msgf("Events: %s sink stopped", s.Name())
+	}()
+	return done
+}
+
+func forward(ctx context.Context, s Sink, published <-chan Event) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case e := <-published:
+			send(ctx, s, e)
+		}
+	}
+}
+
+func send(ctx context.Context, s Sink, e Event) {
+	if err := s.Send(ctx, e); err != nil {
+		sinkEvents.WithLabelValues(s.Name(), "failed").Inc()
+		log.Err(err).Msgf("Events: %s sink failed to send %s event %s", s.Name(), e.Type, e.ID)
+		return
+	}
+	sinkEvents.WithLabelValues(s.Name(), "sent").Inc()
+}
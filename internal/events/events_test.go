@@ -0,0 +1,255 @@
+package events
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"net/url"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"tcptracker/internal/detection"
+	"testing"
+	"time"
+)
+
+func TestParseFilter(t *testing.T) {
+	tests := []struct {
+		name    string
+		query   string
+		event   Event
+		match   bool
+		wantErr bool
+	}{
+		{name: "empty matches all", query: "", event: Event{Type: Connection, SrcIP: "10.0.0.1"}, match: true},
+		{name: "type", query: "type=detection,block", event: Event{Type: Block, SrcIP: "10.0.0.1"}, match: true},
+		{name: "repeated type", query: "type=detection&type=unblock", event: Event{Type: Unblock}, match: true},
+		{name: "expiry type", query: "type=expiry", event: Event{Type: Expiry}, match: true},
+		{name: "other type", query: "type=detection", event: Event{Type: Connection, SrcIP: "10.0.0.1"}, match: false},
+		{name: "source CIDR", query: "source=10.0.0.0/8", event: Event{Type: Connection, SrcIP: "10.1.2.3"}, match: true},
+		{name: "source IP", query: "source=10.0.0.1", event: Event{Type: Connection, SrcIP: "10.0.0.2"}, match: false},
+		{name: "destination port", query: "port=22", event: Event{Type: Connection, DstPort: 22}, match: true},
+		{name: "scanned port", query: "port=22", event: Event{Type: Detection, Ports: []int{21, 22, 23}}, match: true},
+		{name: "other port", query: "port=22", event: Event{Type: Connection, DstPort: 80}, match: false},
+		{name: "unknown type", query: "type=flush", wantErr: true},
+		{name: "invalid source", query: "source=10.0.0", wantErr: true},
+		{name: "invalid port", query: "port=70000", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			query, err := url.ParseQuery(tt.query)
+			require.NoError(t, err)
+			filter, err := ParseFilter(query)
+			if tt.wantErr {
+				require.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.match, filter.Match(tt.event))
+		})
+	}
+}
+
+func TestBroker(t *testing.T) {
+	b := NewBroker("node-1", nil)
+	all, unsubscribeAll := b.Subscribe(Filter{})
+	blocks, unsubscribeBlocks := b.Subscribe(Filter{Types: map[Type]bool{Block: true}})
+
+	seen := time.Now().Add(-time.Second)
+	b.Publish(Event{Type: Connection, SrcIP: "10.0.0.1", Time: seen})
+	b.Publish(Event{Type: Block, SrcIP: "10.0.0.1"})
+	connection, block := <-all, <-all
+	assert.Equal(t, Connection, connection.Type)
+	assert.Equal(t, seen, connection.Time)
+	assert.Equal(t, SchemaVersion, connection.Version)
+	assert.Equal(t, "node-1", connection.Host)
+	assert.Equal(t, Block, block.Type)
+	assert.False(t, block.Time.IsZero())
+	assert.NotEqual(t, connection.ID, block.ID)
+	assert.Equal(t, Block, (<-blocks).Type)
+
+	unsubscribeBlocks()
+	unsubscribeBlocks()
+	_, open := <-blocks
+	assert.False(t, open)
+
+	// slow subscriber doesn't block the publisher
+	for i := 0; i < subscriberBuffer+10; i++ {
+		b.Publish(Event{Type: Connection})
+	}
+	assert.Len(t, all, subscriberBuffer)
+	unsubscribeAll()
+
+	var nilBroker *Broker
+	nilBroker.Publish(Event{Type: Connection})
+}
+
+// TestSchema keeps schema.json in sync with the Event fields
+func TestSchema(t *testing.T) {
+	var schema struct {
+		Required   []string                   `json:"required"`
+		Properties map[string]json.RawMessage `json:"properties"`
+	}
+	require.NoError(t, json.Unmarshal(Schema, &schema))
+	var fields, required []string
+	eventType := reflect.TypeOf(Event{})
+	for i := 0; i < eventType.NumField(); i++ {
+		name, options, _ := strings.Cut(eventType.Field(i).Tag.Get("json"), ",")
+		fields = append(fields, name)
+		if options != "omitempty" {
+			required = append(required, name)
+		}
+	}
+	properties := make([]string, 0, len(schema.Properties))
+	for name := range schema.Properties {
+		properties = append(properties, name)
+	}
+	sort.Strings(fields)
+	sort.Strings(properties)
+	assert.Equal(t, fields, properties)
+	assert.ElementsMatch(t, required, schema.Required)
+	assert.Contains(t, string(schema.Properties["version"]), `"const": 1`)
+}
+
+func TestSummary(t *testing.T) {
+	expiresAt := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	tests := []struct {
+		event Event
+		want  string
+	}{
+		{
+			event: Event{Type: Connection, SrcIP: "10.0.0.1", SrcPort: 40000, DstIP: "10.0.0.2", DstPort: 22},
+			want:  "connection 10.0.0.1:40000 -> 10.0.0.2:22",
+		},
+		{
+			event: Event{Type: Detection, SrcIP: "10.0.0.1", DstIP: "172.17.0.2", DstOwner: "web", Ports: []int{21, 22, 23, 25},
+				DetectionID: "abc", DetectionType: detection.PortScan, Score: 4},
+			want: "portscan detected: 10.0.0.1 -> 172.17.0.2 (web) on ports 21,22,23,25, score 4, detection abc",
+		},
+		{
+			event: Event{Type: Block, SrcIP: "10.0.0.1", Action: "DROP", DetectionType: detection.PortScan, Score: 4, ExpiresAt: &expiresAt},
+			want:  "10.0.0.1 blocked with DROP action, portscan score 4, expires 2024-05-01T12:00:00Z",
+		},
+		{event: Event{Type: Unblock, SrcIP: "10.0.0.1"}, want: "10.0.0.1 unblocked"},
+		{event: Event{Type: Expiry, SrcIP: "10.0.0.1"}, want: "block of 10.0.0.1 expired"},
+	}
+	for _, tt := range tests {
+		t.Run(string(tt.event.Type), func(t *testing.T) {
+			assert.Equal(t, tt.want, tt.event.Summary())
+		})
+	}
+}
+
+type fakeSink struct {
+	sent   []Event
+	fail   bool
+	closed bool
+	m      sync.Mutex
+}
+
+func (s *fakeSink) Name() string { return "fake" }
+
+func (s *fakeSink) Send(ctx context.Context, e Event) error {
+	s.m.Lock()
+	defer s.m.Unlock()
+	if s.fail {
+		return errors.New("collector is down")
+	}
+	s.sent = append(s.sent, e)
+	return nil
+}
+
+func (s *fakeSink) Close() error {
+	s.m.Lock()
+	defer s.m.Unlock()
+	s.closed = true
+	return nil
+}
+
+func (s *fakeSink) events() []Event {
+	s.m.Lock()
+	defer s.m.Unlock()
+	return append([]Event{}, s.sent...)
+}
+
+func TestAttachSink(t *testing.T) {
+	b := NewBroker("node-1", nil)
+	sink := &fakeSink{}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := b.Attach(ctx, sink, Filter{Types: map[Type]bool{Detection: true}}, 0)
+	failing := &fakeSink{fail: true}
+	failingDone := b.Attach(ctx, failing, Filter{}, 3)
+	failed := testutil.ToFloat64(sinkEvents.WithLabelValues("fake", "failed"))
+
+	b.Publish(Event{Type: Connection, SrcIP: "10.0.0.1"})
+	b.Publish(Event{Type: Detection, SrcIP: "10.0.0.1"})
+	b.Publish(Event{Type: Detection, SrcIP: "10.0.0.2"})
+	cancel()
+	<-done
+	<-failingDone
+	assert.Equal(t, failed+3, testutil.ToFloat64(sinkEvents.WithLabelValues("fake", "failed")))
+	// published before the cancellation are sent
+	sent := sink.events()
+	require.Len(t, sent, 2)
+	assert.Equal(t, "10.0.0.1", sent[0].SrcIP)
+	assert.Equal(t, "10.0.0.2", sent[1].SrcIP)
+	assert.True(t, sink.closed)
+}
+
+// blockingSink waits for release in Send
+type blockingSink struct {
+	release chan struct{}
+}
+
+func (s blockingSink) Name() string { return "blocking" }
+
+func (s blockingSink) Send(ctx context.Context, e Event) error {
+	<-s.release
+	return nil
+}
+
+func (s blockingSink) Close() error { return nil }
+
+func TestAttachSinkDropsOnFullBuffer(t *testing.T) {
+	b := NewBroker("node-1", nil)
+	sink := blockingSink{release: make(chan struct{})}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := b.Attach(ctx, sink, Filter{}, 1)
+	dropped := testutil.ToFloat64(sinkEvents.WithLabelValues("blocking", "dropped"))
+
+	// one event is being sent and one waits in the buffer at most
+	for i := 0; i < 5; i++ {
+		b.Publish(Event{Type: Connection})
+	}
+	assert.GreaterOrEqual(t, testutil.ToFloat64(sinkEvents.WithLabelValues("blocking", "dropped")), dropped+3)
+	close(sink.release)
+	cancel()
+	<-done
+}
+
+func TestLogSink(t *testing.T) {
+	var buf bytes.Buffer
+	logger := log.Logger
+	log.Logger = zerolog.New(&buf)
+	defer func() { log.Logger = logger }()
+
+	e := Event{Version: SchemaVersion, ID: "1", Type: Detection, SrcIP: "10.0.0.1", DetectionType: detection.PortScan, Ports: []int{22}}
+	require.NoError(t, LogSink{}.Send(context.Background(), e))
+	var line struct {
+		Level   string `json:"level"`
+		Message string `json:"message"`
+		Event   Event  `json:"event"`
+	}
+	require.NoError(t, json.Unmarshal(buf.Bytes(), &line))
+	assert.Equal(t, "warn", line.Level)
+	assert.Equal(t, e.Summary(), line.Message)
+	assert.Equal(t, e.ID, line.Event.ID)
+	assert.Equal(t, []int{22}, line.Event.Ports)
+}
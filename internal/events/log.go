@@ -0,0 +1,36 @@
+package events
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+)
+
+// LogSink writes the events as structured log lines with the whole event in the `event` field,
+// detections are warnings
+type LogSink struct{}
+
+// Name of the sink
+func (LogSink) Name() string {
+	return "log"
+}
+
+// Send logs the event at info level, detections at warn level
+func (LogSink) Send(_ context.Context, e Event) error {
+	data, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	level := zerolog.InfoLevel
+	if e.Type == Detection {
+		level = zerolog.WarnLevel
+	}
+	log.WithLevel(level).RawJSON("event", data).Msg(e.Summary())
+	return nil
+}
+
+// Close is a no-op
+func (LogSink) Close() error {
+	return nil
+}
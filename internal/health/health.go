@@ -0,0 +1,137 @@
+package health
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// Status of a check or the whole report
+type Status string
+
+const (
+	OK   Status = "ok"
+	Fail Status = "fail"
+)
+
+// defaultTimeout of a single check, probes are called every few seconds by orchestrators
+const defaultTimeout = 2 * time.Second
+
+// CheckFunc returns nil when the component works
+type CheckFunc func(ctx context.Context) error
+
+type check struct {
+	name     string
+	fn       CheckFunc
+	liveness bool
+}
+
+// Result of a single check
+type Result struct {
+	Name     string `json:"name"`
+	Status   Status `json:"status"`
+	Error    string `json:"error,omitempty"`
+	Duration string `json:"duration"`
+}
+
+// Report is OK only when all the checks are OK
+type Report struct {
+	Status Status   `json:"status"`
+	Checks []Result `json:"checks"`
+}
+
+// Checks are run by liveness and readiness probes
+type Checks struct {
+	checks  []check
+	timeout time.Duration
+	m       sync.RWMutex
+}
+
+// New creates Checks, timeout of a single check defaults to 2 seconds
+func New(timeout time.Duration) *Checks {
+	if timeout <= 0 {
+		timeout = defaultTimeout
+	}
+	return &Checks{timeout: timeout}
+}
+
+// Live adds the check to liveness and readiness, failing it means the process should be restarted
+func (c *Checks) Live(name string, fn CheckFunc) {
+	c.add(check{name: name, fn: fn, liveness: true})
+}
+
+// Ready adds the check to readiness only, failing it means the process cannot do its job right now
+func (c *Checks) Ready(name string, fn CheckFunc) {
+	c.add(check{name: name, fn: fn})
+}
+
+func (c *Checks) add(ch check) {
+	c.m.Lock()
+	defer c.m.Unlock()
+	c.checks = append(c.checks, ch)
+}
+
+// Liveness runs the liveness checks, it is OK on nil Checks
+func (c *Checks) Liveness(ctx context.Context) Report {
+	return c.run(ctx, true)
+}
+
+// Readiness runs all the checks, it is OK on nil Checks
+func (c *Checks) Readiness(ctx context.Context) Report {
+	return c.run(ctx, false)
+}
+
+// run executes the checks concurrently, so one hanging check doesn't delay the others beyond the timeout
+func (c *Checks) run(ctx context.Context, livenessOnly bool) Report {
+	report := Report{Status: OK, Checks: []Result{}}
+	if c == nil {
+		return report
+	}
+	c.m.RLock()
+	var selected []check
+	for _, ch := range c.checks {
+		if ch.liveness || !livenessOnly {
+			selected = append(selected, ch)
+		}
+	}
+	c.m.RUnlock()
+
+	report.Checks = make([]Result, len(selected))
+	var wg sync.WaitGroup
+	for i, ch := range selected {
+		wg.Add(1)
+		go func(i int, ch check) {
+			defer wg.Done()
+			report.Checks[i] = c.runCheck(ctx, ch)
+		}(i, ch)
+	}
+	wg.Wait()
+	for _, r := range report.Checks {
+		if r.Status != OK {
+			report.Status = Fail
+		}
+	}
+	return report
+}
+
+func (c *Checks) runCheck(ctx context.Context, ch check) Result {
+	ctx, cancel := context.WithTimeout(ctx, c.timeout)
+	defer cancel()
+	start := time.Now()
+	errs := make(chan error, 1)
+	go func() {
+		errs <- ch.fn(ctx)
+	}()
+	var err error
+	select {
+	case err = <-errs:
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+	result := Result{Name: ch.name, Status: OK, Duration: time.Since(start).String()}
+	if err != nil {
+		result.Status = Fail
+		result.Error = err.Error()
+	}
+	return result
+}
@@ -0,0 +1,50 @@
+package health
+
+import (
+	"context"
+	"errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"testing"
+	"time"
+)
+
+func TestChecks(t *testing.T) {
+	checks := New(50 * time.Millisecond)
+	checks.Live("capture", func(context.Context) error { return nil })
+	checks.Ready("firewall", func(context.Context) error { return errors.New("chain tcptracker is missing") })
+	checks.Ready("cache", func(ctx context.Context) error {
+		<-ctx.Done()
+		return ctx.Err()
+	})
+
+	liveness := checks.Liveness(context.Background())
+	assert.Equal(t, OK, liveness.Status)
+	require.Len(t, liveness.Checks, 1)
+	assert.Equal(t, "capture", liveness.Checks[0].Name)
+
+	readiness := checks.Readiness(context.Background())
+	assert.Equal(t, Fail, readiness.Status)
+	require.Len(t, readiness.Checks, 3)
+	assert.Equal(t, Result{Name: "firewall", Status: Fail, Error: "chain tcptracker is missing"},
+		Result{Name: readiness.Checks[1].Name, Status: readiness.Checks[1].Status, Error: readiness.Checks[1].Error})
+	assert.Equal(t, Fail, readiness.Checks[2].Status)
+	assert.Equal(t, context.DeadlineExceeded.Error(), readiness.Checks[2].Error)
+}
+
+func TestChecksTimeoutOfHangingCheck(t *testing.T) {
+	checks := New(10 * time.Millisecond)
+	release := make(chan struct{})
+	defer close(release)
+	checks.Live("stuck", func(context.Context) error {
+		<-release
+		return nil
+	})
+	report := checks.Liveness(context.Background())
+	assert.Equal(t, Fail, report.Status)
+}
+
+func TestNilChecks(t *testing.T) {
+	var checks *Checks
+	assert.Equal(t, Report{Status: OK, Checks: []Result{}}, checks.Readiness(context.Background()))
+}
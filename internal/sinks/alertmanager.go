@@ -0,0 +1,270 @@
+package sinks
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/rs/zerolog/log"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"tcptracker/internal/events"
+	"time"
+)
+
+const (
+	// AlertsPath is the endpoint of Alertmanager API v2 receiving the alerts
+	AlertsPath = "/api/v2/alerts"
+	// AlertName of the alerts pushed for the blocked sources
+	AlertName = "TCPTrackerDetection"
+
+	alertPushAttempts = 3
+	alertPushBackoff  = 500 * time.Millisecond
+	// alertTimeout bounds the resend of the active alerts
+	alertTimeout = 10 * time.Second
+	// resendsBeforeResolve of the blocks without expiry, Alertmanager resolves them when the tracker is gone
+	resendsBeforeResolve = 3
+)
+
+// Alert of Alertmanager API v2 (postableAlert)
+type Alert struct {
+	Labels      map[string]string `json:"labels"`
+	Annotations map[string]string `json:"annotations,omitempty"`
+	StartsAt    time.Time         `json:"startsAt"`
+	EndsAt      time.Time         `json:"endsAt"`
+	// expires tells EndsAt is the block expiry, otherwise it is extended on every resend
+	expires bool
+}
+
+// AlertmanagerParams of the Alertmanager sink, URLs are the base URLs of all the instances, e.g. http://alertmanager:9093
+type AlertmanagerParams struct {
+	URLs           []string
+	ResendInterval time.Duration
+	Timeout        time.Duration
+}
+
+// Alertmanager pushes an alert for every blocked source, it ends when the block expires and is resolved as soon
+// as the block is lifted or the tracker stops. Active alerts are resent every ResendInterval to all the instances,
+// so a restarted Alertmanager gets them back, and alerts of blocks without expiry are resolved by Alertmanager
+// when the tracker stops resending them.
+type Alertmanager struct {
+	urls           []string
+	client         *http.Client
+	resendInterval time.Duration
+	backoff        time.Duration
+	now            func() time.Time
+	// active alerts by source IP
+	active  map[string]Alert
+	m       sync.Mutex
+	stop    chan struct{}
+	stopped chan struct{}
+}
+
+// NewAlertmanager creates the sink and starts resending the active alerts
+func NewAlertmanager(p AlertmanagerParams) (*Alertmanager, error) {
+	if len(p.URLs) == 0 {
+		return nil, fmt.Errorf("alertmanager URLs are required")
+	}
+	if p.ResendInterval <= 0 {
+		return nil, fmt.Errorf("alertmanager resend interval must be positive, got %s", p.ResendInterval)
+	}
+	a := &Alertmanager{
+		client:         &http.Client{Timeout: p.Timeout},
+		resendInterval: p.ResendInterval,
+		backoff:        alertPushBackoff,
+		now:            time.Now,
+		active:         make(map[string]Alert),
+		stop:           make(chan struct{}),
+		stopped:        make(chan struct{}),
+	}
+	for _, u := range p.URLs {
+		a.urls = append(a.urls, strings.TrimSuffix(u, "/")+AlertsPath)
+	}
+	go a.resend()
+	return a, nil
+}
+
+// Name of the sink
+func (a *Alertmanager) Name() string {
+	return "alertmanager"
+}
+
+// Send fires the alert of the block, unblock and expiry resolve it, other events are ignored
+func (a *Alertmanager) Send(ctx context.Context, e events.Event) error {
+	now := a.now()
+	var alerts []Alert
+	a.m.Lock()
+	previous, active := a.active[e.SrcIP]
+	switch e.Type {
+	case events.Block:
+		alert := a.alert(e, now)
+		// the source blocked again by another detector has another alert, the previous one is resolved
+		if active && previous.Labels["detector"] != alert.Labels["detector"] {
+			previous.EndsAt = now
+			alerts = append(alerts, previous)
+		}
+		a.active[e.SrcIP] = alert
+		alerts = append(alerts, alert)
+	case events.Unblock, events.Expiry:
+		if active {
+			delete(a.active, e.SrcIP)
+			previous.EndsAt = now
+			alerts = append(alerts, previous)
+		}
+	}
+	a.m.Unlock()
+	if len(alerts) == 0 {
+		return nil
+	}
+	return a.push(ctx, alerts)
+}
+
+// alert of the block, severity follows the detection score
+func (a *Alertmanager) alert(e events.Event, now time.Time) Alert {
+	alert := Alert{
+		Labels: map[string]string{
+			"alertname": AlertName,
+			"source":    e.SrcIP,
+			"detector":  string(e.DetectionType),
+			"host":      e.Host,
+			"severity":  alertSeverity(Severity(events.Event{Type: events.Detection, Score: e.Score})),
+		},
+		Annotations: map[string]string{
+			"summary":     e.Summary(),
+			"detectionId": e.DetectionID,
+			"score":       strconv.Itoa(e.Score),
+			"action":      e.Action,
+		},
+		StartsAt: e.Time,
+		EndsAt:   now.Add(resendsBeforeResolve * a.resendInterval),
+	}
+	if e.ExpiresAt != nil {
+		alert.EndsAt = *e.ExpiresAt
+		alert.expires = true
+	}
+	return alert
+}
+
+// alertSeverity is the severity label of the Prometheus alerting conventions
+func alertSeverity(severity int) string {
+	switch {
+	case severity >= 9:
+		return "critical"
+	case severity >= 4:
+		return "warning"
+	}
+	return "info"
+}
+
+// resend pushes the active alerts every resendInterval until Close
+func (a *Alertmanager) resend() {
+	defer close(a.stopped)
+	ticker := time.NewTicker(a.resendInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-a.stop:
+			return
+		case <-ticker.C:
+		}
+		now := a.now()
+		a.m.Lock()
+		alerts := make([]Alert, 0, len(a.active))
+		for ip, alert := range a.active {
+			if !alert.expires {
+				alert.EndsAt = now.Add(resendsBeforeResolve * a.resendInterval)
+				a.active[ip] = alert
+			}
+			alerts = append(alerts, alert)
+		}
+		a.m.Unlock()
+		if len(alerts) == 0 {
+			continue
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), alertTimeout)
+		if err := a.push(ctx, alerts); err != nil {
+			log.Err(err).Msgf("Alertmanager: resending %d active alerts failed", len(alerts))
+		}
+		cancel()
+	}
+}
+
+// push sends the alerts to every instance, it fails when none of them accepted them
+func (a *Alertmanager) push(ctx context.Context, alerts []Alert) error {
+	body, err := json.Marshal(alerts)
+	if err != nil {
+		return err
+	}
+	var errs []string
+	for _, u := range a.urls {
+		if err := a.post(ctx, u, body); err != nil {
+			log.Warn().Err(err).Msgf("Alertmanager: pushing %d alerts to %s failed", len(alerts), u)
+			errs = append(errs, err.Error())
+		}
+	}
+	if len(errs) == len(a.urls) {
+		return fmt.Errorf("pushing alerts failed: %s", strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+// post retries with backoff, Alertmanager de-duplicates the alerts by their labels
+func (a *Alertmanager) post(ctx context.Context, u string, body []byte) error {
+	var err error
+	for attempt := 0; attempt < alertPushAttempts; attempt++ {
+		if attempt > 0 {
+			select {
+			case <-ctx.Done():
+				return err
+			case <-time.After(a.backoff << (attempt - 1)):
+			}
+		}
+		if err = a.send(ctx, u, body); err == nil {
+			return nil
+		}
+	}
+	return err
+}
+
+func (a *Alertmanager) send(ctx context.Context, u string, body []byte) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, u, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := a.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= http.StatusMultipleChoices {
+		detail, _ := io.ReadAll(io.LimitReader(resp.Body, maxErrorBody))
+		return fmt.Errorf("alertmanager responded with %s: %s", resp.Status, strings.TrimSpace(string(detail)))
+	}
+	return nil
+}
+
+// Close stops resending and resolves the active alerts, the firewall chain is removed on shutdown with all the blocks
+func (a *Alertmanager) Close() error {
+	close(a.stop)
+	<-a.stopped
+	defer a.client.CloseIdleConnections()
+	now := a.now()
+	a.m.Lock()
+	alerts := make([]Alert, 0, len(a.active))
+	for _, alert := range a.active {
+		alert.EndsAt = now
+		alerts = append(alerts, alert)
+	}
+	a.active = make(map[string]Alert)
+	a.m.Unlock()
+	if len(alerts) == 0 {
+		return nil
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), alertTimeout)
+	defer cancel()
+	return a.push(ctx, alerts)
+}
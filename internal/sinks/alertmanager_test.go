@@ -0,0 +1,143 @@
+package sinks
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"tcptracker/internal/events"
+	"testing"
+	"time"
+)
+
+// fakeAlertmanager records the pushed alerts
+type fakeAlertmanager struct {
+	status int
+	pushes [][]Alert
+	m      sync.Mutex
+}
+
+func (f *fakeAlertmanager) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost || r.URL.Path != AlertsPath || r.Header.Get("Content-Type") != "application/json" {
+		http.Error(w, "unexpected request", http.StatusNotFound)
+		return
+	}
+	var alerts []Alert
+	if err := json.NewDecoder(r.Body).Decode(&alerts); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	f.m.Lock()
+	defer f.m.Unlock()
+	if f.status != 0 {
+		w.WriteHeader(f.status)
+		return
+	}
+	f.pushes = append(f.pushes, alerts)
+}
+
+func (f *fakeAlertmanager) received() [][]Alert {
+	f.m.Lock()
+	defer f.m.Unlock()
+	return append([][]Alert{}, f.pushes...)
+}
+
+func newTestAlertmanager(t *testing.T, resendInterval time.Duration, urls ...string) *Alertmanager {
+	a, err := NewAlertmanager(AlertmanagerParams{URLs: urls, ResendInterval: resendInterval, Timeout: time.Second})
+	require.NoError(t, err)
+	a.backoff = time.Millisecond
+	t.Cleanup(func() { a.Close() })
+	return a
+}
+
+func TestAlertmanagerFiresAndResolves(t *testing.T) {
+	fake := &fakeAlertmanager{}
+	server := httptest.NewServer(fake)
+	defer server.Close()
+	a := newTestAlertmanager(t, time.Hour, server.URL+"/")
+	resolved := detected.Add(10 * time.Minute)
+	a.now = func() time.Time { return resolved }
+	ctx := context.Background()
+
+	require.NoError(t, a.Send(ctx, detectionEvent()), "detections wait for the block")
+	require.NoError(t, a.Send(ctx, blockEvent()))
+	require.NoError(t, a.Send(ctx, events.Event{Type: events.Unblock, SrcIP: "10.0.0.1", Time: resolved}))
+	require.NoError(t, a.Send(ctx, events.Event{Type: events.Expiry, SrcIP: "10.0.0.1"}), "already resolved")
+
+	pushes := fake.received()
+	require.Len(t, pushes, 2)
+	firing, resolvedAlert := pushes[0][0], pushes[1][0]
+	assert.Equal(t, map[string]string{
+		"alertname": AlertName, "source": "10.0.0.1", "detector": "portscan", "host": "node-1", "severity": "warning",
+	}, firing.Labels)
+	assert.Equal(t, "d1", firing.Annotations["detectionId"])
+	assert.Equal(t, "DROP", firing.Annotations["action"])
+	assert.True(t, detected.Equal(firing.StartsAt))
+	assert.True(t, expiresAt.Equal(firing.EndsAt), "ends with the block")
+	assert.Equal(t, firing.Labels, resolvedAlert.Labels)
+	assert.True(t, resolved.Equal(resolvedAlert.EndsAt), "resolved when unblocked")
+}
+
+func TestAlertmanagerResendsActiveAlerts(t *testing.T) {
+	fake, other := &fakeAlertmanager{}, &fakeAlertmanager{status: http.StatusServiceUnavailable}
+	server, otherServer := httptest.NewServer(fake), httptest.NewServer(other)
+	defer server.Close()
+	defer otherServer.Close()
+	a := newTestAlertmanager(t, 20*time.Millisecond, server.URL, otherServer.URL)
+
+	block := blockEvent()
+	block.ExpiresAt = nil
+	block.Score = 200
+	require.NoError(t, a.Send(context.Background(), block), "one of the instances accepted it")
+	require.Eventually(t, func() bool { return len(fake.received()) >= 3 }, 5*time.Second, 10*time.Millisecond)
+	pushes := fake.received()
+	assert.Equal(t, "critical", pushes[0][0].Labels["severity"])
+	assert.True(t, pushes[2][0].EndsAt.After(pushes[0][0].EndsAt), "alert without expiry is extended")
+	assert.True(t, pushes[0][0].EndsAt.After(time.Now()))
+}
+
+func TestAlertmanagerResolvesPreviousDetector(t *testing.T) {
+	fake := &fakeAlertmanager{}
+	server := httptest.NewServer(fake)
+	defer server.Close()
+	a := newTestAlertmanager(t, time.Hour, server.URL)
+
+	require.NoError(t, a.Send(context.Background(), blockEvent()))
+	reblock := blockEvent()
+	reblock.DetectionType = "synflood"
+	require.NoError(t, a.Send(context.Background(), reblock))
+	pushes := fake.received()
+	require.Len(t, pushes, 2)
+	require.Len(t, pushes[1], 2)
+	assert.Equal(t, "portscan", pushes[1][0].Labels["detector"])
+	assert.False(t, pushes[1][0].EndsAt.After(time.Now()))
+	assert.Equal(t, "synflood", pushes[1][1].Labels["detector"])
+}
+
+func TestAlertmanagerPushFails(t *testing.T) {
+	fake := &fakeAlertmanager{status: http.StatusBadRequest}
+	server := httptest.NewServer(fake)
+	defer server.Close()
+	a := newTestAlertmanager(t, time.Hour, server.URL)
+	err := a.Send(context.Background(), blockEvent())
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "400")
+}
+
+func TestAlertmanagerResolvesOnClose(t *testing.T) {
+	fake := &fakeAlertmanager{}
+	server := httptest.NewServer(fake)
+	defer server.Close()
+	a, err := NewAlertmanager(AlertmanagerParams{URLs: []string{server.URL}, ResendInterval: time.Hour, Timeout: time.Second})
+	require.NoError(t, err)
+
+	require.NoError(t, a.Send(context.Background(), blockEvent()))
+	require.NoError(t, a.Close())
+	pushes := fake.received()
+	require.Len(t, pushes, 2)
+	assert.Equal(t, "10.0.0.1", pushes[1][0].Labels["source"])
+	assert.False(t, pushes[1][0].EndsAt.After(time.Now()), "blocks are removed on shutdown")
+}
@@ -0,0 +1,254 @@
+// Package sinks delivers the events of the tracker to external systems, e.g. SIEM over syslog
+package sinks
+
+import (
+	"fmt"
+	"runtime/debug"
+	"strconv"
+	"strings"
+	"tcptracker/internal/events"
+	"time"
+)
+
+const (
+	vendor  = "tcptracker"
+	product = "tcptracker"
+	// leefTimeFormat is devTimeFormat of LEEF, Java SimpleDateFormat of the time layout
+	leefTimeLayout = "2006-01-02T15:04:05.000Z07:00"
+	leefTimeFormat = "yyyy-MM-dd'T'HH:mm:ss.SSSXXX"
+)
+
+// Formatter writes the event as the body of the syslog message
+type Formatter func(e events.Event) string
+
+var formatters = map[string]Formatter{
+	"cef":  CEF,
+	"leef": LEEF,
+}
+
+// ParseFormat returns the Formatter of cef or leef
+func ParseFormat(name string) (Formatter, error) {
+	f, ok := formatters[strings.ToLower(name)]
+	if !ok {
+		return nil, fmt.Errorf("unknown format %q, use cef or leef", name)
+	}
+	return f, nil
+}
+
+// Severity of the event from 0 to 10 as in CEF, detections are high and raise with the score,
+// blocks are medium and lifted blocks are low
+func Severity(e events.Event) int {
+	switch e.Type {
+	case events.Detection:
+		switch {
+		case e.Score >= 100:
+			return 9
+		case e.Score >= 20:
+			return 8
+		}
+		return 7
+	case events.Block:
+		return 6
+	case events.Unblock, events.Expiry:
+		return 3
+	}
+	return 1
+}
+
+// syslogSeverity maps CEF severity to the syslog one, critical (2) to informational (6)
+func syslogSeverity(severity int) int {
+	switch {
+	case severity >= 9:
+		return 2
+	case severity >= 7:
+		return 3
+	case severity >= 4:
+		return 4
+	case severity >= 2:
+		return 5
+	}
+	return 6
+}
+
+// signatureID identifies the kind of the event, detections by their detector
+func signatureID(e events.Event) string {
+	if e.Type == events.Detection && e.DetectionType != "" {
+		return string(e.DetectionType)
+	}
+	return string(e.Type)
+}
+
+func name(e events.Event) string {
+	switch e.Type {
+	case events.Connection:
+		return "New connection"
+	case events.Detection:
+		return fmt.Sprintf("%s detected", e.DetectionType)
+	case events.Block:
+		return "Source blocked"
+	case events.Unblock:
+		return "Source unblocked"
+	case events.Expiry:
+		return "Block expired"
+	}
+	return string(e.Type)
+}
+
+// field of the extension, empty values are left out
+type field struct {
+	key   string
+	value string
+}
+
+// fields are shared by CEF and LEEF, keys are CEF names
+func fields(e events.Event) []field {
+	all := []field{
+		{"externalId", e.ID},
+		{"cat", string(e.Type)},
+		{"src", e.SrcIP},
+		{"spt", port(e.SrcPort)},
+		{"dst", e.DstIP},
+		{"dpt", port(e.DstPort)},
+		{"act", e.Action},
+		{"cs1Label", "detectionId"}, {"cs1", e.DetectionID},
+		{"cs2Label", "detector"}, {"cs2", string(e.DetectionType)},
+		{"cs3Label", "ports"}, {"cs3", joinPorts(e.Ports)},
+		{"cs4Label", "dstOwner"}, {"cs4", e.DstOwner},
+		{"cn1Label", "score"}, {"cn1", score(e)},
+	}
+	var set []field
+	for i, f := range all {
+		// labels are kept only with their values
+		if strings.HasSuffix(f.key, "Label") && all[i+1].value == "" {
+			continue
+		}
+		if f.value != "" {
+			set = append(set, f)
+		}
+	}
+	return set
+}
+
+// CEF is ArcSight Common Event Format, e.g.
+// CEF:0|tcptracker|tcptracker|1.0|portscan|portscan detected|7|rt=... src=10.0.0.1 ...
+func CEF(e events.Event) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "CEF:0|%s|%s|%s|%s|%s|%d|", cefHeader(vendor), cefHeader(product), cefHeader(productVersion()),
+		cefHeader(signatureID(e)), cefHeader(name(e)), Severity(e))
+	b.WriteString("rt=" + strconv.FormatInt(e.Time.UnixMilli(), 10))
+	if e.Host != "" {
+		b.WriteString(" dvchost=" + cefValue(e.Host))
+	}
+	for _, f := range fields(e) {
+		b.WriteString(" " + f.key + "=" + cefValue(f.value))
+	}
+	if e.ExpiresAt != nil {
+		b.WriteString(" end=" + strconv.FormatInt(e.ExpiresAt.UnixMilli(), 10))
+	}
+	b.WriteString(" msg=" + cefValue(e.Summary()))
+	return b.String()
+}
+
+// LEEF is IBM QRadar Log Event Extended Format 2.0 with tab delimited attributes, e.g.
+// LEEF:2.0|tcptracker|tcptracker|1.0|portscan|x09|devTime=...	sev=7	src=10.0.0.1 ...
+func LEEF(e events.Event) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "LEEF:2.0|%s|%s|%s|%s|x09|", leefHeader(vendor), leefHeader(product), leefHeader(productVersion()),
+		leefHeader(signatureID(e)))
+	attributes := []field{
+		{"devTime", e.Time.Format(leefTimeLayout)},
+		{"devTimeFormat", leefTimeFormat},
+		{"sev", strconv.Itoa(max(Severity(e), 1))},
+	}
+	if e.Host != "" {
+		attributes = append(attributes, field{"identHostName", e.Host})
+	}
+	for _, f := range fields(e) {
+		if key, ok := leefKeys[f.key]; ok {
+			attributes = append(attributes, field{key, f.value})
+		}
+	}
+	if e.ExpiresAt != nil {
+		attributes = append(attributes, field{"expiresAt", e.ExpiresAt.Format(leefTimeLayout)})
+	}
+	attributes = append(attributes, field{"msg", e.Summary()})
+	for i, a := range attributes {
+		if i > 0 {
+			b.WriteByte('\t')
+		}
+		b.WriteString(a.key + "=" + leefValue(a.value))
+	}
+	return b.String()
+}
+
+// leefKeys are LEEF names of the CEF keys, custom labels are not needed
+var leefKeys = map[string]string{
+	"externalId": "eventId",
+	"cat":        "cat",
+	"src":        "src",
+	"spt":        "srcPort",
+	"dst":        "dst",
+	"dpt":        "dstPort",
+	"act":        "action",
+	"cs1":        "detectionId",
+	"cs2":        "detector",
+	"cs3":        "ports",
+	"cs4":        "dstOwner",
+	"cn1":        "score",
+}
+
+var (
+	cefHeaderEscaper  = strings.NewReplacer(`\`, `\\`, `|`, `\|`, "\n", " ", "\r", " ")
+	cefValueEscaper   = strings.NewReplacer(`\`, `\\`, `=`, `\=`, "\n", `\n`, "\r", `\r`)
+	leefHeaderEscaper = strings.NewReplacer(`|`, `\|`, "\n", " ", "\r", " ")
+	leefValueEscaper  = strings.NewReplacer("\t", " ", "\n", " ", "\r", " ")
+)
+
+func cefHeader(s string) string  { return cefHeaderEscaper.Replace(s) }
+func cefValue(s string) string   { return cefValueEscaper.Replace(s) }
+func leefHeader(s string) string { return leefHeaderEscaper.Replace(s) }
+func leefValue(s string) string  { return leefValueEscaper.Replace(s) }
+
+func port(p int) string {
+	if p == 0 {
+		return ""
+	}
+	return strconv.Itoa(p)
+}
+
+func score(e events.Event) string {
+	if e.Type != events.Detection && e.Type != events.Block {
+		return ""
+	}
+	return strconv.Itoa(e.Score)
+}
+
+func joinPorts(ports []int) string {
+	s := make([]string, 0, len(ports))
+	for _, p := range ports {
+		s = append(s, strconv.Itoa(p))
+	}
+	return strings.Join(s, ",")
+}
+
+func max(a, b int) int {
+	if a > b {
+		return a
+	}
+	return b
+}
+
+// productVersion is the module version of the binary, (devel) for local builds
+func productVersion() string {
+	if info, ok := debug.ReadBuildInfo(); ok && info.Main.Version != "" {
+		return info.Main.Version
+	}
+	return "(devel)"
+}
+
+// rfc5424Time has microseconds, the most allowed by RFC 5424
+const rfc5424Time = "2006-01-02T15:04:05.000000Z07:00"
+
+func syslogTime(t time.Time) string {
+	return t.UTC().Format(rfc5424Time)
+}
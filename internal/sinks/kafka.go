@@ -0,0 +1,155 @@
+package sinks
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/twmb/franz-go/pkg/kgo"
+	"github.com/twmb/franz-go/pkg/sasl"
+	"github.com/twmb/franz-go/pkg/sasl/plain"
+	"github.com/twmb/franz-go/pkg/sasl/scram"
+	"net"
+	"tcptracker/internal/events"
+	"time"
+)
+
+// saslMechanisms of the Kafka sink, used when the username is set
+var saslMechanisms = map[string]func(user, pass string) sasl.Mechanism{
+	"plain": func(user, pass string) sasl.Mechanism {
+		return plain.Auth{User: user, Pass: pass}.AsMechanism()
+	},
+	"scram-sha-256": func(user, pass string) sasl.Mechanism {
+		return scram.Auth{User: user, Pass: pass}.AsSha256Mechanism()
+	},
+	"scram-sha-512": func(user, pass string) sasl.Mechanism {
+		return scram.Auth{User: user, Pass: pass}.AsSha512Mechanism()
+	},
+}
+
+// ParseSASLMechanism checks the SASL mechanism of the Kafka sink: plain, scram-sha-256 or scram-sha-512
+func ParseSASLMechanism(name string) error {
+	if _, ok := saslMechanisms[name]; !ok {
+		return fmt.Errorf("unknown SASL mechanism %q, use plain, scram-sha-256 or scram-sha-512", name)
+	}
+	return nil
+}
+
+// KafkaParams of the Kafka sink, Brokers are the seed brokers host:port
+type KafkaParams struct {
+	StreamParams
+	Brokers []string
+	// Username enables SASL authentication with SASLMechanism
+	Username      string
+	Password      string
+	SASLMechanism string
+	// TLS connects to the brokers over TLS, TLSCA verifies them, the system roots are used when empty
+	TLS     bool
+	TLSCA   string
+	Timeout time.Duration
+}
+
+// Kafka produces the events in batches with the Kafka protocol, the records are keyed by the source IP,
+// so the events of a source keep their order in a partition. The records are compressed by the producer,
+// so they are stored compressed in the topic.
+type Kafka struct {
+	*batcher
+	client *kgo.Client
+}
+
+// NewKafka creates the sink, the brokers are not contacted until the first batch
+func NewKafka(p KafkaParams) (*Kafka, error) {
+	if err := p.validate(); err != nil {
+		return nil, err
+	}
+	if len(p.Brokers) == 0 {
+		return nil, errors.New("kafka brokers are required")
+	}
+	for _, broker := range p.Brokers {
+		if _, port, err := net.SplitHostPort(broker); err != nil || port == "" {
+			return nil, fmt.Errorf("kafka broker must be host:port, got %q", broker)
+		}
+	}
+	if p.Timeout <= 0 {
+		p.Timeout = streamTimeout
+	}
+	compression := kgo.NoCompression()
+	if p.Compression == "gzip" {
+		compression = kgo.GzipCompression()
+	}
+	opts := []kgo.Opt{
+		kgo.SeedBrokers(p.Brokers...),
+		kgo.ClientID(appName),
+		kgo.SoftwareNameAndVersion(appName, productVersion()),
+		kgo.ProducerBatchCompression(compression),
+		// the batcher collects the events, the records are sent right away
+		kgo.ProducerLinger(0),
+		kgo.ProduceRequestTimeout(p.Timeout),
+		kgo.RecordDeliveryTimeout(p.Timeout),
+		kgo.DialTimeout(p.Timeout),
+	}
+	if p.Username != "" {
+		mechanism, ok := saslMechanisms[p.SASLMechanism]
+		if !ok {
+			return nil, ParseSASLMechanism(p.SASLMechanism)
+		}
+		opts = append(opts, kgo.SASL(mechanism(p.Username, p.Password)))
+	}
+	if p.TLS {
+		tlsConfig := &tls.Config{MinVersion: tls.VersionTLS12}
+		if p.TLSCA != "" {
+			pool, err := certPool(p.TLSCA)
+			if err != nil {
+				return nil, err
+			}
+			tlsConfig.RootCAs = pool
+		}
+		opts = append(opts, kgo.DialTLSConfig(tlsConfig))
+	}
+	client, err := kgo.NewClient(opts...)
+	if err != nil {
+		return nil, err
+	}
+	k := &Kafka{client: client}
+	if k.batcher, err = newBatcher(k.Name(), p.StreamParams, k.produce); err != nil {
+		client.Close()
+		return nil, err
+	}
+	return k, nil
+}
+
+// Name of the sink
+func (k *Kafka) Name() string {
+	return "kafka"
+}
+
+// Send adds the event to the batch, it is published when the batch is full or after the linger
+func (k *Kafka) Send(ctx context.Context, e events.Event) error {
+	k.add(ctx, e)
+	return nil
+}
+
+// produce waits for the acknowledgement of all the records, the whole batch is retried by the batcher and
+// the consumers de-duplicate by the event ID
+func (k *Kafka) produce(ctx context.Context, topic string, batch []events.Event) error {
+	records := make([]*kgo.Record, 0, len(batch))
+	for _, e := range batch {
+		value, err := json.Marshal(e)
+		if err != nil {
+			return err
+		}
+		records = append(records, &kgo.Record{Topic: topic, Key: []byte(e.SrcIP), Value: value})
+	}
+	if err := k.client.ProduceSync(ctx, records...).FirstErr(); err != nil {
+		return fmt.Errorf("producing to %s failed: %w", topic, err)
+	}
+	return nil
+}
+
+// Close publishes the pending events and closes the connections to the brokers
+func (k *Kafka) Close() error {
+	k.close()
+	k.client.Close()
+	return nil
+}
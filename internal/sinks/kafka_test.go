@@ -0,0 +1,109 @@
+package sinks
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/twmb/franz-go/pkg/kfake"
+	"github.com/twmb/franz-go/pkg/kgo"
+	"github.com/twmb/franz-go/pkg/sasl/plain"
+	"tcptracker/internal/events"
+	"testing"
+	"time"
+)
+
+func newFakeKafka(t *testing.T, topics ...string) []string {
+	cluster, err := kfake.NewCluster(
+		kfake.NumBrokers(1),
+		kfake.SeedTopics(1, topics...),
+		kfake.EnableSASL(),
+		kfake.Superuser("PLAIN", "producer", "secret"),
+	)
+	require.NoError(t, err)
+	t.Cleanup(cluster.Close)
+	return cluster.ListenAddrs()
+}
+
+// consumed reads the records of the topic from the start
+func consumed(t *testing.T, brokers []string, topic string, count int) []*kgo.Record {
+	client, err := kgo.NewClient(
+		kgo.SeedBrokers(brokers...),
+		kgo.SASL(plain.Auth{User: "producer", Pass: "secret"}.AsMechanism()),
+		kgo.ConsumeTopics(topic),
+		kgo.ConsumeResetOffset(kgo.NewOffset().AtStart()),
+	)
+	require.NoError(t, err)
+	defer client.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	var records []*kgo.Record
+	for len(records) < count {
+		fetches := client.PollFetches(ctx)
+		require.NoError(t, ctx.Err())
+		records = append(records, fetches.Records()...)
+	}
+	return records
+}
+
+func TestKafkaProducesBatches(t *testing.T) {
+	for _, compression := range []string{"none", "gzip"} {
+		t.Run(compression, func(t *testing.T) {
+			brokers := newFakeKafka(t, "tcptracker.connection", "tcptracker.detection")
+			k, err := NewKafka(KafkaParams{
+				StreamParams:  StreamParams{Topic: "tcptracker." + TypePlaceholder, BatchSize: 2, Linger: time.Hour, Compression: compression},
+				Brokers:       brokers,
+				Username:      "producer",
+				Password:      "secret",
+				SASLMechanism: "plain",
+				Timeout:       time.Second,
+			})
+			require.NoError(t, err)
+			require.NoError(t, k.Send(context.Background(), connectionEvent("10.0.0.1")))
+			require.NoError(t, k.Send(context.Background(), connectionEvent("10.0.0.3")))
+			require.NoError(t, k.Send(context.Background(), detectionEvent()))
+			require.NoError(t, k.Close())
+
+			connections := consumed(t, brokers, "tcptracker.connection", 2)
+			require.Len(t, connections, 2)
+			assert.Equal(t, "10.0.0.1", string(connections[0].Key), "keyed by source")
+			var e events.Event
+			require.NoError(t, json.Unmarshal(connections[0].Value, &e))
+			assert.Equal(t, 22, e.DstPort)
+			detections := consumed(t, brokers, "tcptracker.detection", 1)
+			require.NoError(t, json.Unmarshal(detections[0].Value, &e))
+			assert.Equal(t, "d1", e.DetectionID)
+		})
+	}
+}
+
+func TestKafkaProduceErrors(t *testing.T) {
+	brokers := newFakeKafka(t, "events")
+	k, err := NewKafka(KafkaParams{
+		StreamParams:  StreamParams{Topic: "events", BatchSize: 10, Linger: time.Hour, Compression: "none"},
+		Brokers:       brokers,
+		Username:      "producer",
+		Password:      "wrong",
+		SASLMechanism: "plain",
+		Timeout:       time.Second,
+	})
+	require.NoError(t, err)
+	defer k.Close()
+
+	err = k.produce(context.Background(), "events", []events.Event{connectionEvent("10.0.0.1")})
+	assert.ErrorContains(t, err, "producing to events failed")
+}
+
+func TestNewKafkaRejectsParams(t *testing.T) {
+	stream := StreamParams{Topic: "events", BatchSize: 1, Linger: time.Second, Compression: "none"}
+	for name, p := range map[string]KafkaParams{
+		"no brokers":     {StreamParams: stream},
+		"broker no port": {StreamParams: stream, Brokers: []string{"kafka"}},
+		"mechanism":      {StreamParams: stream, Brokers: []string{"kafka:9092"}, Username: "producer", SASLMechanism: "gssapi"},
+	} {
+		t.Run(name, func(t *testing.T) {
+			_, err := NewKafka(p)
+			assert.Error(t, err)
+		})
+	}
+}
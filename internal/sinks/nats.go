@@ -0,0 +1,195 @@
+package sinks
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"github.com/nats-io/nats.go"
+	"github.com/rs/zerolog/log"
+	"net/url"
+	"tcptracker/internal/events"
+	"time"
+)
+
+const (
+	natsContentType = "application/x-ndjson"
+	// natsReconnectWait between the reconnects of a broken connection, the jitter spreads the trackers
+	natsReconnectWait   = 2 * time.Second
+	natsReconnectJitter = time.Second
+)
+
+// NATSParams of the NATS sink, URL is nats://host:4222 or tls://host:4222
+type NATSParams struct {
+	StreamParams
+	URL      string
+	User     string
+	Password string
+	Token    string
+	// TLSCA verifies the server, the system roots are used when empty
+	TLSCA   string
+	Timeout time.Duration
+}
+
+// NATS publishes the batches of the events as JSON lines to the subject with the core NATS protocol.
+// The messages have Content-Type and Content-Encoding headers when the server supports them, every batch
+// is confirmed by a flush, so the errors of the server like permission violations fail the batch.
+// A broken connection is reconnected in the background, the batches fail meanwhile and are not buffered.
+type NATS struct {
+	*batcher
+	url         string
+	options     []nats.Option
+	compression string
+	timeout     time.Duration
+	// conn is used only by the flushing of the batcher, one at a time
+	conn *nats.Conn
+}
+
+// NewNATS creates the sink, it connects on the first batch
+func NewNATS(p NATSParams) (*NATS, error) {
+	if err := p.validate(); err != nil {
+		return nil, err
+	}
+	u, err := url.Parse(p.URL)
+	if err != nil || (u.Scheme != "nats" && u.Scheme != "tls") || u.Port() == "" {
+		return nil, fmt.Errorf("NATS URL must be nats://host:port or tls://host:port, got %q", p.URL)
+	}
+	if p.Timeout <= 0 {
+		p.Timeout = streamTimeout
+	}
+	options := []nats.Option{
+		nats.Name(appName + "/" + productVersion()),
+		nats.Timeout(p.Timeout),
+		nats.MaxReconnects(-1),
+		nats.ReconnectWait(natsReconnectWait),
+		nats.ReconnectJitter(natsReconnectJitter, natsReconnectJitter),
+		// the batcher retries the failed batches, the buffer would publish them again after the reconnect
+		nats.ReconnectBufSize(-1),
+		nats.DisconnectErrHandler(func(_ *nats.Conn, err error) {
+			// Close disconnects without error
+			if err != nil {
+				log.Warn().Err(err).Msgf("NATS: disconnected from %s", u.Host)
+			}
+		}),
+		nats.ReconnectHandler(func(c *nats.Conn) {
+			log.Info().Msgf("NATS: reconnected to %s", c.ConnectedUrlRedacted())
+		}),
+		nats.ErrorHandler(func(_ *nats.Conn, _ *nats.Subscription, err error) {
+			log.Err(err).Msg("NATS: server error")
+		}),
+	}
+	if p.User != "" {
+		options = append(options, nats.UserInfo(p.User, p.Password))
+	}
+	if p.Token != "" {
+		options = append(options, nats.Token(p.Token))
+	}
+	if u.Scheme == "tls" || p.TLSCA != "" {
+		tlsConfig := &tls.Config{ServerName: u.Hostname(), MinVersion: tls.VersionTLS12}
+		if p.TLSCA != "" {
+			pool, err := certPool(p.TLSCA)
+			if err != nil {
+				return nil, err
+			}
+			tlsConfig.RootCAs = pool
+		}
+		options = append(options, nats.Secure(tlsConfig))
+	}
+	n := &NATS{
+		url:         p.URL,
+		options:     options,
+		compression: p.Compression,
+		timeout:     p.Timeout,
+	}
+	if n.batcher, err = newBatcher(n.Name(), p.StreamParams, n.publish); err != nil {
+		return nil, err
+	}
+	return n, nil
+}
+
+// Name of the sink
+func (n *NATS) Name() string {
+	return "nats"
+}
+
+// Send adds the event to the batch, it is published when the batch is full or after the linger
+func (n *NATS) Send(ctx context.Context, e events.Event) error {
+	n.add(ctx, e)
+	return nil
+}
+
+func (n *NATS) publish(ctx context.Context, subject string, batch []events.Event) error {
+	if n.conn == nil || n.conn.IsClosed() {
+		conn, err := nats.Connect(n.url, n.options...)
+		if err != nil {
+			return err
+		}
+		log.Info().Msgf("NATS: connected to %s", conn.ConnectedUrlRedacted())
+		n.conn = conn
+	}
+	// the batch is split before anything is published, so a failed batch is retried as a whole
+	payloads, err := n.payloads(batch)
+	if err != nil {
+		return err
+	}
+	// the errors of the server are reported before the PONG of the flush, the previous one is not of this batch
+	before := n.conn.LastError()
+	for _, payload := range payloads {
+		msg := nats.NewMsg(subject)
+		msg.Data = payload
+		if n.conn.HeadersSupported() {
+			msg.Header.Set("Content-Type", natsContentType)
+			if n.compression == "gzip" {
+				msg.Header.Set("Content-Encoding", "gzip")
+			}
+		}
+		if err := n.conn.PublishMsg(msg); err != nil {
+			return err
+		}
+	}
+	ctx, cancel := context.WithTimeout(ctx, n.timeout)
+	defer cancel()
+	if err := n.conn.FlushWithContext(ctx); err != nil {
+		return err
+	}
+	if err := n.conn.LastError(); err != nil && err != before {
+		return err
+	}
+	return nil
+}
+
+// payloads of the batch, it is split in halves until they fit the max payload of the server
+func (n *NATS) payloads(batch []events.Event) ([][]byte, error) {
+	data, err := ndjson(batch)
+	if err != nil {
+		return nil, err
+	}
+	payload, err := compress(data, n.compression)
+	if err != nil {
+		return nil, err
+	}
+	maxPayload := n.conn.MaxPayload()
+	if int64(len(payload)) <= maxPayload {
+		return [][]byte{payload}, nil
+	}
+	if len(batch) == 1 {
+		return nil, fmt.Errorf("event of %d bytes exceeds max payload %d", len(payload), maxPayload)
+	}
+	first, err := n.payloads(batch[:len(batch)/2])
+	if err != nil {
+		return nil, err
+	}
+	second, err := n.payloads(batch[len(batch)/2:])
+	if err != nil {
+		return nil, err
+	}
+	return append(first, second...), nil
+}
+
+// Close publishes the pending events and closes the connection
+func (n *NATS) Close() error {
+	n.close()
+	if n.conn != nil {
+		n.conn.Close()
+	}
+	return nil
+}
@@ -0,0 +1,221 @@
+package sinks
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"tcptracker/internal/events"
+	"testing"
+	"time"
+)
+
+// natsMessage is published by HPUB or PUB
+type natsMessage struct {
+	subject string
+	headers string
+	payload []byte
+}
+
+// natsConnect is the part of the CONNECT options checked by the tests
+type natsConnect struct {
+	User    string `json:"user"`
+	Pass    string `json:"pass"`
+	Headers bool   `json:"headers"`
+}
+
+// fakeNATS speaks enough of the NATS protocol to receive the publishes of one client at a time
+type fakeNATS struct {
+	listener net.Listener
+	info     string
+	connect  natsConnect
+	messages []natsMessage
+	// deny answers the publishes with -ERR
+	deny bool
+	m    sync.Mutex
+}
+
+func newFakeNATS(t *testing.T, info string) *fakeNATS {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	f := &fakeNATS{listener: l, info: info}
+	go f.serve()
+	t.Cleanup(func() { l.Close() })
+	return f
+}
+
+func (f *fakeNATS) url() string {
+	return "nats://" + f.listener.Addr().String()
+}
+
+func (f *fakeNATS) serve() {
+	for {
+		conn, err := f.listener.Accept()
+		if err != nil {
+			return
+		}
+		f.handle(conn)
+	}
+}
+
+func (f *fakeNATS) handle(conn net.Conn) {
+	defer conn.Close()
+	fmt.Fprintf(conn, "INFO %s\r\n", f.info)
+	r := bufio.NewReader(conn)
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return
+		}
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		f.m.Lock()
+		switch fields[0] {
+		case "CONNECT":
+			_ = json.Unmarshal([]byte(strings.TrimPrefix(strings.TrimSpace(line), "CONNECT ")), &f.connect)
+		case "PING":
+			fmt.Fprint(conn, "PONG\r\n")
+		case "HPUB", "PUB":
+			msg := natsMessage{subject: fields[1]}
+			var headerLen, total int
+			if fields[0] == "HPUB" {
+				fmt.Sscan(fields[2], &headerLen)
+				fmt.Sscan(fields[3], &total)
+			} else {
+				fmt.Sscan(fields[2], &total)
+			}
+			data := make([]byte, total+2)
+			if _, err := io.ReadFull(r, data); err != nil {
+				f.m.Unlock()
+				return
+			}
+			msg.headers, msg.payload = string(data[:headerLen]), data[headerLen:total]
+			if f.deny {
+				fmt.Fprintf(conn, "-ERR 'Permissions Violation for Publish to \"%s\"'\r\n", msg.subject)
+			} else {
+				f.messages = append(f.messages, msg)
+			}
+		}
+		f.m.Unlock()
+	}
+}
+
+func (f *fakeNATS) received() []natsMessage {
+	f.m.Lock()
+	defer f.m.Unlock()
+	return append([]natsMessage{}, f.messages...)
+}
+
+func newTestNATS(t *testing.T, url, compression string) *NATS {
+	n, err := NewNATS(NATSParams{
+		StreamParams: StreamParams{Topic: "tcptracker.events." + TypePlaceholder, BatchSize: 2, Linger: time.Hour, Compression: compression},
+		URL:          url,
+		User:         "tracker",
+		Password:     "secret",
+		Timeout:      time.Second,
+	})
+	require.NoError(t, err)
+	n.backoff = time.Millisecond
+	return n
+}
+
+func lines(t *testing.T, payload []byte) []string {
+	return strings.Split(strings.TrimSpace(string(payload)), "\n")
+}
+
+func TestNATSPublishesBatches(t *testing.T) {
+	server := newFakeNATS(t, `{"server_id":"fake","headers":true,"max_payload":1048576}`)
+	n := newTestNATS(t, server.url(), "gzip")
+
+	require.NoError(t, n.Send(context.Background(), connectionEvent("10.0.0.1")))
+	require.NoError(t, n.Send(context.Background(), connectionEvent("10.0.0.3")))
+	require.NoError(t, n.Close())
+
+	messages := server.received()
+	require.Len(t, messages, 1)
+	assert.Equal(t, "tcptracker.events.connection", messages[0].subject)
+	assert.True(t, strings.HasPrefix(messages[0].headers, "NATS/1.0\r\n"))
+	assert.Contains(t, messages[0].headers, "Content-Type: application/x-ndjson\r\n")
+	assert.Contains(t, messages[0].headers, "Content-Encoding: gzip\r\n")
+	gz, err := gzip.NewReader(bytes.NewReader(messages[0].payload))
+	require.NoError(t, err)
+	payload, err := io.ReadAll(gz)
+	require.NoError(t, err)
+	published := lines(t, payload)
+	require.Len(t, published, 2)
+	assert.Contains(t, published[1], `"srcIp":"10.0.0.3"`)
+	assert.Equal(t, "tracker", server.connect.User)
+	assert.Equal(t, "secret", server.connect.Pass)
+	assert.True(t, server.connect.Headers)
+}
+
+func TestNATSWithoutHeaders(t *testing.T) {
+	// max payload fits one event, the batch is split
+	server := newFakeNATS(t, `{"server_id":"old","max_payload":250}`)
+	n := newTestNATS(t, server.url(), "none")
+
+	require.NoError(t, n.Send(context.Background(), connectionEvent("10.0.0.1")))
+	require.NoError(t, n.Send(context.Background(), connectionEvent("10.0.0.3")))
+	messages := server.received()
+	require.Len(t, messages, 2)
+	assert.Empty(t, messages[0].headers, "PUB")
+	assert.Len(t, lines(t, messages[0].payload), 1)
+	assert.Contains(t, string(messages[1].payload), `"srcIp":"10.0.0.3"`)
+	require.NoError(t, n.Close())
+}
+
+func TestNATSSplitsBeforePublishing(t *testing.T) {
+	server := newFakeNATS(t, `{"server_id":"old","max_payload":250}`)
+	n := newTestNATS(t, server.url(), "none")
+	defer n.Close()
+
+	large := connectionEvent("10.0.0.3")
+	large.DstOwner = strings.Repeat("x", 250)
+	batch := []events.Event{connectionEvent("10.0.0.1"), large}
+	err := n.publish(context.Background(), "tcptracker.events.connection", batch)
+	assert.ErrorContains(t, err, "exceeds max payload")
+	// the first half is not published, the retried batch would repeat it
+	assert.Empty(t, server.received())
+}
+
+func TestNATSServerErrors(t *testing.T) {
+	server := newFakeNATS(t, `{"server_id":"fake","headers":true,"max_payload":1048576}`)
+	n := newTestNATS(t, server.url(), "none")
+	defer n.Close()
+
+	server.m.Lock()
+	server.deny = true
+	server.m.Unlock()
+	err := n.publish(context.Background(), "tcptracker.events.connection", []events.Event{connectionEvent("10.0.0.1")})
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "Permissions Violation")
+
+	server.m.Lock()
+	server.deny = false
+	server.m.Unlock()
+	require.NoError(t, n.publish(context.Background(), "tcptracker.events.connection", []events.Event{connectionEvent("10.0.0.1")}))
+	assert.Len(t, server.received(), 1)
+
+	// the dropped connection is reconnected by the next batch
+	n.conn.Close()
+	require.NoError(t, n.publish(context.Background(), "tcptracker.events.connection", []events.Event{connectionEvent("10.0.0.3")}))
+	assert.Len(t, server.received(), 2)
+}
+
+func TestNewNATSRejectsURL(t *testing.T) {
+	_, err := NewNATS(NATSParams{
+		StreamParams: StreamParams{Topic: "events", BatchSize: 1, Linger: time.Second, Compression: "none"},
+		URL:          "http://nats:4222",
+	})
+	assert.Error(t, err)
+}
@@ -0,0 +1,238 @@
+package sinks
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/rs/zerolog/log"
+	"os"
+	"strings"
+	"sync"
+	"tcptracker/internal/events"
+	"time"
+)
+
+const (
+	// TypePlaceholder in the topic is replaced by the event type, e.g. tcptracker.{type}
+	TypePlaceholder = "{type}"
+
+	streamAttempts = 3
+	streamBackoff  = 100 * time.Millisecond
+	// streamTimeout bounds publishing a batch on linger and close
+	streamTimeout = 10 * time.Second
+)
+
+var (
+	streamBatches = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "tcptracker_stream_batches_total",
+		Help: "Batches published to the message bus by sink and result: published or failed",
+	}, []string{"sink", "result"})
+	streamEvents = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "tcptracker_stream_events_total",
+		Help: "Events published to the message bus by sink and result: published or failed",
+	}, []string{"sink", "result"})
+)
+
+var compressions = map[string]bool{"none": true, "gzip": true}
+
+// ParseCompression checks the compression of the batches, none or gzip
+func ParseCompression(name string) error {
+	if !compressions[name] {
+		return fmt.Errorf("unknown compression %q, use none or gzip", name)
+	}
+	return nil
+}
+
+// StreamParams are shared by the Kafka and NATS sinks, the batch is published when it has BatchSize events
+// or Linger after the first of them
+type StreamParams struct {
+	// Topic of the events, TypePlaceholder is replaced by the event type
+	Topic       string
+	BatchSize   int
+	Linger      time.Duration
+	Compression string
+	// Metrics are optional
+	Metrics *prometheus.Registry
+}
+
+func (p StreamParams) validate() error {
+	if p.Topic == "" {
+		return errors.New("topic is required")
+	}
+	if p.BatchSize < 1 || p.Linger <= 0 {
+		return fmt.Errorf("batch size and linger must be positive, got %d and %s", p.BatchSize, p.Linger)
+	}
+	return ParseCompression(p.Compression)
+}
+
+// publishFunc publishes the batch of the events of the same topic
+type publishFunc func(ctx context.Context, topic string, batch []events.Event) error
+
+// batcher collects the events of a stream sink, the batch is published by Send filling it or by the linger loop.
+// Failed batches are retried a few times and dropped, a slow bus fills the sink buffer and the next events
+// are dropped by the Broker, so the capture is never blocked.
+type batcher struct {
+	name    string
+	topic   string
+	size    int
+	publish publishFunc
+	backoff time.Duration
+	pending []events.Event
+	m       sync.Mutex
+	// flushing serializes the publishing of Send and the linger loop
+	flushing sync.Mutex
+	stop     chan struct{}
+	stopped  chan struct{}
+}
+
+func newBatcher(name string, p StreamParams, publish publishFunc) (*batcher, error) {
+	if p.Metrics != nil {
+		for _, c := range []prometheus.Collector{streamBatches, streamEvents} {
+			// Kafka and NATS sinks share the collectors
+			if err := p.Metrics.Register(c); err != nil && !errors.As(err, &prometheus.AlreadyRegisteredError{}) {
+				return nil, err
+			}
+		}
+	}
+	b := &batcher{
+		name:    name,
+		topic:   p.Topic,
+		size:    p.BatchSize,
+		publish: publish,
+		backoff: streamBackoff,
+		stop:    make(chan struct{}),
+		stopped: make(chan struct{}),
+	}
+	go b.linger(p.Linger)
+	return b, nil
+}
+
+// add queues the event, the full batch is published right away
+func (b *batcher) add(ctx context.Context, e events.Event) {
+	b.m.Lock()
+	b.pending = append(b.pending, e)
+	full := len(b.pending) >= b.size
+	b.m.Unlock()
+	if full {
+		b.flush(ctx)
+	}
+}
+
+func (b *batcher) linger(interval time.Duration) {
+	defer close(b.stopped)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-b.stop:
+			return
+		case <-ticker.C:
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), streamTimeout)
+		b.flush(ctx)
+		cancel()
+	}
+}
+
+// flush publishes the pending events grouped by their topics
+func (b *batcher) flush(ctx context.Context) {
+	b.flushing.Lock()
+	defer b.flushing.Unlock()
+	b.m.Lock()
+	pending := b.pending
+	b.pending = nil
+	b.m.Unlock()
+
+	var topics []string
+	batches := make(map[string][]events.Event)
+	for _, e := range pending {
+		topic := strings.ReplaceAll(b.topic, TypePlaceholder, string(e.Type))
+		if _, ok := batches[topic]; !ok {
+			topics = append(topics, topic)
+		}
+		batches[topic] = append(batches[topic], e)
+	}
+	for _, topic := range topics {
+		batch := batches[topic]
+		if err := b.retry(ctx, topic, batch); err != nil {
+			log.Err(err).Msgf("Events: %s sink dropped the batch of %d events to %s", b.name, len(batch), topic)
+			streamBatches.WithLabelValues(b.name, "failed").Inc()
+			streamEvents.WithLabelValues(b.name, "failed").Add(float64(len(batch)))
+			continue
+		}
+		streamBatches.WithLabelValues(b.name, "published").Inc()
+		streamEvents.WithLabelValues(b.name, "published").Add(float64(len(batch)))
+	}
+}
+
+func (b *batcher) retry(ctx context.Context, topic string, batch []events.Event) error {
+	var err error
+	for attempt := 0; attempt < streamAttempts; attempt++ {
+		if attempt > 0 {
+			select {
+			case <-ctx.Done():
+				return err
+			case <-time.After(b.backoff << (attempt - 1)):
+			}
+		}
+		if err = b.publish(ctx, topic, batch); err == nil {
+			return nil
+		}
+	}
+	return err
+}
+
+// close stops the linger loop and publishes the pending events
+func (b *batcher) close() {
+	close(b.stop)
+	<-b.stopped
+	ctx, cancel := context.WithTimeout(context.Background(), streamTimeout)
+	defer cancel()
+	b.flush(ctx)
+}
+
+// ndjson writes the events as JSON lines
+func ndjson(batch []events.Event) ([]byte, error) {
+	var b bytes.Buffer
+	enc := json.NewEncoder(&b)
+	for _, e := range batch {
+		if err := enc.Encode(e); err != nil {
+			return nil, err
+		}
+	}
+	return b.Bytes(), nil
+}
+
+// compress the payload with gzip, none returns it as it is
+func compress(data []byte, compression string) ([]byte, error) {
+	if compression != "gzip" {
+		return data, nil
+	}
+	var b bytes.Buffer
+	w := gzip.NewWriter(&b)
+	if _, err := w.Write(data); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return b.Bytes(), nil
+}
+
+// certPool reads the PEM certificates verifying the servers
+func certPool(path string) (*x509.CertPool, error) {
+	pem, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("%s: no certificates found", path)
+	}
+	return pool, nil
+}
@@ -0,0 +1,117 @@
+package sinks
+
+import (
+	"context"
+	"errors"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"sync"
+	"tcptracker/internal/events"
+	"testing"
+	"time"
+)
+
+// published records the batches by topic
+type published struct {
+	batches map[string][][]events.Event
+	fail    int
+	m       sync.Mutex
+}
+
+func (p *published) publish(_ context.Context, topic string, batch []events.Event) error {
+	p.m.Lock()
+	defer p.m.Unlock()
+	if p.fail > 0 {
+		p.fail--
+		return errors.New("bus is down")
+	}
+	if p.batches == nil {
+		p.batches = make(map[string][][]events.Event)
+	}
+	p.batches[topic] = append(p.batches[topic], batch)
+	return nil
+}
+
+func (p *published) topic(topic string) [][]events.Event {
+	p.m.Lock()
+	defer p.m.Unlock()
+	return append([][]events.Event{}, p.batches[topic]...)
+}
+
+func connectionEvent(ip string) events.Event {
+	return events.Event{Type: events.Connection, SrcIP: ip, DstIP: "10.0.0.2", DstPort: 22, Time: detected}
+}
+
+func TestBatcherPublishesFullBatches(t *testing.T) {
+	p := &published{}
+	b, err := newBatcher("test", StreamParams{Topic: "tcptracker." + TypePlaceholder, BatchSize: 3, Linger: time.Hour}, p.publish)
+	require.NoError(t, err)
+	ctx := context.Background()
+
+	b.add(ctx, connectionEvent("10.0.0.1"))
+	b.add(ctx, detectionEvent())
+	assert.Empty(t, p.topic("tcptracker.connection"), "batch is not full")
+	b.add(ctx, connectionEvent("10.0.0.3"))
+
+	connections := p.topic("tcptracker.connection")
+	require.Len(t, connections, 1)
+	assert.Equal(t, "10.0.0.1", connections[0][0].SrcIP)
+	assert.Equal(t, "10.0.0.3", connections[0][1].SrcIP)
+	assert.Len(t, p.topic("tcptracker.detection"), 1)
+
+	b.add(ctx, connectionEvent("10.0.0.4"))
+	b.close()
+	assert.Len(t, p.topic("tcptracker.connection"), 2, "pending events are published on close")
+}
+
+func TestBatcherLinger(t *testing.T) {
+	p := &published{}
+	b, err := newBatcher("test", StreamParams{Topic: "events", BatchSize: 100, Linger: 10 * time.Millisecond}, p.publish)
+	require.NoError(t, err)
+	defer b.close()
+
+	b.add(context.Background(), connectionEvent("10.0.0.1"))
+	require.Eventually(t, func() bool { return len(p.topic("events")) == 1 }, 5*time.Second, 5*time.Millisecond)
+}
+
+func TestBatcherRetriesAndDrops(t *testing.T) {
+	p := &published{fail: 1}
+	b, err := newBatcher("retry", StreamParams{Topic: "events", BatchSize: 1, Linger: time.Hour}, p.publish)
+	require.NoError(t, err)
+	b.backoff = time.Millisecond
+	defer b.close()
+	published := testutil.ToFloat64(streamEvents.WithLabelValues("retry", "published"))
+	failed := testutil.ToFloat64(streamEvents.WithLabelValues("retry", "failed"))
+
+	b.add(context.Background(), connectionEvent("10.0.0.1"))
+	assert.Len(t, p.topic("events"), 1, "retried")
+	p.fail = streamAttempts
+	b.add(context.Background(), connectionEvent("10.0.0.2"))
+	assert.Len(t, p.topic("events"), 1, "dropped")
+	assert.Equal(t, published+1, testutil.ToFloat64(streamEvents.WithLabelValues("retry", "published")))
+	assert.Equal(t, failed+1, testutil.ToFloat64(streamEvents.WithLabelValues("retry", "failed")))
+}
+
+func TestStreamParams(t *testing.T) {
+	valid := StreamParams{Topic: "events", BatchSize: 1, Linger: time.Second, Compression: "gzip"}
+	assert.NoError(t, valid.validate())
+	invalid := valid
+	invalid.Compression = "snappy"
+	assert.Error(t, invalid.validate())
+	invalid = valid
+	invalid.BatchSize = 0
+	assert.Error(t, invalid.validate())
+}
+
+func TestBatcherMetricsConflict(t *testing.T) {
+	registry := prometheus.NewRegistry()
+	// same name with other labels
+	registry.MustRegister(prometheus.NewCounter(prometheus.CounterOpts{Name: "tcptracker_stream_batches_total", Help: "other"}))
+	_, err := NewNATS(NATSParams{
+		StreamParams: StreamParams{Topic: "events", BatchSize: 1, Linger: time.Second, Compression: "none", Metrics: registry},
+		URL:          "nats://nats:4222",
+	})
+	assert.Error(t, err)
+}
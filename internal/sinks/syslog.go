@@ -0,0 +1,237 @@
+package sinks
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"github.com/rs/zerolog/log"
+	"net"
+	"net/url"
+	"os"
+	"strings"
+	"tcptracker/internal/events"
+	"time"
+)
+
+const (
+	appName      = "tcptracker"
+	dialTimeout  = 5 * time.Second
+	writeTimeout = 5 * time.Second
+	// backoff of reconnecting to the collector
+	minBackoff = 500 * time.Millisecond
+	maxBackoff = 30 * time.Second
+)
+
+var facilities = map[string]int{
+	"kern": 0, "user": 1, "mail": 2, "daemon": 3, "auth": 4, "syslog": 5, "lpr": 6, "news": 7,
+	"uucp": 8, "cron": 9, "authpriv": 10, "ftp": 11,
+	"local0": 16, "local1": 17, "local2": 18, "local3": 19, "local4": 20, "local5": 21, "local6": 22, "local7": 23,
+}
+
+// ParseFacility returns the code of the syslog facility name, e.g. authpriv or local0
+func ParseFacility(name string) (int, error) {
+	code, ok := facilities[strings.ToLower(name)]
+	if !ok {
+		return 0, fmt.Errorf("unknown syslog facility %q", name)
+	}
+	return code, nil
+}
+
+// ParseSyslogAddr splits udp://host:514, tcp://host:601, tls://host:6514 or unix:///dev/log
+// into the network and the address
+func ParseSyslogAddr(addr string) (network, address string, err error) {
+	u, err := url.Parse(addr)
+	if err != nil {
+		return "", "", err
+	}
+	switch u.Scheme {
+	case "udp", "tcp", "tls":
+		if _, _, err := net.SplitHostPort(u.Host); err != nil {
+			return "", "", fmt.Errorf("%s: %w", addr, err)
+		}
+		return u.Scheme, u.Host, nil
+	case "unix":
+		if u.Path == "" {
+			return "", "", fmt.Errorf("%s: socket path is required", addr)
+		}
+		return u.Scheme, u.Path, nil
+	}
+	return "", "", fmt.Errorf("%s: unsupported scheme %q, use udp, tcp, tls or unix", addr, u.Scheme)
+}
+
+// SyslogParams of the Syslog sink, see ParseSyslogAddr, ParseFormat and ParseFacility
+type SyslogParams struct {
+	Addr     string
+	Format   string
+	Facility string
+	// TLSCA verifies the collector over tls, the system roots are used when empty
+	TLSCA string
+}
+
+// Syslog sends the events as RFC 5424 messages with CEF or LEEF body, over UDP, TCP or TLS with octet counting
+// framing (RFC 6587) or to the local unix socket. Failed messages are retried with exponential backoff until
+// they are sent, meanwhile the next events wait in the buffer of the sink subscription.
+// Send and Close are called by a single goroutine of the Broker.
+type Syslog struct {
+	network   string
+	address   string
+	tlsConfig *tls.Config
+	format    Formatter
+	facility  int
+	pid       int
+	conn      net.Conn
+	// framed tells the messages are written to a stream, they are prefixed with their length
+	framed  bool
+	backoff time.Duration
+}
+
+// NewSyslog creates the sink, it connects on the first event
+func NewSyslog(p SyslogParams) (*Syslog, error) {
+	network, address, err := ParseSyslogAddr(p.Addr)
+	if err != nil {
+		return nil, err
+	}
+	format, err := ParseFormat(p.Format)
+	if err != nil {
+		return nil, err
+	}
+	facility, err := ParseFacility(p.Facility)
+	if err != nil {
+		return nil, err
+	}
+	s := &Syslog{
+		network:  network,
+		address:  address,
+		format:   format,
+		facility: facility,
+		pid:      os.Getpid(),
+		backoff:  minBackoff,
+	}
+	if network == "tls" {
+		host, _, _ := net.SplitHostPort(address)
+		s.tlsConfig = &tls.Config{ServerName: host, MinVersion: tls.VersionTLS12}
+		if p.TLSCA != "" {
+			pool, err := certPool(p.TLSCA)
+			if err != nil {
+				return nil, err
+			}
+			s.tlsConfig.RootCAs = pool
+		}
+	}
+	return s, nil
+}
+
+// Name of the sink
+func (s *Syslog) Name() string {
+	return "syslog"
+}
+
+// Send writes the message, it reconnects and retries until it is written or ctx is cancelled
+func (s *Syslog) Send(ctx context.Context, e events.Event) error {
+	msg := s.message(e)
+	backoff := s.backoff
+	for {
+		err := s.write(ctx, msg)
+		if err == nil {
+			return nil
+		}
+		log.Err(err).Msgf("Syslog: sending to %s://%s failed, retrying in %s", s.network, s.address, backoff)
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("syslog event %s: %w", e.ID, err)
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+		if backoff > maxBackoff {
+			backoff = maxBackoff
+		}
+	}
+}
+
+func (s *Syslog) write(ctx context.Context, msg string) error {
+	if s.conn == nil {
+		if err := s.connect(ctx); err != nil {
+			return err
+		}
+	}
+	if s.framed {
+		msg = fmt.Sprintf("%d %s", len(msg), msg)
+	}
+	if err := s.conn.SetWriteDeadline(time.Now().Add(writeTimeout)); err != nil {
+		return s.disconnect(err)
+	}
+	if _, err := s.conn.Write([]byte(msg)); err != nil {
+		return s.disconnect(err)
+	}
+	return nil
+}
+
+func (s *Syslog) connect(ctx context.Context) error {
+	dialer := &net.Dialer{Timeout: dialTimeout}
+	var conn net.Conn
+	var err error
+	switch s.network {
+	case "tls":
+		conn, err = (&tls.Dialer{NetDialer: dialer, Config: s.tlsConfig}).DialContext(ctx, "tcp", s.address)
+		s.framed = true
+	case "unix":
+		// /dev/log is a datagram socket, other daemons listen on stream sockets
+		conn, err = dialer.DialContext(ctx, "unixgram", s.address)
+		s.framed = false
+		if err != nil {
+			conn, err = dialer.DialContext(ctx, "unix", s.address)
+			s.framed = true
+		}
+	default:
+		conn, err = dialer.DialContext(ctx, s.network, s.address)
+		s.framed = s.network == "tcp"
+	}
+	if err != nil {
+		return err
+	}
+	s.conn = conn
+	log.Info().Msgf("Syslog: connected to %s://%s", s.network, s.address)
+	return nil
+}
+
+// disconnect drops the broken connection, the next write reconnects
+func (s *Syslog) disconnect(err error) error {
+	errClose := s.conn.Close()
+	s.conn = nil
+	if errClose != nil && !errors.Is(errClose, net.ErrClosed) {
+		log.Err(errClose).Msg("Syslog: closing the connection failed")
+	}
+	return err
+}
+
+// message is RFC 5424 syslog message, the severity is mapped from the event severity
+func (s *Syslog) message(e events.Event) string {
+	priority := s.facility*8 + syslogSeverity(Severity(e))
+	return fmt.Sprintf("<%d>1 %s %s %s %d %s - %s",
+		priority, syslogTime(e.Time), headerField(e.Host), appName, s.pid, headerField(string(e.Type)), s.format(e))
+}
+
+// headerField of RFC 5424 is printable ASCII without spaces, - when empty
+func headerField(s string) string {
+	s = strings.Map(func(r rune) rune {
+		if r <= ' ' || r > '~' {
+			return '_'
+		}
+		return r
+	}, s)
+	if s == "" {
+		return "-"
+	}
+	return s
+}
+
+// Close closes the connection to the collector
+func (s *Syslog) Close() error {
+	if s.conn == nil {
+		return nil
+	}
+	err := s.conn.Close()
+	s.conn = nil
+	return err
+}
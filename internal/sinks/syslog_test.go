@@ -0,0 +1,242 @@
+package sinks
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"encoding/pem"
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"io"
+	"net"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"tcptracker/internal/detection"
+	"tcptracker/internal/events"
+	"testing"
+	"time"
+)
+
+var (
+	detected  = time.Date(2024, 5, 1, 11, 0, 0, 0, time.UTC)
+	expiresAt = detected.Add(time.Hour)
+)
+
+func detectionEvent() events.Event {
+	return events.Event{
+		Version: events.SchemaVersion, ID: "e1", Type: events.Detection, Time: detected, Host: "node-1",
+		SrcIP: "10.0.0.1", DstIP: "10.0.0.2", Ports: []int{21, 22, 23, 25},
+		DetectionID: "d1", DetectionType: detection.PortScan, Score: 4,
+	}
+}
+
+func blockEvent() events.Event {
+	return events.Event{
+		Version: events.SchemaVersion, ID: "e2", Type: events.Block, Time: detected, Host: "node-1",
+		SrcIP: "10.0.0.1", DetectionID: "d1", DetectionType: detection.PortScan, Score: 4, Action: "DROP", ExpiresAt: &expiresAt,
+	}
+}
+
+func TestCEF(t *testing.T) {
+	version := productVersion()
+	assert.Equal(t, "CEF:0|tcptracker|tcptracker|"+version+"|portscan|portscan detected|7|rt=1714561200000 dvchost=node-1"+
+		" externalId=e1 cat=detection src=10.0.0.1 dst=10.0.0.2 cs1Label=detectionId cs1=d1 cs2Label=detector cs2=portscan"+
+		" cs3Label=ports cs3=21,22,23,25 cn1Label=score cn1=4"+
+		" msg=portscan detected: 10.0.0.1 -> 10.0.0.2 on ports 21,22,23,25, score 4, detection d1", CEF(detectionEvent()))
+	assert.Equal(t, "CEF:0|tcptracker|tcptracker|"+version+"|block|Source blocked|6|rt=1714561200000 dvchost=node-1"+
+		" externalId=e2 cat=block src=10.0.0.1 act=DROP cs1Label=detectionId cs1=d1 cs2Label=detector cs2=portscan"+
+		" cn1Label=score cn1=4 end=1714564800000"+
+		" msg=10.0.0.1 blocked with DROP action, portscan score 4, expires 2024-05-01T12:00:00Z", CEF(blockEvent()))
+
+	escaped := events.Event{Type: events.Detection, DetectionType: "a|b", DstOwner: `ns=a\b`, Time: detected}
+	assert.Contains(t, CEF(escaped), `|a\|b|a\|b detected|`)
+	assert.Contains(t, CEF(escaped), `cs4=ns\=a\\b`)
+}
+
+func TestLEEF(t *testing.T) {
+	assert.Equal(t, "LEEF:2.0|tcptracker|tcptracker|"+productVersion()+"|block|x09|"+strings.Join([]string{
+		"devTime=2024-05-01T11:00:00.000Z", "devTimeFormat=yyyy-MM-dd'T'HH:mm:ss.SSSXXX", "sev=6", "identHostName=node-1",
+		"eventId=e2", "cat=block", "src=10.0.0.1", "action=DROP", "detectionId=d1", "detector=portscan", "score=4",
+		"expiresAt=2024-05-01T12:00:00.000Z", "msg=10.0.0.1 blocked with DROP action, portscan score 4, expires 2024-05-01T12:00:00Z",
+	}, "\t"), LEEF(blockEvent()))
+}
+
+func TestSeverity(t *testing.T) {
+	tests := []struct {
+		event  events.Event
+		cef    int
+		syslog int
+	}{
+		{event: events.Event{Type: events.Connection}, cef: 1, syslog: 6},
+		{event: events.Event{Type: events.Detection, Score: 4}, cef: 7, syslog: 3},
+		{event: events.Event{Type: events.Detection, Score: 20}, cef: 8, syslog: 3},
+		{event: events.Event{Type: events.Detection, Score: 1000}, cef: 9, syslog: 2},
+		{event: events.Event{Type: events.Block}, cef: 6, syslog: 4},
+		{event: events.Event{Type: events.Unblock}, cef: 3, syslog: 5},
+		{event: events.Event{Type: events.Expiry}, cef: 3, syslog: 5},
+	}
+	for _, tt := range tests {
+		t.Run(fmt.Sprintf("%s %d", tt.event.Type, tt.event.Score), func(t *testing.T) {
+			assert.Equal(t, tt.cef, Severity(tt.event))
+			assert.Equal(t, tt.syslog, syslogSeverity(Severity(tt.event)))
+		})
+	}
+}
+
+func TestParseSyslogAddr(t *testing.T) {
+	tests := []struct {
+		addr    string
+		network string
+		address string
+		wantErr bool
+	}{
+		{addr: "udp://10.0.0.5:514", network: "udp", address: "10.0.0.5:514"},
+		{addr: "tls://siem.example.com:6514", network: "tls", address: "siem.example.com:6514"},
+		{addr: "unix:///dev/log", network: "unix", address: "/dev/log"},
+		{addr: "tcp://siem.example.com", wantErr: true},
+		{addr: "http://siem.example.com:514", wantErr: true},
+		{addr: "unix://", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.addr, func(t *testing.T) {
+			network, address, err := ParseSyslogAddr(tt.addr)
+			assert.Equal(t, tt.wantErr, err != nil, err)
+			assert.Equal(t, tt.network, network)
+			assert.Equal(t, tt.address, address)
+		})
+	}
+}
+
+func newTestSyslog(t *testing.T, addr, format, ca string) *Syslog {
+	s, err := NewSyslog(SyslogParams{Addr: addr, Format: format, Facility: "authpriv", TLSCA: ca})
+	require.NoError(t, err)
+	s.backoff = 10 * time.Millisecond
+	t.Cleanup(func() { s.Close() })
+	return s
+}
+
+func send(t *testing.T, s *Syslog, e events.Event) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	require.NoError(t, s.Send(ctx, e))
+}
+
+func TestSyslogUDP(t *testing.T) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer conn.Close()
+	s := newTestSyslog(t, "udp://"+conn.LocalAddr().String(), "cef", "")
+
+	send(t, s, detectionEvent())
+	buf := make([]byte, 4096)
+	require.NoError(t, conn.SetReadDeadline(time.Now().Add(5*time.Second)))
+	n, _, err := conn.ReadFrom(buf)
+	require.NoError(t, err)
+	// authpriv (10) * 8 + error (3)
+	want := "<83>1 2024-05-01T11:00:00.000000Z node-1 tcptracker " + strconv.Itoa(os.Getpid()) + " detection - CEF:0|"
+	assert.True(t, strings.HasPrefix(string(buf[:n]), want), string(buf[:n]))
+}
+
+// readFramed reads the octet counted message
+func readFramed(t *testing.T, r *bufio.Reader) string {
+	length, err := r.ReadString(' ')
+	require.NoError(t, err)
+	n, err := strconv.Atoi(strings.TrimSpace(length))
+	require.NoError(t, err)
+	msg := make([]byte, n)
+	_, err = io.ReadFull(r, msg)
+	require.NoError(t, err)
+	return string(msg)
+}
+
+func TestSyslogTCPRetriesUntilCollectorIsUp(t *testing.T) {
+	// the port of the collector which is down
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	addr := l.Addr().String()
+	require.NoError(t, l.Close())
+	s := newTestSyslog(t, "tcp://"+addr, "leef", "")
+
+	sent := make(chan error, 1)
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		sent <- s.Send(ctx, blockEvent())
+	}()
+	time.Sleep(50 * time.Millisecond)
+	l, err = net.Listen("tcp", addr)
+	require.NoError(t, err)
+	defer l.Close()
+	conn, err := l.Accept()
+	require.NoError(t, err)
+	defer conn.Close()
+	require.NoError(t, <-sent)
+
+	r := bufio.NewReader(conn)
+	msg := readFramed(t, r)
+	assert.True(t, strings.HasPrefix(msg, "<84>1 "), msg)
+	assert.Contains(t, msg, " block - LEEF:2.0|")
+	send(t, s, detectionEvent())
+	assert.Contains(t, readFramed(t, r), " detection - LEEF:2.0|")
+}
+
+func TestSyslogTLS(t *testing.T) {
+	server := httptest.NewUnstartedServer(nil)
+	server.StartTLS()
+	tlsConfig := server.TLS
+	ca := filepath.Join(t.TempDir(), "ca.pem")
+	require.NoError(t, os.WriteFile(ca, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw}), 0o600))
+	server.Close()
+
+	l, err := tls.Listen("tcp", "127.0.0.1:0", tlsConfig)
+	require.NoError(t, err)
+	defer l.Close()
+	received := make(chan string, 1)
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		length, _ := bufio.NewReader(conn).ReadString(' ')
+		received <- length
+	}()
+	s := newTestSyslog(t, "tls://"+l.Addr().String(), "cef", ca)
+	send(t, s, detectionEvent())
+	select {
+	case length := <-received:
+		assert.Regexp(t, `^\d+ $`, length)
+	case <-time.After(5 * time.Second):
+		t.Fatal("message not received")
+	}
+}
+
+func TestSyslogUnixSocket(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "log")
+	conn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: path, Net: "unixgram"})
+	require.NoError(t, err)
+	defer conn.Close()
+	s := newTestSyslog(t, "unix://"+path, "cef", "")
+
+	send(t, s, blockEvent())
+	buf := make([]byte, 4096)
+	require.NoError(t, conn.SetReadDeadline(time.Now().Add(5*time.Second)))
+	n, err := conn.Read(buf)
+	require.NoError(t, err)
+	assert.True(t, strings.HasPrefix(string(buf[:n]), "<84>1 "), "datagrams are not framed")
+}
+
+func TestSyslogSendGivesUpOnCancel(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	addr := l.Addr().String()
+	require.NoError(t, l.Close())
+	s := newTestSyslog(t, "tcp://"+addr, "cef", "")
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	assert.Error(t, s.Send(ctx, blockEvent()))
+}
@@ -0,0 +1,378 @@
+package sinks
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/rs/zerolog/log"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"tcptracker/internal/events"
+	"text/template"
+	"time"
+)
+
+const (
+	// SignatureHeader carries sha256=<hex encoded HMAC-SHA256> of the timestamp, a dot and the body
+	SignatureHeader = "X-Tcptracker-Signature"
+	// TimestampHeader is the signed unix time of the delivery, receivers reject old ones to prevent replays
+	TimestampHeader = "X-Tcptracker-Timestamp"
+	// DeliveryHeader is the event ID, it is the same for the retries of the delivery
+	DeliveryHeader = "X-Tcptracker-Delivery"
+
+	defaultContentType = "application/json"
+	// backoff of retrying a failed delivery, Retry-After of the receiver is followed up to maxBackoff
+	webhookBackoff = time.Second
+	// maxErrorBody is the part of the response body kept in the error
+	maxErrorBody = 512
+)
+
+var (
+	webhookDeliveries = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "tcptracker_webhook_deliveries_total",
+		Help: "Webhook deliveries by target host and result: delivered, failed, deduplicated or ratelimited",
+	}, []string{"target", "result"})
+	webhookRetries = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "tcptracker_webhook_retries_total",
+		Help: "Retried webhook requests by target host",
+	}, []string{"target"})
+	webhookDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "tcptracker_webhook_delivery_duration_seconds",
+		Help:    "Time of delivering the webhook including the retries, by target host",
+		Buckets: []float64{.05, .1, .25, .5, 1, 2.5, 5, 10, 30, 60},
+	}, []string{"target"})
+)
+
+// errRateLimited is returned when the burst of events exceeded the rate limit, the event is not delivered
+var errRateLimited = errors.New("webhook rate limit exceeded")
+
+// templates are the built-in bodies, json is the event itself
+var templates = map[string]string{
+	"json":  `{{json .}}`,
+	"slack": `{"text": {{json (printf ":rotating_light: *%s* on %s: %s" .DetectionType .Host .Summary)}}}`,
+	"mattermost": `{"username": "tcptracker", "icon_emoji": ":rotating_light:",
+"text": {{json (printf "#### %s detected on %s\n%s" .DetectionType .Host .Summary)}}}`,
+	"teams": `{"@type": "MessageCard", "@context": "https://schema.org/extensions", "themeColor": "D70000",
+"summary": {{json .Summary}}, "title": {{json (printf "%s detected on %s" .DetectionType .Host)}}, "text": {{json .Summary}}}`,
+	"pagerduty": `{"routing_key": {{json (env "PAGERDUTY_ROUTING_KEY")}}, "event_action": "trigger",
+"dedup_key": {{json .DetectionID}}, "payload": {"summary": {{json .Summary}}, "source": {{json .Host}},
+"severity": "{{if ge (severity .) 9}}critical{{else}}error{{end}}", "timestamp": {{json .Time}},
+"component": "tcptracker", "class": {{json .DetectionType}}, "custom_details": {{json .}}}}`,
+}
+
+var templateFuncs = template.FuncMap{
+	// json writes the value as JSON, strings are quoted and escaped
+	"json": func(v interface{}) (string, error) {
+		data, err := json.Marshal(v)
+		return string(data), err
+	},
+	"severity": Severity,
+	"env":      os.Getenv,
+}
+
+// ParseTemplate returns the built-in template (json, slack, mattermost, teams or pagerduty) or parses the file,
+// the template is executed with the events.Event
+func ParseTemplate(nameOrPath string) (*template.Template, error) {
+	text, ok := templates[nameOrPath]
+	if !ok {
+		data, err := os.ReadFile(nameOrPath)
+		if err != nil {
+			return nil, fmt.Errorf("template is neither built-in (json, slack, mattermost, teams, pagerduty) nor a file: %w", err)
+		}
+		text = string(data)
+	}
+	return template.New(nameOrPath).Funcs(templateFuncs).Option("missingkey=error").Parse(text)
+}
+
+// WebhookParams of the Webhook sink, RatePerMinute 0 disables the rate limit
+type WebhookParams struct {
+	URLs          []string
+	Template      string
+	ContentType   string
+	Secret        string
+	Attempts      int
+	Timeout       time.Duration
+	RatePerMinute int
+	Burst         int
+	// DedupWindow drops the repeated detections of the same source and type within the window, 0 disables it
+	DedupWindow time.Duration
+	// Metrics are optional
+	Metrics *prometheus.Registry
+}
+
+// Webhook POSTs the events rendered by the template to every URL concurrently, failed requests are retried
+// with exponential backoff. Repeated detections of a source are dropped before the rate limit, so a single
+// scanner cannot use up the limit, and bursts above it are dropped, so a flood of detections doesn't
+// flood the chat or the pager.
+type Webhook struct {
+	targets     []target
+	template    *template.Template
+	contentType string
+	secret      []byte
+	attempts    int
+	client      *http.Client
+	limiter     *limiter
+	dedup       *dedup
+	backoff     time.Duration
+	now         func() time.Time
+}
+
+// target is the URL and its host used in the metrics and logs, the URL can hold a secret token
+type target struct {
+	url  string
+	host string
+}
+
+// NewWebhook creates the sink and registers its metrics
+func NewWebhook(p WebhookParams) (*Webhook, error) {
+	tmpl, err := ParseTemplate(p.Template)
+	if err != nil {
+		return nil, err
+	}
+	w := &Webhook{
+		template:    tmpl,
+		contentType: p.ContentType,
+		secret:      []byte(p.Secret),
+		attempts:    p.Attempts,
+		client:      &http.Client{Timeout: p.Timeout},
+		backoff:     webhookBackoff,
+		now:         time.Now,
+	}
+	for _, raw := range p.URLs {
+		u, err := url.Parse(raw)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			// the URL is not printed, it can hold a token
+			return nil, errors.New("webhook URLs must be http(s) URLs")
+		}
+		w.targets = append(w.targets, target{url: raw, host: u.Host})
+	}
+	if w.contentType == "" {
+		w.contentType = defaultContentType
+	}
+	if w.attempts < 1 {
+		w.attempts = 1
+	}
+	if p.RatePerMinute > 0 {
+		w.limiter = newLimiter(float64(p.RatePerMinute)/60, p.Burst)
+	}
+	if p.DedupWindow > 0 {
+		w.dedup = newDedup(p.DedupWindow)
+	}
+	if p.Metrics != nil {
+		p.Metrics.MustRegister(webhookDeliveries, webhookRetries, webhookDuration)
+	}
+	return w, nil
+}
+
+// Name of the sink
+func (w *Webhook) Name() string {
+	return "webhook"
+}
+
+// Send renders the body and delivers it to all the URLs, it fails when any of them failed
+func (w *Webhook) Send(ctx context.Context, e events.Event) error {
+	if w.dedup != nil && w.dedup.repeated(e, w.now()) {
+		for _, t := range w.targets {
+			webhookDeliveries.WithLabelValues(t.host, "deduplicated").Inc()
+		}
+		return nil
+	}
+	if w.limiter != nil && !w.limiter.allow(w.now()) {
+		for _, t := range w.targets {
+			webhookDeliveries.WithLabelValues(t.host, "ratelimited").Inc()
+		}
+		return errRateLimited
+	}
+	var body bytes.Buffer
+	if err := w.template.Execute(&body, e); err != nil {
+		return fmt.Errorf("rendering %s template: %w", w.template.Name(), err)
+	}
+	errs := make([]error, len(w.targets))
+	var wg sync.WaitGroup
+	for i, t := range w.targets {
+		wg.Add(1)
+		go func(i int, t target) {
+			defer wg.Done()
+			errs[i] = w.deliver(ctx, t, e, body.Bytes())
+		}(i, t)
+	}
+	wg.Wait()
+	var failed []string
+	for i, err := range errs {
+		if err != nil {
+			failed = append(failed, fmt.Sprintf("%s: %v", w.targets[i].host, err))
+		}
+	}
+	if len(failed) > 0 {
+		return fmt.Errorf("webhook delivery failed: %s", strings.Join(failed, "; "))
+	}
+	return nil
+}
+
+// deliver retries the retryable failures until the attempts are used up or ctx is cancelled
+func (w *Webhook) deliver(ctx context.Context, t target, e events.Event, body []byte) error {
+	start := time.Now()
+	defer func() { webhookDuration.WithLabelValues(t.host).Observe(time.Since(start).Seconds()) }()
+	backoff := w.backoff
+	var err error
+	for attempt := 1; ; attempt++ {
+		var retryAfter time.Duration
+		retryAfter, err = w.post(ctx, t, e, body)
+		if err == nil {
+			webhookDeliveries.WithLabelValues(t.host, "delivered").Inc()
+			return nil
+		}
+		var permanent *permanentError
+		if attempt >= w.attempts || errors.As(err, &permanent) {
+			break
+		}
+		wait := backoff
+		if retryAfter > wait {
+			wait = retryAfter
+		}
+		if wait > maxBackoff {
+			wait = maxBackoff
+		}
+		log.Warn().Err(err).Msgf("Webhook: delivery of event %s to %s failed, retrying in %s", e.ID, t.host, wait)
+		select {
+		case <-ctx.Done():
+			webhookDeliveries.WithLabelValues(t.host, "failed").Inc()
+			return err
+		case <-time.After(wait):
+		}
+		webhookRetries.WithLabelValues(t.host).Inc()
+		backoff *= 2
+	}
+	webhookDeliveries.WithLabelValues(t.host, "failed").Inc()
+	return err
+}
+
+// permanentError is not retried, the receiver rejected the request
+type permanentError struct {
+	err error
+}
+
+func (e *permanentError) Error() string {
+	return e.err.Error()
+}
+
+// post sends the signed request, it returns Retry-After of the receiver
+func (w *Webhook) post(ctx context.Context, t target, e events.Event, body []byte) (time.Duration, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, t.url, bytes.NewReader(body))
+	if err != nil {
+		return 0, &permanentError{err}
+	}
+	req.Header.Set("Content-Type", w.contentType)
+	req.Header.Set("User-Agent", appName+"/"+productVersion())
+	req.Header.Set(DeliveryHeader, e.ID)
+	if len(w.secret) > 0 {
+		timestamp := strconv.FormatInt(w.now().Unix(), 10)
+		req.Header.Set(TimestampHeader, timestamp)
+		req.Header.Set(SignatureHeader, "sha256="+Sign(w.secret, timestamp, body))
+	}
+	resp, err := w.client.Do(req)
+	if err != nil {
+		// url.Error prints the URL, it can hold a token
+		var urlErr *url.Error
+		if errors.As(err, &urlErr) {
+			err = fmt.Errorf("%s %s: %w", urlErr.Op, t.host, urlErr.Err)
+		}
+		return 0, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < http.StatusMultipleChoices {
+		_, _ = io.Copy(io.Discard, resp.Body)
+		return 0, nil
+	}
+	detail, _ := io.ReadAll(io.LimitReader(resp.Body, maxErrorBody))
+	err = fmt.Errorf("responded with %s: %s", resp.Status, strings.TrimSpace(string(detail)))
+	if resp.StatusCode != http.StatusTooManyRequests && resp.StatusCode < http.StatusInternalServerError {
+		return 0, &permanentError{err}
+	}
+	seconds, _ := strconv.Atoi(resp.Header.Get("Retry-After"))
+	return time.Duration(seconds) * time.Second, err
+}
+
+// Sign returns hex encoded HMAC-SHA256 of the timestamp, a dot and the body, receivers verify it with the shared secret
+func Sign(secret []byte, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(timestamp + "."))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// Close closes the idle connections
+func (w *Webhook) Close() error {
+	w.client.CloseIdleConnections()
+	return nil
+}
+
+// limiter is a token bucket refilled at rate tokens per second up to burst
+type limiter struct {
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func newLimiter(rate float64, burst int) *limiter {
+	if burst < 1 {
+		burst = 1
+	}
+	return &limiter{rate: rate, burst: float64(burst), tokens: float64(burst)}
+}
+
+func (l *limiter) allow(now time.Time) bool {
+	if !l.last.IsZero() {
+		l.tokens += now.Sub(l.last).Seconds() * l.rate
+		if l.tokens > l.burst {
+			l.tokens = l.burst
+		}
+	}
+	l.last = now
+	if l.tokens < 1 {
+		return false
+	}
+	l.tokens--
+	return true
+}
+
+// dedup remembers the source and the detection type of the notified events for the window
+type dedup struct {
+	window time.Duration
+	seen   map[string]time.Time
+	pruned time.Time
+}
+
+func newDedup(window time.Duration) *dedup {
+	return &dedup{window: window, seen: make(map[string]time.Time)}
+}
+
+// repeated tells the source was notified about the detection type within the window, the first one is remembered
+func (d *dedup) repeated(e events.Event, now time.Time) bool {
+	if now.Sub(d.pruned) > d.window {
+		for key, at := range d.seen {
+			if now.Sub(at) >= d.window {
+				delete(d.seen, key)
+			}
+		}
+		d.pruned = now
+	}
+	key := e.SrcIP + " " + string(e.DetectionType)
+	if at, ok := d.seen[key]; ok && now.Sub(at) < d.window {
+		return true
+	}
+	d.seen[key] = now
+	return false
+}
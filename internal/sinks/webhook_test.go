@@ -0,0 +1,200 @@
+package sinks
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestParseTemplate(t *testing.T) {
+	t.Setenv("PAGERDUTY_ROUTING_KEY", "routing-key")
+	for name := range templates {
+		t.Run(name, func(t *testing.T) {
+			tmpl, err := ParseTemplate(name)
+			require.NoError(t, err)
+			var b strings.Builder
+			require.NoError(t, tmpl.Execute(&b, detectionEvent()))
+			assert.True(t, json.Valid([]byte(b.String())), b.String())
+			assert.Contains(t, b.String(), "10.0.0.1")
+		})
+	}
+
+	path := filepath.Join(t.TempDir(), "body.tmpl")
+	require.NoError(t, os.WriteFile(path, []byte(`{{.SrcIP}} severity {{severity .}}`), 0o600))
+	tmpl, err := ParseTemplate(path)
+	require.NoError(t, err)
+	var b strings.Builder
+	require.NoError(t, tmpl.Execute(&b, detectionEvent()))
+	assert.Equal(t, "10.0.0.1 severity 7", b.String())
+
+	_, err = ParseTemplate("discord")
+	assert.Error(t, err)
+}
+
+// receiver records the requests and responds with the statuses in order, then 204
+type receiver struct {
+	statuses []int
+	requests []*http.Request
+	bodies   []string
+	m        sync.Mutex
+}
+
+func (r *receiver) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	body, _ := io.ReadAll(req.Body)
+	r.m.Lock()
+	defer r.m.Unlock()
+	r.requests = append(r.requests, req)
+	r.bodies = append(r.bodies, string(body))
+	status := http.StatusNoContent
+	if len(r.statuses) > 0 {
+		status, r.statuses = r.statuses[0], r.statuses[1:]
+	}
+	w.WriteHeader(status)
+}
+
+func (r *receiver) received() int {
+	r.m.Lock()
+	defer r.m.Unlock()
+	return len(r.requests)
+}
+
+func newTestWebhook(t *testing.T, p WebhookParams) *Webhook {
+	if p.Template == "" {
+		p.Template = "json"
+	}
+	w, err := NewWebhook(p)
+	require.NoError(t, err)
+	w.backoff = time.Millisecond
+	t.Cleanup(func() { w.Close() })
+	return w
+}
+
+func TestWebhookSignsDelivery(t *testing.T) {
+	r := &receiver{}
+	server := httptest.NewServer(r)
+	defer server.Close()
+	w := newTestWebhook(t, WebhookParams{URLs: []string{server.URL}, Secret: "webhook-secret", Attempts: 3})
+	w.now = func() time.Time { return detected }
+
+	require.NoError(t, w.Send(context.Background(), detectionEvent()))
+	require.Equal(t, 1, r.received())
+	req, body := r.requests[0], r.bodies[0]
+	assert.Equal(t, "application/json", req.Header.Get("Content-Type"))
+	assert.Equal(t, "e1", req.Header.Get(DeliveryHeader))
+	assert.Equal(t, "1714561200", req.Header.Get(TimestampHeader))
+	assert.Equal(t, "sha256="+Sign([]byte("webhook-secret"), "1714561200", []byte(body)), req.Header.Get(SignatureHeader))
+	var sent map[string]interface{}
+	require.NoError(t, json.Unmarshal([]byte(body), &sent))
+	assert.Equal(t, "portscan", sent["detectionType"])
+}
+
+func TestWebhookRetries(t *testing.T) {
+	tests := []struct {
+		name     string
+		statuses []int
+		attempts int
+		requests int
+		wantErr  bool
+	}{
+		{name: "server error is retried", statuses: []int{500, 503}, attempts: 3, requests: 3},
+		{name: "too many requests is retried", statuses: []int{429}, attempts: 3, requests: 2},
+		{name: "attempts are used up", statuses: []int{500, 500, 500}, attempts: 3, requests: 3, wantErr: true},
+		{name: "rejected request is not retried", statuses: []int{400}, attempts: 3, requests: 1, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := &receiver{statuses: tt.statuses}
+			server := httptest.NewServer(r)
+			defer server.Close()
+			w := newTestWebhook(t, WebhookParams{URLs: []string{server.URL}, Attempts: tt.attempts})
+			host := strings.TrimPrefix(server.URL, "http://")
+			failed := testutil.ToFloat64(webhookDeliveries.WithLabelValues(host, "failed"))
+
+			err := w.Send(context.Background(), detectionEvent())
+			assert.Equal(t, tt.wantErr, err != nil, err)
+			assert.Equal(t, tt.requests, r.received())
+			assert.Empty(t, r.requests[0].Header.Get(SignatureHeader), "not signed without secret")
+			if tt.wantErr {
+				assert.Equal(t, failed+1, testutil.ToFloat64(webhookDeliveries.WithLabelValues(host, "failed")))
+			}
+		})
+	}
+}
+
+func TestWebhookDeliversToAllURLs(t *testing.T) {
+	ok, failing := &receiver{}, &receiver{statuses: []int{404}}
+	okServer, failingServer := httptest.NewServer(ok), httptest.NewServer(failing)
+	defer okServer.Close()
+	defer failingServer.Close()
+	w := newTestWebhook(t, WebhookParams{URLs: []string{okServer.URL, failingServer.URL}, Template: "slack", Attempts: 2})
+
+	err := w.Send(context.Background(), detectionEvent())
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "404")
+	assert.Equal(t, 1, ok.received())
+	assert.Contains(t, ok.bodies[0], `"text": ":rotating_light: *portscan* on node-1: portscan detected`)
+}
+
+func TestWebhookRateLimit(t *testing.T) {
+	r := &receiver{}
+	server := httptest.NewServer(r)
+	defer server.Close()
+	w := newTestWebhook(t, WebhookParams{URLs: []string{server.URL}, Attempts: 1, RatePerMinute: 1, Burst: 2})
+	now := detected
+	w.now = func() time.Time { return now }
+
+	require.NoError(t, w.Send(context.Background(), detectionEvent()))
+	require.NoError(t, w.Send(context.Background(), detectionEvent()))
+	assert.ErrorIs(t, w.Send(context.Background(), detectionEvent()), errRateLimited)
+	now = now.Add(time.Minute)
+	require.NoError(t, w.Send(context.Background(), detectionEvent()))
+	assert.Equal(t, 3, r.received())
+}
+
+func TestWebhookDeduplicatesSourceBeforeRateLimit(t *testing.T) {
+	r := &receiver{}
+	server := httptest.NewServer(r)
+	defer server.Close()
+	w := newTestWebhook(t, WebhookParams{
+		URLs: []string{server.URL}, Attempts: 1, RatePerMinute: 1, Burst: 2, DedupWindow: 10 * time.Minute,
+	})
+	now := detected
+	w.now = func() time.Time { return now }
+	other := detectionEvent()
+	other.SrcIP = "10.0.0.9"
+
+	for i := 0; i < 5; i++ {
+		require.NoError(t, w.Send(context.Background(), detectionEvent()))
+	}
+	// the repeated scanner did not use up the burst
+	require.NoError(t, w.Send(context.Background(), other))
+	assert.Equal(t, 2, r.received())
+	now = now.Add(10 * time.Minute)
+	require.NoError(t, w.Send(context.Background(), detectionEvent()))
+	assert.Equal(t, 3, r.received())
+}
+
+func TestNewWebhookRejectsInvalidURL(t *testing.T) {
+	_, err := NewWebhook(WebhookParams{URLs: []string{"hooks.slack.com/services/T0"}, Template: "slack"})
+	assert.Error(t, err)
+}
+
+func TestWebhookErrorsHideURL(t *testing.T) {
+	server := httptest.NewServer(&receiver{})
+	server.Close()
+	w := newTestWebhook(t, WebhookParams{URLs: []string{server.URL + "/services/webhook-token"}, Attempts: 1})
+	err := w.Send(context.Background(), detectionEvent())
+	require.Error(t, err)
+	assert.NotContains(t, err.Error(), "webhook-token")
+}
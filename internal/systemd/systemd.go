@@ -0,0 +1,110 @@
+// Package systemd implements the service notifications and the socket activation of systemd,
+// both are no-ops when the process is not started by systemd
+package systemd
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// listenFDsStart is the first file descriptor passed by the socket activation, after stdin, stdout and stderr
+const listenFDsStart = 3
+
+// Notification states, see sd_notify(3)
+const (
+	Ready    = "READY=1"
+	Stopping = "STOPPING=1"
+	Watchdog = "WATCHDOG=1"
+)
+
+// Notify sends the state to the NOTIFY_SOCKET of the service manager, false is returned when it is not set
+func Notify(state string) (bool, error) {
+	socket := os.Getenv("NOTIFY_SOCKET")
+	if socket == "" {
+		return false, nil
+	}
+	// abstract socket
+	if strings.HasPrefix(socket, "@") {
+		socket = "\x00" + socket[1:]
+	}
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: socket, Net: "unixgram"})
+	if err != nil {
+		return false, err
+	}
+	defer conn.Close()
+	if _, err := conn.Write([]byte(state)); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// Status is the free-form state shown by `systemctl status`
+func Status(status string) string {
+	return "STATUS=" + status
+}
+
+// WatchdogInterval is WatchdogSec= of the unit, 0 when the watchdog is disabled or meant for another process
+func WatchdogInterval() (time.Duration, error) {
+	usec := os.Getenv("WATCHDOG_USEC")
+	if usec == "" {
+		return 0, nil
+	}
+	if pid := os.Getenv("WATCHDOG_PID"); pid != "" && pid != strconv.Itoa(os.Getpid()) {
+		return 0, nil
+	}
+	n, err := strconv.ParseInt(usec, 10, 64)
+	if err != nil || n <= 0 {
+		return 0, fmt.Errorf("invalid WATCHDOG_USEC %q", usec)
+	}
+	return time.Duration(n) * time.Microsecond, nil
+}
+
+// Listeners returns the sockets passed by the socket activation by their FileDescriptorName=,
+// the env vars are unset so the child processes do not take them
+func Listeners() (map[string]net.Listener, error) {
+	defer func() {
+		os.Unsetenv("LISTEN_PID")
+		os.Unsetenv("LISTEN_FDS")
+		os.Unsetenv("LISTEN_FDNAMES")
+	}()
+	return listeners(listenFDsStart)
+}
+
+func listeners(start int) (map[string]net.Listener, error) {
+	if pid := os.Getenv("LISTEN_PID"); pid != strconv.Itoa(os.Getpid()) {
+		return nil, nil
+	}
+	n, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil || n < 0 {
+		return nil, fmt.Errorf("invalid LISTEN_FDS %q", os.Getenv("LISTEN_FDS"))
+	}
+	var names []string
+	if fdNames := os.Getenv("LISTEN_FDNAMES"); fdNames != "" {
+		names = strings.Split(fdNames, ":")
+	}
+	activated := make(map[string]net.Listener, n)
+	for i := 0; i < n; i++ {
+		// systemd names the sockets "unknown" without FileDescriptorName=
+		name := "unknown"
+		if i < len(names) {
+			name = names[i]
+		}
+		f := os.NewFile(uintptr(start+i), name)
+		listener, err := net.FileListener(f)
+		// the listener holds its own copy of the descriptor
+		f.Close()
+		if err != nil {
+			return nil, fmt.Errorf("socket %s (fd %d): %w", name, start+i, err)
+		}
+		if _, ok := activated[name]; ok {
+			listener.Close()
+			return nil, fmt.Errorf("socket %s is passed more than once", name)
+		}
+		activated[name] = listener
+	}
+	return activated, nil
+}
@@ -5,7 +5,9 @@
 package mock
 
 import (
+	context "context"
 	reflect "reflect"
+	detection "tcptracker/internal/detection"
 
 	gomock "github.com/golang/mock/gomock"
 )
@@ -33,18 +35,74 @@ func (m *MockFirewall) EXPECT() *MockFirewallMockRecorder {
 	return m.recorder
 }
 
+// Allow mocks base method.
+func (m *MockFirewall) Allow(ip string) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "Allow", ip)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// Allow indicates an expected call of Allow.
+func (mr *MockFirewallMockRecorder) Allow(ip interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Allow", reflect.TypeOf((*MockFirewall)(nil).Allow), ip)
+}
+
+// AllowList mocks base method.
+func (m *MockFirewall) AllowList() []string {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "AllowList")
+	ret0, _ := ret[0].([]string)
+	return ret0
+}
+
+// AllowList indicates an expected call of AllowList.
+func (mr *MockFirewallMockRecorder) AllowList() *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "AllowList", reflect.TypeOf((*MockFirewall)(nil).AllowList))
+}
+
 // Block mocks base method.
-func (m *MockFirewall) Block(ip string) error {
+func (m *MockFirewall) Block(d detection.Detection) error {
 	m.ctrl.T.Helper()
-	ret := m.ctrl.Call(m, "Block", ip)
+	ret := m.ctrl.Call(m, "Block", d)
 	ret0, _ := ret[0].(error)
 	return ret0
 }
 
 // Block indicates an expected call of Block.
-func (mr *MockFirewallMockRecorder) Block(ip interface{}) *gomock.Call {
+func (mr *MockFirewallMockRecorder) Block(d interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Block", reflect.TypeOf((*MockFirewall)(nil).Block), d)
+}
+
+// Blocks mocks base method.
+func (m *MockFirewall) Blocks() []detection.Block {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "Blocks")
+	ret0, _ := ret[0].([]detection.Block)
+	return ret0
+}
+
+// Blocks indicates an expected call of Blocks.
+func (mr *MockFirewallMockRecorder) Blocks() *gomock.Call {
 	mr.mock.ctrl.T.Helper()
-	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Block", reflect.TypeOf((*MockFirewall)(nil).Block), ip)
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Blocks", reflect.TypeOf((*MockFirewall)(nil).Blocks))
+}
+
+// Check mocks base method.
+func (m *MockFirewall) Check(ctx context.Context) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "Check", ctx)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// Check indicates an expected call of Check.
+func (mr *MockFirewallMockRecorder) Check(ctx interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Check", reflect.TypeOf((*MockFirewall)(nil).Check), ctx)
 }
 
 // Close mocks base method.
@@ -61,6 +119,34 @@ func (mr *MockFirewallMockRecorder) Close() *gomock.Call {
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Close", reflect.TypeOf((*MockFirewall)(nil).Close))
 }
 
+// Disallow mocks base method.
+func (m *MockFirewall) Disallow(ip string) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "Disallow", ip)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// Disallow indicates an expected call of Disallow.
+func (mr *MockFirewallMockRecorder) Disallow(ip interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Disallow", reflect.TypeOf((*MockFirewall)(nil).Disallow), ip)
+}
+
+// Unblock mocks base method.
+func (m *MockFirewall) Unblock(ip string) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "Unblock", ip)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// Unblock indicates an expected call of Unblock.
+func (mr *MockFirewallMockRecorder) Unblock(ip interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Unblock", reflect.TypeOf((*MockFirewall)(nil).Unblock), ip)
+}
+
 // MockipTableCoreos is a mock of ipTableCoreos interface.
 type MockipTableCoreos struct {
 	ctrl     *gomock.Controller
@@ -132,6 +218,20 @@ func (mr *MockipTableCoreosMockRecorder) ClearAndDeleteChain(arg0, arg1 interfac
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "ClearAndDeleteChain", reflect.TypeOf((*MockipTableCoreos)(nil).ClearAndDeleteChain), arg0, arg1)
 }
 
+// ClearChain mocks base method.
+func (m *MockipTableCoreos) ClearChain(arg0, arg1 string) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "ClearChain", arg0, arg1)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// ClearChain indicates an expected call of ClearChain.
+func (mr *MockipTableCoreosMockRecorder) ClearChain(arg0, arg1 interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "ClearChain", reflect.TypeOf((*MockipTableCoreos)(nil).ClearChain), arg0, arg1)
+}
+
 // DeleteIfExists mocks base method.
 func (m *MockipTableCoreos) DeleteIfExists(arg0, arg1 string, arg2 ...string) error {
 	m.ctrl.T.Helper()
@@ -151,6 +251,26 @@ func (mr *MockipTableCoreosMockRecorder) DeleteIfExists(arg0, arg1 interface{},
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "DeleteIfExists", reflect.TypeOf((*MockipTableCoreos)(nil).DeleteIfExists), varargs...)
 }
 
+// Exists mocks base method.
+func (m *MockipTableCoreos) Exists(arg0, arg1 string, arg2 ...string) (bool, error) {
+	m.ctrl.T.Helper()
+	varargs := []interface{}{arg0, arg1}
+	for _, a := range arg2 {
+		varargs = append(varargs, a)
+	}
+	ret := m.ctrl.Call(m, "Exists", varargs...)
+	ret0, _ := ret[0].(bool)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// Exists indicates an expected call of Exists.
+func (mr *MockipTableCoreosMockRecorder) Exists(arg0, arg1 interface{}, arg2 ...interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	varargs := append([]interface{}{arg0, arg1}, arg2...)
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Exists", reflect.TypeOf((*MockipTableCoreos)(nil).Exists), varargs...)
+}
+
 // Insert mocks base method.
 func (m *MockipTableCoreos) Insert(arg0, arg1 string, arg2 int, arg3 ...string) error {
 	m.ctrl.T.Helper()
@@ -170,6 +290,21 @@ func (mr *MockipTableCoreosMockRecorder) Insert(arg0, arg1, arg2 interface{}, ar
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Insert", reflect.TypeOf((*MockipTableCoreos)(nil).Insert), varargs...)
 }
 
+// List mocks base method.
+func (m *MockipTableCoreos) List(arg0, arg1 string) ([]string, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "List", arg0, arg1)
+	ret0, _ := ret[0].([]string)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// List indicates an expected call of List.
+func (mr *MockipTableCoreosMockRecorder) List(arg0, arg1 interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "List", reflect.TypeOf((*MockipTableCoreos)(nil).List), arg0, arg1)
+}
+
 // NewChain mocks base method.
 func (m *MockipTableCoreos) NewChain(arg0, arg1 string) error {
 	m.ctrl.T.Helper()
@@ -81,6 +81,20 @@ func (mr *MockIptablesMockMockRecorder) ClearAndDeleteChain(table, chain interfa
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "ClearAndDeleteChain", reflect.TypeOf((*MockIptablesMock)(nil).ClearAndDeleteChain), table, chain)
 }
 
+// ClearChain mocks base method.
+func (m *MockIptablesMock) ClearChain(table, chain string) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "ClearChain", table, chain)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// ClearChain indicates an expected call of ClearChain.
+func (mr *MockIptablesMockMockRecorder) ClearChain(table, chain interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "ClearChain", reflect.TypeOf((*MockIptablesMock)(nil).ClearChain), table, chain)
+}
+
 // DeleteIfExists mocks base method.
 func (m *MockIptablesMock) DeleteIfExists(table, chain string, rulespec ...string) error {
 	m.ctrl.T.Helper()
@@ -100,6 +114,26 @@ func (mr *MockIptablesMockMockRecorder) DeleteIfExists(table, chain interface{},
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "DeleteIfExists", reflect.TypeOf((*MockIptablesMock)(nil).DeleteIfExists), varargs...)
 }
 
+// Exists mocks base method.
+func (m *MockIptablesMock) Exists(table, chain string, rulespec ...string) (bool, error) {
+	m.ctrl.T.Helper()
+	varargs := []interface{}{table, chain}
+	for _, a := range rulespec {
+		varargs = append(varargs, a)
+	}
+	ret := m.ctrl.Call(m, "Exists", varargs...)
+	ret0, _ := ret[0].(bool)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// Exists indicates an expected call of Exists.
+func (mr *MockIptablesMockMockRecorder) Exists(table, chain interface{}, rulespec ...interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	varargs := append([]interface{}{table, chain}, rulespec...)
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Exists", reflect.TypeOf((*MockIptablesMock)(nil).Exists), varargs...)
+}
+
 // Insert mocks base method.
 func (m *MockIptablesMock) Insert(table, chain string, pos int, rulespec ...string) error {
 	m.ctrl.T.Helper()
@@ -119,6 +153,21 @@ func (mr *MockIptablesMockMockRecorder) Insert(table, chain, pos interface{}, ru
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Insert", reflect.TypeOf((*MockIptablesMock)(nil).Insert), varargs...)
 }
 
+// List mocks base method.
+func (m *MockIptablesMock) List(table, chain string) ([]string, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "List", table, chain)
+	ret0, _ := ret[0].([]string)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// List indicates an expected call of List.
+func (mr *MockIptablesMockMockRecorder) List(table, chain interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "List", reflect.TypeOf((*MockIptablesMock)(nil).List), table, chain)
+}
+
 // NewChain mocks base method.
 func (m *MockIptablesMock) NewChain(table, chain string) error {
 	m.ctrl.T.Helper()
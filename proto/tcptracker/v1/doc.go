@@ -0,0 +1,4 @@
+// Package trackerv1 contains generated gRPC client and server of tcptracker.v1.TrackerService
+package trackerv1
+
+//go:generate sh -c "cd ../.. && protoc --go_out=. --go_opt=paths=source_relative --go-grpc_out=. --go-grpc_opt=paths=source_relative tcptracker/v1/tracker.proto"
@@ -0,0 +1,443 @@
+// Code generated by protoc-gen-go-grpc. DO NOT EDIT.
+// versions:
+// - protoc-gen-go-grpc v1.3.0
+// - protoc             v3.21.12
+// source: tcptracker/v1/tracker.proto
+
+// Programmatic control of the tracker, it shares the state with the REST API
+
+package trackerv1
+
+import (
+	context "context"
+	grpc "google.golang.org/grpc"
+	codes "google.golang.org/grpc/codes"
+	status "google.golang.org/grpc/status"
+)
+
+// This is a compile-time assertion to ensure that this generated file
+// is compatible with the grpc package it is being compiled against.
+// Requires gRPC-Go v1.32.0 or later.
+const _ = grpc.SupportPackageIsVersion7
+
+const (
+	TrackerService_ListConnections_FullMethodName  = "/tcptracker.v1.TrackerService/ListConnections"
+	TrackerService_WatchConnections_FullMethodName = "/tcptracker.v1.TrackerService/WatchConnections"
+	TrackerService_ListBlocks_FullMethodName       = "/tcptracker.v1.TrackerService/ListBlocks"
+	TrackerService_AddBlock_FullMethodName         = "/tcptracker.v1.TrackerService/AddBlock"
+	TrackerService_RemoveBlock_FullMethodName      = "/tcptracker.v1.TrackerService/RemoveBlock"
+	TrackerService_ListAllowlist_FullMethodName    = "/tcptracker.v1.TrackerService/ListAllowlist"
+	TrackerService_AddAllowlist_FullMethodName     = "/tcptracker.v1.TrackerService/AddAllowlist"
+	TrackerService_RemoveAllowlist_FullMethodName  = "/tcptracker.v1.TrackerService/RemoveAllowlist"
+	TrackerService_GetConfig_FullMethodName        = "/tcptracker.v1.TrackerService/GetConfig"
+)
+
+// TrackerServiceClient is the client API for TrackerService service.
+//
+// For semantics around ctx use and closing/ending streaming RPCs, please refer to https://pkg.go.dev/google.golang.org/grpc/?tab=doc#ClientConn.NewStream.
+type TrackerServiceClient interface {
+	// ListConnections returns the recently captured connections, newest first
+	ListConnections(ctx context.Context, in *ListConnectionsRequest, opts ...grpc.CallOption) (*ListConnectionsResponse, error)
+	// WatchConnections streams the events as they happen, only connections unless types are given
+	WatchConnections(ctx context.Context, in *WatchConnectionsRequest, opts ...grpc.CallOption) (TrackerService_WatchConnectionsClient, error)
+	ListBlocks(ctx context.Context, in *ListBlocksRequest, opts ...grpc.CallOption) (*ListBlocksResponse, error)
+	// AddBlock blocks the IP manually, zero ttl uses the default TTL of the tracker
+	AddBlock(ctx context.Context, in *AddBlockRequest, opts ...grpc.CallOption) (*AddBlockResponse, error)
+	RemoveBlock(ctx context.Context, in *RemoveBlockRequest, opts ...grpc.CallOption) (*RemoveBlockResponse, error)
+	ListAllowlist(ctx context.Context, in *ListAllowlistRequest, opts ...grpc.CallOption) (*ListAllowlistResponse, error)
+	// AddAllowlist never blocks the IP again, it is unblocked when blocked already
+	AddAllowlist(ctx context.Context, in *AddAllowlistRequest, opts ...grpc.CallOption) (*AddAllowlistResponse, error)
+	RemoveAllowlist(ctx context.Context, in *RemoveAllowlistRequest, opts ...grpc.CallOption) (*RemoveAllowlistResponse, error)
+	GetConfig(ctx context.Context, in *GetConfigRequest, opts ...grpc.CallOption) (*Config, error)
+}
+
+type trackerServiceClient struct {
+	cc grpc.ClientConnInterface
+}
+
+func NewTrackerServiceClient(cc grpc.ClientConnInterface) TrackerServiceClient {
+	return &trackerServiceClient{cc}
+}
+
+func (c *trackerServiceClient) ListConnections(ctx context.Context, in *ListConnectionsRequest, opts ...grpc.CallOption) (*ListConnectionsResponse, error) {
+	out := new(ListConnectionsResponse)
+	err := c.cc.Invoke(ctx, TrackerService_ListConnections_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *trackerServiceClient) WatchConnections(ctx context.Context, in *WatchConnectionsRequest, opts ...grpc.CallOption) (TrackerService_WatchConnectionsClient, error) {
+	stream, err := c.cc.NewStream(ctx, &TrackerService_ServiceDesc.Streams[0], TrackerService_WatchConnections_FullMethodName, opts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &trackerServiceWatchConnectionsClient{stream}
+	if err := x.ClientStream.SendMsg(in); err != nil {
+		return nil, err
+	}
+	if err := x.ClientStream.CloseSend(); err != nil {
+		return nil, err
+	}
+	return x, nil
+}
+
+type TrackerService_WatchConnectionsClient interface {
+	Recv() (*Event, error)
+	grpc.ClientStream
+}
+
+type trackerServiceWatchConnectionsClient struct {
+	grpc.ClientStream
+}
+
+func (x *trackerServiceWatchConnectionsClient) Recv() (*Event, error) {
+	m := new(Event)
+	if err := x.ClientStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func (c *trackerServiceClient) ListBlocks(ctx context.Context, in *ListBlocksRequest, opts ...grpc.CallOption) (*ListBlocksResponse, error) {
+	out := new(ListBlocksResponse)
+	err := c.cc.Invoke(ctx, TrackerService_ListBlocks_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *trackerServiceClient) AddBlock(ctx context.Context, in *AddBlockRequest, opts ...grpc.CallOption) (*AddBlockResponse, error) {
+	out := new(AddBlockResponse)
+	err := c.cc.Invoke(ctx, TrackerService_AddBlock_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *trackerServiceClient) RemoveBlock(ctx context.Context, in *RemoveBlockRequest, opts ...grpc.CallOption) (*RemoveBlockResponse, error) {
+	out := new(RemoveBlockResponse)
+	err := c.cc.Invoke(ctx, TrackerService_RemoveBlock_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *trackerServiceClient) ListAllowlist(ctx context.Context, in *ListAllowlistRequest, opts ...grpc.CallOption) (*ListAllowlistResponse, error) {
+	out := new(ListAllowlistResponse)
+	err := c.cc.Invoke(ctx, TrackerService_ListAllowlist_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *trackerServiceClient) AddAllowlist(ctx context.Context, in *AddAllowlistRequest, opts ...grpc.CallOption) (*AddAllowlistResponse, error) {
+	out := new(AddAllowlistResponse)
+	err := c.cc.Invoke(ctx, TrackerService_AddAllowlist_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *trackerServiceClient) RemoveAllowlist(ctx context.Context, in *RemoveAllowlistRequest, opts ...grpc.CallOption) (*RemoveAllowlistResponse, error) {
+	out := new(RemoveAllowlistResponse)
+	err := c.cc.Invoke(ctx, TrackerService_RemoveAllowlist_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *trackerServiceClient) GetConfig(ctx context.Context, in *GetConfigRequest, opts ...grpc.CallOption) (*Config, error) {
+	out := new(Config)
+	err := c.cc.Invoke(ctx, TrackerService_GetConfig_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// TrackerServiceServer is the server API for TrackerService service.
+// All implementations must embed UnimplementedTrackerServiceServer
+// for forward compatibility
+type TrackerServiceServer interface {
+	// ListConnections returns the recently captured connections, newest first
+	ListConnections(context.Context, *ListConnectionsRequest) (*ListConnectionsResponse, error)
+	// WatchConnections streams the events as they happen, only connections unless types are given
+	WatchConnections(*WatchConnectionsRequest, TrackerService_WatchConnectionsServer) error
+	ListBlocks(context.Context, *ListBlocksRequest) (*ListBlocksResponse, error)
+	// AddBlock blocks the IP manually, zero ttl uses the default TTL of the tracker
+	AddBlock(context.Context, *AddBlockRequest) (*AddBlockResponse, error)
+	RemoveBlock(context.Context, *RemoveBlockRequest) (*RemoveBlockResponse, error)
+	ListAllowlist(context.Context, *ListAllowlistRequest) (*ListAllowlistResponse, error)
+	// AddAllowlist never blocks the IP again, it is unblocked when blocked already
+	AddAllowlist(context.Context, *AddAllowlistRequest) (*AddAllowlistResponse, error)
+	RemoveAllowlist(context.Context, *RemoveAllowlistRequest) (*RemoveAllowlistResponse, error)
+	GetConfig(context.Context, *GetConfigRequest) (*Config, error)
+	mustEmbedUnimplementedTrackerServiceServer()
+}
+
+// UnimplementedTrackerServiceServer must be embedded to have forward compatible implementations.
+type UnimplementedTrackerServiceServer struct {
+}
+
+func (UnimplementedTrackerServiceServer) ListConnections(context.Context, *ListConnectionsRequest) (*ListConnectionsResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method ListConnections not implemented")
+}
+func (UnimplementedTrackerServiceServer) WatchConnections(*WatchConnectionsRequest, TrackerService_WatchConnectionsServer) error {
+	return status.Errorf(codes.Unimplemented, "method WatchConnections not implemented")
+}
+func (UnimplementedTrackerServiceServer) ListBlocks(context.Context, *ListBlocksRequest) (*ListBlocksResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method ListBlocks not implemented")
+}
+func (UnimplementedTrackerServiceServer) AddBlock(context.Context, *AddBlockRequest) (*AddBlockResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method AddBlock not implemented")
+}
+func (UnimplementedTrackerServiceServer) RemoveBlock(context.Context, *RemoveBlockRequest) (*RemoveBlockResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method RemoveBlock not implemented")
+}
+func (UnimplementedTrackerServiceServer) ListAllowlist(context.Context, *ListAllowlistRequest) (*ListAllowlistResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method ListAllowlist not implemented")
+}
+func (UnimplementedTrackerServiceServer) AddAllowlist(context.Context, *AddAllowlistRequest) (*AddAllowlistResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method AddAllowlist not implemented")
+}
+func (UnimplementedTrackerServiceServer) RemoveAllowlist(context.Context, *RemoveAllowlistRequest) (*RemoveAllowlistResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method RemoveAllowlist not implemented")
+}
+func (UnimplementedTrackerServiceServer) GetConfig(context.Context, *GetConfigRequest) (*Config, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method GetConfig not implemented")
+}
+func (UnimplementedTrackerServiceServer) mustEmbedUnimplementedTrackerServiceServer() {}
+
+// UnsafeTrackerServiceServer may be embedded to opt out of forward compatibility for this service.
+// Use of this interface is not recommended, as added methods to TrackerServiceServer will
+// result in compilation errors.
+type UnsafeTrackerServiceServer interface {
+	mustEmbedUnimplementedTrackerServiceServer()
+}
+
+func RegisterTrackerServiceServer(s grpc.ServiceRegistrar, srv TrackerServiceServer) {
+	s.RegisterService(&TrackerService_ServiceDesc, srv)
+}
+
+func _TrackerService_ListConnections_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(ListConnectionsRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(TrackerServiceServer).ListConnections(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: TrackerService_ListConnections_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(TrackerServiceServer).ListConnections(ctx, req.(*ListConnectionsRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _TrackerService_WatchConnections_Handler(srv interface{}, stream grpc.ServerStream) error {
+	m := new(WatchConnectionsRequest)
+	if err := stream.RecvMsg(m); err != nil {
+		return err
+	}
+	return srv.(TrackerServiceServer).WatchConnections(m, &trackerServiceWatchConnectionsServer{stream})
+}
+
+type TrackerService_WatchConnectionsServer interface {
+	Send(*Event) error
+	grpc.ServerStream
+}
+
+type trackerServiceWatchConnectionsServer struct {
+	grpc.ServerStream
+}
+
+func (x *trackerServiceWatchConnectionsServer) Send(m *Event) error {
+	return x.ServerStream.SendMsg(m)
+}
+
+func _TrackerService_ListBlocks_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(ListBlocksRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(TrackerServiceServer).ListBlocks(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: TrackerService_ListBlocks_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(TrackerServiceServer).ListBlocks(ctx, req.(*ListBlocksRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _TrackerService_AddBlock_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(AddBlockRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(TrackerServiceServer).AddBlock(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: TrackerService_AddBlock_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(TrackerServiceServer).AddBlock(ctx, req.(*AddBlockRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _TrackerService_RemoveBlock_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(RemoveBlockRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(TrackerServiceServer).RemoveBlock(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: TrackerService_RemoveBlock_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(TrackerServiceServer).RemoveBlock(ctx, req.(*RemoveBlockRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _TrackerService_ListAllowlist_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(ListAllowlistRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(TrackerServiceServer).ListAllowlist(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: TrackerService_ListAllowlist_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(TrackerServiceServer).ListAllowlist(ctx, req.(*ListAllowlistRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _TrackerService_AddAllowlist_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(AddAllowlistRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(TrackerServiceServer).AddAllowlist(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: TrackerService_AddAllowlist_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(TrackerServiceServer).AddAllowlist(ctx, req.(*AddAllowlistRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _TrackerService_RemoveAllowlist_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(RemoveAllowlistRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(TrackerServiceServer).RemoveAllowlist(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: TrackerService_RemoveAllowlist_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(TrackerServiceServer).RemoveAllowlist(ctx, req.(*RemoveAllowlistRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _TrackerService_GetConfig_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(GetConfigRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(TrackerServiceServer).GetConfig(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: TrackerService_GetConfig_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(TrackerServiceServer).GetConfig(ctx, req.(*GetConfigRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+// TrackerService_ServiceDesc is the grpc.ServiceDesc for TrackerService service.
+// It's only intended for direct use with grpc.RegisterService,
+// and not to be introspected or modified (even as a copy)
+var TrackerService_ServiceDesc = grpc.ServiceDesc{
+	ServiceName: "tcptracker.v1.TrackerService",
+	HandlerType: (*TrackerServiceServer)(nil),
+	Methods: []grpc.MethodDesc{
+		{
+			MethodName: "ListConnections",
+			Handler:    _TrackerService_ListConnections_Handler,
+		},
+		{
+			MethodName: "ListBlocks",
+			Handler:    _TrackerService_ListBlocks_Handler,
+		},
+		{
+			MethodName: "AddBlock",
+			Handler:    _TrackerService_AddBlock_Handler,
+		},
+		{
+			MethodName: "RemoveBlock",
+			Handler:    _TrackerService_RemoveBlock_Handler,
+		},
+		{
+			MethodName: "ListAllowlist",
+			Handler:    _TrackerService_ListAllowlist_Handler,
+		},
+		{
+			MethodName: "AddAllowlist",
+			Handler:    _TrackerService_AddAllowlist_Handler,
+		},
+		{
+			MethodName: "RemoveAllowlist",
+			Handler:    _TrackerService_RemoveAllowlist_Handler,
+		},
+		{
+			MethodName: "GetConfig",
+			Handler:    _TrackerService_GetConfig_Handler,
+		},
+	},
+	Streams: []grpc.StreamDesc{
+		{
+			StreamName:    "WatchConnections",
+			Handler:       _TrackerService_WatchConnections_Handler,
+			ServerStreams: true,
+		},
+	},
+	Metadata: "tcptracker/v1/tracker.proto",
+}